@@ -1,9 +1,9 @@
 package bridge
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	_ "crypto/tls"
-	"ehang.io/nps/lib/nps_mux"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -19,6 +19,8 @@ import (
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/graceful"
+	"ehang.io/nps/lib/nps_mux"
 	"ehang.io/nps/lib/version"
 	"ehang.io/nps/server/connection"
 	"ehang.io/nps/server/tool"
@@ -29,15 +31,34 @@ import (
 var ServerTlsEnable bool = false
 
 type Client struct {
-	mu        sync.Mutex // 保护 signal/tunnel/Version 等字段的并发读写
-	tunnel    *nps_mux.Mux
-	signal    *conn.Conn
-	file      *nps_mux.Mux
-	Version   string
-	retryTime atomic.Int32 // it will be add 1 when ping not ok until to 3 will close the client
+	mu             sync.Mutex // 保护 signal/tunnel/Version 等字段的并发读写
+	tunnel         conn.Tunnel
+	signal         *conn.Conn
+	file           conn.Tunnel
+	key            []byte // session key of the tunnel connection, nil if aead is not negotiated
+	Version        string
+	caps           conn.Caps     // capabilities negotiated on the main signal connection
+	retryTime      atomic.Int32  // it will be add 1 when ping not ok until to 3 will close the client
+	token          string        // resume token of the session, empty if npc can not resume
+	suspendedUntil time.Time     // the session is kept until then after a drop, zero if connected
+	ready          chan struct{} // closed when the suspended session is resumed
+}
+
+// connected 客户端有桥接连接或在等待重连
+func (s *Client) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signal != nil || s.tunnel != nil || !s.suspendedUntil.IsZero()
 }
 
-func NewClient(t, f *nps_mux.Mux, s *conn.Conn, vs string) *Client {
+// HasCap reports whether the client negotiated the capability on its signal connection
+func (s *Client) HasCap(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.caps.Has(name)
+}
+
+func NewClient(t, f conn.Tunnel, s *conn.Conn, vs string) *Client {
 	return &Client{
 		signal:  s,
 		tunnel:  t,
@@ -52,26 +73,41 @@ type Bridge struct {
 	Register       sync.Map
 	tunnelType     string //bridge type kcp or tcp
 	OpenTask       chan *file.Tunnel
-	CloseTask      chan *file.Tunnel
+	CloseTask      chan *file.Tunnel // 停止并删除隧道
 	CloseClient    chan int
 	SecretChan     chan *conn.Secret
-	ipVerify       bool
+	ipVerify       atomic.Bool
 	runList        sync.Map //map[int]interface{}
-	disconnectTime int
+	disconnectTime atomic.Int32
+	resumeTimeout  time.Duration // 客户端掉线后保留会话的时间，0 不保留
+	// Remote 集群模式下打开到其他节点上客户端的链接
+	Remote func(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error)
 }
 
 func NewTunnel(tunnelPort int, tunnelType string, ipVerify bool, runList sync.Map, disconnectTime int) *Bridge {
-	return &Bridge{
-		TunnelPort:     tunnelPort,
-		tunnelType:     tunnelType,
-		OpenTask:       make(chan *file.Tunnel),
-		CloseTask:      make(chan *file.Tunnel),
-		CloseClient:    make(chan int),
-		SecretChan:     make(chan *conn.Secret),
-		ipVerify:       ipVerify,
-		runList:        runList,
-		disconnectTime: disconnectTime,
+	s := &Bridge{
+		TunnelPort:    tunnelPort,
+		tunnelType:    tunnelType,
+		OpenTask:      make(chan *file.Tunnel),
+		CloseTask:     make(chan *file.Tunnel),
+		CloseClient:   make(chan int),
+		SecretChan:    make(chan *conn.Secret),
+		runList:       runList,
+		resumeTimeout: time.Duration(beego.AppConfig.DefaultInt("bridge_resume_timeout", 30)) * time.Second,
 	}
+	s.SetIpVerify(ipVerify)
+	s.SetDisconnectTime(disconnectTime)
+	return s
+}
+
+// SetIpVerify 修改 ip_limit，之后的访问生效
+func (s *Bridge) SetIpVerify(ipVerify bool) {
+	s.ipVerify.Store(ipVerify)
+}
+
+// SetDisconnectTime 修改 disconnect_timeout，之后建立的桥接连接生效
+func (s *Bridge) SetDisconnectTime(disconnectTime int) {
+	s.disconnectTime.Store(int32(disconnectTime))
 }
 
 func (s *Bridge) StartTunnel() error {
@@ -95,6 +131,26 @@ func (s *Bridge) StartTunnel() error {
 			})
 		}()
 
+		go func() {
+			if err := s.startWsTunnel(); err != nil && !graceful.Closed() {
+				logs.Error("websocket bridge error", err)
+				os.Exit(0)
+			}
+		}()
+
+		go func() {
+			l, err := connection.GetQuicBridgeListener()
+			if err != nil {
+				logs.Error("quic bridge error", err)
+				os.Exit(0)
+			}
+			if l != nil {
+				conn.AcceptQuic(l, func(c net.Conn) {
+					s.cliProcess(conn.NewConn(c))
+				})
+			}
+		}()
+
 		// tls
 		if ServerTlsEnable {
 			go func() {
@@ -102,14 +158,20 @@ func (s *Bridge) StartTunnel() error {
 				tlsBridgePort := beego.AppConfig.DefaultInt("tls_bridge_port", 8025)
 
 				logs.Info("tls server start, the bridge type is %s, the tls bridge port is %d", "tcp", tlsBridgePort)
-				tlsListener, tlsErr := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), tlsBridgePort, ""})
+				tlsListener, tlsErr := graceful.ListenTCP(&net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), tlsBridgePort, ""})
 				if tlsErr != nil {
 					logs.Error(tlsErr)
 					os.Exit(0)
 					return
 				}
+				tlsConfig := &tls.Config{Certificates: []tls.Certificate{crypt.GetCert()}}
+				if ca := crypt.GetClientCA(); ca != nil {
+					// 客户端证书可选, 是否必须由客户端的认证方式决定
+					tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+					tlsConfig.ClientCAs = ca.Pool()
+				}
 				conn.Accept(tlsListener, func(c net.Conn) {
-					s.cliProcess(conn.NewConn(tls.Server(c, &tls.Config{Certificates: []tls.Certificate{crypt.GetCert()}})))
+					s.cliProcess(conn.NewConn(tls.Server(c, tlsConfig)))
 				})
 			}()
 		}
@@ -118,25 +180,30 @@ func (s *Bridge) StartTunnel() error {
 }
 
 // requestClientLocalAddr asks the client for private/LAN IPs on the main signal conn.
-// New clients reply with WriteLenContent; old clients ignore the flag and we time out.
+// A client that negotiated CapLocalIp replies at once, so the reply is waited here.
+// A legacy client may or may not reply, the reply is read by GetHealthFromClient without waiting.
 func (s *Bridge) requestClientLocalAddr(id int, c *conn.Conn) {
-	if c == nil || c.Conn == nil {
+	if c == nil || c.Conn == nil || !c.Legacy && !c.Caps.Has(conn.CapLocalIp) {
 		return
 	}
-	if _, err := c.Write([]byte(common.REPORT_LOCAL_IP)); err != nil {
+	if _, err := c.Write([]byte(common.REPORT_LOCAL_IP)); err != nil || c.Legacy {
 		return
 	}
-	_ = c.Conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_ = c.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	defer func() {
 		// clear deadline so health / later reads are not affected
 		_ = c.Conn.SetReadDeadline(time.Time{})
 	}()
 	b, err := c.GetShortLenContent()
 	if err != nil {
-		logs.Trace("clientId %d did not report local addr (old client or timeout): %v", id, err)
+		logs.Warn("clientId %d report local addr error: %v", id, err)
 		return
 	}
-	localAddr := strings.TrimSpace(string(b))
+	setLocalAddr(id, string(b))
+}
+
+func setLocalAddr(id int, addr string) {
+	localAddr := strings.TrimSpace(addr)
 	if localAddr == "" {
 		return
 	}
@@ -148,11 +215,49 @@ func (s *Bridge) requestClientLocalAddr(id int, c *conn.Conn) {
 	}
 }
 
+// PushVkey 把轮换后的 vkey 推送给在线的 npc,返回是否已推送
+func (s *Bridge) PushVkey(id int) bool {
+	v, ok := s.Client.Load(id)
+	if !ok {
+		return false
+	}
+	cl := v.(*Client)
+	cl.mu.Lock()
+	sig := cl.signal
+	cl.mu.Unlock()
+	return s.pushVkey(id, sig)
+}
+
+// pushVkey 新的 vkey 用 npc 连接时的旧 vkey 加密
+func (s *Bridge) pushVkey(id int, c *conn.Conn) bool {
+	client, err := file.GetDb().GetClient(id)
+	if err != nil || c == nil {
+		return false
+	}
+	oldKey, newKey, ok := client.PendingKey()
+	if !ok {
+		return false
+	}
+	if !c.Caps.Has(conn.CapVkey) {
+		logs.Warn("clientId %d does not support the vkey rotation, change the vkey of npc before %s", id, client.OldKeyExpire)
+		return false
+	}
+	if err := c.SendNewVkey(oldKey, newKey); err != nil {
+		logs.Warn("clientId %d push the new vkey error: %v", id, err)
+		return false
+	}
+	logs.Info("clientId %d the new vkey is pushed, the old vkey expires at %s", id, client.OldKeyExpire)
+	return true
+}
+
 // get health information form client
 func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 	for {
-		if info, status, err := c.GetHealthInfo(); err != nil {
+		if info, status, addr, err := c.GetHealthInfoOrAddr(); err != nil {
 			break
+		} else if addr {
+			// 旧的 npc 对 REPORT_LOCAL_IP 的回复
+			setLocalAddr(id, info)
 		} else if !status { //the status is true , return target to the targetArr
 			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 				v := value.(*file.Tunnel)
@@ -210,7 +315,7 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 			})
 		}
 	}
-	s.DelClient(id)
+	s.dropClient(id, c)
 }
 
 // 验证失败，返回错误验证flag，并且关闭连接
@@ -219,8 +324,115 @@ func (s *Bridge) verifyError(c *conn.Conn) {
 	c.Close()
 }
 
+// 验证成功，告知客户端可以进行能力协商
 func (s *Bridge) verifySuccess(c *conn.Conn) {
-	c.Write([]byte(common.VERIFY_SUCCESS))
+	c.Write([]byte(common.VERIFY_HELLO))
+}
+
+// hello 与客户端交换协议版本和能力集，返回之后的工作类型。
+// vkey 为认证时证明过的 vkey，挑战认证时用它签名两个 hello，防止能力被中间人篡改
+func (s *Bridge) hello(c *conn.Conn, auth *conn.Auth, vkey string, id int) (string, error) {
+	remote, err := c.GetHello()
+	if err != nil {
+		return "", err
+	}
+	local := conn.LocalHello()
+	c.Caps = conn.Negotiate(local, remote)
+	if c.Caps.Has(conn.CapStripe) && remote.Conns > 1 {
+		local.Conns = allowedBridgeConns(id, remote.Conns)
+		c.Conns = local.Conns
+	}
+	if c.Caps.Has(conn.CapResume) {
+		// 令牌只在 WORK_MAIN 时保存，npc 重连时带上以接回原会话
+		local.Token = crypt.GetRandomString(16)
+		local.Resumed = s.canResume(id, remote.Resume)
+		c.Token, c.Resumed = local.Token, local.Resumed
+	}
+	local.Weights = clientWeights(id)
+	c.Weights = local.Weights
+	if err := c.SendHello(local); err != nil {
+		return "", err
+	}
+	transcript := conn.Transcript(remote, local)
+	if auth != nil {
+		if err := c.SendHelloProof(vkey, transcript); err != nil {
+			return "", err
+		}
+	}
+	if remote.ProtoVersion != local.ProtoVersion {
+		logs.Info("client %s protocol version %d, server protocol version %d", c.Conn.RemoteAddr(), remote.ProtoVersion, local.ProtoVersion)
+	}
+	if c.Caps.Has(conn.CapAead) {
+		if c.Key, err = conn.SessionKey(local, remote, vkey, transcript); err != nil {
+			return "", err
+		}
+	}
+	return c.ReadFlag()
+}
+
+// allowedBridgeConns 客户端请求的数据连接数不超过后台为其设置的数量
+func allowedBridgeConns(id, requested int) int {
+	client, err := file.GetDb().GetClient(id)
+	if err != nil || client.BridgeConns <= 1 {
+		return 1
+	}
+	if requested > client.BridgeConns {
+		return client.BridgeConns
+	}
+	return requested
+}
+
+// clientWeights 后台为客户端设置的各优先级带宽份额,未设置时为 nil
+func clientWeights(id int) []int {
+	client, err := file.GetDb().GetClient(id)
+	if err != nil {
+		return nil
+	}
+	weights, _ := conn.ParseWeights(client.Weights)
+	return weights
+}
+
+// verify 按客户端的认证方式校验 vkey 和 tls 客户端证书，auth 为 nil 时 vkey 是旧客户端发送的 md5(vkey)
+func (s *Bridge) verify(c *conn.Conn, auth *conn.Auth, vkey string) (int, error) {
+	addr := c.Conn.RemoteAddr().String()
+	certId, certErr := 0, errors.New("no client certificate")
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			certId, certErr = file.GetDb().GetIdByCert(certs[0], addr)
+		}
+	}
+	var id int
+	var err error
+	if auth != nil {
+		id, err = file.GetDb().GetIdByAuth(auth.Verify, addr)
+	} else {
+		id, err = file.GetDb().GetIdByVerifyKey(vkey, addr)
+	}
+	if err == nil {
+		switch getAuthMode(id) {
+		case file.AuthModeVkey:
+			return id, nil
+		case file.AuthModeBoth:
+			if certErr == nil && certId == id {
+				return id, nil
+			}
+		}
+	}
+	if certErr == nil && getAuthMode(certId) == file.AuthModeCert {
+		return certId, nil
+	}
+	if certErr != nil {
+		return 0, certErr
+	}
+	return 0, errors.New("the vkey or the certificate does not match the auth mode of the client")
+}
+
+func getAuthMode(id int) string {
+	if c, err := file.GetDb().GetClient(id); err == nil {
+		return c.GetAuthMode()
+	}
+	// public vkey
+	return file.AuthModeVkey
 }
 
 func (s *Bridge) cliProcess(c *conn.Conn) {
@@ -255,16 +467,48 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 		c.Close()
 		return
 	}
+	var auth *conn.Auth
+	if string(buf) == common.VERIFY_HMAC {
+		if auth, err = c.Challenge(); err != nil {
+			logs.Info("client %s challenge error %v", c.Conn.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+	} else if !beego.AppConfig.DefaultBool("allow_legacy_auth", false) {
+		logs.Warn("client %s uses the legacy md5(vkey) auth, upgrade npc or set allow_legacy_auth=true", c.Conn.RemoteAddr())
+		s.verifyError(c)
+		return
+	}
 	//verify
-	id, err := file.GetDb().GetIdByVerifyKey(string(buf), c.Conn.RemoteAddr().String())
+	id, err := s.verify(c, auth, string(buf))
 	if err != nil {
 		logs.Info("Current client connection validation error, close this client:", c.Conn.RemoteAddr())
 		s.verifyError(c)
 		return
+	}
+	// 旧的认证方式只有 md5(vkey)
+	vkey := string(buf)
+	if auth != nil {
+		// 用 vkey 签名证明服务端也知道 vkey，只用证书认证时不签名
+		vkey = ""
+		if client, err := file.GetDb().GetClient(id); err == nil {
+			vkey = client.ProofKey(auth.Verify)
+		}
+		if err = c.SendAuthProof(auth, vkey); err != nil {
+			c.Close()
+			return
+		}
 	} else {
 		s.verifySuccess(c)
 	}
-	if flag, err := c.ReadFlag(); err == nil {
+	flag, err := c.ReadFlag()
+	if err == nil && flag == common.WORK_HELLO {
+		flag, err = s.hello(c, auth, vkey, id)
+	} else if err == nil {
+		// 不支持协商的旧客户端
+		c.Caps, c.Legacy = conn.LegacyCaps(), true
+	}
+	if err == nil {
 		// 握手完成，交给 typeDeal 做长连接
 		_ = c.SetReadDeadline(time.Time{})
 		s.typeDeal(flag, c, id, string(vs))
@@ -275,6 +519,68 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 	return
 }
 
+// GetBridgeStats 返回客户端每条数据连接的状态,未开启多连接时为空
+func (s *Bridge) GetBridgeStats(id int) []file.BridgeConnStat {
+	v, ok := s.Client.Load(id)
+	if !ok {
+		return nil
+	}
+	cl := v.(*Client)
+	cl.mu.Lock()
+	st, isStripe := cl.tunnel.(*conn.Stripe)
+	cl.mu.Unlock()
+	if !isStripe {
+		return nil
+	}
+	return st.Stats()
+}
+
+// GetMuxStats 返回客户端每条桥接连接的多路复用状态,客户端不在本节点时为空
+func (s *Bridge) GetMuxStats(id int) []nps_mux.Stats {
+	v, ok := s.Client.Load(id)
+	if !ok {
+		return nil
+	}
+	cl := v.(*Client)
+	cl.mu.Lock()
+	tunnel := cl.tunnel
+	cl.mu.Unlock()
+	if tunnel == nil {
+		return nil
+	}
+	return conn.MuxStats(tunnel)
+}
+
+// GetClientIds 返回本节点有桥接连接的客户端，包括等待重连的
+func (s *Bridge) GetClientIds() []int {
+	var ids []int
+	s.Client.Range(func(key, value interface{}) bool {
+		if value.(*Client).connected() {
+			ids = append(ids, key.(int))
+		}
+		return true
+	})
+	return ids
+}
+
+// CloseUdpClients 平滑重启时 kcp、quic 桥接的连接随 udp socket 关闭而中断，通知这些客户端立即重连到新进程
+func (s *Bridge) CloseUdpClients() {
+	s.Client.Range(func(key, value interface{}) bool {
+		cl := value.(*Client)
+		cl.mu.Lock()
+		signal := cl.signal
+		cl.mu.Unlock()
+		if signal == nil {
+			return true
+		}
+		if _, ok := signal.Conn.RemoteAddr().(*net.UDPAddr); ok {
+			signal.Write([]byte(common.RES_RECONNECT))
+			s.DelClient(key.(int))
+		}
+		return true
+	})
+}
+
 func (s *Bridge) DelClient(id int) {
 	if v, ok := s.Client.Load(id); ok {
 		cl := v.(*Client)
@@ -285,6 +591,7 @@ func (s *Bridge) DelClient(id int) {
 		if signalToClose != nil {
 			signalToClose.Close()
 		}
+		cl.wake()
 		s.Client.Delete(id)
 		if file.GetDb().IsPubClient(id) {
 			return
@@ -310,35 +617,82 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 			_ = tcpConn.SetKeepAlive(true)
 			_ = tcpConn.SetKeepAlivePeriod(5 * time.Second)
 		}
+		s.resumeSession(id, c)
 		//the vKey connect by another ,close the client of before
-		if v, ok := s.Client.LoadOrStore(id, NewClient(nil, nil, c, vs)); ok {
-			cl := v.(*Client)
-			cl.mu.Lock()
-			oldSignal := cl.signal
-			cl.signal = c
-			cl.Version = vs
-			cl.mu.Unlock()
+		v, ok := s.Client.LoadOrStore(id, NewClient(nil, nil, c, vs))
+		cl := v.(*Client)
+		cl.mu.Lock()
+		oldSignal := cl.signal
+		cl.signal = c
+		cl.Version = vs
+		cl.caps = c.Caps
+		cl.token = c.Token
+		cl.mu.Unlock()
+		if ok {
 			cl.retryTime.Store(0)
 			if oldSignal != nil {
 				oldSignal.WriteClose()
 			}
+			if c.Resumed {
+				logs.Info("clientId %d session resumed", id)
+			}
 		}
-		// Request private/LAN IPs from client. Old clients ignore the flag; short timeout keeps compatibility.
+		logs.Trace("clientId %d capabilities: %v", id, c.Caps.List())
+		// Request private/LAN IPs from client if negotiated.
 		s.requestClientLocalAddr(id, c)
+		// 轮换 vkey 期间用旧的 vkey 连接的 npc
+		s.pushVkey(id, c)
 		go s.GetHealthFromClient(id, c)
 		logs.Info("clientId %d connection succeeded, address:%s ", id, c.Conn.RemoteAddr())
 	case common.WORK_CHAN:
-		muxConn := nps_mux.NewMux(c.Conn, s.tunnelType, s.disconnectTime)
-		if v, ok := s.Client.LoadOrStore(id, NewClient(muxConn, nil, nil, vs)); ok {
-			cl := v.(*Client)
-			cl.mu.Lock()
-			oldTunnel := cl.tunnel
-			cl.tunnel = muxConn
-			cl.mu.Unlock()
-			if oldTunnel != nil {
-				oldTunnel.Close()
+		var session string
+		if c.Caps.Has(conn.CapStripe) {
+			// npc 每次运行的标识,同一标识的数据连接组成一个 stripe
+			b, err := c.GetShortLenContent()
+			if err != nil {
+				c.Close()
+				return
+			}
+			session = string(b)
+		}
+		muxConn := conn.NewTunnel(c.Conn, s.tunnelType, int(s.disconnectTime.Load()))
+		conn.SetWeights(muxConn, c.Weights)
+		if c.Caps.Has(conn.CapHalfClose) {
+			conn.EnableHalfClose(muxConn)
+		}
+		v, ok := s.Client.LoadOrStore(id, NewClient(nil, nil, nil, vs))
+		cl := v.(*Client)
+		cl.mu.Lock()
+		oldTunnel := cl.tunnel
+		if c.Conns > 1 {
+			if st, isStripe := oldTunnel.(*conn.Stripe); isStripe && st.Session == session {
+				if st.Len() >= st.Size {
+					cl.mu.Unlock()
+					logs.Warn("clientId %d has %d bridge connections already", id, st.Size)
+					muxConn.Close()
+					return
+				}
+				st.Add(muxConn, c.Conn.RemoteAddr().String(), c.Key)
+				oldTunnel = nil
+			} else {
+				st = conn.NewStripe(session, c.Conns)
+				st.Add(muxConn, c.Conn.RemoteAddr().String(), c.Key)
+				cl.tunnel = st
 			}
+		} else {
+			cl.tunnel = muxConn
+		}
+		cl.key = c.Key
+		if cl.caps == nil {
+			// the main connection is not ready yet
+			cl.caps = c.Caps
+		}
+		cl.mu.Unlock()
+		if ok && oldTunnel != nil {
+			oldTunnel.Close()
 		}
+		// 挂起期间等待的访问可以继续
+		cl.wake()
 	case common.WORK_CONFIG:
 		client, err := file.GetDb().GetClient(id)
 		if err != nil || (!isPub && !client.ConfigConnAllow) {
@@ -356,7 +710,7 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 			logs.Error("secret error, failed to match the key successfully")
 		}
 	case common.WORK_FILE:
-		muxConn := nps_mux.NewMux(c.Conn, s.tunnelType, s.disconnectTime)
+		muxConn := conn.NewTunnel(c.Conn, s.tunnelType, int(s.disconnectTime.Load()))
 		if v, ok := s.Client.LoadOrStore(id, NewClient(nil, muxConn, nil, vs)); ok {
 			cl := v.(*Client)
 			cl.mu.Lock()
@@ -384,6 +738,10 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 				if sig == nil {
 					return
 				}
+				if !cl.HasCap(conn.CapP2p) {
+					logs.Warn("p2p error, client %d does not support p2p", t.Client.Id)
+					return
+				}
 				//向密钥对应的客户端发送与服务端udp建立连接信息，地址，密钥
 				sig.Write([]byte(common.NEW_UDP_CONN))
 				svrAddr := beego.AppConfig.String("p2p_ip") + ":" + beego.AppConfig.String("p2p_port")
@@ -411,6 +769,15 @@ func (s *Bridge) register(c *conn.Conn) {
 }
 
 func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (target net.Conn, err error) {
+	if v, ok := s.Client.Load(clientId); s.Remote != nil && !link.LocalProxy && (!ok || !v.(*Client).connected()) {
+		// 客户端连接在集群的其他节点
+		return s.Remote(clientId, link, t)
+	}
+	return s.SendLocalLinkInfo(clientId, link, t)
+}
+
+// SendLocalLinkInfo 只使用本节点的客户端连接
+func (s *Bridge) SendLocalLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (target net.Conn, err error) {
 	//if the proxy type is local
 	if link.LocalProxy {
 		target, err = net.Dial("tcp", link.Host)
@@ -418,7 +785,7 @@ func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (ta
 	}
 	if v, ok := s.Client.Load(clientId); ok {
 		//If ip is restricted to do ip verification
-		if s.ipVerify {
+		if s.ipVerify.Load() {
 			ip := common.GetIpByAddr(link.RemoteAddr)
 			if v, ok := s.Register.Load(ip); !ok {
 				return nil, errors.New(fmt.Sprintf("The ip %s is not in the validation list", ip))
@@ -428,7 +795,7 @@ func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (ta
 				}
 			}
 		}
-		var tunnel *nps_mux.Mux
+		var tunnel conn.Tunnel
 		cl := v.(*Client)
 		cl.mu.Lock()
 		if t != nil && t.Mode == "file" {
@@ -436,21 +803,44 @@ func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (ta
 		} else {
 			tunnel = cl.tunnel
 		}
+		key := cl.key
 		cl.mu.Unlock()
 		if tunnel == nil {
-			err = errors.New("the client connect error")
+			// 客户端重连中，等待会话恢复或快速失败
+			if tunnel, key, err = s.waitResume(clientId, cl, link.Option.Timeout, t != nil && t.Mode == "file"); err != nil {
+				return
+			}
+		}
+		if link.ConnType == "udp5" && !cl.HasCap(conn.CapUdpOverMux) {
+			err = errors.New(fmt.Sprintf("the client %d does not support udp over mux", clientId))
+			return
+		}
+		if link.ConnType == common.CONN_BIND && !cl.HasCap(conn.CapBind) {
+			err = errors.New(fmt.Sprintf("the client %d does not support socks5 bind", clientId))
+			return
+		}
+		if err = setLinkCodec(cl, link, key); err != nil {
 			return
 		}
 		if target, err = tunnel.NewConn(); err != nil {
 			return
 		}
+		conn.SetPriority(target, link.Priority)
+		// stripe 中每条连接有自己的会话密钥
+		link.SetKey(conn.StreamKey(target, key))
 		if t != nil && t.Mode == "file" {
 			//TODO if t.mode is file ,not use crypt or compress
 			link.Crypt = false
 			link.Compress = false
+			link.Cipher = ""
+			link.Compression = ""
 			return
 		}
-		if _, err = conn.NewConn(target).SendInfo(link, ""); err != nil {
+		lc := conn.NewConn(target)
+		if cl.HasCap(conn.CapMsg) {
+			lc.Caps = conn.Caps{conn.CapMsg: true}
+		}
+		if _, err = lc.SendLinkInfo(link); err != nil {
 			logs.Info("new connect error ,the target %s refuse to connect", link.Host)
 			return
 		}
@@ -460,6 +850,33 @@ func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (ta
 	return
 }
 
+// setLinkCodec 按协商的能力选择链接的加密和压缩，旧客户端仍使用 tls 或 snappy，密钥在选定连接后设置
+func setLinkCodec(cl *Client, link *conn.Link, key []byte) error {
+	compression := link.Compression
+	link.Compression = ""
+	if !cl.HasCap(conn.CapAead) || key == nil {
+		if link.Compress && !cl.HasCap(conn.CapSnappy) {
+			link.Compress = false
+		}
+		return nil
+	}
+	if link.Compress {
+		// udp 链接需要保留包边界，只有 snappy 每次写入对应一次读取
+		if compression == "" || link.ConnType == common.CONN_UDP || !cl.HasCap(compression) {
+			compression = conn.CompressSnappy
+		}
+		link.Compression = compression
+	}
+	if link.Crypt {
+		link.Cipher = conn.CipherAead
+		link.Salt = make([]byte, 16)
+		if _, err := rand.Read(link.Salt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Bridge) ping() {
 	ticker := time.NewTicker(time.Second * 5)
 	defer ticker.Stop()
@@ -467,9 +884,19 @@ func (s *Bridge) ping() {
 		select {
 		case <-ticker.C:
 			arr := make([]int, 0)
+			closed := make([]int, 0)
 			s.Client.Range(func(key, value interface{}) bool {
 				v := value.(*Client)
 				v.mu.Lock()
+				if !v.suspendedUntil.IsZero() {
+					// 挂起的客户端超过宽限期才关闭
+					expired := time.Now().After(v.suspendedUntil)
+					v.mu.Unlock()
+					if expired {
+						arr = append(arr, key.(int))
+					}
+					return true
+				}
 				tunnel := v.tunnel
 				signal := v.signal
 				if tunnel == nil || signal == nil {
@@ -482,10 +909,15 @@ func (s *Bridge) ping() {
 				isClose := tunnel.IsClose()
 				v.mu.Unlock()
 				if isClose {
-					arr = append(arr, key.(int))
+					closed = append(closed, key.(int))
 				}
 				return true
 			})
+			for _, v := range closed {
+				if !s.suspendClient(v) {
+					arr = append(arr, v)
+				}
+			}
 			for _, v := range arr {
 				logs.Info("the client %d closed", v)
 				s.DelClient(v)
@@ -494,9 +926,36 @@ func (s *Bridge) ping() {
 	}
 }
 
+// statusClient 查询状态的客户端，支持的 npc 用挑战认证证明 vkey，旧的 npc 发送 md5(vkey)
+func (s *Bridge) statusClient(c *conn.Conn) (int, error) {
+	if !c.Caps.Has(conn.CapStatusAuth) {
+		b, err := c.GetShortContent(32)
+		if err != nil {
+			return 0, err
+		}
+		return file.GetDb().GetClientIdByVkey(string(b))
+	}
+	a, err := c.Challenge()
+	if err != nil {
+		return 0, err
+	}
+	return file.GetDb().GetClientIdByKey(a.Verify)
+}
+
 // get config and add task from client config
+// 启动时的配置有一项失败就断开客户端；重新加载配置时只拒绝失败的项
 func (s *Bridge) getConfig(c *conn.Conn, isPub bool, client *file.Client) {
-	var fail bool
+	var fail, reload bool
+	// reject 回复失败，返回 true 时断开客户端
+	reject := func() bool {
+		if reload {
+			c.WriteAddReject()
+			return false
+		}
+		c.WriteAddFail()
+		fail = true
+		return true
+	}
 loop:
 	for {
 		flag, err := c.ReadFlag()
@@ -504,19 +963,17 @@ loop:
 			break
 		}
 		switch flag {
+		case common.RELOAD_CONF:
+			reload = true
 		case common.WORK_STATUS:
-			if b, err := c.GetShortContent(32); err != nil {
+			if id, err := s.statusClient(c); err != nil {
 				break loop
 			} else {
-				var str string
-				id, err := file.GetDb().GetClientIdByVkey(string(b))
-				if err != nil {
-					break loop
-				}
+				var remarks []string
 				file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
 					v := value.(*file.Host)
 					if v.Client.Id == id {
-						str += v.Remark + common.CONN_DATA_SEQ
+						remarks = append(remarks, v.Remark)
 					}
 					return true
 				})
@@ -524,12 +981,11 @@ loop:
 					v := value.(*file.Tunnel)
 					//if _, ok := s.runList[v.Id]; ok && v.Client.Id == id {
 					if _, ok := s.runList.Load(v.Id); ok && v.Client.Id == id {
-						str += v.Remark + common.CONN_DATA_SEQ
+						remarks = append(remarks, v.Remark)
 					}
 					return true
 				})
-				binary.Write(c, binary.LittleEndian, int32(len([]byte(str))))
-				binary.Write(c, binary.LittleEndian, []byte(str))
+				c.WriteStatus(remarks)
 			}
 		case common.NEW_CONF:
 			var err error
@@ -550,9 +1006,10 @@ loop:
 		case common.NEW_HOST:
 			h, err := c.GetHostInfo()
 			if err != nil {
-				fail = true
-				c.WriteAddFail()
-				break loop
+				if reject() {
+					break loop
+				}
+				continue loop
 			}
 			h.Client = client
 			if h.Location == "" {
@@ -560,9 +1017,10 @@ loop:
 			}
 			if !client.HasHost(h) {
 				if file.GetDb().IsHostExist(h) {
-					fail = true
-					c.WriteAddFail()
-					break loop
+					if reject() {
+						break loop
+					}
+					continue loop
 				} else {
 					file.GetDb().NewHost(h)
 					c.WriteAddOk()
@@ -572,30 +1030,40 @@ loop:
 			}
 		case common.NEW_TASK:
 			if t, err := c.GetTaskInfo(); err != nil {
-				fail = true
-				c.WriteAddFail()
-				break loop
-			} else {
-				ports := common.GetPorts(t.Ports)
-				targets := common.GetPorts(t.Target.TargetStr)
-				if len(ports) > 1 && (t.Mode == "tcp" || t.Mode == "udp") && (len(ports) != len(targets)) {
-					fail = true
-					c.WriteAddFail()
+				if reject() {
 					break loop
-				} else if t.Mode == "secret" || t.Mode == "p2p" {
-					ports = append(ports, 0)
 				}
-				if len(ports) == 0 {
-					fail = true
-					c.WriteAddFail()
-					break loop
+				continue loop
+			} else {
+				ports, targets, ok := taskPorts(t)
+				if !ok {
+					if reject() {
+						break loop
+					}
+					continue loop
 				}
 				for i := 0; i < len(ports); i++ {
 					tl := new(file.Tunnel)
 					tl.Mode = t.Mode
 					tl.Port = ports[i]
 					tl.ServerIp = t.ServerIp
-					if len(ports) == 1 {
+					if isPortRange(t, ports) {
+						// 端口范围用一个隧道监听所有端口
+						tl.Ports = t.Ports
+						tl.Remark = t.Remark
+						tl.Target = &file.Target{TargetStr: t.Target.TargetStr, LocalProxy: t.Target.LocalProxy}
+						if t.TargetAddr != "" {
+							tl.Target.TargetStr = t.TargetAddr + ":" + t.Target.TargetStr
+						}
+						if err := tl.CheckPortRange(); err != nil {
+							logs.Notice("Add task error ", err.Error())
+							if reject() {
+								break loop
+							}
+							continue loop
+						}
+						ports = ports[:1]
+					} else if len(ports) == 1 {
 						tl.Target = t.Target
 						tl.Remark = t.Remark
 					} else {
@@ -616,17 +1084,26 @@ loop:
 					tl.LocalPath = t.LocalPath
 					tl.StripPre = t.StripPre
 					tl.MultiAccount = t.MultiAccount
+					if conn.ValidCompression(t.Compression) {
+						tl.Compression = t.Compression
+					}
+					if conn.ValidPriority(t.Priority) {
+						tl.Priority = t.Priority
+					}
 					if !client.HasTunnel(tl) {
 						if err := file.GetDb().NewTask(tl); err != nil {
 							logs.Notice("Add task error ", err.Error())
-							fail = true
-							c.WriteAddFail()
-							break loop
+							if reject() {
+								break loop
+							}
+							continue loop
 						}
-						if b := tool.TestServerPort(tl.Port, tl.Mode); !b && t.Mode != "secret" && t.Mode != "p2p" {
-							fail = true
-							c.WriteAddFail()
-							break loop
+						if b := tool.TestServerPorts(tl.GetPorts(), tl.Mode); !b && t.Mode != "secret" && t.Mode != "p2p" {
+							file.GetDb().DelTask(tl.Id)
+							if reject() {
+								break loop
+							}
+							continue loop
 						} else {
 							s.OpenTask <- tl
 						}
@@ -634,6 +1111,48 @@ loop:
 					c.WriteAddOk()
 				}
 			}
+		case common.DEL_TASK:
+			t, err := c.GetTaskInfo()
+			if err != nil {
+				if reject() {
+					break loop
+				}
+				continue loop
+			}
+			ports, _, ok := taskPorts(t)
+			if !ok {
+				if reject() {
+					break loop
+				}
+				continue loop
+			}
+			for _, port := range ports {
+				s.delConfigTask(client, t.Mode, port, t.Password)
+			}
+			c.WriteAddOk()
+		case common.DEL_HOST:
+			h, err := c.GetHostInfo()
+			if err != nil {
+				if reject() {
+					break loop
+				}
+				continue loop
+			}
+			if h.Location == "" {
+				h.Location = "/"
+			}
+			var ids []int
+			file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+				v := value.(*file.Host)
+				if v.NoStore && v.Client.Id == client.Id && v.Host == h.Host && v.Location == h.Location && v.Scheme == h.Scheme {
+					ids = append(ids, v.Id)
+				}
+				return true
+			})
+			for _, id := range ids {
+				file.GetDb().DelHost(id)
+			}
+			c.WriteAddOk()
 		}
 	}
 	if fail && client != nil {
@@ -641,3 +1160,40 @@ loop:
 	}
 	c.Close()
 }
+
+// taskPorts 配置文件中的隧道可以是多个端口，tcp 和 udp 的多个端口为端口范围隧道，与目标端口一一对应
+func taskPorts(t *file.Tunnel) (ports, targets []int, ok bool) {
+	ports = common.GetPorts(t.Ports)
+	targets = common.GetPorts(t.Target.TargetStr)
+	if t.Mode == "secret" || t.Mode == "p2p" {
+		ports = append(ports, 0)
+	}
+	return ports, targets, len(ports) > 0
+}
+
+// isPortRange 配置文件中 tcp 和 udp 的多个端口为端口范围隧道
+func isPortRange(t *file.Tunnel, ports []int) bool {
+	return len(ports) > 1 && (t.Mode == "tcp" || t.Mode == "udp")
+}
+
+// delConfigTask 删除客户端配置文件中的隧道，secret 和 p2p 没有端口，按密码区分
+func (s *Bridge) delConfigTask(client *file.Client, mode string, port int, password string) {
+	var tasks []*file.Tunnel
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.NoStore && v.Client.Id == client.Id && v.Mode == mode && v.Port == port && (port != 0 || v.Password == password) {
+			tasks = append(tasks, v)
+		}
+		return true
+	})
+	for _, t := range tasks {
+		s.CloseTask <- t
+		// 等待端口关闭，修改后的隧道可能马上使用同一端口
+		for i := 0; i < 100; i++ {
+			if _, err := file.GetDb().GetTask(t.Id); err != nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+	"github.com/astaxie/beego/logs"
+)
+
+// Suspended reports whether the client lost its bridge connections and waits to resume
+func (s *Client) Suspended() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.suspendedUntil.IsZero()
+}
+
+// wake 结束挂起，唤醒等待重连的访问
+func (s *Client) wake() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suspendedUntil = time.Time{}
+	if s.ready != nil {
+		close(s.ready)
+		s.ready = nil
+	}
+}
+
+// canResume 令牌与客户端当前会话一致时可以接回原会话
+func (s *Bridge) canResume(id int, token string) bool {
+	if token == "" || s.resumeTimeout <= 0 {
+		return false
+	}
+	v, ok := s.Client.Load(id)
+	if !ok {
+		return false
+	}
+	cl := v.(*Client)
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.token == token
+}
+
+// resumeSession 主连接接入时结束挂起，令牌不一致时原会话不能接回，先关闭原会话。
+// 平滑重启后等待重连的客户端没有令牌，直接接回
+func (s *Bridge) resumeSession(id int, c *conn.Conn) {
+	v, ok := s.Client.Load(id)
+	if !ok {
+		return
+	}
+	cl := v.(*Client)
+	cl.mu.Lock()
+	suspended := !cl.suspendedUntil.IsZero()
+	stale := suspended && cl.token != "" && !c.Resumed
+	if suspended {
+		// 数据连接连上之前由 ping 按普通连接检查，不再按宽限期关闭
+		cl.suspendedUntil = time.Time{}
+	}
+	cl.mu.Unlock()
+	if stale {
+		logs.Info("clientId %d can not resume the last session, close it", id)
+		s.DelClient(id)
+	}
+}
+
+// suspendClient 关闭客户端的桥接连接但保留会话，隧道端口不关闭，返回 false 表示不能挂起
+func (s *Bridge) suspendClient(id int) bool {
+	if s.resumeTimeout <= 0 {
+		return false
+	}
+	v, ok := s.Client.Load(id)
+	if !ok {
+		return false
+	}
+	cl := v.(*Client)
+	cl.mu.Lock()
+	if cl.token == "" {
+		cl.mu.Unlock()
+		return false
+	}
+	if !cl.suspendedUntil.IsZero() {
+		cl.mu.Unlock()
+		return true
+	}
+	signal, tunnel, fileTunnel := cl.signal, cl.tunnel, cl.file
+	cl.signal, cl.tunnel, cl.file = nil, nil, nil
+	cl.suspendedUntil = time.Now().Add(s.resumeTimeout)
+	cl.ready = make(chan struct{})
+	cl.mu.Unlock()
+	if signal != nil {
+		signal.Close()
+	}
+	if tunnel != nil {
+		tunnel.Close()
+	}
+	if fileTunnel != nil {
+		fileTunnel.Close()
+	}
+	logs.Info("the client %d disconnected, keep the session for %s", id, s.resumeTimeout)
+	return true
+}
+
+// dropClient 信号连接断开时调用，会话可恢复则挂起，否则关闭客户端；已被新连接替换的不处理
+func (s *Bridge) dropClient(id int, c *conn.Conn) {
+	if v, ok := s.Client.Load(id); ok {
+		cl := v.(*Client)
+		cl.mu.Lock()
+		replaced := cl.signal != c
+		cl.mu.Unlock()
+		if replaced {
+			return
+		}
+	}
+	if !s.suspendClient(id) {
+		s.DelClient(id)
+	}
+}
+
+// waitResume 客户端重连期间新的访问最多等待 timeout，超过宽限期或未挂起时立即失败
+func (s *Bridge) waitResume(id int, cl *Client, timeout time.Duration, isFile bool) (conn.Tunnel, []byte, error) {
+	cl.mu.Lock()
+	ready, until := cl.ready, cl.suspendedUntil
+	cl.mu.Unlock()
+	if ready == nil {
+		return nil, nil, errors.New("the client connect error")
+	}
+	// 主连接已重连时 until 为零，等待数据连接
+	if d := time.Until(until); !until.IsZero() && d < timeout {
+		timeout = d
+	}
+	if timeout <= 0 {
+		return nil, nil, fmt.Errorf("the client %d is reconnecting", id)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+	case <-timer.C:
+		return nil, nil, fmt.Errorf("the client %d is reconnecting", id)
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	tunnel := cl.tunnel
+	if isFile {
+		tunnel = cl.file
+	}
+	if tunnel == nil {
+		return nil, nil, errors.New("the client connect error")
+	}
+	return tunnel, cl.key, nil
+}
+
+// Expect 平滑重启后旧进程上的客户端在 d 内会重连，期间新的访问等待重连而不是立即失败
+func (s *Bridge) Expect(ids []int, d time.Duration) {
+	for _, id := range ids {
+		s.Client.LoadOrStore(id, &Client{suspendedUntil: time.Now().Add(d), ready: make(chan struct{})})
+	}
+}
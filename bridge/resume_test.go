@@ -0,0 +1,87 @@
+package bridge
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+)
+
+type fakeTunnel struct {
+	conn.Tunnel
+	closed bool
+}
+
+func (t *fakeTunnel) IsClose() bool { return t.closed }
+func (t *fakeTunnel) Close() error  { t.closed = true; return nil }
+
+func newSuspendedClient(t *testing.T, s *Bridge, id int, token string) *Client {
+	a, b := net.Pipe()
+	t.Cleanup(func() { b.Close() })
+	cl := NewClient(&fakeTunnel{}, nil, conn.NewConn(a), "")
+	cl.token = token
+	s.Client.Store(id, cl)
+	if !s.suspendClient(id) {
+		t.Fatal("the client is not suspended")
+	}
+	return cl
+}
+
+func TestResumeSession(t *testing.T) {
+	s := &Bridge{resumeTimeout: time.Minute}
+	cl := newSuspendedClient(t, s, 1, "token")
+	if !s.canResume(1, "token") || s.canResume(1, "other") || s.canResume(1, "") {
+		t.Fatal("canResume does not match the token")
+	}
+	s.resumeSession(1, &conn.Conn{Resumed: true})
+	if cl.Suspended() {
+		t.Fatal("the resumed client is still suspended")
+	}
+	if v, ok := s.Client.Load(1); !ok || v.(*Client) != cl {
+		t.Fatal("the resumed session is not kept")
+	}
+	// visitors wait for the data connection rather than the expired grace period
+	start := time.Now()
+	if _, _, err := s.waitResume(1, cl, 100*time.Millisecond, false); err == nil || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("visitor did not wait for the data connection: %v", err)
+	}
+}
+
+func TestResumeSessionTokenMismatch(t *testing.T) {
+	s := &Bridge{resumeTimeout: time.Minute, CloseClient: make(chan int, 1)}
+	cl := newSuspendedClient(t, s, 2, "token")
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := s.waitResume(2, cl, 5*time.Second, false)
+		done <- err
+	}()
+	s.resumeSession(2, &conn.Conn{})
+	if _, ok := s.Client.Load(2); ok {
+		t.Fatal("the session can not be resumed but is kept")
+	}
+	// the waiting visitor fails fast instead of waiting for the timeout
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("waiting visitor got a tunnel of the closed session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting visitor is not woken")
+	}
+}
+
+func TestResumeSessionAfterRestart(t *testing.T) {
+	s := &Bridge{resumeTimeout: time.Minute}
+	s.Expect([]int{3}, time.Minute)
+	v, _ := s.Client.Load(3)
+	cl := v.(*Client)
+	// clients expected after a graceful restart have no token of this process
+	s.resumeSession(3, &conn.Conn{})
+	if cl.Suspended() {
+		t.Fatal("the expected client is still suspended")
+	}
+	if _, ok := s.Client.Load(3); !ok {
+		t.Fatal("the expected client is closed")
+	}
+}
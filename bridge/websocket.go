@@ -0,0 +1,43 @@
+package bridge
+
+import (
+	"net"
+	"net/http"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/server/connection"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/net/websocket"
+)
+
+// startWsTunnel serve the bridge over websocket, the handshake and the mux are the same as tcp
+func (s *Bridge) startWsTunnel() error {
+	l, path, err := connection.GetWsBridgeListener()
+	if err != nil || l == nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		// npc does not send a browser origin
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			r := ws.Request()
+			remoteAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+			if err != nil {
+				logs.Warn("websocket bridge remote addr %s error %v", r.RemoteAddr, err)
+				return
+			}
+			var localAddr net.Addr
+			if v, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				localAddr = v
+			}
+			c := conn.NewWsConn(ws, localAddr, remoteAddr)
+			s.cliProcess(conn.NewConn(c))
+			// the websocket is closed when the handler returns
+			<-c.Done()
+		},
+	})
+	return (&http.Server{Handler: mux}).Serve(l)
+}
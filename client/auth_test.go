@@ -0,0 +1,108 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/version"
+)
+
+// oldServer answers like a nps older than the challenge auth, the verify values read are sent to got
+func oldServer(t *testing.T, got chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := conn.NewConn(nc)
+				defer c.Close()
+				c.GetShortContent(3)
+				c.GetShortLenContent()
+				c.GetShortLenContent()
+				c.Write([]byte(crypt.Md5(version.GetVersion())))
+				b, err := c.GetShortContent(32)
+				if err != nil {
+					return
+				}
+				got <- string(b)
+				c.Write([]byte(common.VERIFY_EER))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestLegacyAuthOptIn(t *testing.T) {
+	defer SetLegacyAuth(false)
+	got := make(chan string, 4)
+	addr := oldServer(t, got)
+
+	// an error reply does not downgrade the auth
+	SetLegacyAuth(false)
+	if _, err := connectServer("tcp", "key", addr, common.WORK_MAIN, ""); err == nil {
+		t.Fatal("connected")
+	}
+	if v := <-got; v != common.VERIFY_HMAC {
+		t.Fatal(v)
+	}
+	if _, ok := legacyAuth.Load(addr); ok {
+		t.Fatal("fall back to the legacy auth without legacy_auth")
+	}
+	select {
+	case v := <-got:
+		t.Fatal("sent", v)
+	default:
+	}
+
+	// legacy_auth is set, md5(vkey) is sent to the old server
+	SetLegacyAuth(true)
+	connectServer("tcp", "key", addr, common.WORK_MAIN, "")
+	if v := <-got; v != common.VERIFY_HMAC {
+		t.Fatal(v)
+	}
+	if v := <-got; v != common.Getverifyval("key") {
+		t.Fatal(v)
+	}
+}
+
+// an empty proof of the server is accepted only if npc sends its certificate to a verified server
+func TestCertAuth(t *testing.T) {
+	defer func() {
+		tlsClientCert = nil
+		crypt.SetServerVerifier(nil)
+	}()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	tc := tls.Client(a, &tls.Config{})
+	if certAuth(tc) {
+		t.Fatal("no client certificate")
+	}
+	tlsClientCert = []tls.Certificate{{}}
+	if certAuth(tc) {
+		t.Fatal("the server is not verified")
+	}
+	v, err := crypt.NewServerVerifier(strings.Repeat("a", 64), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypt.SetServerVerifier(v)
+	if !certAuth(tc) {
+		t.Fatal("the certificate is sent to a verified server")
+	}
+	if certAuth(a) {
+		t.Fatal("the certificate is not sent without tls")
+	}
+}
@@ -23,12 +23,16 @@ import (
 )
 
 type TRPClient struct {
-	svrAddr        string
+	svrAddr        string // one server or a list to fail over
+	activeAddr     string // the server of the main connection
+	configAddr     string // the server the config is sent to, the main connection tries it first
+	fails          int    // failed connections in a row, for the backoff
 	bridgeConnType string
 	proxyUrl       string
 	vKey           string
 	p2pAddr        map[string]string
-	tunnel         *nps_mux.Mux
+	tunnel         conn.Tunnel // a mux or a stripe of several bridge connections
+	session        string      // identify the bridge connections of this run to nps
 	signal         *conn.Conn
 	ticker         *time.Ticker
 	cnf            *config.Config
@@ -36,6 +40,7 @@ type TRPClient struct {
 	once           sync.Once
 	closeCh        chan struct{}   // closed when client is shutting down; stops ping
 	logger         *logs.BeeLogger // 每个客户端独立的 logger
+	onVkey         func(vkey string)
 }
 
 // new client
@@ -59,6 +64,11 @@ func (s *TRPClient) SetLogger(logger *logs.BeeLogger) {
 	s.logger = logger
 }
 
+// SetVkeyHandler 设置保存 nps 轮换后的 vkey 的方法，未设置时只在日志中提示
+func (s *TRPClient) SetVkeyHandler(f func(vkey string)) {
+	s.onVkey = f
+}
+
 // log 辅助方法：如果设置了独立 logger 就使用，否则使用全局 logger
 func (s *TRPClient) logInfo(format string, v ...interface{}) {
 	if s.logger != nil {
@@ -97,6 +107,14 @@ func (s *TRPClient) IsConnected() bool {
 	return s.signal != nil
 }
 
+// ActiveServer 返回当前连接的服务器，未连接时为空
+func (s *TRPClient) ActiveServer() string {
+	if !s.IsConnected() {
+		return ""
+	}
+	return s.activeAddr
+}
+
 var NowStatus int
 var CloseClient bool
 
@@ -108,10 +126,23 @@ retry:
 		return
 	}
 	NowStatus = 0
-	c, err := NewConn(s.bridgeConnType, s.vKey, s.svrAddr, common.WORK_MAIN, s.proxyUrl)
+	var c *conn.Conn
+	var addr string
+	var err error
+	if s.configAddr != "" {
+		// 隧道添加在发送配置的服务器上，只先试一次
+		addr = s.configAddr
+		s.configAddr = ""
+		c, err = connectServer(s.bridgeConnType, s.vKey, addr, common.WORK_MAIN, s.proxyUrl)
+	}
+	if c == nil {
+		c, addr, err = NewConnServer(s.bridgeConnType, s.vKey, s.svrAddr, common.WORK_MAIN, s.proxyUrl)
+	}
 	if err != nil {
-		s.logError("The connection server failed and will be reconnected in five seconds, error", err.Error())
-		time.Sleep(time.Second * 5)
+		d := retryPolicy.Backoff(s.fails)
+		s.fails++
+		s.logError("The connection server failed and will be reconnected in %s, error %s", d, err.Error())
+		time.Sleep(d)
 		goto retry
 	}
 	if c == nil {
@@ -119,14 +150,21 @@ retry:
 		time.Sleep(time.Second * 5)
 		goto retry
 	}
-	s.logInfo("Successful connection with server %s", s.svrAddr)
+	s.fails = 0
+	s.activeAddr = addr
+	s.session = crypt.GetRandomString(16)
+	s.logInfo("Successful connection with server %s", addr)
+	if c.Resumed {
+		s.logInfo("the session is resumed, the tunnels of server are kept")
+	}
+	s.logTrace("negotiated capabilities: %v", c.Caps.List())
 	//monitor the connection
 	go s.ping()
 	s.signal = c
-	//start a channel connection
-	go s.newChan()
+	//start channel connections, more than one if nps allows
+	go s.newChan(c.Conns)
 	//start health check if the it's open
-	if s.cnf != nil && len(s.cnf.Healths) > 0 {
+	if s.cnf != nil && len(s.cnf.Healths) > 0 && c.Caps.Has(conn.CapHealth) {
 		go heathCheck(s.cnf.Healths, s.signal)
 	}
 	NowStatus = 1
@@ -172,16 +210,39 @@ mainLoop:
 				}
 				go s.newUdpConn(localAddr, string(lAddr), string(pwd))
 			}
+		case common.RES_RECONNECT:
+			s.logInfo("the server is restarting, reconnect")
+			break mainLoop
+		case common.NEW_VKEY:
+			vkey, err := s.signal.GetNewVkey(s.vKey)
+			if err != nil {
+				s.logWarn("get the new vkey error: %s", err.Error())
+				break mainLoop
+			}
+			s.newVkey(vkey)
 		}
 	}
 	s.Close()
 }
 
+// newVkey 之后的连接使用 nps 轮换后的 vkey，旧的 vkey 宽限期后失效
+func (s *TRPClient) newVkey(vkey string) {
+	if v, ok := resumeTokens.Load(s.vKey); ok {
+		resumeTokens.Store(vkey, v)
+	}
+	s.vKey = vkey
+	if s.onVkey != nil {
+		s.onVkey(vkey)
+	} else {
+		s.logWarn("the vkey is rotated by the server, the old vkey will expire, restart npc with -vkey=%s", vkey)
+	}
+}
+
 func (s *TRPClient) newUdpConn(localAddr, rAddr string, md5Password string) {
 	var localConn net.PacketConn
 	var err error
 	var remoteAddress string
-	if remoteAddress, localConn, err = handleP2PUdp(localAddr, rAddr, md5Password, common.WORK_P2P_PROVIDER); err != nil {
+	if remoteAddress, localConn, err = handleP2PUdp(localAddr, rAddr, md5Password, common.WORK_P2P_PROVIDER, s.signal.Caps.Has(conn.CapMsg)); err != nil {
 		s.logError(err.Error())
 		return
 	}
@@ -203,42 +264,86 @@ func (s *TRPClient) newUdpConn(localAddr, rAddr string, md5Password string) {
 			s.logTrace("successful connection with client ,address %s", udpTunnel.RemoteAddr().String())
 			//read link info from remote
 			conn.Accept(nps_mux.NewMux(udpTunnel, s.bridgeConnType, s.disconnectTime), func(c net.Conn) {
-				go s.handleChan(c)
+				go s.handleChan(c, nil, nil)
 			})
 			break
 		}
 	}
 }
 
-// pmux tunnel
-func (s *TRPClient) newChan() {
-	tunnel, err := NewConn(s.bridgeConnType, s.vKey, s.svrAddr, common.WORK_CHAN, s.proxyUrl)
-	if err != nil {
-		// WORK_MAIN may already be up; without Close the client stays half-connected
-		// (handleMain blocks, outer reconnect loop never runs). See #115.
-		s.logError("connect to %s error: %v, client will reconnect", s.svrAddr, err)
-		s.Close()
-		return
+// pmux tunnel, n connections are a stripe
+func (s *TRPClient) newChan(n int) {
+	if n < 1 {
+		n = 1
+	}
+	var stripe *conn.Stripe
+	if n > 1 {
+		stripe = conn.NewStripe(s.session, n)
 	}
-	s.tunnel = nps_mux.NewMux(tunnel.Conn, s.bridgeConnType, s.disconnectTime)
+	for i := 0; i < n; i++ {
+		// the tunnel must be on the server of the main connection
+		tunnel, err := NewConn(s.bridgeConnType, s.vKey, s.activeAddr, common.WORK_CHAN, s.proxyUrl)
+		if err == nil && tunnel.Caps.Has(conn.CapStripe) {
+			err = tunnel.WriteLenContent([]byte(s.session))
+		}
+		if err != nil {
+			if i > 0 {
+				// the stripe works with less connections
+				s.logWarn("connect bridge connection %d to %s error: %v", i+1, s.activeAddr, err)
+				continue
+			}
+			// WORK_MAIN may already be up; without Close the client stays half-connected
+			// (handleMain blocks, outer reconnect loop never runs). See #115.
+			s.logError("connect to %s error: %v, client will reconnect", s.activeAddr, err)
+			s.Close()
+			return
+		}
+		t := conn.NewTunnel(tunnel.Conn, s.bridgeConnType, s.disconnectTime)
+		conn.SetWeights(t, tunnel.Weights)
+		if tunnel.Caps.Has(conn.CapHalfClose) {
+			conn.EnableHalfClose(t)
+		}
+		if stripe == nil {
+			s.tunnel = t
+		} else {
+			stripe.Add(t, tunnel.Conn.LocalAddr().String(), tunnel.Key)
+			s.tunnel = stripe
+		}
+		go s.acceptChan(t, tunnel.Key, tunnel.Caps)
+	}
+	if stripe != nil {
+		s.logInfo("%d bridge connections to %s", stripe.Len(), s.activeAddr)
+	}
+}
+
+// acceptChan accept the links of a bridge connection, the key is the session key of the connection
+func (s *TRPClient) acceptChan(t conn.Tunnel, key []byte, caps conn.Caps) {
 	for {
-		src, err := s.tunnel.Accept()
+		src, err := t.Accept()
 		if err != nil {
 			s.logWarn(err.Error())
-			s.Close()
+			t.Close()
+			// a member of the stripe is dropped, the client is closed when no member left
+			if s.tunnel == nil || s.tunnel.IsClose() {
+				s.Close()
+			}
 			break
 		}
-		go s.handleChan(src)
+		go s.handleChan(src, key, caps)
 	}
 }
 
-func (s *TRPClient) handleChan(src net.Conn) {
-	lk, err := conn.NewConn(src).GetLinkInfo()
+func (s *TRPClient) handleChan(src net.Conn, key []byte, caps conn.Caps) {
+	c := conn.NewConn(src)
+	c.Caps = caps
+	lk, err := c.GetLinkInfo()
 	if err != nil || lk == nil {
 		src.Close()
 		s.logError("get connection info from server error %v", err)
 		return
 	}
+	lk.SetKey(key)
+	conn.SetPriority(src, lk.Priority)
 	//host for target processing
 	lk.Host = common.FormatAddress(lk.Host)
 	//if Conn type is http, read the request and log
@@ -247,7 +352,13 @@ func (s *TRPClient) handleChan(src net.Conn) {
 			s.logWarn("connect to %s error %s", lk.Host, err.Error())
 			src.Close()
 		} else {
-			srcConn := conn.GetConn(src, lk.Crypt, lk.Compress, nil, false)
+			srcConn, err := conn.GetConn(src, lk, nil, false)
+			if err != nil {
+				s.logWarn("link of %s error %s", lk.Host, err.Error())
+				src.Close()
+				targetConn.Close()
+				return
+			}
 			go func() {
 				common.CopyBuffer(srcConn, targetConn)
 				srcConn.Close()
@@ -271,6 +382,11 @@ func (s *TRPClient) handleChan(src net.Conn) {
 		}
 		return
 	}
+	if lk.ConnType == common.CONN_BIND {
+		s.logTrace("new %s connection with the peer %s, remote address:%s", lk.ConnType, lk.Host, lk.RemoteAddr)
+		s.handleBind(src, lk)
+		return
+	}
 	if lk.ConnType == "udp5" {
 		s.logTrace("new %s connection with the goal of %s, remote address:%s", lk.ConnType, lk.Host, lk.RemoteAddr)
 		s.handleUdp(src)
@@ -322,8 +438,37 @@ func (s *TRPClient) handleChan(src net.Conn) {
 			}
 		}
 
-		conn.CopyWaitGroup(src, targetConn, lk.Crypt, lk.Compress, nil, nil, false, nil, nil, nil)
+		conn.CopyWaitGroup(src, targetConn, lk, nil, nil, false, nil, nil, nil)
+	}
+}
+
+// listen for the peer of a socks5 BIND, the address of the listener and of the peer are sent before the data
+func (s *TRPClient) handleBind(src net.Conn, lk *conn.Link) {
+	l, err := conn.ListenBind("", 0)
+	if err != nil {
+		s.logWarn("socks5 bind listen error %s", err.Error())
+		src.Close()
+		return
+	}
+	defer l.Close()
+	c := conn.NewConn(src)
+	if err := c.WriteLenContent([]byte(conn.BindAddr(l, lk.Host))); err != nil {
+		src.Close()
+		return
+	}
+	target, err := conn.AcceptBind(l, lk.Host)
+	if err != nil {
+		s.logWarn("socks5 bind accept error %s", err.Error())
+		src.Close()
+		return
+	}
+	l.Close()
+	if err := c.WriteLenContent([]byte(target.RemoteAddr().String())); err != nil {
+		src.Close()
+		target.Close()
+		return
 	}
+	conn.CopyWaitGroup(src, target, lk, nil, nil, false, nil, nil, nil)
 }
 
 func (s *TRPClient) handleUdp(serverConn net.Conn) {
@@ -18,6 +18,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"ehang.io/nps/lib/common"
@@ -28,6 +29,7 @@ import (
 	"github.com/astaxie/beego/logs"
 	"github.com/xtaci/kcp-go"
 	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
 )
 
 var tlsEnable1 = false
@@ -40,32 +42,96 @@ func GetTlsEnable() bool {
 	return tlsEnable1
 }
 
+var tlsClientCert []tls.Certificate
+
+// SetTlsClientCert load the client certificate issued by nps, the key file can be the same as the cert file
+func SetTlsClientCert(certFile, keyFile string) error {
+	if certFile == "" {
+		tlsClientCert = nil
+		return nil
+	}
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	tlsClientCert = []tls.Certificate{cert}
+	return nil
+}
+
+// certAuth npc 在 tls 连接上发送了证书并验证了服务端证书，服务端只用证书认证时可以不证明 vkey
+func certAuth(c net.Conn) bool {
+	_, ok := c.(*tls.Conn)
+	return ok && len(tlsClientCert) > 0 && crypt.VerifiesServer()
+}
+
+var wsPath = "/ws"
+
+// SetWsPath set the websocket path of the bridge, used when conn_type is ws or wss
+func SetWsPath(path string) {
+	if path == "" {
+		return
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	wsPath = path
+}
+
+func GetWsPath() string {
+	return wsPath
+}
+
+var bridgeConns = 1
+
+// SetBridgeConns set the bridge data connections to request, nps may allow less
+func SetBridgeConns(n int) {
+	if n > 0 {
+		bridgeConns = n
+	}
+}
+
+// resumeTokens is the resume token of the last main connection of a vkey
+var resumeTokens sync.Map
+
+// legacyAuth is the servers which only accept md5(vkey), they are older than the challenge auth
+var legacyAuth sync.Map
+
+var legacyAuthEnable bool
+
+// SetLegacyAuth allow md5(vkey) to the servers refusing the challenge auth, it can be read on the way
+func SetLegacyAuth(enable bool) {
+	legacyAuthEnable = enable
+}
+
+var errLegacyAuth = errors.New("the server only supports the legacy auth")
+
 func GetTaskStatus(path string) {
 	cnf, err := config.NewConfig(path)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	c, err := NewConn(cnf.CommonConfig.Tp, cnf.CommonConfig.VKey, cnf.CommonConfig.Server, common.WORK_CONFIG, cnf.CommonConfig.ProxyUrl)
+	//read now vKey and write to server
+	f, err := common.ReadAllFromFile(filepath.Join(common.GetTmpPath(), "npc_vkey.txt"))
 	if err != nil {
 		log.Fatalln(err)
 	}
-	if _, err := c.Write([]byte(common.WORK_STATUS)); err != nil {
-		log.Fatalln(err)
-	}
-	//read now vKey and write to server
-	if f, err := common.ReadAllFromFile(filepath.Join(common.GetTmpPath(), "npc_vkey.txt")); err != nil {
-		log.Fatalln(err)
-	} else if _, err := c.Write([]byte(crypt.Md5(string(f)))); err != nil {
-		log.Fatalln(err)
+	// 隧道运行在主连接所在的服务器上，这里不知道是哪一台，所以合并所有服务器的状态
+	var arr []string
+	var ok bool
+	for _, addr := range GetServerList(cnf.CommonConfig.Server).Candidates() {
+		l, err := serverStatus(cnf.CommonConfig, addr, string(f))
+		if err != nil {
+			logs.Warn("get the status from %s error %v", addr, err)
+			continue
+		}
+		arr, ok = append(arr, l...), true
 	}
-	var isPub bool
-	binary.Read(c, binary.LittleEndian, &isPub)
-	if l, err := c.GetLen(); err != nil {
-		log.Fatalln(err)
-	} else if b, err := c.GetShortContent(l); err != nil {
-		log.Fatalln(err)
+	if !ok {
+		log.Fatalln("can not get the status from the servers")
 	} else {
-		arr := strings.Split(string(b), common.CONN_DATA_SEQ)
 		for _, v := range cnf.Hosts {
 			if common.InStrArr(arr, v.Remark) {
 				log.Println(v.Remark, "ok")
@@ -77,6 +143,9 @@ func GetTaskStatus(path string) {
 			ports := common.GetPorts(v.Ports)
 			if v.Mode == "secret" {
 				ports = append(ports, 0)
+			} else if len(ports) > 1 && (v.Mode == "tcp" || v.Mode == "udp") {
+				// 端口范围为一个隧道
+				ports = ports[:1]
 			}
 			for _, vv := range ports {
 				var remark string
@@ -108,7 +177,22 @@ func StartFromFile(path string) {
 	logs.Info("Loading configuration file %s successfully", path)
 
 	SetTlsEnable(cnf.CommonConfig.TlsEnable)
+	SetWsPath(cnf.CommonConfig.WsPath)
+	SetRetryPolicy(cnf.CommonConfig.RetryTimes, cnf.CommonConfig.RetryInterval, cnf.CommonConfig.RetryMaxInterval)
+	SetBridgeConns(cnf.CommonConfig.BridgeConns)
+	SetLegacyAuth(cnf.CommonConfig.LegacyAuth)
+	if err := SetTlsClientCert(cnf.CommonConfig.TlsCertFile, cnf.CommonConfig.TlsKeyFile); err != nil {
+		logs.Error("load client certificate error", err)
+		os.Exit(0)
+	}
+	if v, err := crypt.NewServerVerifier(cnf.CommonConfig.TlsFingerprint, cnf.CommonConfig.TlsCaFile, cnf.CommonConfig.TlsKnownHosts); err != nil {
+		logs.Error("load server verification error", err)
+		os.Exit(0)
+	} else {
+		crypt.SetServerVerifier(v)
+	}
 	logs.Info("the version of client is %s, the core version of client is %s,tls enable is %t", version.VERSION, version.GetVersion(), GetTlsEnable())
+	go watchConfig(path, cnf)
 re:
 	if first || cnf.CommonConfig.AutoReconnection {
 		if !first {
@@ -119,11 +203,36 @@ re:
 		return
 	}
 	first = false
-	c, err := NewConn(cnf.CommonConfig.Tp, cnf.CommonConfig.VKey, cnf.CommonConfig.Server, common.WORK_CONFIG, cnf.CommonConfig.ProxyUrl)
+	confLock.Lock()
+	vkey, addr, err := sendConfig(cnf)
 	if err != nil {
+		confLock.Unlock()
 		logs.Error(err)
 		goto re
 	}
+	if cnf.CommonConfig.Client.WebUserName == "" || cnf.CommonConfig.Client.WebPassword == "" {
+		logs.Notice("web access login username:user password:%s", vkey)
+	} else {
+		logs.Notice("web access login username:%s password:%s", cnf.CommonConfig.Client.WebUserName, cnf.CommonConfig.Client.WebPassword)
+	}
+	rpClient = NewRPClient(cnf.CommonConfig.Server, vkey, cnf.CommonConfig.Tp, cnf.CommonConfig.ProxyUrl, cnf, cnf.CommonConfig.DisconnectTime)
+	rpClient.configAddr = addr
+	if vkey == cnf.CommonConfig.VKey {
+		rpClient.SetVkeyHandler(func(vkey string) { saveVkey(path, cnf, vkey) })
+	}
+	confLock.Unlock()
+	rpClient.Start()
+	CloseLocalServer()
+	goto re
+}
+
+// sendConfig 发送配置文件中的隧道和域名解析，启动本地服务，返回连接使用的 vkey 和服务器
+func sendConfig(cnf *config.Config) (string, string, error) {
+	c, addr, err := NewConnServer(cnf.CommonConfig.Tp, cnf.CommonConfig.VKey, cnf.CommonConfig.Server, common.WORK_CONFIG, cnf.CommonConfig.ProxyUrl)
+	if err != nil {
+		return "", "", err
+	}
+	defer c.Close()
 	var isPub bool
 	binary.Read(c, binary.LittleEndian, &isPub)
 
@@ -133,17 +242,14 @@ re:
 	if isPub {
 		// send global configuration to server and get status of config setting
 		if _, err := c.SendInfo(cnf.CommonConfig.Client, common.NEW_CONF); err != nil {
-			logs.Error(err)
-			goto re
+			return "", "", err
 		}
 		if !c.GetAddStatus() {
-			logs.Error("the web_user may have been occupied!")
-			goto re
+			return "", "", errors.New("the web_user may have been occupied!")
 		}
 
 		if b, err = c.GetShortContent(16); err != nil {
-			logs.Error(err)
-			goto re
+			return "", "", err
 		}
 		vkey = string(b)
 	}
@@ -152,28 +258,24 @@ re:
 	//send hosts to server
 	for _, v := range cnf.Hosts {
 		if _, err := c.SendInfo(v, common.NEW_HOST); err != nil {
-			logs.Error(err)
-			goto re
+			return "", "", err
 		}
 		if !c.GetAddStatus() {
-			logs.Error(errAdd, v.Host)
-			goto re
+			return "", "", fmt.Errorf("%w %s", errAdd, v.Host)
 		}
 	}
 
 	//send  task to server
 	for _, v := range cnf.Tasks {
 		if _, err := c.SendInfo(v, common.NEW_TASK); err != nil {
-			logs.Error(err)
-			goto re
+			return "", "", err
 		}
 		if !c.GetAddStatus() {
-			logs.Error(errAdd, v.Ports, v.Remark)
-			goto re
+			return "", "", fmt.Errorf("%w %s %s", errAdd, v.Ports, v.Remark)
 		}
 		if v.Mode == "file" {
 			//start local file server
-			go startLocalFileServer(cnf.CommonConfig, v, vkey)
+			go startLocalFileServer(cnf.CommonConfig, addr, v, vkey)
 		}
 	}
 
@@ -181,45 +283,100 @@ re:
 	for _, v := range cnf.LocalServer {
 		go StartLocalServer(v, cnf.CommonConfig)
 	}
+	return vkey, addr, nil
+}
 
-	c.Close()
-	if cnf.CommonConfig.Client.WebUserName == "" || cnf.CommonConfig.Client.WebPassword == "" {
-		logs.Notice("web access login username:user password:%s", vkey)
-	} else {
-		logs.Notice("web access login username:%s password:%s", cnf.CommonConfig.Client.WebUserName, cnf.CommonConfig.Client.WebPassword)
+// serverStatus 返回一台服务器上正在运行的隧道和域名解析
+func serverStatus(cnf *config.CommonConfig, server, vkey string) ([]string, error) {
+	c, err := connectServer(cnf.Tp, cnf.VKey, server, common.WORK_CONFIG, cnf.ProxyUrl)
+	if err != nil {
+		return nil, err
 	}
-	NewRPClient(cnf.CommonConfig.Server, vkey, cnf.CommonConfig.Tp, cnf.CommonConfig.ProxyUrl, cnf, cnf.CommonConfig.DisconnectTime).Start()
-	CloseLocalServer()
-	goto re
+	defer c.Close()
+	if _, err := c.Write([]byte(common.WORK_STATUS)); err != nil {
+		return nil, err
+	}
+	if !c.Caps.Has(conn.CapStatusAuth) {
+		if !legacyAuthEnable {
+			return nil, fmt.Errorf("server %s only takes md5(vkey) for the status, set legacy_auth=true to send it", server)
+		}
+		if _, err := c.Write([]byte(crypt.Md5(vkey))); err != nil {
+			return nil, err
+		}
+	}
+	var isPub bool
+	binary.Read(c, binary.LittleEndian, &isPub)
+	if c.Caps.Has(conn.CapStatusAuth) {
+		// 用挑战认证证明 vkey
+		if s, err := c.ReadFlag(); err != nil {
+			return nil, err
+		} else if s != common.VERIFY_CHALLENGE {
+			return nil, errors.New("unexpected reply " + s)
+		}
+		if _, err := c.AnswerChallenge(vkey); err != nil {
+			return nil, err
+		}
+	}
+	return c.GetStatus()
 }
 
-// Create a new connection with the server and verify it
+// activeServer 与主连接连到同一台服务器，主连接未连接时为配置的服务器列表
+func activeServer(cnf *config.CommonConfig) string {
+	if c := rpClient; c != nil && c.cnf != nil && c.cnf.CommonConfig == cnf {
+		if addr := c.ActiveServer(); addr != "" {
+			return addr
+		}
+	}
+	return cnf.Server
+}
+
+// Create a new connection with the server and verify it, the server can be a list to fail over
 func NewConn(tp string, vkey string, server string, connType string, proxyUrl string) (*conn.Conn, error) {
+	c, _, err := NewConnServer(tp, vkey, server, connType, proxyUrl)
+	return c, err
+}
+
+// connectServer connect to the server of the address only, retry once by the legacy auth of an old server
+func connectServer(tp string, vkey string, addr string, connType string, proxyUrl string) (*conn.Conn, error) {
+	c, err := newConn(tp, vkey, addr, connType, proxyUrl)
+	if err == errLegacyAuth {
+		c, err = newConn(tp, vkey, addr, connType, proxyUrl)
+	}
+	return c, err
+}
+
+// NewConnServer try the servers of the list by the retry policy, returns the conn and the server connected
+func NewConnServer(tp string, vkey string, server string, connType string, proxyUrl string) (*conn.Conn, string, error) {
+	list := GetServerList(server)
 	var err error
+	for i := 0; ; i++ {
+		for _, addr := range list.Candidates() {
+			var c *conn.Conn
+			if c, err = connectServer(tp, vkey, addr, connType, proxyUrl); err == nil {
+				list.MarkOk(addr)
+				return c, addr, nil
+			}
+			list.MarkFail(addr, err)
+		}
+		if i >= retryPolicy.Times {
+			return nil, "", err
+		}
+		time.Sleep(retryPolicy.Backoff(i))
+	}
+}
+
+func newConn(tp string, vkey string, server string, connType string, proxyUrl string) (c *conn.Conn, err error) {
 	var connection net.Conn
 	var sess *kcp.UDPSession
-	if tp == "tcp" {
+	switch tp {
+	case "tcp":
 		if proxyUrl != "" {
-			u, er := url.Parse(proxyUrl)
-			if er != nil {
-				return nil, er
-			}
-			switch u.Scheme {
-			case "socks5":
-				n, er := proxy.FromURL(u, nil)
-				if er != nil {
-					return nil, er
-				}
-				connection, err = n.Dial("tcp", server)
-			default:
-				connection, err = NewHttpProxyConn(u, server)
-			}
+			connection, err = dialServer(server, proxyUrl)
 		} else {
 			if GetTlsEnable() {
 				//tls 流量加密
-				conf := &tls.Config{
-					InsecureSkipVerify: true,
-				}
+				conf := crypt.ClientTlsConfig(server)
+				conf.Certificates = tlsClientCert
 				connection, err = tls.Dial("tcp", server, conf)
 			} else {
 				connection, err = net.Dial("tcp", server)
@@ -242,7 +399,16 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 			//_, err = header.WriteTo(connection)
 			//_, err = io.WriteString(connection, "HELO")
 		}
-	} else {
+	case "ws", "wss":
+		connection, err = NewWsConn(tp, server, proxyUrl)
+	case "quic":
+		if proxyUrl != "" {
+			return nil, errors.New("the quic bridge can not be used with a proxy")
+		}
+		conf := crypt.ClientTlsConfig(server)
+		conf.NextProtos = []string{conn.QuicAlpn}
+		connection, err = conn.DialQuic(server, conf, 0)
+	default:
 		sess, err = kcp.DialWithOptions(server, nil, 10, 3)
 		if err == nil {
 			conn.SetUdpSession(sess)
@@ -252,9 +418,15 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		// close the conn of a failed handshake, another server may be tried
+		if err != nil {
+			connection.Close()
+		}
+	}()
 	connection.SetDeadline(time.Now().Add(time.Second * 10))
 	defer connection.SetDeadline(time.Time{})
-	c := conn.NewConn(connection)
+	c = conn.NewConn(connection)
 	if _, err := c.Write([]byte(common.CONN_TEST)); err != nil {
 		return nil, err
 	}
@@ -273,22 +445,163 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 		//logs.Error("The client does not match the server version. The current core version of the client is", version.GetVersion())
 		//return nil, err
 	}
-	if _, err := c.Write([]byte(common.Getverifyval(vkey))); err != nil {
+	_, legacy := legacyAuth.Load(server)
+	verifyVal := []byte(common.Getverifyval(vkey))
+	if !legacy {
+		verifyVal = []byte(common.VERIFY_HMAC)
+	}
+	if _, err := c.Write(verifyVal); err != nil {
 		return nil, err
 	}
-	if s, err := c.ReadFlag(); err != nil {
+	s, err := c.ReadFlag()
+	if err != nil {
 		return nil, err
-	} else if s == common.VERIFY_EER {
+	}
+	var auth *conn.Auth
+	if s == common.VERIFY_CHALLENGE {
+		if auth, err = c.AnswerChallenge(vkey); err != nil {
+			return nil, err
+		}
+		if s, err = c.ReadFlag(); err != nil {
+			return nil, err
+		}
+	} else if s == common.VERIFY_EER && !legacy {
+		// 旧版本的服务端不支持挑战认证，只有配置了 legacy_auth 才改用 md5(vkey) 重新连接，
+		// 否则伪造的一个错误回复就能让 npc 降级
+		if !legacyAuthEnable {
+			return nil, fmt.Errorf("server %s refused the challenge auth, the vkey is incorrect or the server is older than npc, set legacy_auth=true to connect to an old server", server)
+		}
+		logs.Warn("server %s does not support the challenge auth, fall back to the legacy auth", server)
+		legacyAuth.Store(server, true)
+		return nil, errLegacyAuth
+	}
+	if s == common.VERIFY_EER {
 		return nil, errors.New(fmt.Sprintf("Validation key %s incorrect", vkey))
+	} else if s == common.VERIFY_HELLO {
+		if auth != nil {
+			if err = c.VerifyAuthProof(auth, vkey, certAuth(c.Conn)); err != nil {
+				return nil, err
+			}
+		}
+		var resume string
+		if v, ok := resumeTokens.Load(vkey); ok && connType == common.WORK_MAIN {
+			resume = v.(string)
+		}
+		// 会话密钥和 hello 的签名用服务端证明过的 vkey，旧的认证方式只有 md5(vkey)
+		key := common.Getverifyval(vkey)
+		if auth != nil {
+			key = ""
+			if auth.Proven {
+				key = vkey
+			}
+		}
+		if err := hello(c, auth, key, resume); err != nil {
+			return nil, err
+		}
+	} else {
+		// the server does not support negotiation
+		c.Caps = conn.LegacyCaps()
 	}
 	if _, err := c.Write([]byte(connType)); err != nil {
 		return nil, err
 	}
+	if connType == common.WORK_MAIN && c.Token != "" {
+		resumeTokens.Store(vkey, c.Token)
+	}
 	c.SetAlive(tp)
 
 	return c, nil
 }
 
+// exchange protocol version and capabilities with the server, resume is the token of the last session.
+// vkey is the key proven by the server, the hellos are signed by it after the challenge auth
+func hello(c *conn.Conn, auth *conn.Auth, vkey string, resume string) error {
+	if _, err := c.Write([]byte(common.WORK_HELLO)); err != nil {
+		return err
+	}
+	local := conn.LocalHello()
+	local.Conns = bridgeConns
+	local.Resume = resume
+	if err := c.SendHello(local); err != nil {
+		return err
+	}
+	remote, err := c.GetHello()
+	if err != nil {
+		return err
+	}
+	transcript := conn.Transcript(local, remote)
+	if auth != nil {
+		if err := c.VerifyHelloProof(vkey, transcript); err != nil {
+			return err
+		}
+	}
+	if remote.ProtoVersion != local.ProtoVersion {
+		logs.Info("the protocol version of server %s is %d, client is %d", remote.Version, remote.ProtoVersion, local.ProtoVersion)
+	}
+	c.Caps = conn.Negotiate(local, remote)
+	if c.Caps.Has(conn.CapStripe) && remote.Conns > 1 {
+		c.Conns = remote.Conns
+	}
+	if c.Caps.Has(conn.CapResume) {
+		c.Token, c.Resumed = remote.Token, remote.Resumed
+	}
+	c.Weights = remote.Weights
+	if c.Caps.Has(conn.CapAead) {
+		if c.Key, err = conn.SessionKey(local, remote, vkey, transcript); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dial the server through the socks5 or http proxy
+func dialServer(server string, proxyUrl string) (net.Conn, error) {
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5":
+		n, err := proxy.FromURL(u, nil)
+		if err != nil {
+			return nil, err
+		}
+		return n.Dial("tcp", server)
+	default:
+		return NewHttpProxyConn(u, server)
+	}
+}
+
+// websocket connection, ws or wss, the proxy is also supported
+func NewWsConn(tp string, server string, proxyUrl string) (net.Conn, error) {
+	var raw net.Conn
+	var err error
+	if proxyUrl != "" {
+		raw, err = dialServer(server, proxyUrl)
+	} else {
+		raw, err = net.DialTimeout("tcp", server, time.Second*10)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tp == "wss" {
+		raw = tls.Client(raw, crypt.ClientTlsConfig(server))
+	}
+	cfg, err := websocket.NewConfig(tp+"://"+server+GetWsPath(), "http://"+server)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Now().Add(time.Second * 10))
+	ws, err := websocket.NewClient(cfg, raw)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	return conn.NewWsConn(ws, raw.LocalAddr(), raw.RemoteAddr()), nil
+}
+
 // http proxy connection
 func NewHttpProxyConn(url *url.URL, remoteAddr string) (net.Conn, error) {
 	req, err := http.NewRequest("CONNECT", "http://"+remoteAddr, nil)
@@ -322,7 +635,7 @@ func basicAuth(username, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
-func getRemoteAddressFromServer(rAddr string, localConn *net.UDPConn, md5Password, role string, add int) error {
+func getRemoteAddressFromServer(rAddr string, localConn *net.UDPConn, md5Password, role string, add int, msg bool) error {
 	rAddr, err := getNextAddr(rAddr, add)
 	if err != nil {
 		logs.Error(err)
@@ -332,29 +645,34 @@ func getRemoteAddressFromServer(rAddr string, localConn *net.UDPConn, md5Passwor
 	if err != nil {
 		return err
 	}
-	if _, err := localConn.WriteTo(common.GetWriteStr(md5Password, role), addr); err != nil {
+	b := common.GetWriteStr(md5Password, role)
+	if msg {
+		b = conn.P2pMsg(md5Password, role)
+	}
+	if _, err := localConn.WriteTo(b, addr); err != nil {
 		return err
 	}
 	return nil
 }
 
-func handleP2PUdp(localAddr, rAddr, md5Password, role string) (remoteAddress string, c net.PacketConn, err error) {
+// handleP2PUdp msg 为 p2p 服务端支持 CapMsg
+func handleP2PUdp(localAddr, rAddr, md5Password, role string, msg bool) (remoteAddress string, c net.PacketConn, err error) {
 	localConn, err := newUdpConnByAddr(localAddr)
 	if err != nil {
 		return
 	}
 	defer localConn.Close()
-	err = getRemoteAddressFromServer(rAddr, localConn, md5Password, role, 0)
+	err = getRemoteAddressFromServer(rAddr, localConn, md5Password, role, 0, msg)
 	if err != nil {
 		logs.Error(err)
 		return
 	}
-	err = getRemoteAddressFromServer(rAddr, localConn, md5Password, role, 1)
+	err = getRemoteAddressFromServer(rAddr, localConn, md5Password, role, 1, msg)
 	if err != nil {
 		logs.Error(err)
 		return
 	}
-	err = getRemoteAddressFromServer(rAddr, localConn, md5Password, role, 2)
+	err = getRemoteAddressFromServer(rAddr, localConn, md5Password, role, 2, msg)
 	if err != nil {
 		logs.Error(err)
 		return
@@ -371,15 +689,21 @@ func handleP2PUdp(localAddr, rAddr, md5Password, role string) (remoteAddress str
 			localConn.SetReadDeadline(time.Time{})
 			return
 		}
+		str := string(buf[:n])
+		if msg {
+			if str, err = conn.ParseP2pAddr(buf[:n]); err != nil {
+				continue
+			}
+		}
 		rAddr2, _ := getNextAddr(rAddr, 1)
 		rAddr3, _ := getNextAddr(rAddr, 2)
 		switch addr.String() {
 		case rAddr:
-			remoteAddr1 = string(buf[:n])
+			remoteAddr1 = str
 		case rAddr2:
-			remoteAddr2 = string(buf[:n])
+			remoteAddr2 = str
 		case rAddr3:
-			remoteAddr3 = string(buf[:n])
+			remoteAddr3 = str
 		}
 		if remoteAddr1 != "" && remoteAddr2 != "" && remoteAddr3 != "" {
 			break
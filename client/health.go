@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"ehang.io/nps/lib/conn"
@@ -16,8 +17,12 @@ import (
 
 var isStart bool
 var serverConn *conn.Conn
+var healthStop chan struct{}
+var healthLock sync.Mutex
 
 func heathCheck(healths []*file.Health, c *conn.Conn) bool {
+	healthLock.Lock()
+	defer healthLock.Unlock()
 	serverConn = c
 	if isStart {
 		for _, v := range healths {
@@ -26,6 +31,26 @@ func heathCheck(healths []*file.Health, c *conn.Conn) bool {
 		return true
 	}
 	isStart = true
+	startHealthCheck(healths)
+	return true
+}
+
+// restartHealthCheck 配置文件中的健康检查修改后重新开始，c 为空时在下次连接后开始
+func restartHealthCheck(healths []*file.Health, c *conn.Conn) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	if isStart {
+		close(healthStop)
+		isStart = false
+	}
+	if c != nil && len(healths) > 0 {
+		serverConn = c
+		isStart = true
+		startHealthCheck(healths)
+	}
+}
+
+func startHealthCheck(healths []*file.Health) {
 	h := &sheap.IntHeap{}
 	for _, v := range healths {
 		if v.HealthMaxFail > 0 && v.HealthCheckTimeout > 0 && v.HealthCheckInterval > 0 {
@@ -34,11 +59,11 @@ func heathCheck(healths []*file.Health, c *conn.Conn) bool {
 			v.HealthMap = make(map[string]int)
 		}
 	}
-	go session(healths, h)
-	return true
+	healthStop = make(chan struct{})
+	go session(healths, h, healthStop)
 }
 
-func session(healths []*file.Health, h *sheap.IntHeap) {
+func session(healths []*file.Health, h *sheap.IntHeap, stop chan struct{}) {
 	for {
 		if h.Len() == 0 {
 			logs.Error("health check error")
@@ -50,6 +75,9 @@ func session(healths []*file.Health, h *sheap.IntHeap) {
 		}
 		timer := time.NewTimer(time.Duration(rs) * time.Second)
 		select {
+		case <-stop:
+			timer.Stop()
+			return
 		case <-timer.C:
 			for _, v := range healths {
 				if v.HealthNextTime.Before(time.Now()) {
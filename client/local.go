@@ -3,6 +3,7 @@ package client
 import (
 	"ehang.io/nps/lib/nps_mux"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"runtime"
@@ -20,10 +21,10 @@ import (
 )
 
 var (
-	LocalServer   []*net.TCPListener
+	localServer   sync.Map // map[*config.LocalServer]io.Closer
 	udpConn       net.Conn
 	muxSession    *nps_mux.Mux
-	fileServer    []*http.Server
+	fileServer    sync.Map // map[*file.Tunnel]*http.Server
 	p2pNetBridge  *p2pBridge
 	lock          sync.RWMutex
 	udpConnStatus bool
@@ -54,16 +55,31 @@ func (p2pBridge *p2pBridge) SendLinkInfo(clientId int, link *conn.Link, t *file.
 }
 
 func CloseLocalServer() {
-	for _, v := range LocalServer {
-		v.Close()
+	localServer.Range(func(key, value interface{}) bool {
+		closeLocalServer(key.(*config.LocalServer))
+		return true
+	})
+	fileServer.Range(func(key, value interface{}) bool {
+		closeFileServer(key.(*file.Tunnel))
+		return true
+	})
+}
+
+func closeLocalServer(l *config.LocalServer) {
+	if v, ok := localServer.LoadAndDelete(l); ok {
+		v.(io.Closer).Close()
 	}
-	for _, v := range fileServer {
-		v.Close()
+}
+
+func closeFileServer(t *file.Tunnel) {
+	if v, ok := fileServer.LoadAndDelete(t); ok {
+		v.(*http.Server).Close()
 	}
 }
 
-func startLocalFileServer(config *config.CommonConfig, t *file.Tunnel, vkey string) {
-	remoteConn, err := NewConn(config.Tp, vkey, config.Server, common.WORK_FILE, config.ProxyUrl)
+// startLocalFileServer 连接添加了隧道的服务器 server
+func startLocalFileServer(config *config.CommonConfig, server string, t *file.Tunnel, vkey string) {
+	remoteConn, err := NewConn(config.Tp, vkey, server, common.WORK_FILE, config.ProxyUrl)
 	if err != nil {
 		logs.Error("Local connection server failed ", err.Error())
 		return
@@ -72,8 +88,8 @@ func startLocalFileServer(config *config.CommonConfig, t *file.Tunnel, vkey stri
 		Handler: http.StripPrefix(t.StripPre, http.FileServer(http.Dir(t.LocalPath))),
 	}
 	logs.Info("start local file system, local path %s, strip prefix %s ,remote port %s ", t.LocalPath, t.StripPre, t.Ports)
-	fileServer = append(fileServer, srv)
-	listener := nps_mux.NewMux(remoteConn.Conn, common.CONN_TCP, config.DisconnectTime)
+	fileServer.Store(t, srv)
+	listener := conn.NewTunnel(remoteConn.Conn, common.CONN_TCP, config.DisconnectTime)
 	logs.Error(srv.Serve(listener))
 }
 
@@ -101,17 +117,21 @@ func StartLocalServer(l *config.LocalServer, config *config.CommonConfig) error
 	switch l.Type {
 	case "p2ps":
 		logs.Info("successful start-up of local socks5 monitoring, port", l.Port)
-		return proxy.NewSock5ModeServer(p2pNetBridge, task).Start()
+		svr := proxy.NewSock5ModeServer(p2pNetBridge, task)
+		localServer.Store(l, svr)
+		return svr.Start()
 	case "p2pt":
 		logs.Info("successful start-up of local tcp trans monitoring, port", l.Port)
-		return proxy.NewTunnelModeServer(proxy.HandleTrans, p2pNetBridge, task).Start()
+		svr := proxy.NewTunnelModeServer(proxy.HandleTrans, p2pNetBridge, task)
+		localServer.Store(l, svr)
+		return svr.Start()
 	case "p2p", "secret":
 		listener, err := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP("0.0.0.0"), l.Port, ""})
 		if err != nil {
 			logs.Error("local listener startup failed port %d, error %s", l.Port, err.Error())
 			return err
 		}
-		LocalServer = append(LocalServer, listener)
+		localServer.Store(l, listener)
 		logs.Info("successful start-up of local tcp monitoring, port", l.Port)
 		conn.Accept(listener, func(c net.Conn) {
 			logs.Trace("new %s connection", l.Type)
@@ -131,6 +151,10 @@ func handleUdpMonitor(config *config.CommonConfig, l *config.LocalServer) {
 	for {
 		select {
 		case <-ticker.C:
+			if _, ok := localServer.Load(l); !ok {
+				// 本地服务已关闭
+				return
+			}
 			if !udpConnStatus {
 				udpConn = nil
 				tmpConn, err := common.GetLocalUdpAddr()
@@ -152,7 +176,7 @@ func handleUdpMonitor(config *config.CommonConfig, l *config.LocalServer) {
 }
 
 func handleSecret(localTcpConn net.Conn, config *config.CommonConfig, l *config.LocalServer) {
-	remoteConn, err := NewConn(config.Tp, config.VKey, config.Server, common.WORK_SECRET, config.ProxyUrl)
+	remoteConn, err := NewConn(config.Tp, config.VKey, activeServer(config), common.WORK_SECRET, config.ProxyUrl)
 	if err != nil {
 		logs.Error("Local connection server failed ", err.Error())
 		return
@@ -161,7 +185,7 @@ func handleSecret(localTcpConn net.Conn, config *config.CommonConfig, l *config.
 		logs.Error("Local connection server failed ", err.Error())
 		return
 	}
-	conn.CopyWaitGroup(remoteConn.Conn, localTcpConn, false, false, nil, nil, false, nil, nil, nil)
+	conn.CopyWaitGroup(remoteConn.Conn, localTcpConn, nil, nil, nil, false, nil, nil, nil)
 }
 
 func handleP2PVisitor(localTcpConn net.Conn, config *config.CommonConfig, l *config.LocalServer) {
@@ -178,14 +202,14 @@ func handleP2PVisitor(localTcpConn net.Conn, config *config.CommonConfig, l *con
 		udpConnStatus = false
 		return
 	} else {
-		conn.CopyWaitGroup(target, localTcpConn, false, config.Client.Cnf.Compress, nil, nil, false, nil, nil, nil)
+		conn.CopyWaitGroup(target, localTcpConn, link, nil, nil, false, nil, nil, nil)
 	}
 }
 
 func newUdpConn(localAddr string, config *config.CommonConfig, l *config.LocalServer) {
 	lock.Lock()
 	defer lock.Unlock()
-	remoteConn, err := NewConn(config.Tp, config.VKey, config.Server, common.WORK_P2P, config.ProxyUrl)
+	remoteConn, err := NewConn(config.Tp, config.VKey, activeServer(config), common.WORK_P2P, config.ProxyUrl)
 	if err != nil {
 		logs.Error("Local connection server failed ", err.Error())
 		return
@@ -202,7 +226,7 @@ func newUdpConn(localAddr string, config *config.CommonConfig, l *config.LocalSe
 	}
 	var localConn net.PacketConn
 	var remoteAddress string
-	if remoteAddress, localConn, err = handleP2PUdp(localAddr, string(rAddr), crypt.Md5(l.Password), common.WORK_P2P_VISITOR); err != nil {
+	if remoteAddress, localConn, err = handleP2PUdp(localAddr, string(rAddr), crypt.Md5(l.Password), common.WORK_P2P_VISITOR, remoteConn.Caps.Has(conn.CapMsg)); err != nil {
 		logs.Error(err)
 		return
 	}
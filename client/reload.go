@@ -0,0 +1,434 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/config"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+var (
+	confLock sync.Mutex
+	rpClient *TRPClient // the client started by StartFromFile
+)
+
+// configDiff 配置文件修改后需要删除和新增的项，修改的项先删除再新增
+type configDiff struct {
+	delHosts  []*file.Host
+	newHosts  []*file.Host
+	delTasks  []*file.Tunnel
+	newTasks  []*file.Tunnel
+	delLocals []*config.LocalServer
+	newLocals []*config.LocalServer
+	healths   bool // 健康检查有修改
+	common    bool // [common] 有修改，重启 npc 后生效
+	// nps 拒绝的新增项，以及因修改失败而保留的原来的项，由 sendConfigDiff 设置
+	rejectedHosts []*file.Host
+	rejectedTasks []*file.Tunnel
+	keptHosts     []*file.Host
+	keptTasks     []*file.Tunnel
+}
+
+func (d *configDiff) remote() bool {
+	return len(d.delHosts)+len(d.newHosts)+len(d.delTasks)+len(d.newTasks) > 0
+}
+
+func (d *configDiff) empty() bool {
+	return !d.remote() && len(d.delLocals)+len(d.newLocals) == 0 && !d.healths
+}
+
+// diffConfig 比较修改前后的配置，now 中没有修改的项换成 old 中正在使用的对象
+func diffConfig(old, now *config.Config) *configDiff {
+	d := new(configDiff)
+	d.common = !reflect.DeepEqual(old.CommonConfig, now.CommonConfig)
+	del, same := diffItems(len(old.Hosts), len(now.Hosts), func(i, j int) bool {
+		return reflect.DeepEqual(old.Hosts[i], now.Hosts[j])
+	})
+	for _, i := range del {
+		d.delHosts = append(d.delHosts, old.Hosts[i])
+	}
+	for j, i := range same {
+		if i < 0 {
+			d.newHosts = append(d.newHosts, now.Hosts[j])
+		} else {
+			now.Hosts[j] = old.Hosts[i]
+		}
+	}
+	del, same = diffItems(len(old.Tasks), len(now.Tasks), func(i, j int) bool {
+		return reflect.DeepEqual(old.Tasks[i], now.Tasks[j])
+	})
+	for _, i := range del {
+		d.delTasks = append(d.delTasks, old.Tasks[i])
+	}
+	for j, i := range same {
+		if i < 0 {
+			d.newTasks = append(d.newTasks, now.Tasks[j])
+		} else {
+			now.Tasks[j] = old.Tasks[i]
+		}
+	}
+	del, same = diffItems(len(old.LocalServer), len(now.LocalServer), func(i, j int) bool {
+		return *old.LocalServer[i] == *now.LocalServer[j]
+	})
+	for _, i := range del {
+		d.delLocals = append(d.delLocals, old.LocalServer[i])
+	}
+	for j, i := range same {
+		if i < 0 {
+			d.newLocals = append(d.newLocals, now.LocalServer[j])
+		} else {
+			now.LocalServer[j] = old.LocalServer[i]
+		}
+	}
+	if len(old.Healths) != len(now.Healths) {
+		d.healths = true
+	} else {
+		for i := range old.Healths {
+			if !healthEqual(old.Healths[i], now.Healths[i]) {
+				d.healths = true
+				break
+			}
+		}
+	}
+	if !d.healths {
+		now.Healths = old.Healths
+	}
+	return d
+}
+
+// diffItems 返回 old 中没有相同项的下标，以及 now 中每一项在 old 中相同项的下标，没有则为 -1
+func diffItems(oldLen, nowLen int, equal func(i, j int) bool) (del []int, same []int) {
+	used := make([]bool, oldLen)
+	same = make([]int, nowLen)
+	for j := range same {
+		same[j] = -1
+		for i := 0; i < oldLen; i++ {
+			if !used[i] && equal(i, j) {
+				used[i] = true
+				same[j] = i
+				break
+			}
+		}
+	}
+	for i, v := range used {
+		if !v {
+			del = append(del, i)
+		}
+	}
+	return
+}
+
+// healthEqual 只比较配置项，不比较检查的状态
+func healthEqual(a, b *file.Health) bool {
+	return a.HealthCheckTimeout == b.HealthCheckTimeout && a.HealthMaxFail == b.HealthMaxFail &&
+		a.HealthCheckInterval == b.HealthCheckInterval && a.HttpHealthUrl == b.HttpHealthUrl &&
+		a.HealthCheckType == b.HealthCheckType && a.HealthCheckTarget == b.HealthCheckTarget
+}
+
+// watchConfig 配置文件修改后重新加载
+func watchConfig(path string, cnf *config.Config) {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	ticker := time.NewTicker(time.Second * 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = fi.ModTime()
+		now, err := config.NewConfig(path)
+		if err == nil && now.CommonConfig == nil {
+			err = errors.New("the [common] section is missing")
+		}
+		if err != nil {
+			logs.Error("reload %s error, keep the running config %v", path, err)
+			continue
+		}
+		reloadConfig(cnf, now)
+	}
+}
+
+// reloadConfig 只应用有变化的隧道、域名解析、健康检查和本地服务，其他隧道不受影响
+func reloadConfig(cnf, now *config.Config) {
+	confLock.Lock()
+	defer confLock.Unlock()
+	d := diffConfig(cnf, now)
+	if d.common {
+		logs.Warn("the [common] of the config is changed, restart npc to take effect")
+	}
+	if d.empty() {
+		return
+	}
+	logs.Info("reload config, hosts -%d +%d, tasks -%d +%d, local servers -%d +%d", len(d.delHosts), len(d.newHosts),
+		len(d.delTasks), len(d.newTasks), len(d.delLocals), len(d.newLocals))
+	for _, v := range d.delLocals {
+		closeLocalServer(v)
+	}
+	// 重新连接时发送新的配置
+	cnf.Hosts, cnf.Tasks, cnf.Healths, cnf.LocalServer = now.Hosts, now.Tasks, now.Healths, now.LocalServer
+	if d.remote() {
+		if err := sendConfigDiff(cnf.CommonConfig, d); err != nil {
+			if cnf.CommonConfig.AutoReconnection && rpClient != nil {
+				logs.Warn("%v, reconnect to apply the config", err)
+				rpClient.Close()
+			} else {
+				logs.Error("%v, restart npc to apply the config", err)
+			}
+			return
+		}
+		// nps 拒绝的项不生效，修改失败的项保留原来的项
+		cnf.Hosts, cnf.Tasks = nil, nil
+		for _, v := range now.Hosts {
+			if !hasHost(d.rejectedHosts, v) {
+				cnf.Hosts = append(cnf.Hosts, v)
+			}
+		}
+		for _, v := range now.Tasks {
+			if !hasTask(d.rejectedTasks, v) {
+				cnf.Tasks = append(cnf.Tasks, v)
+			}
+		}
+		cnf.Hosts = append(cnf.Hosts, d.keptHosts...)
+		cnf.Tasks = append(cnf.Tasks, d.keptTasks...)
+	}
+	for _, v := range d.delTasks {
+		if v.Mode == "file" {
+			closeFileServer(v)
+		}
+	}
+	for _, v := range d.newTasks {
+		if v.Mode == "file" {
+			go startLocalFileServer(cnf.CommonConfig, activeServer(cnf.CommonConfig), v, cnf.CommonConfig.VKey)
+		}
+	}
+	for _, v := range d.newLocals {
+		go StartLocalServer(v, cnf.CommonConfig)
+	}
+	if d.healths {
+		var c *conn.Conn
+		if rpClient != nil && rpClient.signal != nil && rpClient.signal.Caps.Has(conn.CapHealth) {
+			c = rpClient.signal
+		}
+		restartHealthCheck(cnf.Healths, c)
+	}
+}
+
+// sendConfigDiff 通过新的配置连接删除和新增隧道和域名解析，nps 拒绝一项时其他项照常生效。
+// 修改的项先删除原来的项，新的项被拒绝时重新添加原来的项。返回后 d 中只有生效的删除和新增项，
+// 返回的错误是连接的错误
+func sendConfigDiff(cnf *config.CommonConfig, d *configDiff) error {
+	c, err := NewConn(cnf.Tp, cnf.VKey, activeServer(cnf), common.WORK_CONFIG, cnf.ProxyUrl)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var isPub bool
+	binary.Read(c, binary.LittleEndian, &isPub)
+	if isPub {
+		return errors.New("the config of a public vkey can not be changed online")
+	}
+	if !c.Caps.Has(conn.CapConfigDiff) {
+		return errors.New("the server does not support changing the config online")
+	}
+	if _, err := c.Write([]byte(common.RELOAD_CONF)); err != nil {
+		return err
+	}
+	// 节名(Remark)与新增项相同的删除项是被修改的项，和新增项一起处理
+	oldHosts := make(map[string]*file.Host)
+	for _, v := range d.newHosts {
+		oldHosts[v.Remark] = nil
+	}
+	var delHosts []*file.Host
+	for _, v := range d.delHosts {
+		if old, ok := oldHosts[v.Remark]; ok && old == nil {
+			oldHosts[v.Remark] = v
+			continue
+		}
+		if err := sendConfigItem(c, v, common.DEL_HOST); err != nil {
+			return err
+		}
+		delHosts = append(delHosts, v)
+	}
+	oldTasks := make(map[string]*file.Tunnel)
+	for _, v := range d.newTasks {
+		oldTasks[v.Remark] = nil
+	}
+	var delTasks []*file.Tunnel
+	for _, v := range d.delTasks {
+		if old, ok := oldTasks[v.Remark]; ok && old == nil {
+			oldTasks[v.Remark] = v
+			continue
+		}
+		if err := sendConfigItem(c, v, common.DEL_TASK); err != nil {
+			return err
+		}
+		delTasks = append(delTasks, v)
+	}
+	var newHosts []*file.Host
+	for _, v := range d.newHosts {
+		var old interface{}
+		o := oldHosts[v.Remark]
+		if o != nil {
+			old = o
+		}
+		ok, err := replaceConfigItem(c, old, v, common.DEL_HOST, common.NEW_HOST)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ok:
+			newHosts = append(newHosts, v)
+			if o != nil {
+				delHosts = append(delHosts, o)
+			}
+		case o != nil:
+			logs.Error("%v %s%s, keep the running host", errAdd, v.Host, v.Location)
+			d.rejectedHosts, d.keptHosts = append(d.rejectedHosts, v), append(d.keptHosts, o)
+		default:
+			logs.Error("%v %s%s", errAdd, v.Host, v.Location)
+			d.rejectedHosts = append(d.rejectedHosts, v)
+		}
+	}
+	var newTasks []*file.Tunnel
+	for _, v := range d.newTasks {
+		var old interface{}
+		o := oldTasks[v.Remark]
+		if o != nil {
+			old = o
+		}
+		ok, err := replaceConfigItem(c, old, v, common.DEL_TASK, common.NEW_TASK)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ok:
+			newTasks = append(newTasks, v)
+			if o != nil {
+				delTasks = append(delTasks, o)
+			}
+		case o != nil:
+			logs.Error("%v %s %s, keep the running tunnel", errAdd, v.Ports, v.Remark)
+			d.rejectedTasks, d.keptTasks = append(d.rejectedTasks, v), append(d.keptTasks, o)
+		default:
+			logs.Error("%v %s %s", errAdd, v.Ports, v.Remark)
+			d.rejectedTasks = append(d.rejectedTasks, v)
+		}
+	}
+	d.delHosts, d.newHosts, d.delTasks, d.newTasks = delHosts, newHosts, delTasks, newTasks
+	return nil
+}
+
+// replaceConfigItem 删除原来的项 old 后新增 v，nps 拒绝 v 时重新添加 old，old 为 nil 时只新增。
+// 返回 v 是否生效
+func replaceConfigItem(c *conn.Conn, old, v interface{}, delFlag, newFlag string) (bool, error) {
+	if old != nil {
+		if err := sendConfigItem(c, old, delFlag); err != nil {
+			return false, err
+		}
+	}
+	err := sendConfigItem(c, v, newFlag)
+	if err != errAdd {
+		return err == nil, err
+	}
+	if old != nil {
+		if err := sendConfigItem(c, old, newFlag); err != nil && err != errAdd {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func sendConfigItem(c *conn.Conn, v interface{}, flag string) error {
+	if _, err := c.SendInfo(v, flag); err != nil {
+		return err
+	}
+	if !c.GetAddStatus() {
+		return errAdd
+	}
+	return nil
+}
+
+func hasHost(l []*file.Host, h *file.Host) bool {
+	for _, v := range l {
+		if v == h {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTask(l []*file.Tunnel, t *file.Tunnel) bool {
+	for _, v := range l {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// saveVkey 把 nps 轮换后的 vkey 写入配置文件
+func saveVkey(path string, cnf *config.Config, vkey string) {
+	confLock.Lock()
+	defer confLock.Unlock()
+	// 先修改正在使用的配置，重新加载时 [common] 没有变化
+	cnf.CommonConfig.VKey = vkey
+	os.WriteFile(filepath.Join(common.GetTmpPath(), "npc_vkey.txt"), []byte(vkey), 0600)
+	fi, err := os.Stat(path)
+	if err != nil {
+		logs.Error("save the new vkey error %v, set vkey=%s in %s", err, vkey, path)
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		logs.Error("save the new vkey error %v, set vkey=%s in %s", err, vkey, path)
+		return
+	}
+	content, ok := replaceVkey(string(b), vkey)
+	if !ok {
+		logs.Warn("the vkey of %s is not a plain value, set vkey=%s", path, vkey)
+		return
+	}
+	if err := os.WriteFile(path, []byte(content), fi.Mode()); err != nil {
+		logs.Error("save the new vkey error %v, set vkey=%s in %s", err, vkey, path)
+		return
+	}
+	logs.Info("the vkey rotated by the server is saved to %s", path)
+}
+
+// replaceVkey 替换 [common] 中的 vkey，vkey 来自环境变量等模板时不替换
+func replaceVkey(content, vkey string) (string, bool) {
+	lines := strings.Split(content, "\n")
+	var inCommon bool
+	for i, line := range lines {
+		l := strings.TrimSpace(line)
+		if strings.HasPrefix(l, "[") {
+			inCommon = l == "[common]"
+			continue
+		}
+		if !inCommon || !strings.HasPrefix(l, "vkey=") {
+			continue
+		}
+		if strings.Contains(l, "{{") {
+			return content, false
+		}
+		lines[i] = "vkey=" + vkey
+		if strings.HasSuffix(line, "\r") {
+			lines[i] += "\r"
+		}
+		return strings.Join(lines, "\n"), true
+	}
+	return content, false
+}
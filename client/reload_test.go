@@ -0,0 +1,144 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ehang.io/nps/lib/config"
+)
+
+const reloadConf = `[common]
+server_addr=127.0.0.1:8024
+vkey=123
+
+[health_check_test]
+health_check_timeout=1
+health_check_max_failed=3
+health_check_interval=1
+health_check_type=tcp
+health_check_target=127.0.0.1:8083
+
+[web]
+host=a.o.com
+target_addr=127.0.0.1:8083
+
+[tcp]
+mode=tcp
+target_addr=127.0.0.1:8080
+server_port=10000
+
+[udp]
+mode=udp
+target_addr=114.114.114.114:53
+server_port=12253
+
+[p2p_ssh]
+local_port=2000
+password=ssh2
+target_addr=123.206.77.88:22
+`
+
+func loadConfig(t *testing.T, content string) *config.Config {
+	path := filepath.Join(t.TempDir(), "npc.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cnf, err := config.NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cnf
+}
+
+func TestDiffConfig(t *testing.T) {
+	old := loadConfig(t, reloadConf)
+	d := diffConfig(old, loadConfig(t, reloadConf))
+	if !d.empty() || d.common {
+		t.Fatalf("the same config is changed %+v", d)
+	}
+
+	now := loadConfig(t, reloadConf+`
+[socks5]
+mode=socks5
+server_port=19009
+`)
+	d = diffConfig(old, now)
+	if len(d.newTasks) != 1 || d.newTasks[0].Remark != "socks5" || len(d.delTasks) != 0 || len(d.newHosts) != 0 {
+		t.Fatalf("add task %+v", d)
+	}
+	// the running objects are kept
+	if now.Tasks[0] != old.Tasks[0] || now.Hosts[0] != old.Hosts[0] || now.Healths[0] != old.Healths[0] || now.LocalServer[0] != old.LocalServer[0] {
+		t.Fatal("the unchanged items should not be replaced")
+	}
+
+	now = loadConfig(t, `[common]
+server_addr=127.0.0.1:8025
+vkey=123
+
+[health_check_test]
+health_check_timeout=1
+health_check_max_failed=3
+health_check_interval=5
+health_check_type=tcp
+health_check_target=127.0.0.1:8083
+
+[web]
+host=b.o.com
+target_addr=127.0.0.1:8083
+
+[tcp]
+mode=tcp
+target_addr=127.0.0.1:8081
+server_port=10000
+
+[udp]
+mode=udp
+target_addr=114.114.114.114:53
+server_port=12253
+
+[p2p_ssh]
+local_port=2001
+password=ssh2
+target_addr=123.206.77.88:22
+`)
+	d = diffConfig(old, now)
+	if !d.common || !d.healths {
+		t.Fatalf("common and health check should be changed %+v", d)
+	}
+	if len(d.delHosts) != 1 || d.delHosts[0].Host != "a.o.com" || len(d.newHosts) != 1 || d.newHosts[0].Host != "b.o.com" {
+		t.Fatalf("change host %+v", d)
+	}
+	if len(d.delTasks) != 1 || d.delTasks[0].Target.TargetStr != "127.0.0.1:8080" || len(d.newTasks) != 1 || d.newTasks[0].Target.TargetStr != "127.0.0.1:8081" {
+		t.Fatalf("change task %+v", d)
+	}
+	if now.Tasks[1] != old.Tasks[1] {
+		t.Fatal("the udp task is not changed")
+	}
+	if len(d.delLocals) != 1 || d.delLocals[0].Port != 2000 || len(d.newLocals) != 1 || d.newLocals[0].Port != 2001 {
+		t.Fatalf("change local server %+v", d)
+	}
+
+	d = diffConfig(old, loadConfig(t, "[common]\nserver_addr=127.0.0.1:8024\nvkey=123\n"))
+	if len(d.delHosts) != 1 || len(d.delTasks) != 2 || len(d.delLocals) != 1 || !d.healths || d.common {
+		t.Fatalf("remove all %+v", d)
+	}
+}
+
+func TestReplaceVkey(t *testing.T) {
+	content, ok := replaceVkey(reloadConf, "456")
+	if !ok || !strings.Contains(content, "\nvkey=456\n") || strings.Contains(content, "vkey=123") {
+		t.Fatalf("replace vkey %v\n%s", ok, content)
+	}
+	if content, ok = replaceVkey(strings.ReplaceAll(reloadConf, "\n", "\r\n"), "456"); !ok || !strings.Contains(content, "\r\nvkey=456\r\n") {
+		t.Fatalf("replace vkey of crlf %v\n%q", ok, content)
+	}
+	// only the vkey of [common]
+	if _, ok = replaceVkey("[common]\nserver_addr=127.0.0.1:8024\n[tcp]\nvkey=123\n", "456"); ok {
+		t.Fatal("the vkey out of [common] is replaced")
+	}
+	if _, ok = replaceVkey("[common]\nvkey={{.NPC_VKEY}}\n", "456"); ok {
+		t.Fatal("the vkey from the env is replaced")
+	}
+}
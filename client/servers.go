@@ -0,0 +1,188 @@
+package client
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// RetryPolicy is the retry and backoff of the connections to the servers
+type RetryPolicy struct {
+	Times       int           // rounds to retry after all servers failed, 0 tries every server once
+	Interval    time.Duration // the first backoff, doubled after every failure
+	MaxInterval time.Duration
+}
+
+var retryPolicy = RetryPolicy{Interval: time.Second * 5, MaxInterval: time.Minute}
+
+// SetRetryPolicy set the policy, the interval in seconds, zero keeps the default
+func SetRetryPolicy(times, interval, maxInterval int) {
+	if times > 0 {
+		retryPolicy.Times = times
+	}
+	if interval > 0 {
+		retryPolicy.Interval = time.Duration(interval) * time.Second
+	}
+	if maxInterval > 0 {
+		retryPolicy.MaxInterval = time.Duration(maxInterval) * time.Second
+	}
+	if retryPolicy.MaxInterval < retryPolicy.Interval {
+		retryPolicy.MaxInterval = retryPolicy.Interval
+	}
+}
+
+func GetRetryPolicy() RetryPolicy {
+	return retryPolicy
+}
+
+// Backoff returns the wait time after the n-th failure, n starts from 0
+func (p RetryPolicy) Backoff(n int) time.Duration {
+	d := p.Interval
+	for i := 0; i < n && d < p.MaxInterval; i++ {
+		d *= 2
+	}
+	if d > p.MaxInterval {
+		d = p.MaxInterval
+	}
+	return d
+}
+
+type serverNode struct {
+	addr      string
+	weight    int
+	fails     int
+	downUntil time.Time
+}
+
+// ServerList is the servers of server_addr, eg: 1.1.1.1:8024,2.2.2.2:8024
+// the servers are tried in order, with weights (1.1.1.1:8024*3,2.2.2.2:8024*1) a healthy server is picked by the weight
+type ServerList struct {
+	mu       sync.Mutex
+	nodes    []*serverNode
+	weighted bool
+	active   string
+}
+
+var serverLists sync.Map
+
+// GetServerList returns the shared list of the server_addr, so the health of the servers is kept between connections
+func GetServerList(server string) *ServerList {
+	if v, ok := serverLists.Load(server); ok {
+		return v.(*ServerList)
+	}
+	v, _ := serverLists.LoadOrStore(server, ParseServerList(server))
+	return v.(*ServerList)
+}
+
+func ParseServerList(server string) *ServerList {
+	l := new(ServerList)
+	for _, v := range strings.Split(server, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		n := &serverNode{addr: v, weight: 1}
+		if i := strings.LastIndex(v, "*"); i > 0 {
+			if w, err := strconv.Atoi(v[i+1:]); err == nil && w > 0 {
+				n.addr, n.weight = v[:i], w
+				l.weighted = true
+			}
+		}
+		l.nodes = append(l.nodes, n)
+	}
+	if len(l.nodes) == 0 {
+		l.nodes = append(l.nodes, &serverNode{addr: server, weight: 1})
+	}
+	return l
+}
+
+// Candidates returns the servers to try, the healthy ones first
+func (s *ServerList) Candidates() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var healthy, down []*serverNode
+	for _, n := range s.nodes {
+		if n.downUntil.After(now) {
+			down = append(down, n)
+		} else {
+			healthy = append(healthy, n)
+		}
+	}
+	if s.weighted {
+		healthy = weightedShuffle(healthy)
+	}
+	sort.SliceStable(down, func(i, j int) bool {
+		return down[i].downUntil.Before(down[j].downUntil)
+	})
+	addrs := make([]string, 0, len(s.nodes))
+	for _, n := range append(healthy, down...) {
+		addrs = append(addrs, n.addr)
+	}
+	return addrs
+}
+
+// weightedShuffle order the servers by weighted random picks without replacement
+func weightedShuffle(nodes []*serverNode) []*serverNode {
+	rest := append([]*serverNode(nil), nodes...)
+	res := make([]*serverNode, 0, len(nodes))
+	for len(rest) > 0 {
+		total := 0
+		for _, n := range rest {
+			total += n.weight
+		}
+		r := rand.Intn(total)
+		for i, n := range rest {
+			if r -= n.weight; r < 0 {
+				res = append(res, n)
+				rest = append(rest[:i], rest[i+1:]...)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// MarkFail mark the server down for the backoff of its failures
+func (s *ServerList) MarkFail(addr string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.nodes {
+		if n.addr == addr {
+			d := retryPolicy.Backoff(n.fails)
+			n.fails++
+			n.downUntil = time.Now().Add(d)
+			if len(s.nodes) > 1 {
+				logs.Warn("server %s failed %d times, skip it for %s, error %v", addr, n.fails, d, err)
+			}
+		}
+	}
+}
+
+// MarkOk mark the server healthy and active
+func (s *ServerList) MarkOk(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.nodes {
+		if n.addr == addr {
+			n.fails = 0
+			n.downUntil = time.Time{}
+		}
+	}
+	if s.active != addr && len(s.nodes) > 1 {
+		logs.Info("the active server is %s", addr)
+	}
+	s.active = addr
+}
+
+// Active returns the server connected last time
+func (s *ServerList) Active() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerListFailover(t *testing.T) {
+	l := ParseServerList("a:8024, b:8024,c:8024")
+	if got := l.Candidates(); !reflect.DeepEqual(got, []string{"a:8024", "b:8024", "c:8024"}) {
+		t.Fatalf("candidates %v", got)
+	}
+	l.MarkFail("a:8024", errors.New("down"))
+	l.MarkFail("b:8024", errors.New("down"))
+	l.MarkFail("b:8024", errors.New("down"))
+	// the healthy server first, then the one back up first
+	if got := l.Candidates(); !reflect.DeepEqual(got, []string{"c:8024", "a:8024", "b:8024"}) {
+		t.Fatalf("candidates %v", got)
+	}
+	l.MarkOk("a:8024")
+	if got := l.Candidates(); got[0] != "a:8024" || l.Active() != "a:8024" {
+		t.Fatalf("candidates %v, active %s", got, l.Active())
+	}
+}
+
+func TestServerListWeighted(t *testing.T) {
+	l := ParseServerList("a:8024*9,b:8024*1")
+	if !l.weighted || l.nodes[0].addr != "a:8024" || l.nodes[1].weight != 1 {
+		t.Fatal("parse weighted list error")
+	}
+	first := 0
+	for i := 0; i < 1000; i++ {
+		if l.Candidates()[0] == "a:8024" {
+			first++
+		}
+	}
+	if first < 800 || first > 980 {
+		t.Fatalf("a:8024 picked first %d times of 1000", first)
+	}
+	if l := ParseServerList("[::1]:8024"); l.nodes[0].addr != "[::1]:8024" || l.weighted {
+		t.Fatal("parse single server error")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Interval: time.Second, MaxInterval: 5 * time.Second}
+	for n, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := p.Backoff(n); got != want {
+			t.Fatalf("backoff %d: %s, want %s", n, got, want)
+		}
+	}
+}
@@ -666,6 +666,11 @@ func startNpcClientWithContext(ctx context.Context, id, server, vkey string, tls
 			rpcClient.SetLogger(clientLogger)
 		}
 
+		// nps 轮换 vkey 后保存并用新的 vkey 重新启动
+		rpcClient.SetVkeyHandler(func(newKey string) {
+			go rotateShortcutKey(server, vkey, newKey, tlsEnable)
+		})
+
 		// 将客户端保存到全局 map
 		runningMu.Lock()
 		clients[id] = rpcClient
@@ -713,6 +718,31 @@ func startNpcClientWithContext(ctx context.Context, id, server, vkey string, tls
 	}
 }
 
+// rotateShortcutKey 保存 nps 轮换后的 vkey，客户端以 addr|vkey 标识，所以用新的 vkey 重新启动
+func rotateShortcutKey(addr, oldKey, newKey string, tls bool) {
+	oldId, newId := addr+"|"+oldKey, addr+"|"+newKey
+	var name string
+	shortcutsMu.Lock()
+	for i, it := range shortcuts {
+		if it.Addr == addr && it.Key == oldKey {
+			shortcuts[i].Key = newKey
+			name = it.Name
+		}
+	}
+	store, _ := loadPersistentStore()
+	store.Shortcuts = shortcuts
+	if state, ok := store.ClientStates[oldId]; ok {
+		delete(store.ClientStates, oldId)
+		store.ClientStates[newId] = state
+	}
+	savePersistentStoreLocked(store)
+	shortcutsMu.Unlock()
+	logs.Info("the vkey of %s is rotated by the server, restart the client", addr)
+	app := NewApp()
+	app.ToggleClient(name, addr, oldKey, tls, false)
+	app.ToggleClient(name, addr, newKey, tls, true)
+}
+
 // monitorFirstConnection 监听连接的结果，持续检查连接状态
 func monitorFirstConnection(ctx context.Context, id string, rpcClient *client.TRPClient) {
 	ticker := time.NewTicker(100 * time.Millisecond)
@@ -26,6 +26,14 @@ func GetClientStatus() int {
 	return client.NowStatus
 }
 
+//export GetActiveServer
+func GetActiveServer() *C.char {
+	if cl == nil {
+		return C.CString("")
+	}
+	return C.CString(cl.ActiveServer())
+}
+
 //export CloseClient
 func CloseClient() {
 	if cl != nil {
@@ -119,9 +119,9 @@ func main() {
 
 	svcConfig.Arguments = append(svcConfig.Arguments, "service")
 	if len(os.Args) > 1 && os.Args[1] == "service" {
-		_ = logs.SetLogger(logs.AdapterFile, `{"level":`+level+`,"filename":"`+logPath+`","daily":false,"maxlines":100000,"color":true}`)
+		_ = server.SetLogger(logs.AdapterFile, level, `"filename":"`+logPath+`","daily":false,"maxlines":100000,"color":true`)
 	} else {
-		_ = logs.SetLogger(logs.AdapterConsole, `{"level":`+level+`,"color":true}`)
+		_ = server.SetLogger(logs.AdapterConsole, level, `"color":true`)
 	}
 	if !common.IsWindows() {
 		svcConfig.Dependencies = []string{
@@ -145,7 +145,7 @@ func main() {
 
 	if len(os.Args) > 1 && os.Args[1] != "service" {
 		switch os.Args[1] {
-		case "reload":
+		case "reload", "upgrade":
 			daemon.InitDaemon("nps", common.GetRunPath(), common.GetTmpPath())
 			return
 		case "install":
@@ -455,8 +455,25 @@ func run() {
 	logs.Info("the config path is:" + common.GetRunPath())
 	logs.Info("the version of server is %s ,allow client core version to be %s,tls enable is %t", version.VERSION, version.GetVersion(), bridge.ServerTlsEnable)
 	connection.InitConnectionService()
-	//crypt.InitTls(filepath.Join(common.GetRunPath(), "conf", "server.pem"), filepath.Join(common.GetRunPath(), "conf", "server.key"))
-	crypt.InitTls()
+	if !common.IsWindows() {
+		daemon.SavePid("nps", common.GetTmpPath())
+	}
+	certFile := beego.AppConfig.DefaultString("tls_cert_file", filepath.Join(common.GetRunPath(), "conf", "bridge.pem"))
+	keyFile := beego.AppConfig.DefaultString("tls_key_file", filepath.Join(common.GetRunPath(), "conf", "bridge.key"))
+	if err := crypt.InitTls(certFile, keyFile); err != nil {
+		logs.Error("load bridge certificate error", err)
+		os.Exit(0)
+	}
+	logs.Info("the bridge certificate is %s, sha256 fingerprint is %s", certFile, crypt.GetCertFingerprint())
+	if beego.AppConfig.DefaultBool("tls_client_auth", false) {
+		caCert := beego.AppConfig.DefaultString("tls_client_ca_cert_file", filepath.Join(common.GetRunPath(), "conf", "client_ca.pem"))
+		caKey := beego.AppConfig.DefaultString("tls_client_ca_key_file", filepath.Join(common.GetRunPath(), "conf", "client_ca.key"))
+		if err := crypt.InitClientCA(caCert, caKey); err != nil {
+			logs.Error("load client ca error", err)
+			os.Exit(0)
+		}
+		logs.Info("tls client certificate auth enabled, the ca is %s", caCert)
+	}
 	tool.InitAllowPort()
 	tool.StartSystemInfo()
 	timeout, err := beego.AppConfig.Int("disconnect_timeout")
@@ -491,7 +508,8 @@ func initConfig(confDir string) {
 	}
 }
 
-const defaultNpsConf = `http_proxy_ip=0.0.0.0
+const defaultNpsConf = `# 本文件修改后自动重新加载(或 kill -HUP <pid>): log_level, allow_ports, disconnect_timeout, ip_limit, http_cache, 管理面板的登录和权限等立即生效, 其他(如端口)需要重启, 管理面板中会提示
+http_proxy_ip=0.0.0.0
 http_proxy_port=80
 https_proxy_port=443
 show_http_proxy_port=true
@@ -501,6 +519,7 @@ bridge_port=8024
 bridge_ip=0.0.0.0
 
 public_vkey=123
+#allow_legacy_auth=true
 
 flow_store_interval=1
 
@@ -539,8 +558,49 @@ http_cache_length=100
 
 disconnect_timeout=60
 
+# 客户端掉线后保留会话的秒数, 期间重连的 npc 接回原会话, 隧道端口不关闭, 新的访问等待重连, 0 关闭
+#bridge_resume_timeout=30
+
+# 平滑重启(非 windows): nps upgrade 或 kill -USR2 <pid>, 新进程继承所有监听端口, 旧进程不再接受新连接,
+# 空闲的客户端断开后重连到新进程, 其余连接结束或超过该秒数后旧进程退出; 以系统服务运行时服务管理器会把旧进程退出视为停止
+#graceful_timeout=60
+
 open_captcha=false
 
 tls_enable=true
 tls_bridge_port=8025
+# tls 桥接证书, 文件不存在时自动生成并保存, 启动日志中打印证书指纹供 npc 固定(tls_fingerprint)
+#tls_cert_file=conf/bridge.pem
+#tls_key_file=conf/bridge.key
+
+# tls 桥接端口的客户端证书认证(mTLS), 客户端的认证方式在管理面板中设置
+#tls_client_auth=true
+# 导入已有的 CA, 文件不存在时自动生成
+#tls_client_ca_cert_file=conf/client_ca.pem
+#tls_client_ca_key_file=conf/client_ca.key
+
+# websocket 桥接, npc 使用 conn_type=ws 或 wss 连接, 可与 bridge_port 或 http/https 代理端口复用
+#ws_bridge_port=8026
+#ws_bridge_path=/ws
+# 与 https_proxy_port 复用时按 SNI 区分, 必须设置
+#ws_bridge_host=ws.proxy.com
+# 独立端口时是否使用 tls(wss)
+#ws_bridge_tls=false
+#ws_bridge_cert_file=conf/server.pem
+#ws_bridge_key_file=conf/server.key
+
+# quic 桥接(udp), npc 使用 conn_type=quic 连接, 每个连接对应一个 quic 流
+#quic_bridge_port=8027
+#quic_bridge_cert_file=conf/server.pem
+#quic_bridge_key_file=conf/server.key
+
+# 集群模式(active/active), 多个 nps 共享配置, npc 可连接任意节点, 隧道端口由存活节点中选出的一个监听
+# 本节点 id@节点间通信地址
+#cluster_node=1@10.0.0.1:8028
+# 其他节点, 逗号分隔
+#cluster_peers=2@10.0.0.2:8028,3@10.0.0.3:8028
+# 节点间认证密钥, 所有节点必须相同
+#cluster_key=
+# 共享配置存储, file:目录(共享目录, 如 nfs) 或 node:id(使用该节点的 conf 目录), 配置变更以最后一次写入为准
+#cluster_store=file:conf
 `
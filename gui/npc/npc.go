@@ -112,6 +112,11 @@ func onclick(s, v, c string) {
 		go func() {
 			for {
 				cl = client.NewRPClient(s, v, c, "", nil, 60)
+				cl.SetVkeyHandler(func(vkey string) {
+					// nps 轮换 vkey 后重新连接时使用新的 vkey
+					v = vkey
+					saveConfig(s, vkey, c)
+				})
 				status = "Stop!"
 				refreshCh <- struct{}{}
 				cl.Start()
@@ -4,6 +4,8 @@ const (
 	CONN_DATA_SEQ     = "*#*" //Separator
 	VERIFY_EER        = "vkey"
 	VERIFY_SUCCESS    = "sucs"
+	VERIFY_HELLO      = "suhl" // verify success and WORK_HELLO accepted, old clients only check VERIFY_EER
+	WORK_HELLO        = "helo" // capability negotiation, followed by the real work flag
 	WORK_MAIN         = "main"
 	WORK_CHAN         = "chan"
 	WORK_CONFIG       = "conf"
@@ -20,6 +22,7 @@ const (
 	WORK_STATUS       = "stus"
 	RES_MSG           = "msg0"
 	RES_CLOSE         = "clse"
+	RES_RECONNECT     = "rcon" // nps is restarting and its udp bridge is closed, npc reconnects at once, old clients ignore it
 	NEW_UDP_CONN      = "udpc" //p2p udp conn
 	// REPORT_LOCAL_IP: server requests client local/private IPs on WORK_MAIN.
 	// New clients reply with WriteLenContent; old clients ignore the flag (server times out).
@@ -27,8 +30,13 @@ const (
 	NEW_TASK          = "task"
 	NEW_CONF          = "conf"
 	NEW_HOST          = "host"
+	DEL_TASK          = "dtsk" // remove a task of npc.conf, only sent if the server has CapConfigDiff
+	DEL_HOST          = "dhst"
+	RELOAD_CONF       = "rcnf" // the items after it change the running config, a failed item is rejected only
+	NEW_VKEY          = "nkey" // the rotated vkey pushed on WORK_MAIN, only sent if the client has CapVkey
 	CONN_TCP          = "tcp"
 	CONN_UDP          = "udp"
+	CONN_BIND         = "bind" // socks5 BIND, the client listens for the connection of the peer
 	CONN_TEST         = "TST"
 	UnauthorizedBytes = `HTTP/1.1 401 Unauthorized
 Content-Type: text/plain; charset=utf-8
@@ -49,3 +57,9 @@ WWW-Authenticate: Basic realm="easyProxy"
 
 `
 )
+
+// challenge-response auth of the bridge, see conn/auth.go
+const (
+	VERIFY_HMAC      = "#hmac-sha256-challenge-response#" // sent in place of md5(vkey), which is hex
+	VERIFY_CHALLENGE = "chlg"
+)
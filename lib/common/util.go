@@ -54,24 +54,30 @@ func DomainCheck(domain string) bool {
 
 // Check if the Request request is validated
 func CheckAuth(r *http.Request, user, passwd string) bool {
+	u, p, ok := GetBasicAuth(r)
+	return ok && u == user && p == passwd
+}
+
+// GetBasicAuth get the user and password of the Authorization or Proxy-Authorization header
+func GetBasicAuth(r *http.Request) (user, passwd string, ok bool) {
 	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
 	if len(s) != 2 {
 		s = strings.SplitN(r.Header.Get("Proxy-Authorization"), " ", 2)
 		if len(s) != 2 {
-			return false
+			return
 		}
 	}
 
 	b, err := base64.StdEncoding.DecodeString(s[1])
 	if err != nil {
-		return false
+		return
 	}
 
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
-		return false
+		return
 	}
-	return pair[0] == user && pair[1] == passwd
+	return pair[0], pair[1], true
 }
 
 // get bool by str
@@ -11,14 +11,25 @@ import (
 )
 
 type CommonConfig struct {
-	Server           string
+	Server           string //server address, a list like a:8024,b:8024 or a:8024*3,b:8024*1 to fail over
 	VKey             string
-	Tp               string //bridgeType kcp or tcp
+	Tp               string //bridgeType kcp, tcp, ws, wss or quic
 	AutoReconnection bool
 	TlsEnable        bool
+	WsPath           string //websocket path of the bridge when conn_type is ws or wss
+	TlsCertFile      string //client certificate for the tls bridge
+	TlsKeyFile       string
+	TlsFingerprint   string //pinned sha256 fingerprint of the server certificate
+	TlsCaFile        string //ca bundle to verify the server certificate
+	TlsKnownHosts    string //trust on first use, the fingerprints are saved to this file
 	ProxyUrl         string
 	Client           *file.Client
 	DisconnectTime   int
+	RetryTimes       int //rounds to retry after all servers failed
+	RetryInterval    int //first backoff in seconds, doubled after every failure
+	RetryMaxInterval int
+	BridgeConns      int  //bridge data connections to request, nps may allow less
+	LegacyAuth       bool //send md5(vkey) to a server older than the challenge auth
 }
 
 type LocalServer struct {
@@ -153,6 +164,28 @@ func dealCommon(s string) *CommonConfig {
 			c.DisconnectTime = common.GetIntNoErrByStr(item[1])
 		case "tls_enable":
 			c.TlsEnable = common.GetBoolByStr(item[1])
+		case "ws_path":
+			c.WsPath = item[1]
+		case "tls_cert_file":
+			c.TlsCertFile = item[1]
+		case "tls_key_file":
+			c.TlsKeyFile = item[1]
+		case "tls_fingerprint":
+			c.TlsFingerprint = item[1]
+		case "tls_ca_file":
+			c.TlsCaFile = item[1]
+		case "tls_known_hosts":
+			c.TlsKnownHosts = item[1]
+		case "retry_times":
+			c.RetryTimes = common.GetIntNoErrByStr(item[1])
+		case "retry_interval":
+			c.RetryInterval = common.GetIntNoErrByStr(item[1])
+		case "retry_max_interval":
+			c.RetryMaxInterval = common.GetIntNoErrByStr(item[1])
+		case "bridge_conns":
+			c.BridgeConns = common.GetIntNoErrByStr(item[1])
+		case "legacy_auth":
+			c.LegacyAuth = common.GetBoolByStr(item[1])
 		}
 	}
 	return c
@@ -247,6 +280,10 @@ func dealTunnel(s string) *file.Tunnel {
 			t.LocalPath = item[1]
 		case "strip_pre":
 			t.StripPre = item[1]
+		case "compression":
+			t.Compression = item[1]
+		case "priority":
+			t.Priority = item[1]
 		case "multi_account":
 			t.MultiAccount = &file.MultiAccount{}
 			if common.FileExists(item[1]) {
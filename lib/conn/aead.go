@@ -0,0 +1,129 @@
+package conn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// CipherAead encrypt the link data by aes-256-gcm with the session key of the bridge
+const CipherAead = "aead"
+
+const aeadMaxPayload = 16 * 1024
+
+// AeadConn seal every write into frames of 2 bytes length + sealed data,
+// the nonce is a counter so a replayed, dropped or reordered frame fails to open
+type AeadConn struct {
+	conn    io.ReadWriteCloser
+	wAead   cipher.AEAD
+	rAead   cipher.AEAD
+	wNonce  []byte
+	rNonce  []byte
+	wMux    sync.Mutex
+	wBuf    []byte
+	rBuf    []byte
+	pending []byte
+}
+
+// NewAeadConn derive the keys of both directions from the session key and the salt of the link
+func NewAeadConn(conn io.ReadWriteCloser, sessionKey, salt []byte, isServer bool) (*AeadConn, error) {
+	if len(sessionKey) == 0 {
+		return nil, errors.New("the session key is empty")
+	}
+	key, err := hkdf.Key(sha256.New, sessionKey, salt, "nps aead stream", 64)
+	if err != nil {
+		return nil, err
+	}
+	c2s, s2c := key[:32], key[32:]
+	if isServer {
+		c2s, s2c = s2c, c2s
+	}
+	s := &AeadConn{conn: conn}
+	if s.wAead, err = newGcm(c2s); err != nil {
+		return nil, err
+	}
+	if s.rAead, err = newGcm(s2c); err != nil {
+		return nil, err
+	}
+	s.wNonce = make([]byte, s.wAead.NonceSize())
+	s.rNonce = make([]byte, s.rAead.NonceSize())
+	s.wBuf = make([]byte, 2+aeadMaxPayload+s.wAead.Overhead())
+	s.rBuf = make([]byte, aeadMaxPayload+s.rAead.Overhead())
+	return s, nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *AeadConn) Write(b []byte) (n int, err error) {
+	s.wMux.Lock()
+	defer s.wMux.Unlock()
+	for len(b) > 0 {
+		l := len(b)
+		if l > aeadMaxPayload {
+			l = aeadMaxPayload
+		}
+		sealed := s.wAead.Seal(s.wBuf[2:2], s.wNonce, b[:l], nil)
+		binary.BigEndian.PutUint16(s.wBuf, uint16(len(sealed)))
+		incNonce(s.wNonce)
+		if _, err = s.conn.Write(s.wBuf[:2+len(sealed)]); err != nil {
+			return
+		}
+		n += l
+		b = b[l:]
+	}
+	return
+}
+
+func (s *AeadConn) Read(b []byte) (n int, err error) {
+	if len(s.pending) == 0 {
+		var lb [2]byte
+		if _, err = io.ReadFull(s.conn, lb[:]); err != nil {
+			return
+		}
+		l := int(binary.BigEndian.Uint16(lb[:]))
+		if l < s.rAead.Overhead() || l > len(s.rBuf) {
+			return 0, errors.New("aead frame length error")
+		}
+		if _, err = io.ReadFull(s.conn, s.rBuf[:l]); err != nil {
+			return
+		}
+		if s.pending, err = s.rAead.Open(s.rBuf[:0], s.rNonce, s.rBuf[:l], nil); err != nil {
+			return
+		}
+		incNonce(s.rNonce)
+	}
+	n = copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return
+}
+
+func (s *AeadConn) Close() error {
+	return s.conn.Close()
+}
+
+// CloseWrite the frames are written whole, shut down the write direction of the conn
+func (s *AeadConn) CloseWrite() error {
+	s.wMux.Lock()
+	defer s.wMux.Unlock()
+	return CloseWrite(s.conn)
+}
+
+func incNonce(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
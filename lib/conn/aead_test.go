@@ -0,0 +1,58 @@
+package conn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func newAeadPair(t *testing.T, clientKey, serverKey []byte) (client, server *AeadConn) {
+	c1, c2 := net.Pipe()
+	salt := []byte("salt of the link")
+	var err error
+	if client, err = NewAeadConn(c1, clientKey, salt, false); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = NewAeadConn(c2, serverKey, salt, true); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestAeadConn(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	client, server := newAeadPair(t, key, key)
+	defer client.Close()
+	defer server.Close()
+
+	data := bytes.Repeat([]byte("nps aead "), 5000) // more than one frame
+	go func() {
+		client.Write(data)
+		client.Write([]byte("end"))
+	}()
+	buf := make([]byte, len(data)+3)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:len(data)], data) || string(buf[len(data):]) != "end" {
+		t.Fatal("data mismatch")
+	}
+
+	go server.Write([]byte("reply"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(client, b); err != nil || string(b) != "reply" {
+		t.Fatalf("reply %q %v", b, err)
+	}
+}
+
+func TestAeadConnWrongKey(t *testing.T) {
+	client, server := newAeadPair(t, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32))
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("hello"))
+	if _, err := server.Read(make([]byte, 5)); err == nil {
+		t.Fatal("expected error with a different session key")
+	}
+}
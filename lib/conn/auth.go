@@ -0,0 +1,184 @@
+package conn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"ehang.io/nps/lib/common"
+)
+
+/*
+	Challenge-response auth of the bridge, the vkey is never sent:
+	npc: VERIFY_HMAC in place of md5(vkey)
+	nps: VERIFY_CHALLENGE and a msg of the server nonce
+	npc: a msg of the client nonce, unix time and HMAC-SHA256(vkey, "npc"+server nonce+client nonce+time)
+	nps: VERIFY_HELLO and a msg of HMAC-SHA256(vkey, "nps"+...) to prove it knows the vkey too, or VERIFY_EER
+	An old nps answers VERIFY_HMAC with VERIFY_EER.
+	After the hellos nps signs the hash of both hellos by the vkey, see SendHelloProof.
+*/
+
+// AuthWindow npc 和 nps 的时间相差超过该值时认证失败
+const AuthWindow = 5 * time.Minute
+
+const (
+	tagAuthChallenge uint8 = 1
+	tagAuthNonce     uint8 = 2
+	tagAuthTime      uint8 = 3
+	tagAuthSign      uint8 = 4
+)
+
+var errAuthProof = errors.New("the server can not prove the vkey")
+
+var errNoAuthProof = errors.New("the server does not prove the vkey, it is accepted only if npc has a certificate and verifies the server by tls_fingerprint, tls_ca_file or tls_known_hosts")
+
+// Auth is the answer of npc to the challenge
+type Auth struct {
+	Challenge string
+	Nonce     string
+	Time      int64
+	Sign      []byte
+	Proven    bool // nps signed the answer by the vkey
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (a *Auth) sign(vkey, role string) []byte {
+	h := hmac.New(sha256.New, []byte(vkey))
+	h.Write([]byte(role + a.Challenge + a.Nonce + strconv.FormatInt(a.Time, 10)))
+	return h.Sum(nil)
+}
+
+// Verify the answer is signed by the vkey
+func (a *Auth) Verify(vkey string) bool {
+	return hmac.Equal(a.Sign, a.sign(vkey, "npc"))
+}
+
+// Challenge send a challenge to npc and read the answer, called after VERIFY_HMAC is read
+func (s *Conn) Challenge() (*Auth, error) {
+	challenge := newNonce()
+	if _, err := s.Write([]byte(common.VERIFY_CHALLENGE)); err != nil {
+		return nil, err
+	}
+	if err := s.WriteMsg(NewMsg().AddString(tagAuthChallenge, challenge)); err != nil {
+		return nil, err
+	}
+	m, err := s.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	a := &Auth{Challenge: challenge, Nonce: m.String(tagAuthNonce), Time: m.Int(tagAuthTime), Sign: m.Get(tagAuthSign)}
+	if d := time.Since(time.Unix(a.Time, 0)); d > AuthWindow || d < -AuthWindow {
+		return nil, errors.New("the time of the client differs from the server by " + d.String())
+	}
+	return a, nil
+}
+
+// SendAuthProof sign the answer of npc, an empty vkey if npc is verified by its certificate
+func (s *Conn) SendAuthProof(a *Auth, vkey string) error {
+	if _, err := s.Write([]byte(common.VERIFY_HELLO)); err != nil {
+		return err
+	}
+	m := NewMsg()
+	if vkey != "" {
+		m.Add(tagAuthSign, a.sign(vkey, "nps"))
+	}
+	a.Proven = vkey != ""
+	return s.WriteMsg(m)
+}
+
+// AnswerChallenge answer the challenge of nps by the vkey, called after VERIFY_CHALLENGE is read
+func (s *Conn) AnswerChallenge(vkey string) (*Auth, error) {
+	m, err := s.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	a := &Auth{Challenge: m.String(tagAuthChallenge), Nonce: newNonce(), Time: time.Now().Unix()}
+	a.Sign = a.sign(vkey, "npc")
+	return a, s.WriteMsg(NewMsg().AddString(tagAuthNonce, a.Nonce).AddInt(tagAuthTime, a.Time).Add(tagAuthSign, a.Sign))
+}
+
+// VerifyAuthProof check nps knows the vkey, called after VERIFY_HELLO is read.
+// cert tells npc sent its certificate to a verified server, then nps may verify it by the certificate only,
+// an empty proof is rejected otherwise.
+func (s *Conn) VerifyAuthProof(a *Auth, vkey string, cert bool) error {
+	m, err := s.ReadMsg()
+	if err != nil {
+		return err
+	}
+	proof := m.Get(tagAuthSign)
+	if len(proof) == 0 {
+		if cert {
+			return nil
+		}
+		return errNoAuthProof
+	}
+	if !hmac.Equal(proof, a.sign(vkey, "nps")) {
+		return errAuthProof
+	}
+	a.Proven = true
+	return nil
+}
+
+// vkeyAead the new vkey of a rotation is sealed by the vkey npc is connected with
+func vkeyAead(oldKey string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, []byte(oldKey), nil, "nps vkey rotation", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SendNewVkey push the rotated vkey to npc on the main signal conn
+func (s *Conn) SendNewVkey(oldKey, newKey string) error {
+	aead, err := vkeyAead(oldKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	b, err := GetLenBytes(NewMsg().Add(tagVkey, aead.Seal(nonce, nonce, []byte(newKey), nil)).Marshal())
+	if err != nil {
+		return err
+	}
+	_, err = s.Write(append([]byte(common.NEW_VKEY), b...))
+	return err
+}
+
+// GetNewVkey read the vkey of SendNewVkey, called after NEW_VKEY is read
+func (s *Conn) GetNewVkey(oldKey string) (string, error) {
+	m, err := s.ReadMsg()
+	if err != nil {
+		return "", err
+	}
+	aead, err := vkeyAead(oldKey)
+	if err != nil {
+		return "", err
+	}
+	b := m.Get(tagVkey)
+	if len(b) < aead.NonceSize() {
+		return "", errMsg
+	}
+	vkey, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(vkey), nil
+}
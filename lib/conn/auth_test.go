@@ -0,0 +1,137 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/common"
+)
+
+// challenge runs the server side of the auth, vkey is the key of the client found by the answer
+func challenge(t *testing.T, c *Conn, vkey string) (*Auth, error) {
+	flag := make([]byte, len(common.VERIFY_HMAC))
+	if _, err := c.Read(flag); err != nil || string(flag) != common.VERIFY_HMAC {
+		t.Fatal(string(flag), err)
+	}
+	a, err := c.Challenge()
+	if err != nil {
+		return nil, err
+	}
+	if !a.Verify(vkey) {
+		return a, errAuthProof
+	}
+	return a, c.SendAuthProof(a, vkey)
+}
+
+func TestChallengeAuth(t *testing.T) {
+	for _, v := range []struct {
+		clientKey, serverKey string
+		ok                   bool
+	}{{"123", "123", true}, {"123", "456", false}} {
+		a, b := net.Pipe()
+		server, client := NewConn(a), NewConn(b)
+		done := make(chan error, 1)
+		go func() {
+			_, err := challenge(t, server, v.serverKey)
+			if err != nil {
+				a.Close()
+			}
+			done <- err
+		}()
+		client.Write([]byte(common.VERIFY_HMAC))
+		flag, err := client.ReadFlag()
+		if err != nil || flag != common.VERIFY_CHALLENGE {
+			t.Fatal(flag, err)
+		}
+		auth, err := client.AnswerChallenge(v.clientKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.ok {
+			if flag, err = client.ReadFlag(); err != nil || flag != common.VERIFY_HELLO {
+				t.Fatal(flag, err)
+			}
+			if err := client.VerifyAuthProof(auth, v.clientKey, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-done; (err == nil) != v.ok {
+			t.Fatalf("vkey %s of %s: %v", v.clientKey, v.serverKey, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestAuthProof(t *testing.T) {
+	auth := &Auth{Challenge: newNonce(), Nonce: newNonce(), Time: time.Now().Unix()}
+	auth.Sign = auth.sign("123", "npc")
+	for _, v := range []struct {
+		serverKey string
+		cert, ok  bool
+	}{{"123", false, true}, {"456", false, false}, {"", false, false}, {"", true, true}} {
+		a, b := net.Pipe()
+		go NewConn(a).SendAuthProof(auth, v.serverKey)
+		c := NewConn(b)
+		if flag, err := c.ReadFlag(); err != nil || flag != common.VERIFY_HELLO {
+			t.Fatal(flag, err)
+		}
+		if err := c.VerifyAuthProof(auth, "123", v.cert); (err == nil) != v.ok {
+			t.Fatalf("%+v: %v", v, err)
+		}
+		a.Close()
+		b.Close()
+	}
+	// the answer can not be used by another vkey or replayed to another challenge
+	if auth.Verify("456") {
+		t.Fatal("verified by a wrong vkey")
+	}
+	replay := *auth
+	replay.Challenge = newNonce()
+	if replay.Verify("123") {
+		t.Fatal("the answer is replayed")
+	}
+}
+
+func TestChallengeTimeWindow(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	server, client := NewConn(a), NewConn(b)
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Challenge()
+		done <- err
+	}()
+	if flag, err := client.ReadFlag(); err != nil || flag != common.VERIFY_CHALLENGE {
+		t.Fatal(flag, err)
+	}
+	m, err := client.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &Auth{Challenge: m.String(tagAuthChallenge), Nonce: newNonce(), Time: time.Now().Add(-AuthWindow - time.Minute).Unix()}
+	old.Sign = old.sign("123", "npc")
+	client.WriteMsg(NewMsg().AddString(tagAuthNonce, old.Nonce).AddInt(tagAuthTime, old.Time).Add(tagAuthSign, old.Sign))
+	if err := <-done; err == nil {
+		t.Fatal("the answer out of the time window is accepted")
+	}
+}
+
+func TestNewVkey(t *testing.T) {
+	for _, oldKey := range []string{"123", "456"} {
+		a, b := net.Pipe()
+		go NewConn(a).SendNewVkey("123", "789")
+		c := NewConn(b)
+		if flag, err := c.ReadFlag(); err != nil || flag != common.NEW_VKEY {
+			t.Fatal(flag, err)
+		}
+		vkey, err := c.GetNewVkey(oldKey)
+		if ok := oldKey == "123"; (err == nil) != ok || ok && vkey != "789" {
+			t.Fatalf("open by %s: %s %v", oldKey, vkey, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
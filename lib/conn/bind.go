@@ -0,0 +1,57 @@
+package conn
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// BindTimeout is how long the listener of a socks5 BIND waits for the peer
+const BindTimeout = 2 * time.Minute
+
+// ListenBind listens on the port of ip for a socks5 BIND, port 0 is a random port, empty ip is all the interfaces
+func ListenBind(ip string, port int) (*net.TCPListener, error) {
+	return net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(ip), Port: port})
+}
+
+// BindAddr returns the address of the listener told to the socks5 client,
+// a listener on all the interfaces reports the ip routed to the peer
+func BindAddr(l net.Listener, peer string) string {
+	addr := l.Addr().(*net.TCPAddr)
+	ip := addr.IP
+	if ip.IsUnspecified() {
+		ip = net.IPv4zero
+		if host, _, err := net.SplitHostPort(peer); err == nil {
+			// nothing is sent by dialing udp, only the route is looked up
+			if c, err := net.Dial("udp", net.JoinHostPort(host, "80")); err == nil {
+				ip = c.LocalAddr().(*net.UDPAddr).IP
+				c.Close()
+			}
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port))
+}
+
+// AcceptBind accepts the connection of the peer in BindTimeout, the connections from other ips
+// are closed, any ip is accepted if the peer is a domain or an unspecified address
+func AcceptBind(l *net.TCPListener, peer string) (net.Conn, error) {
+	var expect net.IP
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		if expect = net.ParseIP(host); expect != nil && expect.IsUnspecified() {
+			expect = nil
+		}
+	}
+	if err := l.SetDeadline(time.Now().Add(BindTimeout)); err != nil {
+		return nil, err
+	}
+	for {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if expect == nil || c.RemoteAddr().(*net.TCPAddr).IP.Equal(expect) {
+			return c, nil
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,44 @@
+package conn
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestAcceptBind(t *testing.T) {
+	l, err := ListenBind("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	if addr := BindAddr(l, "127.0.0.1:21"); addr != "127.0.0.1:"+port {
+		t.Fatal(addr)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := AcceptBind(l, "127.0.0.1:21")
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	// a connection from another ip is not the peer
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	other, err := d.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	peer, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	c := <-accepted
+	if c == nil || c.RemoteAddr().String() != peer.LocalAddr().String() {
+		t.Fatalf("accepted %v, the peer is %s", c, peer.LocalAddr())
+	}
+	c.Close()
+}
@@ -0,0 +1,114 @@
+package conn
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// compression algorithms of link data
+const (
+	CompressNone   = "none"
+	CompressSnappy = "snappy"
+	CompressZstd   = "zstd"
+	CompressLz4    = "lz4"
+)
+
+// flushWriter is a compress writer flushed after every write, the peer reads the data without waiting for more
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressConn compress the writes and decompress the reads of the conn
+type CompressConn struct {
+	mu sync.Mutex // the writer is used by Write, Close and CloseWrite of different goroutines
+	w  flushWriter
+	r  io.Reader
+	c  io.Closer
+}
+
+// NewCompressConn returns the conn compressed by the algorithm, the conn itself if it is unknown or none
+func NewCompressConn(conn io.ReadWriteCloser, algorithm string) (io.ReadWriteCloser, error) {
+	switch algorithm {
+	case CompressSnappy:
+		return NewSnappyConn(conn), nil
+	case CompressZstd:
+		w, err := zstd.NewWriter(conn, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<18))
+		if err != nil {
+			return nil, err
+		}
+		r, err := zstd.NewReader(conn, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		return &CompressConn{w: w, r: &zstdReader{r}, c: conn}, nil
+	case CompressLz4:
+		w := lz4.NewWriter(conn)
+		if err := w.Apply(lz4.BlockSizeOption(lz4.Block64Kb), lz4.ConcurrencyOption(1), lz4.CompressionLevelOption(lz4.Fast)); err != nil {
+			return nil, err
+		}
+		return &CompressConn{w: w, r: lz4.NewReader(conn), c: conn}, nil
+	}
+	return conn, nil
+}
+
+// ValidCompression check the algorithm set on a tunnel or a client
+func ValidCompression(algorithm string) bool {
+	switch algorithm {
+	case "", CompressNone, CompressSnappy, CompressZstd, CompressLz4:
+		return true
+	}
+	return false
+}
+
+func (s *CompressConn) Write(b []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, err = s.w.Write(b); err != nil {
+		return
+	}
+	err = s.w.Flush()
+	return
+}
+
+func (s *CompressConn) Read(b []byte) (n int, err error) {
+	return s.r.Read(b)
+}
+
+// Close the conn first, every write is flushed so the writer has nothing to send and only releases the buffers,
+// a blocked Write returns by the closed conn and releases the lock
+func (s *CompressConn) Close() error {
+	err := s.c.Close()
+	s.mu.Lock()
+	s.w.Close()
+	s.mu.Unlock()
+	if r, ok := s.r.(*zstdReader); ok {
+		r.Close()
+	}
+	return err
+}
+
+// CloseWrite end the compressed stream so the peer reads io.EOF instead of an unexpected EOF,
+// then shut down the write direction of the conn
+func (s *CompressConn) CloseWrite() error {
+	s.mu.Lock()
+	err := s.w.Close()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return CloseWrite(s.c)
+}
+
+// zstdReader release the decoder goroutines on close
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (s *zstdReader) Close() {
+	s.Decoder.Close()
+}
@@ -0,0 +1,220 @@
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ehang.io/nps/lib/crypt"
+)
+
+func TestCompressConn(t *testing.T) {
+	for _, algorithm := range []string{CompressSnappy, CompressZstd, CompressLz4} {
+		t.Run(algorithm, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			w, err := NewCompressConn(c1, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewCompressConn(c2, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			defer r.Close()
+
+			// every write is flushed, the reader gets it without more data
+			for _, msg := range []string{"ping", "pong", strings.Repeat("compressible data ", 10000)} {
+				errCh := make(chan error, 1)
+				go func() {
+					_, err := w.Write([]byte(msg))
+					errCh <- err
+				}()
+				b := make([]byte, len(msg))
+				if _, err := io.ReadFull(r, b); err != nil || string(b) != msg {
+					t.Fatalf("read %.10q %v", b, err)
+				}
+				if err := <-errCh; err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetConnCodec(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	for _, lk := range []*Link{
+		{Cipher: CipherAead},
+		{Cipher: CipherAead, Compress: true, Compression: CompressZstd},
+		{Compress: true, Compression: CompressLz4},
+		{Compress: true},
+	} {
+		name := fmt.Sprintf("%s_%s", lk.Cipher, lk.Compression)
+		t.Run(name, func(t *testing.T) {
+			lk.Salt = []byte("salt")
+			lk.SetKey(key)
+			c1, c2 := net.Pipe()
+			client, err := GetConn(c1, lk, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := GetConn(c2, lk, nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// snappy writes the stream end on close, close the pipe instead
+			defer c1.Close()
+			defer c2.Close()
+			go server.Write([]byte("hello"))
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(client, b); err != nil || string(b) != "hello" {
+				t.Fatalf("read %q %v", b, err)
+			}
+		})
+	}
+	if _, err := GetConn(nil, &Link{Cipher: CipherAead}, nil, true); err == nil {
+		t.Fatal("expected error without the session key")
+	}
+}
+
+func TestCodecCloseWrite(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	for _, lk := range []*Link{
+		{},
+		{Cipher: CipherAead},
+		{Cipher: CipherAead, Compress: true, Compression: CompressZstd},
+		{Compress: true, Compression: CompressLz4},
+		{Compress: true},
+	} {
+		name := fmt.Sprintf("%s_%s", lk.Cipher, lk.Compression)
+		t.Run(name, func(t *testing.T) {
+			lk.Salt = []byte("salt")
+			lk.SetKey(key)
+			c1, c2 := newTcpPair(t)
+			client, err := GetConn(c1, lk, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := GetConn(c2, lk, nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			if _, err := client.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if err := CloseWrite(client); err != nil {
+				t.Fatal(err)
+			}
+			// the server reads the data and then the end of the stream
+			if b, err := io.ReadAll(server); err != nil || string(b) != "ping" {
+				t.Fatalf("read %q %v", b, err)
+			}
+			done := make(chan error, 1)
+			go func() {
+				_, err := server.Write([]byte("pong"))
+				done <- err
+			}()
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(client, b); err != nil || string(b) != "pong" {
+				t.Fatalf("read %q %v", b, err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			client.Close()
+		})
+	}
+}
+
+// newTcpPair returns both sides of a loopback tcp connection
+func newTcpPair(b testing.TB) (client, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	if client, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		b.Fatal(err)
+	}
+	server = <-ch
+	return
+}
+
+func benchmarkLink(b *testing.B, lk *Link) {
+	lk.Salt = []byte("salt")
+	lk.SetKey(bytes.Repeat([]byte{3}, 32))
+	c1, c2 := newTcpPair(b)
+	var client, server io.ReadWriteCloser
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = GetConn(c2, lk, nil, true)
+		done <- err
+	}()
+	client, err := GetConn(c1, lk, nil, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	go func() {
+		io.Copy(io.Discard, server)
+		server.Close()
+	}()
+	// text like payload, compression helps but the data is not all the same
+	line := "GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n"
+	buf := make([]byte, 32*1024)
+	for i := range buf {
+		buf[i] = line[i%len(line)] + byte(i/1024)
+	}
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func initBenchTls(b *testing.B) {
+	dir := b.TempDir()
+	if err := crypt.InitTls(filepath.Join(dir, "bridge.pem"), filepath.Join(dir, "bridge.key")); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkLinkPlain(b *testing.B) { benchmarkLink(b, &Link{}) }
+func BenchmarkLinkTls(b *testing.B) {
+	initBenchTls(b)
+	benchmarkLink(b, &Link{Crypt: true})
+}
+func BenchmarkLinkSnappy(b *testing.B) { benchmarkLink(b, &Link{Compress: true}) }
+func BenchmarkLinkZstd(b *testing.B) {
+	benchmarkLink(b, &Link{Compress: true, Compression: CompressZstd})
+}
+func BenchmarkLinkLz4(b *testing.B) {
+	benchmarkLink(b, &Link{Compress: true, Compression: CompressLz4})
+}
+func BenchmarkLinkAead(b *testing.B) { benchmarkLink(b, &Link{Cipher: CipherAead}) }
+func BenchmarkLinkAeadSnappy(b *testing.B) {
+	benchmarkLink(b, &Link{Cipher: CipherAead, Compress: true, Compression: CompressSnappy})
+}
+func BenchmarkLinkAeadZstd(b *testing.B) {
+	benchmarkLink(b, &Link{Cipher: CipherAead, Compress: true, Compression: CompressZstd})
+}
+func BenchmarkLinkAeadLz4(b *testing.B) {
+	benchmarkLink(b, &Link{Cipher: CipherAead, Compress: true, Compression: CompressLz4})
+}
@@ -26,8 +26,15 @@ import (
 )
 
 type Conn struct {
-	Conn net.Conn
-	Rb   []byte
+	Conn    net.Conn
+	Rb      []byte
+	Caps    Caps   // capabilities negotiated in the bridge handshake
+	Key     []byte // session key of the aead link encryption, nil if not negotiated
+	Conns   int    // negotiated bridge data connections, more than 1 is a stripe
+	Token   string // resume token of the session, empty if not negotiated
+	Resumed bool   // the last session is reattached
+	Weights []int  // bandwidth shares of the priority classes of the mux, nil is the default
+	Legacy  bool   // the peer sent no hello, Caps is LegacyCaps
 }
 
 //new conn
@@ -153,6 +160,8 @@ func (s *Conn) SetAlive(tp string) {
 		//conn.SetKeepAlivePeriod(time.Duration(2 * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Time{})
+	case *QuicStream:
+		s.Conn.(*QuicStream).SetReadDeadline(time.Time{})
 	}
 }
 
@@ -165,17 +174,29 @@ func (s *Conn) SetReadDeadlineBySecond(t time.Duration) {
 		s.Conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
+	case *QuicStream:
+		s.Conn.(*QuicStream).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	}
 }
 
 //get link info from conn
 func (s *Conn) GetLinkInfo() (lk *Link, err error) {
+	if s.useMsg() {
+		var m *Msg
+		if m, err = s.ReadMsg(); err != nil {
+			return
+		}
+		return linkFromMsg(m), nil
+	}
 	err = s.getInfo(&lk)
 	return
 }
 
 //send info for link
 func (s *Conn) SendHealthInfo(info, status string) (int, error) {
+	if s.useMsg() {
+		return 0, s.WriteMsg(NewMsg().AddString(tagHealthTarget, info).AddBool(tagHealthStatus, common.GetBoolByStr(status)))
+	}
 	raw := bytes.NewBuffer([]byte{})
 	common.BinaryWrite(raw, info, status)
 	return s.Write(raw.Bytes())
@@ -183,20 +204,39 @@ func (s *Conn) SendHealthInfo(info, status string) (int, error) {
 
 //get health info from conn
 func (s *Conn) GetHealthInfo() (info string, status bool, err error) {
+	var addr bool
+	if info, status, addr, err = s.GetHealthInfoOrAddr(); err == nil && addr {
+		err = errors.New("receive health info error")
+	}
+	return
+}
+
+// GetHealthInfoOrAddr also read the reply of REPORT_LOCAL_IP sent to a legacy npc without waiting,
+// the reply has no separator, then addr is true and info is the local addresses
+func (s *Conn) GetHealthInfoOrAddr() (info string, status, addr bool, err error) {
+	if s.useMsg() {
+		var m *Msg
+		if m, err = s.ReadMsg(); err != nil {
+			return
+		}
+		return m.String(tagHealthTarget), m.Bool(tagHealthStatus), false, nil
+	}
 	var l int
 	buf := common.BufPoolMax.Get().([]byte)
 	defer common.PutBufPoolMax(buf)
 	if l, err = s.GetLen(); err != nil {
 		return
+	} else if l == 0 {
+		// the npc has no local address
+		return "", false, true, nil
 	} else if _, err = s.ReadLen(l, buf); err != nil {
 		return
-	} else {
-		arr := strings.Split(string(buf[:l]), common.CONN_DATA_SEQ)
-		if len(arr) >= 2 {
-			return arr[0], common.GetBoolByStr(arr[1]), nil
-		}
 	}
-	return "", false, errors.New("receive health info error")
+	arr := strings.Split(string(buf[:l]), common.CONN_DATA_SEQ)
+	if len(arr) >= 2 {
+		return arr[0], common.GetBoolByStr(arr[1]), false, nil
+	}
+	return string(buf[:l]), false, true, nil
 }
 
 //get task info
@@ -238,7 +278,11 @@ func (s *Conn) SendInfo(t interface{}, flag string) (int, error) {
 		+----+---------------+
 		| 4  |  4  |   ...   |
 		+----+---------------+
+		With CapMsg the content is a control message of the json, see msg.go
 	*/
+	if s.useMsg() {
+		return s.sendJsonMsg(t, flag)
+	}
 	raw := bytes.NewBuffer([]byte{})
 	if flag != "" {
 		binary.Write(raw, binary.LittleEndian, []byte(flag))
@@ -257,6 +301,13 @@ func (s *Conn) SendInfo(t interface{}, flag string) (int, error) {
 
 //get task info
 func (s *Conn) getInfo(t interface{}) (err error) {
+	if s.useMsg() {
+		var m *Msg
+		if m, err = s.ReadMsg(); err != nil {
+			return
+		}
+		return json.Unmarshal(m.Get(tagJson), &t)
+	}
 	var l int
 	buf := common.BufPoolMax.Get().([]byte)
 	defer common.PutBufPoolMax(buf)
@@ -294,6 +345,11 @@ func (s *Conn) Read(b []byte) (n int, err error) {
 	return s.Conn.Read(b)
 }
 
+// half close, a replayed conn of the mixed proxy is copied like the raw conn
+func (s *Conn) CloseWrite() error {
+	return CloseWrite(s.Conn)
+}
+
 //write sign flag
 func (s *Conn) WriteClose() (int, error) {
 	return s.Write([]byte(common.RES_CLOSE))
@@ -329,6 +385,11 @@ func (s *Conn) WriteAddFail() error {
 	return binary.Write(s.Conn, binary.LittleEndian, false)
 }
 
+// WriteAddReject 同 WriteAddFail，但不关闭连接，客户端可以继续发送其他项
+func (s *Conn) WriteAddReject() error {
+	return binary.Write(s.Conn, binary.LittleEndian, false)
+}
+
 func (s *Conn) LocalAddr() net.Addr {
 	return s.Conn.LocalAddr()
 }
@@ -374,12 +435,27 @@ func SetUdpSession(sess *kcp.UDPSession) {
 	sess.SetWriteDelay(false)
 }
 
+// CloseWrite shut down the write direction of the conn, the peer reads io.EOF and still can write,
+// it fails if the conn or a conn it wraps does not support half close
+func CloseWrite(c io.Closer) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("the conn does not support half close")
+}
+
 //conn1 mux conn
-func CopyWaitGroup(conn1, conn2 net.Conn, crypt bool, snappy bool, rate *rate.Rate,
+func CopyWaitGroup(conn1, conn2 net.Conn, lk *Link, rate *rate.Rate,
 	flow *file.Flow, isServer bool, rb []byte, task *file.Tunnel, host *file.Host) {
 	//var in, out int64
 	//var wg sync.WaitGroup
-	connHandle := GetConn(conn1, crypt, snappy, rate, isServer)
+	connHandle, err := GetConn(conn1, lk, rate, isServer)
+	if err != nil {
+		logs.Warn(err)
+		conn1.Close()
+		conn2.Close()
+		return
+	}
 	if rb != nil {
 		connHandle.Write(rb)
 	}
@@ -399,7 +475,7 @@ func CopyWaitGroup(conn1, conn2 net.Conn, crypt bool, snappy bool, rate *rate.Ra
 	//}
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
-	err := goroutine.CopyConnsPool.Invoke(goroutine.NewConns(connHandle, conn2, flow, wg, task, host))
+	err = goroutine.CopyConnsPool.Invoke(goroutine.NewConns(connHandle, conn2, flow, wg, task, host))
 	wg.Wait()
 	if err != nil {
 		logs.Error(err)
@@ -407,16 +483,40 @@ func CopyWaitGroup(conn1, conn2 net.Conn, crypt bool, snappy bool, rate *rate.Ra
 }
 
 //get crypt or snappy conn
-func GetConn(conn net.Conn, cpt, snappy bool, rt *rate.Rate, isServer bool) io.ReadWriteCloser {
-	if cpt {
-		if isServer {
-			return rate.NewRateConn(crypt.NewTlsServerConn(conn), rt)
+//a link negotiated with the cipher and compression is compressed and then encrypted by aead, nil link is a plain conn
+func GetConn(conn net.Conn, lk *Link, rt *rate.Rate, isServer bool) (io.ReadWriteCloser, error) {
+	if lk == nil {
+		return rate.NewRateConn(conn, rt), nil
+	}
+	if lk.Cipher == "" && lk.Compression == "" {
+		if lk.Crypt {
+			if isServer {
+				return rate.NewRateConn(crypt.NewTlsServerConn(conn), rt), nil
+			}
+			return rate.NewRateConn(crypt.NewTlsClientConn(conn), rt), nil
+		} else if lk.Compress {
+			return rate.NewRateConn(NewSnappyConn(conn), rt), nil
+		}
+		return rate.NewRateConn(conn, rt), nil
+	}
+	var c io.ReadWriteCloser = conn
+	if lk.Cipher == CipherAead {
+		ac, err := NewAeadConn(c, lk.key, lk.Salt, isServer)
+		if err != nil {
+			return nil, err
+		}
+		c = ac
+	} else if lk.Cipher != "" {
+		return nil, errors.New("unsupported cipher " + lk.Cipher)
+	}
+	if lk.Compress && lk.Compression != "" {
+		cc, err := NewCompressConn(c, lk.Compression)
+		if err != nil {
+			return nil, err
 		}
-		return rate.NewRateConn(crypt.NewTlsClientConn(conn), rt)
-	} else if snappy {
-		return rate.NewRateConn(NewSnappyConn(conn), rt)
+		c = cc
 	}
-	return rate.NewRateConn(conn, rt)
+	return rate.NewRateConn(c, rt), nil
 }
 
 type LenConn struct {
@@ -0,0 +1,192 @@
+package conn
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"ehang.io/nps/lib/version"
+)
+
+// ProtoVersion bridge协议版本,不兼容的修改时递增
+const ProtoVersion = 1
+
+// capabilities advertised in the hello exchange
+const (
+	CapLocalIp    = "local_ip"  // REPORT_LOCAL_IP on the main signal conn
+	CapHealth     = "health"    // health check report on the main signal conn
+	CapSnappy     = "snappy"    // snappy compression of link data
+	CapUdpOverMux = "udp_mux"   // udp5 links carried over the mux
+	CapP2p        = "p2p"       // NEW_UDP_CONN for p2p providers
+	CapAead       = "aead"      // aead encryption of link data by the session key
+	CapZstd       = "zstd"      // zstd compression of link data
+	CapLz4        = "lz4"       // lz4 compression of link data
+	CapStripe     = "stripe"    // several WORK_CHAN connections of one client
+	CapResume     = "resume"    // reattach to the session after a short bridge drop
+	CapConfigDiff = "confdiff"  // DEL_TASK and DEL_HOST on the config conn
+	CapMsg        = "msg"       // control messages in the tlv encoding of msg.go
+	CapVkey       = "vkey"      // NEW_VKEY on the main signal conn
+	CapHalfClose  = "fin"       // the fin frame of the mux, half close of the streams
+	CapBind       = "bind"      // socks5 BIND links, the client listens for the peer
+	CapStatusAuth = "stus_auth" // WORK_STATUS proves the vkey by a challenge instead of md5(vkey)
+)
+
+// Hello is exchanged after auth by clients and servers that support negotiation
+type Hello struct {
+	ProtoVersion int
+	Version      string
+	Caps         []string
+	Key          []byte // x25519 public key to derive the session key
+	Conns        int    // bridge data connections requested by npc, allowed by nps
+	Token        string // resume token issued by nps
+	Resume       string // token of the last session, sent by npc on WORK_MAIN
+	Resumed      bool   // nps reattached the last session
+	Weights      []int  // bandwidth shares of the high, normal and bulk streams, set by nps
+	priv         *ecdh.PrivateKey
+	raw          []byte // the json sent or read, for the transcript
+}
+
+// Caps is the negotiated capability set of a bridge connection
+type Caps map[string]bool
+
+func (c Caps) Has(name string) bool {
+	return c[name]
+}
+
+func (c Caps) List() []string {
+	l := make([]string, 0, len(c))
+	for k := range c {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// LocalHello returns the hello of this build
+func LocalHello() *Hello {
+	h := &Hello{
+		ProtoVersion: ProtoVersion,
+		Version:      version.VERSION,
+		Caps:         []string{CapLocalIp, CapHealth, CapSnappy, CapUdpOverMux, CapP2p, CapZstd, CapLz4, CapStripe, CapResume, CapConfigDiff, CapMsg, CapVkey, CapHalfClose, CapBind, CapStatusAuth},
+	}
+	if priv, err := ecdh.X25519().GenerateKey(rand.Reader); err == nil {
+		h.priv = priv
+		h.Key = priv.PublicKey().Bytes()
+		h.Caps = append(h.Caps, CapAead)
+	}
+	return h
+}
+
+// Transcript is the hash of the hellos of npc and nps as sent on the wire
+func Transcript(client, server *Hello) []byte {
+	h := sha256.New()
+	for _, v := range []*Hello{client, server} {
+		binary.Write(h, binary.LittleEndian, int32(len(v.raw)))
+		h.Write(v.raw)
+	}
+	return h.Sum(nil)
+}
+
+// SessionKey derive the key of the link encryption from the key exchange and the vkey,
+// the key exchange is not signed, a man in the middle without the vkey gets a different key.
+// vkey is empty if nps does not prove it, e.g. npc is verified by its certificate only
+func SessionKey(local, remote *Hello, vkey string, transcript []byte) ([]byte, error) {
+	if local == nil || local.priv == nil || remote == nil || len(remote.Key) == 0 {
+		return nil, errors.New("no key exchange in the hello")
+	}
+	pub, err := ecdh.X25519().NewPublicKey(remote.Key)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := local.priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, append(shared, vkey...), transcript, "nps session", 32)
+}
+
+func helloSign(vkey string, transcript []byte) []byte {
+	h := hmac.New(sha256.New, []byte(vkey))
+	h.Write([]byte("nps hello"))
+	h.Write(transcript)
+	return h.Sum(nil)
+}
+
+// SendHelloProof sign the transcript by the vkey after the hello of nps, so npc can tell the hellos are not changed,
+// e.g. the aead capability is not stripped. an empty vkey if npc is verified by its certificate
+func (s *Conn) SendHelloProof(vkey string, transcript []byte) error {
+	m := NewMsg()
+	if vkey != "" {
+		m.Add(tagAuthSign, helloSign(vkey, transcript))
+	}
+	return s.WriteMsg(m)
+}
+
+// VerifyHelloProof check the proof of SendHelloProof, vkey is empty if nps did not prove the vkey in the auth
+func (s *Conn) VerifyHelloProof(vkey string, transcript []byte) error {
+	m, err := s.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if vkey == "" {
+		return nil
+	}
+	if !hmac.Equal(m.Get(tagAuthSign), helloSign(vkey, transcript)) {
+		return errors.New("the hello is changed on the way")
+	}
+	return nil
+}
+
+// LegacyCaps is what a peer without hello support is assumed to handle
+func LegacyCaps() Caps {
+	return Caps{CapHealth: true, CapSnappy: true, CapUdpOverMux: true, CapP2p: true}
+}
+
+// Negotiate returns the capabilities supported by both sides
+func Negotiate(local, remote *Hello) Caps {
+	caps := make(Caps)
+	if local == nil || remote == nil {
+		return caps
+	}
+	for _, l := range local.Caps {
+		for _, r := range remote.Caps {
+			if l == r {
+				caps[l] = true
+			}
+		}
+	}
+	return caps
+}
+
+// SendHello write the hello as len+json
+func (s *Conn) SendHello(h *Hello) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	h.raw = b
+	return s.WriteLenContent(b)
+}
+
+// GetHello read the hello of the peer
+func (s *Conn) GetHello() (h *Hello, err error) {
+	var b []byte
+	if b, err = s.GetShortLenContent(); err != nil {
+		return
+	}
+	h = new(Hello)
+	if err = json.Unmarshal(b, h); err != nil {
+		return nil, err
+	}
+	if h.ProtoVersion <= 0 {
+		return nil, errors.New("hello protocol version error")
+	}
+	h.raw = b
+	return
+}
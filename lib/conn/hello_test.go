@@ -0,0 +1,121 @@
+package conn
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestHelloExchange(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	remote := &Hello{ProtoVersion: ProtoVersion, Version: "test", Caps: []string{CapSnappy, "unknown"}}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- NewConn(clientConn).SendHello(remote)
+	}()
+
+	h, err := NewConn(serverConn).GetHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	caps := Negotiate(LocalHello(), h)
+	if !caps.Has(CapSnappy) {
+		t.Fatalf("expected %s negotiated, got %v", CapSnappy, caps.List())
+	}
+	if caps.Has("unknown") || caps.Has(CapLocalIp) {
+		t.Fatalf("unexpected capabilities %v", caps.List())
+	}
+}
+
+func TestGetHelloRejectsInvalidVersion(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go NewConn(clientConn).WriteLenContent([]byte(`{"ProtoVersion":0}`))
+	if _, err := NewConn(serverConn).GetHello(); err == nil {
+		t.Fatal("expected error for protocol version 0")
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	client, server := LocalHello(), LocalHello()
+	transcript := Transcript(client, server)
+	k1, err := SessionKey(client, server, "123", transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := SessionKey(server, client, "123", transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k1) != 32 || string(k1) != string(k2) {
+		t.Fatal("both sides should derive the same session key")
+	}
+	if k3, _ := SessionKey(server, client, "456", transcript); string(k3) == string(k1) {
+		t.Fatal("the session key should depend on the vkey")
+	}
+	if k4, _ := SessionKey(server, client, "123", []byte("other")); string(k4) == string(k1) {
+		t.Fatal("the session key should depend on the transcript")
+	}
+	if _, err := SessionKey(client, &Hello{ProtoVersion: ProtoVersion}, "123", transcript); err == nil {
+		t.Fatal("expected error without the key of the peer")
+	}
+}
+
+// a man in the middle strips the aead capability from the hello of npc
+func TestHelloProof(t *testing.T) {
+	for _, v := range []struct {
+		serverKey, clientKey string
+		strip, ok            bool
+	}{{"123", "123", false, true}, {"123", "123", true, false}, {"456", "123", false, false}, {"", "", false, true}} {
+		a, b := net.Pipe()
+		server, client := NewConn(a), NewConn(b)
+		local := LocalHello()
+		go func() {
+			remote, err := server.GetHello()
+			if err != nil {
+				return
+			}
+			if v.strip {
+				// the raw bytes read by nps differ from the bytes sent by npc
+				remote.Caps = remote.Caps[:len(remote.Caps)-1]
+				remote.raw, _ = json.Marshal(remote)
+			}
+			h := LocalHello()
+			server.SendHello(h)
+			server.SendHelloProof(v.serverKey, Transcript(remote, h))
+		}()
+		if err := client.SendHello(local); err != nil {
+			t.Fatal(err)
+		}
+		remote, err := client.GetHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.VerifyHelloProof(v.clientKey, Transcript(local, remote)); (err == nil) != v.ok {
+			t.Fatalf("%+v: %v", v, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestLegacyCaps(t *testing.T) {
+	caps := LegacyCaps()
+	for _, c := range []string{CapHealth, CapSnappy, CapUdpOverMux, CapP2p} {
+		if !caps.Has(c) {
+			t.Fatalf("an old peer supports %s", c)
+		}
+	}
+	// the local ip of an old npc is not asked by the probe waiting for the reply
+	if caps.Has(CapResume) || caps.Has(CapLocalIp) {
+		t.Fatal(caps.List())
+	}
+}
@@ -23,6 +23,29 @@ type Link struct {
 	RemoteAddr   string
 	ProtoVersion string
 	Option       Options
+	Cipher       string // aead, encrypt by the session key instead of tls
+	Compression  string // snappy, zstd or lz4, negotiated with the client
+	Salt         []byte // salt of the aead stream keys, random per link
+	Priority     string // high, normal or bulk, the class of the stream in the mux
+	key          []byte
+}
+
+// SetKey set the session key of the bridge connection carrying the link, it is never sent
+func (s *Link) SetKey(key []byte) {
+	s.key = key
+}
+
+// SetCompression override the compression of the client, empty keeps it and none disables it
+func (s *Link) SetCompression(algorithm string) {
+	switch algorithm {
+	case "":
+	case CompressNone:
+		s.Compress = false
+		s.Compression = ""
+	default:
+		s.Compress = true
+		s.Compression = algorithm
+	}
 }
 
 type Option func(*Options)
@@ -4,13 +4,14 @@ import (
 	"net"
 	"strings"
 
+	"ehang.io/nps/lib/graceful"
 	"github.com/astaxie/beego/logs"
 	"github.com/xtaci/kcp-go"
 )
 
 func NewTcpListenerAndProcess(addr string, f func(c net.Conn), listener *net.Listener) error {
 	var err error
-	*listener, err = net.Listen("tcp", addr)
+	*listener, err = graceful.Listen(addr)
 	if err != nil {
 		return err
 	}
@@ -19,21 +20,34 @@ func NewTcpListenerAndProcess(addr string, f func(c net.Conn), listener *net.Lis
 }
 
 func NewKcpListenerAndProcess(addr string, f func(c net.Conn)) error {
-	kcpListener, err := kcp.ListenWithOptions(addr, nil, 150, 3)
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	pc, err := graceful.ListenUDP(udpAddr)
+	if err != nil {
+		logs.Error(err)
+		return err
+	}
+	// 平滑重启时旧进程的 kcp 会话结束后再读取
+	graceful.WaitUDP()
+	kcpListener, err := kcp.ServeConn(nil, 150, 3, pc)
 	if err != nil {
 		logs.Error(err)
 		return err
 	}
 	for {
 		c, err := kcpListener.AcceptKCP()
-		SetUdpSession(c)
 		if err != nil {
+			if graceful.Closed() {
+				return nil
+			}
 			logs.Warn(err)
 			continue
 		}
+		SetUdpSession(c)
 		go f(c)
 	}
-	return nil
 }
 
 func Accept(l net.Listener, f func(c net.Conn)) {
@@ -0,0 +1,311 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/common"
+)
+
+// MsgVersion 控制消息编码的版本
+const MsgVersion = 1
+
+/*
+	The control message is formed as follows:
+	+---------+-----+---------+-------+-----+
+	| version | tag |   len   | value | ... |
+	+---------+-----+---------+-------+-----+
+	|    1    |  1  | uvarint |  len  |     |
+	+---------+-----+---------+-------+-----+
+	A tag may appear more than once, unknown tags are skipped,
+	so a new field only needs a new tag.
+*/
+
+// tags of the link info
+const (
+	tagLinkConnType uint8 = iota + 1
+	tagLinkHost
+	tagLinkCrypt
+	tagLinkCompress
+	tagLinkLocalProxy
+	tagLinkRemoteAddr
+	tagLinkProtoVersion
+	tagLinkTimeout
+	tagLinkCipher
+	tagLinkCompression
+	tagLinkSalt
+	tagLinkPriority
+)
+
+// tags of the other messages
+const (
+	tagJson         uint8 = 1 // a task, host or client config, new fields of them need no change
+	tagHealthTarget uint8 = 1
+	tagHealthStatus uint8 = 2
+	tagRemark       uint8 = 1
+	tagP2pPassword  uint8 = 1
+	tagP2pRole      uint8 = 2
+	tagP2pAddr      uint8 = 3
+	tagVkey         uint8 = 1
+)
+
+var errMsg = errors.New("malformed control message")
+
+type msgField struct {
+	tag uint8
+	val []byte
+}
+
+// Msg is a control message of tag-length-value fields
+type Msg struct {
+	fields []msgField
+}
+
+func NewMsg() *Msg {
+	return new(Msg)
+}
+
+func (m *Msg) Add(tag uint8, v []byte) *Msg {
+	m.fields = append(m.fields, msgField{tag, v})
+	return m
+}
+
+func (m *Msg) AddString(tag uint8, v string) *Msg {
+	return m.Add(tag, []byte(v))
+}
+
+func (m *Msg) AddInt(tag uint8, v int64) *Msg {
+	return m.Add(tag, binary.AppendVarint(nil, v))
+}
+
+func (m *Msg) AddBool(tag uint8, v bool) *Msg {
+	if v {
+		return m.Add(tag, []byte{1})
+	}
+	return m.Add(tag, []byte{0})
+}
+
+// Get returns the first value of the tag
+func (m *Msg) Get(tag uint8) []byte {
+	for _, f := range m.fields {
+		if f.tag == tag {
+			return f.val
+		}
+	}
+	return nil
+}
+
+func (m *Msg) String(tag uint8) string {
+	return string(m.Get(tag))
+}
+
+// Strings returns all values of the tag
+func (m *Msg) Strings(tag uint8) []string {
+	var l []string
+	for _, f := range m.fields {
+		if f.tag == tag {
+			l = append(l, string(f.val))
+		}
+	}
+	return l
+}
+
+func (m *Msg) Int(tag uint8) int64 {
+	v, _ := binary.Varint(m.Get(tag))
+	return v
+}
+
+func (m *Msg) Bool(tag uint8) bool {
+	b := m.Get(tag)
+	return len(b) > 0 && b[0] != 0
+}
+
+func (m *Msg) Marshal() []byte {
+	b := []byte{MsgVersion}
+	for _, f := range m.fields {
+		b = append(b, f.tag)
+		b = binary.AppendUvarint(b, uint64(len(f.val)))
+		b = append(b, f.val...)
+	}
+	return b
+}
+
+// UnmarshalMsg 解析控制消息，更高版本的消息只使用认识的 tag
+func UnmarshalMsg(b []byte) (*Msg, error) {
+	if len(b) == 0 || b[0] == 0 {
+		return nil, errMsg
+	}
+	m := new(Msg)
+	for b = b[1:]; len(b) > 0; {
+		tag := b[0]
+		l, n := binary.Uvarint(b[1:])
+		if n <= 0 || l > uint64(len(b)-1-n) {
+			return nil, errMsg
+		}
+		b = b[1+n:]
+		m.fields = append(m.fields, msgField{tag, b[:l:l]})
+		b = b[l:]
+	}
+	return m, nil
+}
+
+// WriteMsg write the message after its length
+func (s *Conn) WriteMsg(m *Msg) error {
+	return s.WriteLenContent(m.Marshal())
+}
+
+// ReadMsg read a message written by WriteMsg
+func (s *Conn) ReadMsg() (*Msg, error) {
+	buf := common.BufPoolMax.Get().([]byte)
+	defer common.PutBufPoolMax(buf)
+	l, err := s.GetLen()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.ReadLen(l, buf); err != nil {
+		return nil, err
+	}
+	return UnmarshalMsg(bytes.Clone(buf[:l]))
+}
+
+// useMsg 对方支持时使用新的编码，否则按旧的格式兼容
+func (s *Conn) useMsg() bool {
+	return s.Caps.Has(CapMsg)
+}
+
+func (s *Link) msg() *Msg {
+	return NewMsg().
+		AddString(tagLinkConnType, s.ConnType).
+		AddString(tagLinkHost, s.Host).
+		AddBool(tagLinkCrypt, s.Crypt).
+		AddBool(tagLinkCompress, s.Compress).
+		AddBool(tagLinkLocalProxy, s.LocalProxy).
+		AddString(tagLinkRemoteAddr, s.RemoteAddr).
+		AddString(tagLinkProtoVersion, s.ProtoVersion).
+		AddInt(tagLinkTimeout, int64(s.Option.Timeout)).
+		AddString(tagLinkCipher, s.Cipher).
+		AddString(tagLinkCompression, s.Compression).
+		Add(tagLinkSalt, s.Salt).
+		AddString(tagLinkPriority, s.Priority)
+}
+
+func linkFromMsg(m *Msg) *Link {
+	lk := &Link{
+		ConnType:     m.String(tagLinkConnType),
+		Host:         m.String(tagLinkHost),
+		Crypt:        m.Bool(tagLinkCrypt),
+		Compress:     m.Bool(tagLinkCompress),
+		LocalProxy:   m.Bool(tagLinkLocalProxy),
+		RemoteAddr:   m.String(tagLinkRemoteAddr),
+		ProtoVersion: m.String(tagLinkProtoVersion),
+		Option:       Options{Timeout: time.Duration(m.Int(tagLinkTimeout))},
+		Cipher:       m.String(tagLinkCipher),
+		Compression:  m.String(tagLinkCompression),
+		Priority:     m.String(tagLinkPriority),
+	}
+	if salt := m.Get(tagLinkSalt); len(salt) > 0 {
+		lk.Salt = salt
+	}
+	return lk
+}
+
+// SendLinkInfo send the link to the client, json for the clients without CapMsg
+func (s *Conn) SendLinkInfo(link *Link) (int, error) {
+	if !s.useMsg() {
+		return s.SendInfo(link, "")
+	}
+	b, err := GetLenBytes(link.msg().Marshal())
+	if err != nil {
+		return 0, err
+	}
+	return s.Write(b)
+}
+
+// WriteStatus write the remarks of the running tasks and hosts
+func (s *Conn) WriteStatus(remarks []string) error {
+	if !s.useMsg() {
+		var str string
+		for _, v := range remarks {
+			str += v + common.CONN_DATA_SEQ
+		}
+		return s.WriteLenContent([]byte(str))
+	}
+	m := NewMsg()
+	for _, v := range remarks {
+		m.AddString(tagRemark, v)
+	}
+	return s.WriteMsg(m)
+}
+
+// GetStatus read the remarks written by WriteStatus
+func (s *Conn) GetStatus() ([]string, error) {
+	if s.useMsg() {
+		m, err := s.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		return m.Strings(tagRemark), nil
+	}
+	l, err := s.GetLen()
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.GetShortContent(l)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(b), common.CONN_DATA_SEQ), nil
+}
+
+// json of a task, host or client config
+func (s *Conn) sendJsonMsg(t interface{}, flag string) (int, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return 0, err
+	}
+	if b, err = GetLenBytes(NewMsg().Add(tagJson, b).Marshal()); err != nil {
+		return 0, err
+	}
+	return s.Write(append([]byte(flag), b...))
+}
+
+// P2pMsg the password and role sent to the p2p server by udp
+func P2pMsg(password, role string) []byte {
+	return NewMsg().AddString(tagP2pPassword, password).AddString(tagP2pRole, role).Marshal()
+}
+
+// ParseP2pMsg parse the message of P2pMsg, or password*#*role*#* of the old clients.
+// isMsg tells the format to reply in.
+func ParseP2pMsg(b []byte) (password, role string, isMsg bool, err error) {
+	// the old message starts with the md5 of the password
+	if len(b) > 0 && b[0] < '0' {
+		m, err := UnmarshalMsg(b)
+		if err != nil {
+			return "", "", true, err
+		}
+		return m.String(tagP2pPassword), m.String(tagP2pRole), true, nil
+	}
+	arr := strings.Split(string(b), common.CONN_DATA_SEQ)
+	if len(arr) < 2 {
+		return "", "", false, errMsg
+	}
+	return arr[0], arr[1], false, nil
+}
+
+// P2pAddrMsg the address of the peer replied by the p2p server
+func P2pAddrMsg(addr string) []byte {
+	return NewMsg().AddString(tagP2pAddr, addr).Marshal()
+}
+
+// ParseP2pAddr parse the message of P2pAddrMsg
+func ParseP2pAddr(b []byte) (string, error) {
+	m, err := UnmarshalMsg(b)
+	if err != nil {
+		return "", err
+	}
+	return m.String(tagP2pAddr), nil
+}
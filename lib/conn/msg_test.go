@@ -0,0 +1,116 @@
+package conn
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/common"
+)
+
+func TestMsgRoundTrip(t *testing.T) {
+	b := NewMsg().AddString(1, "a*#*b").AddInt(2, -7).AddBool(3, true).AddString(1, "").Add(200, []byte{0, 1}).Marshal()
+	m, err := UnmarshalMsg(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.String(1) != "a*#*b" || m.Int(2) != -7 || !m.Bool(3) || m.Bool(4) {
+		t.Fatalf("fields %+v", m.fields)
+	}
+	if l := m.Strings(1); !reflect.DeepEqual(l, []string{"a*#*b", ""}) {
+		t.Fatal(l)
+	}
+	// the fields of a newer version are skipped by the tags
+	if _, err := UnmarshalMsg(append([]byte{MsgVersion + 1}, b[1:]...)); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]byte{nil, {0}, b[:len(b)-1], {MsgVersion, 1, 0x80}} {
+		if _, err := UnmarshalMsg(bad); err == nil {
+			t.Fatalf("%v should be rejected", bad)
+		}
+	}
+}
+
+func TestLinkInfo(t *testing.T) {
+	link := NewLink("tcp", "127.0.0.1:80", true, false, "1.1.1.1:2*#*3", false, "", LinkTimeout(time.Second*3))
+	link.Cipher = "aead"
+	link.Compression = "zstd"
+	link.Salt = []byte{1, 2, 3}
+	link.Priority = PriorityHigh
+	for _, caps := range []Caps{nil, {CapMsg: true}} {
+		a, b := net.Pipe()
+		sender, receiver := NewConn(a), NewConn(b)
+		sender.Caps, receiver.Caps = caps, caps
+		go sender.SendLinkInfo(link)
+		lk, err := receiver.GetLinkInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lk, link) {
+			t.Fatalf("caps %v, got %+v", caps, lk)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestHealthAndStatus(t *testing.T) {
+	for _, caps := range []Caps{nil, {CapMsg: true}} {
+		a, b := net.Pipe()
+		sender, receiver := NewConn(a), NewConn(b)
+		sender.Caps, receiver.Caps = caps, caps
+		go func() {
+			sender.SendHealthInfo("127.0.0.1:80", "1")
+			sender.WriteStatus([]string{"tcp", "web"})
+		}()
+		info, status, err := receiver.GetHealthInfo()
+		if err != nil || info != "127.0.0.1:80" || !status {
+			t.Fatalf("caps %v, health %s %v %v", caps, info, status, err)
+		}
+		remarks, err := receiver.GetStatus()
+		if err != nil || !common.InStrArr(remarks, "tcp") || !common.InStrArr(remarks, "web") {
+			t.Fatalf("caps %v, status %v %v", caps, remarks, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+// the reply of REPORT_LOCAL_IP of a legacy npc comes between the health info
+func TestLegacyLocalAddr(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sender, receiver := NewConn(a), NewConn(b)
+	go func() {
+		sender.SendHealthInfo("127.0.0.1:80", "1")
+		sender.WriteLenContent([]byte("192.168.1.2"))
+		sender.WriteLenContent(nil)
+		sender.SendHealthInfo("127.0.0.1:81", "0")
+	}()
+	for _, want := range []struct {
+		info         string
+		status, addr bool
+	}{{"127.0.0.1:80", true, false}, {"192.168.1.2", false, true}, {"", false, true}, {"127.0.0.1:81", false, false}} {
+		info, status, addr, err := receiver.GetHealthInfoOrAddr()
+		if err != nil || info != want.info || status != want.status || addr != want.addr {
+			t.Fatal(info, status, addr, err)
+		}
+	}
+}
+
+func TestParseP2pMsg(t *testing.T) {
+	password, role, isMsg, err := ParseP2pMsg(P2pMsg("md5", common.WORK_P2P_VISITOR))
+	if err != nil || password != "md5" || role != common.WORK_P2P_VISITOR || !isMsg {
+		t.Fatal(password, role, isMsg, err)
+	}
+	// old clients
+	password, role, isMsg, err = ParseP2pMsg(common.GetWriteStr("0123abcd", common.WORK_P2P_PROVIDER))
+	if err != nil || password != "0123abcd" || role != common.WORK_P2P_PROVIDER || isMsg {
+		t.Fatal(password, role, isMsg, err)
+	}
+	if addr, err := ParseP2pAddr(P2pAddrMsg("1.2.3.4:5")); err != nil || addr != "1.2.3.4:5" {
+		t.Fatal(addr, err)
+	}
+}
@@ -0,0 +1,144 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"ehang.io/nps/lib/graceful"
+	"github.com/astaxie/beego/logs"
+	"github.com/quic-go/quic-go"
+)
+
+const QuicAlpn = "nps"
+
+// QuicConfig is shared by nps and npc, the idle timeout replaces the mux ping
+func QuicConfig(disconnectTime int) *quic.Config {
+	idle := time.Duration(disconnectTime) * time.Second
+	if idle <= 0 {
+		idle = time.Minute
+	}
+	return &quic.Config{
+		HandshakeIdleTimeout: time.Second * 10,
+		MaxIdleTimeout:       idle,
+		KeepAlivePeriod:      time.Second * 5,
+		MaxIncomingStreams:   1 << 16,
+	}
+}
+
+// QuicSession map every mux conn to a native quic stream, so a lost packet only blocks its own stream
+type QuicSession struct {
+	conn *quic.Conn
+}
+
+func NewQuicSession(c *quic.Conn) *QuicSession {
+	return &QuicSession{conn: c}
+}
+
+func (s *QuicSession) NewConn() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(s.conn.Context(), time.Minute*2)
+	defer cancel()
+	st, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &QuicStream{Stream: st, sess: s}, nil
+}
+
+func (s *QuicSession) Accept() (net.Conn, error) {
+	st, err := s.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, errors.New("accpet error,the mux has closed")
+	}
+	return &QuicStream{Stream: st, sess: s}, nil
+}
+
+func (s *QuicSession) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *QuicSession) IsClose() bool {
+	return s.conn.Context().Err() != nil
+}
+
+func (s *QuicSession) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+// QuicStream is a quic stream with the addresses of its connection
+type QuicStream struct {
+	*quic.Stream
+	sess  *QuicSession
+	owner bool // the handshake stream, closing it closes the quic connection
+}
+
+func (s *QuicStream) Session() *QuicSession {
+	return s.sess
+}
+
+func (s *QuicStream) LocalAddr() net.Addr {
+	return s.sess.conn.LocalAddr()
+}
+
+func (s *QuicStream) RemoteAddr() net.Addr {
+	return s.sess.conn.RemoteAddr()
+}
+
+// Close close both directions, quic.Stream.Close only close the write direction
+func (s *QuicStream) Close() error {
+	s.Stream.CancelRead(0)
+	err := s.Stream.Close()
+	if s.owner {
+		s.sess.Close()
+	}
+	return err
+}
+
+// CloseWrite send the fin of the stream, it is still readable
+func (s *QuicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// DialQuic dial the server and open the stream for the bridge handshake
+func DialQuic(server string, tlsConf *tls.Config, disconnectTime int) (*QuicStream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	c, err := quic.DialAddr(ctx, server, tlsConf, QuicConfig(disconnectTime))
+	if err != nil {
+		return nil, err
+	}
+	sess := NewQuicSession(c)
+	st, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return &QuicStream{Stream: st, sess: sess, owner: true}, nil
+}
+
+// AcceptQuic accept quic connections, the first stream of every connection is passed to f
+func AcceptQuic(l *quic.Listener, f func(c net.Conn)) {
+	for {
+		c, err := l.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) || graceful.Closed() {
+				break
+			}
+			logs.Warn(err)
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(c.Context(), time.Second*10)
+			defer cancel()
+			st, err := c.AcceptStream(ctx)
+			if err != nil {
+				logs.Warn("accept quic stream from %s error %v", c.RemoteAddr(), err)
+				c.CloseWithError(0, "")
+				return
+			}
+			f(&QuicStream{Stream: st, sess: NewQuicSession(c), owner: true})
+		}()
+	}
+}
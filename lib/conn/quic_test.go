@@ -0,0 +1,206 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/crypt"
+	"github.com/quic-go/quic-go"
+)
+
+func echo(t Tunnel) {
+	for {
+		c, err := t.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+	}
+}
+
+func roundTrip(t Tunnel, size int) error {
+	c, err := t.NewConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	buf := make([]byte, size)
+	if _, err := c.Write(buf); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(c, buf)
+	return err
+}
+
+// lossyPacketConn drops outgoing packets with the given probability
+type lossyPacketConn struct {
+	net.PacketConn
+	loss float64
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if rand.Float64() < c.loss {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// newQuicPair returns both sides of a quic connection over lossy loopback udp
+func newQuicPair(tb testing.TB, loss float64) (client, server Tunnel) {
+	dir := tb.TempDir()
+	if err := crypt.InitTls(filepath.Join(dir, "bridge.pem"), filepath.Join(dir, "bridge.key")); err != nil {
+		tb.Fatal(err)
+	}
+	listen := func() *quic.Transport {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return &quic.Transport{Conn: &lossyPacketConn{PacketConn: pc, loss: loss}}
+	}
+	st, ct := listen(), listen()
+	tb.Cleanup(func() {
+		st.Close()
+		ct.Close()
+	})
+	l, err := st.Listen(&tls.Config{Certificates: []tls.Certificate{crypt.GetCert()}, NextProtos: []string{QuicAlpn}}, QuicConfig(60))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	accepted := make(chan *quic.Conn, 1)
+	go func() {
+		c, err := l.Accept(context.Background())
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	c, err := ct.Dial(context.Background(), st.Conn.LocalAddr(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QuicAlpn}}, QuicConfig(60))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewQuicSession(c), NewQuicSession(<-accepted)
+}
+
+// lossyRelay copy a to b, a lost segment stalls the whole direction for one rto like tcp retransmission
+func lossyRelay(a, b net.Conn, loss float64, rto time.Duration) {
+	buf := make([]byte, 1400)
+	for {
+		n, err := a.Read(buf)
+		if err != nil {
+			b.Close()
+			return
+		}
+		if rand.Float64() < loss {
+			time.Sleep(rto)
+		}
+		if _, err := b.Write(buf[:n]); err != nil {
+			a.Close()
+			return
+		}
+	}
+}
+
+// newTcpMuxPair returns both sides of nps_mux over a lossy tcp relay
+func newTcpMuxPair(tb testing.TB, loss float64) (client, server Tunnel) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ca, cb := net.Pipe()
+	sa, sb := net.Pipe()
+	go lossyRelay(ca, a, loss, 200*time.Millisecond)
+	go lossyRelay(a, ca, loss, 200*time.Millisecond)
+	go lossyRelay(b, sa, 0, 0)
+	go lossyRelay(sa, b, 0, 0)
+	client = NewTunnel(cb, "tcp", 60)
+	server = NewTunnel(sb, "tcp", 60)
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func TestQuicTunnel(t *testing.T) {
+	client, server := newQuicPair(t, 0)
+	go echo(server)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := roundTrip(client, 64*1024); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	client.Close()
+	time.Sleep(100 * time.Millisecond)
+	if !server.IsClose() {
+		t.Fatal("the server session is not closed with the client")
+	}
+}
+
+func TestNewTunnelUseQuicStreams(t *testing.T) {
+	client, _ := newQuicPair(t, 0)
+	c, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := c.(*QuicStream)
+	if tn := NewTunnel(st, "tcp", 60); tn != Tunnel(client) {
+		t.Fatal("the tunnel of a quic stream must be its session")
+	}
+	a, b := net.Pipe()
+	defer b.Close()
+	tn := NewTunnel(a, "tcp", 60)
+	defer tn.Close()
+	if _, ok := tn.(muxTunnel); !ok {
+		t.Fatal("the tunnel of a tcp conn must be nps_mux")
+	}
+}
+
+// go test -run none -bench Loss ./lib/conn
+// 8 parallel streams, each round trip 32KB, the tcp relay loses segments in both directions of the client side
+func benchmarkLoss(b *testing.B, newPair func(testing.TB, float64) (Tunnel, Tunnel), loss float64) {
+	client, server := newPair(b, loss)
+	go echo(server)
+	b.SetBytes(32 * 1024 * 2)
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := roundTrip(client, 32*1024); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkQuicLoss0(b *testing.B)   { benchmarkLoss(b, newQuicPair, 0) }
+func BenchmarkQuicLoss1(b *testing.B)   { benchmarkLoss(b, newQuicPair, 0.01) }
+func BenchmarkQuicLoss5(b *testing.B)   { benchmarkLoss(b, newQuicPair, 0.05) }
+func BenchmarkTcpMuxLoss0(b *testing.B) { benchmarkLoss(b, newTcpMuxPair, 0) }
+func BenchmarkTcpMuxLoss1(b *testing.B) { benchmarkLoss(b, newTcpMuxPair, 0.01) }
+func BenchmarkTcpMuxLoss5(b *testing.B) { benchmarkLoss(b, newTcpMuxPair, 0.05) }
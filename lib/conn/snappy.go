@@ -37,6 +37,11 @@ func (s *SnappyConn) Read(b []byte) (n int, err error) {
 	return s.r.Read(b)
 }
 
+// CloseWrite every write is flushed, shut down the write direction of the conn
+func (s *SnappyConn) CloseWrite() error {
+	return CloseWrite(s.c)
+}
+
 func (s *SnappyConn) Close() error {
 	err := s.w.Close()
 	err2 := s.c.Close()
@@ -0,0 +1,236 @@
+package conn
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/nps_mux"
+)
+
+// Stripe spread the streams of a client over several bridge connections,
+// a new stream goes to the member with the least open streams and dead members are dropped
+type Stripe struct {
+	Session  string // the members of a stripe are from one run of npc
+	Size     int    // negotiated number of members
+	mu       sync.Mutex
+	members  []*stripeMember
+	sampling bool
+}
+
+// stripeSampleInterval is the period the rates of the members are computed
+var stripeSampleInterval = 2 * time.Second
+
+type stripeMember struct {
+	Tunnel
+	addr     string
+	key      []byte
+	streams  atomic.Int32
+	in       atomic.Int64
+	out      atomic.Int64
+	inRate   atomic.Int64
+	outRate  atomic.Int64
+	lastIn   int64 // the last* fields are only used by the sampler
+	lastOut  int64
+	lastTime time.Time
+}
+
+func NewStripe(session string, size int) *Stripe {
+	return &Stripe{Session: session, Size: size}
+}
+
+// Add a bridge connection to the stripe, the key is the session key of the connection
+func (s *Stripe) Add(t Tunnel, addr string, key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.members = append(s.members, &stripeMember{Tunnel: t, addr: addr, key: key, lastTime: time.Now()})
+	if !s.sampling {
+		s.sampling = true
+		go s.sample(stripeSampleInterval)
+	}
+}
+
+// sample computes the rates of the members periodically, it stops when no member is alive
+func (s *Stripe) sample(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.pick()
+		s.mu.Lock()
+		if len(s.members) == 0 {
+			s.sampling = false
+			s.mu.Unlock()
+			return
+		}
+		members := append([]*stripeMember(nil), s.members...)
+		s.mu.Unlock()
+		now := time.Now()
+		for _, m := range members {
+			in, out := m.in.Load(), m.out.Load()
+			if d := now.Sub(m.lastTime).Seconds(); d > 0 {
+				m.inRate.Store(int64(float64(in-m.lastIn) / d))
+				m.outRate.Store(int64(float64(out-m.lastOut) / d))
+			}
+			m.lastIn, m.lastOut, m.lastTime = in, out, now
+		}
+	}
+}
+
+// pick the alive member with the least streams, the closed ones are removed
+func (s *Stripe) pick() *stripeMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *stripeMember
+	alive := s.members[:0]
+	for _, m := range s.members {
+		if m.IsClose() {
+			continue
+		}
+		alive = append(alive, m)
+		if best == nil || m.streams.Load() < best.streams.Load() {
+			best = m
+		}
+	}
+	for i := len(alive); i < len(s.members); i++ {
+		s.members[i] = nil
+	}
+	s.members = alive
+	return best
+}
+
+func (s *Stripe) remove(m *stripeMember) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.members {
+		if v == m {
+			s.members = append(s.members[:i], s.members[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *Stripe) NewConn() (net.Conn, error) {
+	for {
+		m := s.pick()
+		if m == nil {
+			return nil, errors.New("the stripe has no alive connection")
+		}
+		c, err := m.NewConn()
+		if err != nil {
+			// the member is dead, try the others
+			m.Close()
+			s.remove(m)
+			continue
+		}
+		m.streams.Add(1)
+		return &stripeConn{Conn: c, m: m}, nil
+	}
+}
+
+// Accept is not used, npc accepts the streams of every member itself
+func (s *Stripe) Accept() (net.Conn, error) {
+	return nil, errors.New("the stripe does not accept streams")
+}
+
+func (s *Stripe) Addr() net.Addr {
+	if m := s.pick(); m != nil {
+		return m.Addr()
+	}
+	return nil
+}
+
+func (s *Stripe) IsClose() bool {
+	return s.pick() == nil
+}
+
+func (s *Stripe) Close() error {
+	s.mu.Lock()
+	members := s.members
+	s.members = nil
+	s.mu.Unlock()
+	for _, m := range members {
+		m.Close()
+	}
+	return nil
+}
+
+// Len returns the number of alive members
+func (s *Stripe) Len() int {
+	s.pick()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.members)
+}
+
+// Stats returns the streams, flow and the last sampled rates of every member
+func (s *Stripe) Stats() []file.BridgeConnStat {
+	s.pick()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]file.BridgeConnStat, 0, len(s.members))
+	for _, m := range s.members {
+		stats = append(stats, file.BridgeConnStat{
+			Addr:       m.addr,
+			Streams:    int(m.streams.Load()),
+			InletFlow:  m.in.Load(),
+			ExportFlow: m.out.Load(),
+			InletRate:  m.inRate.Load(),
+			ExportRate: m.outRate.Load(),
+		})
+	}
+	return stats
+}
+
+// MuxStats returns the state of the mux of every member
+func (s *Stripe) MuxStats() []nps_mux.Stats {
+	s.mu.Lock()
+	members := append([]*stripeMember(nil), s.members...)
+	s.mu.Unlock()
+	var stats []nps_mux.Stats
+	for _, m := range members {
+		stats = append(stats, MuxStats(m.Tunnel)...)
+	}
+	return stats
+}
+
+// stripeConn count the bytes and the open streams of the member
+type stripeConn struct {
+	net.Conn
+	m    *stripeMember
+	once sync.Once
+}
+
+// Read is the data from npc, the inlet of the server
+func (s *stripeConn) Read(b []byte) (n int, err error) {
+	n, err = s.Conn.Read(b)
+	s.m.in.Add(int64(n))
+	return
+}
+
+func (s *stripeConn) Write(b []byte) (n int, err error) {
+	n, err = s.Conn.Write(b)
+	s.m.out.Add(int64(n))
+	return
+}
+
+// StreamKey returns the session key of the bridge connection carrying the stream, def if it is not from a stripe
+func StreamKey(c net.Conn, def []byte) []byte {
+	if sc, ok := c.(*stripeConn); ok {
+		return sc.m.key
+	}
+	return def
+}
+
+func (s *stripeConn) CloseWrite() error {
+	return CloseWrite(s.Conn)
+}
+
+func (s *stripeConn) Close() error {
+	s.once.Do(func() {
+		s.m.streams.Add(-1)
+	})
+	return s.Conn.Close()
+}
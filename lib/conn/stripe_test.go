@@ -0,0 +1,100 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStripe(t *testing.T) {
+	s := NewStripe("session", 2)
+	var servers []Tunnel
+	for i := 0; i < 2; i++ {
+		client, server := newTcpMuxPair(t, 0)
+		go echo(client)
+		s.Add(server, "member", nil)
+		servers = append(servers, server)
+	}
+
+	// the new streams are spread by the open streams of the members
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		c, err := s.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, st := range s.Stats() {
+		if st.Streams != 2 {
+			t.Fatalf("streams not spread: %+v", s.Stats())
+		}
+	}
+	buf := make([]byte, 1024)
+	if _, err := conns[0].Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conns[0], buf); err != nil {
+		t.Fatal(err)
+	}
+	var in, out int64
+	for _, st := range s.Stats() {
+		in += st.InletFlow
+		out += st.ExportFlow
+	}
+	if in != 1024 || out != 1024 {
+		t.Fatalf("flow in %d out %d", in, out)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+
+	// a dead member is dropped
+	servers[0].Close()
+	time.Sleep(100 * time.Millisecond)
+	if err := roundTrip(s, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 1 || s.IsClose() {
+		t.Fatalf("expected 1 alive member, got %d", s.Len())
+	}
+	servers[1].Close()
+	if _, err := s.NewConn(); err == nil || !s.IsClose() {
+		t.Fatal("expected error without alive member")
+	}
+}
+
+// the rates are sampled by the stripe, polling Stats does not change them
+func TestStripeRate(t *testing.T) {
+	defer func(d time.Duration) { stripeSampleInterval = d }(stripeSampleInterval)
+	stripeSampleInterval = 200 * time.Millisecond
+	s := NewStripe("session", 1)
+	client, server := newTcpMuxPair(t, 0)
+	go echo(client)
+	s.Add(server, "member", nil)
+	defer s.Close()
+	if err := roundTrip(s, 4096); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats()[0].InletRate == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the rate is not sampled")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	a, b := s.Stats()[0], s.Stats()[0]
+	if a.InletRate != b.InletRate || a.ExportRate != b.ExportRate {
+		t.Fatalf("the rates changed by Stats: %+v %+v", a, b)
+	}
+	// the sampler stops without alive member
+	s.Close()
+	time.Sleep(3 * stripeSampleInterval)
+	s.mu.Lock()
+	sampling := s.sampling
+	s.mu.Unlock()
+	if sampling {
+		t.Fatal("the sampler is still running")
+	}
+}
@@ -0,0 +1,123 @@
+package conn
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"ehang.io/nps/lib/nps_mux"
+)
+
+// priority of the streams of a tunnel, high for interactive and bulk for transfers
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityBulk   = "bulk"
+)
+
+// Tunnel is the multiplexed bridge connection between nps and npc,
+// nps_mux over tcp/kcp/websocket or native streams of a quic connection
+type Tunnel interface {
+	NewConn() (net.Conn, error)
+	Accept() (net.Conn, error)
+	Addr() net.Addr
+	IsClose() bool
+	Close() error
+}
+
+type muxTunnel struct {
+	*nps_mux.Mux
+}
+
+func (s muxTunnel) NewConn() (net.Conn, error) {
+	c, err := s.Mux.NewConn()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewTunnel create the tunnel on the verified bridge connection
+func NewTunnel(c net.Conn, tp string, disconnectTime int) Tunnel {
+	if s, ok := c.(*QuicStream); ok {
+		// every mux conn is a new quic stream, no need to multiplex again
+		return s.Session()
+	}
+	return muxTunnel{nps_mux.NewMux(c, tp, disconnectTime)}
+}
+
+// EnableHalfClose let the streams of the mux tunnel send the fin frame, the other side supports it
+func EnableHalfClose(t Tunnel) {
+	if m, ok := t.(muxTunnel); ok {
+		m.Mux.EnableHalfClose()
+	}
+}
+
+// ValidPriority check the priority set on a tunnel, empty is normal
+func ValidPriority(priority string) bool {
+	switch priority {
+	case "", PriorityHigh, PriorityNormal, PriorityBulk:
+		return true
+	}
+	return false
+}
+
+// SetPriority set the priority class of a mux stream before writing, quic streams are not scheduled
+func SetPriority(c net.Conn, priority string) {
+	if s, ok := c.(*stripeConn); ok {
+		c = s.Conn
+	}
+	s, ok := c.(interface{ SetPriority(uint8) })
+	if !ok {
+		return
+	}
+	switch priority {
+	case PriorityHigh:
+		s.SetPriority(nps_mux.PriorityHigh)
+	case PriorityBulk:
+		s.SetPriority(nps_mux.PriorityBulk)
+	}
+}
+
+// ParseWeights parse the bandwidth shares of the high, normal and bulk streams like 8:4:1, empty is the default
+func ParseWeights(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	arr := strings.Split(s, ":")
+	if len(arr) != 3 {
+		return nil, errors.New("the weights should be high:normal:bulk")
+	}
+	weights := make([]int, len(arr))
+	for i, v := range arr {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 1 || n > 100 {
+			return nil, errors.New("the weight should be 1 to 100")
+		}
+		weights[i] = n
+	}
+	return weights, nil
+}
+
+// SetWeights set the bandwidth shares of the high, normal and bulk streams of the tunnel
+func SetWeights(t Tunnel, weights []int) {
+	m, ok := t.(muxTunnel)
+	if !ok || len(weights) != 3 {
+		return
+	}
+	for i, p := range []uint8{nps_mux.PriorityHigh, nps_mux.PriorityNormal, nps_mux.PriorityBulk} {
+		m.SetWeight(p, uint32(weights[i]))
+	}
+}
+
+// MuxStats returns the state of the mux of every bridge connection of the tunnel, quic tunnels have none
+func MuxStats(t Tunnel) []nps_mux.Stats {
+	switch v := t.(type) {
+	case muxTunnel:
+		return []nps_mux.Stats{v.Stats()}
+	case *Stripe:
+		return v.MuxStats()
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package conn
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WsConn is a websocket bridge connection, the mux runs on it as on a tcp connection
+type WsConn struct {
+	*websocket.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	once       sync.Once
+	done       chan struct{}
+}
+
+// NewWsConn wrap the websocket conn with binary frames and the real addresses of the underlying conn,
+// the addresses of websocket.Conn are the urls of the handshake
+func NewWsConn(ws *websocket.Conn, localAddr, remoteAddr net.Addr) *WsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &WsConn{
+		Conn:       ws,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		done:       make(chan struct{}),
+	}
+}
+
+func (s *WsConn) LocalAddr() net.Addr {
+	if s.localAddr != nil {
+		return s.localAddr
+	}
+	return s.Conn.LocalAddr()
+}
+
+func (s *WsConn) RemoteAddr() net.Addr {
+	if s.remoteAddr != nil {
+		return s.remoteAddr
+	}
+	return s.Conn.RemoteAddr()
+}
+
+func (s *WsConn) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return s.Conn.Close()
+}
+
+// Done is closed when the conn is closed, the websocket handler must not return before it
+func (s *WsConn) Done() <-chan struct{} {
+	return s.done
+}
@@ -0,0 +1,52 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWsConn(t *testing.T) {
+	srv := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			remote, _ := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+			c := NewWsConn(ws, nil, remote)
+			go io.Copy(c, c)
+			<-c.Done()
+		},
+	})
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := websocket.NewConfig("ws://"+addr+"/", "http://"+addr)
+	ws, err := websocket.NewClient(cfg, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewWsConn(ws, raw.LocalAddr(), raw.RemoteAddr())
+	defer c.Close()
+	if c.RemoteAddr().String() != addr {
+		t.Fatalf("remote addr %s, want %s", c.RemoteAddr(), addr)
+	}
+	// the mux reads in fixed size chunks, frames must not be bound to a single read
+	if _, err := c.Write([]byte{0, 1, 2, 3, 4, 5}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[5] != 5 {
+		t.Fatalf("unexpected payload %v", buf)
+	}
+}
@@ -0,0 +1,179 @@
+package crypt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CA issue the client certificates for mutual tls of the bridge
+type CA struct {
+	Cert    *x509.Certificate
+	CertPEM []byte
+	key     crypto.Signer
+}
+
+var clientCA *CA
+
+// InitClientCA load the ca from the files, generate and save it if the files do not exist
+func InitClientCA(certFile, keyFile string) (err error) {
+	clientCA, err = LoadOrCreateCA(certFile, keyFile)
+	return
+}
+
+// GetClientCA returns nil if the ca is not initialized
+func GetClientCA() *CA {
+	return clientCA
+}
+
+func LoadOrCreateCA(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		return createCA(certFile, keyFile)
+	} else if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseCA(certPEM, keyPEM)
+}
+
+func parseCA(certPEM, keyPEM []byte) (*CA, error) {
+	b, _ := pem.Decode(certPEM)
+	if b == nil {
+		return nil, errors.New("ca cert is not pem encoded")
+	}
+	c, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !c.IsCA {
+		return nil, errors.New("the cert is not a ca")
+	}
+	k, _ := pem.Decode(keyPEM)
+	if k == nil {
+		return nil, errors.New("ca key is not pem encoded")
+	}
+	var key interface{}
+	switch k.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(k.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(k.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(k.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported ca key type")
+	}
+	return &CA{Cert: c, CertPEM: certPEM, key: signer}, nil
+}
+
+func createCA(certFile, keyFile string) (*CA, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"NPS Org"}, CommonName: "NPS Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365 * 20),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	return parseCA(certPEM, keyPEM)
+}
+
+// Pool returns the pool to verify the client certificates
+func (s *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Cert)
+	return pool
+}
+
+// Issue a client certificate, the key is generated here and never stored by nps
+func (s *CA) Issue(commonName string, days int) (certPEM, keyPEM []byte, c *x509.Certificate, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return
+	}
+	if days <= 0 {
+		days = 365
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"NPS Org"}, CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24 * time.Duration(days)),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, s.Cert, &priv.PublicKey, s.key)
+	if err != nil {
+		return
+	}
+	if c, err = x509.ParseCertificate(der); err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return
+}
+
+// CertSerial returns the hex serial number, used to map a certificate to the client
+func CertSerial(c *x509.Certificate) string {
+	return hex.EncodeToString(c.SerialNumber.Bytes())
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,45 @@
+package crypt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	ca, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second load must use the saved ca
+	loaded, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Cert.Equal(ca.Cert) {
+		t.Fatal("the saved ca is not loaded")
+	}
+	certPEM, keyPEM, c, err := loaded.Issue("npc-1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject.CommonName != "npc-1" || CertSerial(c) == "" {
+		t.Fatalf("unexpected cert %s %s", c.Subject.CommonName, CertSerial(c))
+	}
+	if _, err := tls.X509KeyPair(append(certPEM, keyPEM...), append(certPEM, keyPEM...)); err != nil {
+		t.Fatal("the bundle can not be loaded by npc", err)
+	}
+	if _, err := c.Verify(x509.VerifyOptions{Roots: ca.Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadOrCreateCA(filepath.Join(dir, "other.pem"), filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Verify(x509.VerifyOptions{Roots: other.Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err == nil {
+		t.Fatal("the cert must not be verified by another ca")
+	}
+}
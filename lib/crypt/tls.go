@@ -3,14 +3,16 @@ package crypt
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
-	"log"
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/astaxie/beego/logs"
@@ -20,14 +22,44 @@ var (
 	cert tls.Certificate
 )
 
-func InitTls() {
-	c, k, err := generateKeyPair("NPS Org")
-	if err == nil {
-		cert, err = tls.X509KeyPair(c, k)
+// InitTls load the bridge key pair, it is generated and saved on the first start
+// so the fingerprint pinned by npc does not change after restart
+func InitTls(certFile, keyFile string) error {
+	c, err := os.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		var k []byte
+		if c, k, err = generateKeyPair("NPS Org"); err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+			return err
+		}
+		if err = os.WriteFile(certFile, c, 0644); err != nil {
+			return err
+		}
+		if err = os.WriteFile(keyFile, k, 0600); err != nil {
+			return err
+		}
+		logs.Info("generate the bridge certificate %s", certFile)
+	} else if err != nil {
+		return err
 	}
-	if err != nil {
-		log.Fatalln("Error initializing crypto certs", err)
+	cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	return err
+}
+
+// GetCertFingerprint returns the sha256 fingerprint of the bridge certificate
+func GetCertFingerprint() string {
+	if len(cert.Certificate) == 0 {
+		return ""
 	}
+	return Fingerprint(cert.Certificate[0])
+}
+
+// Fingerprint returns the lowercase hex sha256 of the der certificate
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
 }
 
 func GetCert() tls.Certificate {
@@ -46,10 +78,7 @@ func NewTlsServerConn(conn net.Conn) net.Conn {
 }
 
 func NewTlsClientConn(conn net.Conn) net.Conn {
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	return tls.Client(conn, conf)
+	return tls.Client(conn, ClientTlsConfig(""))
 }
 
 func generateKeyPair(CommonName string) (rawCert, rawKey []byte, err error) {
@@ -0,0 +1,185 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// ServerVerifier verify the bridge certificate on npc by a pinned fingerprint, a ca bundle or trust on first use
+type ServerVerifier struct {
+	Fingerprint    string
+	Roots          *x509.CertPool
+	KnownHostsFile string
+	mu             sync.Mutex
+	trusted        sync.Map // verified "server fingerprint" and fingerprints, the crypt conn has no server address
+}
+
+var (
+	serverVerifier *ServerVerifier
+	insecureOnce   sync.Once
+)
+
+// NewServerVerifier returns nil if nothing is configured, the server is not verified in that case
+func NewServerVerifier(fingerprint, caFile, knownHostsFile string) (*ServerVerifier, error) {
+	if fingerprint == "" && caFile == "" && knownHostsFile == "" {
+		return nil, nil
+	}
+	v := &ServerVerifier{Fingerprint: NormalizeFingerprint(fingerprint), KnownHostsFile: knownHostsFile}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		v.Roots = x509.NewCertPool()
+		if !v.Roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	return v, nil
+}
+
+func SetServerVerifier(v *ServerVerifier) {
+	serverVerifier = v
+}
+
+// VerifiesServer reports whether the server certificate is verified
+func VerifiesServer() bool {
+	return serverVerifier != nil
+}
+
+// NormalizeFingerprint accept the fingerprint with sha256: prefix, colons or uppercase
+func NormalizeFingerprint(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "sha256:")
+	return strings.Replace(s, ":", "", -1)
+}
+
+// ClientTlsConfig returns the config to dial the bridge, the server address is the key of the known hosts
+func ClientTlsConfig(server string) *tls.Config {
+	v := serverVerifier
+	conf := &tls.Config{
+		// the certificate is verified by VerifyConnection
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("the server has no certificate")
+			}
+			if v == nil {
+				insecureOnce.Do(func() {
+					logs.Warn("the server certificate is not verified, fingerprint %s, set tls_fingerprint, tls_ca_file or tls_known_hosts to verify it", Fingerprint(cs.PeerCertificates[0].Raw))
+				})
+				return nil
+			}
+			return v.verify(server, cs.PeerCertificates)
+		},
+	}
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		conf.ServerName = host
+	}
+	return conf
+}
+
+func (s *ServerVerifier) verify(server string, certs []*x509.Certificate) error {
+	fp := Fingerprint(certs[0].Raw)
+	// the crypt conn accepts any certificate verified by a bridge connection
+	if _, ok := s.trusted.Load(server + " " + fp); ok || (server == "" && s.isTrusted(fp)) {
+		return nil
+	}
+	switch {
+	case s.Fingerprint != "":
+		if fp != s.Fingerprint {
+			return fmt.Errorf("the server fingerprint %s does not match the pinned fingerprint", fp)
+		}
+	case s.Roots != nil:
+		if server == "" {
+			return errors.New("the server certificate is not verified by the bridge connection")
+		}
+		opts := x509.VerifyOptions{Roots: s.Roots, Intermediates: x509.NewCertPool()}
+		if host, _, err := net.SplitHostPort(server); err == nil {
+			opts.DNSName = host
+		}
+		for _, c := range certs[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return err
+		}
+	default:
+		if server == "" {
+			return errors.New("the server certificate is not verified by the bridge connection")
+		}
+		if err := s.checkKnownHost(server, fp); err != nil {
+			return err
+		}
+	}
+	s.trusted.Store(server+" "+fp, true)
+	s.trusted.Store(fp, true)
+	return nil
+}
+
+func (s *ServerVerifier) isTrusted(fp string) bool {
+	_, ok := s.trusted.Load(fp)
+	return ok
+}
+
+// checkKnownHost trust the first fingerprint of the server and save it, reject if it changes later
+func (s *ServerVerifier) checkKnownHost(server, fp string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	known, err := readKnownHosts(s.KnownHostsFile)
+	if err != nil {
+		return err
+	}
+	if v, ok := known[server]; ok {
+		if v != fp {
+			return fmt.Errorf("the fingerprint of %s changed to %s, remove it from %s if the server certificate is replaced", server, fp, s.KnownHostsFile)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.KnownHostsFile), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.KnownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", server, fp); err != nil {
+		return err
+	}
+	logs.Warn("trust the server %s on first use, fingerprint %s, saved to %s", server, fp, s.KnownHostsFile)
+	return nil
+}
+
+// readKnownHosts read lines of "server_addr fingerprint", # starts a comment
+func readKnownHosts(path string) (map[string]string, error) {
+	known := make(map[string]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if arr := strings.Fields(line); len(arr) >= 2 {
+			known[arr[0]] = NormalizeFingerprint(arr[1])
+		}
+	}
+	return known, scanner.Err()
+}
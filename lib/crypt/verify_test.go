@@ -0,0 +1,106 @@
+package crypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T) *x509.Certificate {
+	c, _, err := generateKeyPair("NPS Org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := pem.Decode(c)
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestServerVerifierFingerprint(t *testing.T) {
+	cert, other := newTestCert(t), newTestCert(t)
+	fp := Fingerprint(cert.Raw)
+	v, err := NewServerVerifier("SHA256:"+strings.ToUpper(fp), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify("127.0.0.1:8025", []*x509.Certificate{cert}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify("127.0.0.1:8025", []*x509.Certificate{other}); err == nil {
+		t.Fatal("a different certificate must be rejected")
+	}
+	// the crypt conn has no server address
+	if err := v.verify("", []*x509.Certificate{cert}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerVerifierKnownHosts(t *testing.T) {
+	cert, other := newTestCert(t), newTestCert(t)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	v, _ := NewServerVerifier("", "", path)
+	if err := v.verify("", []*x509.Certificate{cert}); err == nil {
+		t.Fatal("the crypt conn must not trust a certificate not seen by the bridge connection")
+	}
+	if err := v.verify("1.1.1.1:8025", []*x509.Certificate{cert}); err != nil {
+		t.Fatal("first use must be trusted", err)
+	}
+	if b, _ := os.ReadFile(path); !strings.Contains(string(b), "1.1.1.1:8025 "+Fingerprint(cert.Raw)) {
+		t.Fatalf("the fingerprint is not saved: %s", b)
+	}
+	// a new process reads the saved fingerprint
+	v, _ = NewServerVerifier("", "", path)
+	if err := v.verify("1.1.1.1:8025", []*x509.Certificate{other}); err == nil {
+		t.Fatal("a changed certificate must be rejected")
+	}
+	if err := v.verify("1.1.1.1:8025", []*x509.Certificate{cert}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify("2.2.2.2:8025", []*x509.Certificate{other}); err != nil {
+		t.Fatal("another server must be trusted on first use", err)
+	}
+}
+
+func TestServerVerifierCa(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewServerVerifier("", filepath.Join(dir, "ca.pem"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify("127.0.0.1:8025", []*x509.Certificate{newTestCert(t)}); err == nil {
+		t.Fatal("a self signed certificate must be rejected")
+	}
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := newSerial()
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"nps.example.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca.Cert, &priv.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	if err := v.verify("nps.example.com:8025", []*x509.Certificate{cert}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify("other.example.com:8025", []*x509.Certificate{cert}); err == nil {
+		t.Fatal("the server name must be verified")
+	}
+}
@@ -43,6 +43,35 @@ func InitDaemon(f string, runPath string, pidPath string) {
 	case "reload":
 		reload(f, pidPath)
 		os.Exit(0)
+	case "upgrade":
+		upgrade(f, pidPath)
+		os.Exit(0)
+	}
+}
+
+// SavePid write the pid of the running process, used by reload and upgrade
+func SavePid(f string, pidPath string) {
+	ioutil.WriteFile(filepath.Join(pidPath, f+".pid"), []byte(strconv.Itoa(os.Getpid())), 0600)
+}
+
+// upgrade 通知运行中的进程平滑重启，新进程接管监听的端口
+func upgrade(f string, pidPath string) {
+	if common.IsWindows() {
+		log.Println("graceful restart is not supported on windows")
+		return
+	}
+	if !status(f, pidPath) {
+		log.Println("upgrade fail, the process is not running")
+		return
+	}
+	b, err := ioutil.ReadFile(filepath.Join(pidPath, f+".pid"))
+	if err != nil {
+		log.Fatalln("upgrade error,pid file does not exist")
+	}
+	if exec.Command("/bin/sh", "-c", `kill -USR2 `+string(b)).Run() == nil {
+		log.Println("upgrade signal sent, the new process takes over the listening ports")
+	} else {
+		log.Println("upgrade fail")
 	}
 }
 
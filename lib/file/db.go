@@ -2,9 +2,11 @@ package file
 
 import (
 	"crypto/md5"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 
@@ -26,10 +28,14 @@ var (
 func GetDb() *DbUtils {
 	once.Do(func() {
 		jsonDb := NewJsonDb(common.GetRunPath())
+		if store != nil {
+			jsonDb.Store = store
+		}
 		jsonDb.LoadClientFromJsonFile()
 		jsonDb.LoadTaskFromJsonFile()
 		jsonDb.LoadHostFromJsonFile()
 		jsonDb.LoadGlobalFromJsonFile()
+		jsonDb.LoadTemplateFromJsonFile()
 		Db = &DbUtils{JsonDb: jsonDb}
 	})
 	return Db
@@ -77,7 +83,7 @@ func (s *DbUtils) GetIdByVerifyKey(vKey string, addr string) (id int, err error)
 	var exist bool
 	s.JsonDb.Clients.Range(func(key, value interface{}) bool {
 		v := value.(*Client)
-		if common.Getverifyval(v.VerifyKey) == vKey && v.Status {
+		if v.Status && v.MatchKey(func(key string) bool { return common.Getverifyval(key) == vKey }) {
 			v.Addr = common.GetIpByAddr(addr)
 			id = v.Id
 			exist = true
@@ -91,6 +97,41 @@ func (s *DbUtils) GetIdByVerifyKey(vKey string, addr string) (id int, err error)
 	return 0, errors.New("not found")
 }
 
+// GetIdByAuth find the client by the vkey signing the answer of the challenge
+func (s *DbUtils) GetIdByAuth(verify func(vkey string) bool, addr string) (id int, err error) {
+	s.JsonDb.Clients.Range(func(key, value interface{}) bool {
+		v := value.(*Client)
+		if v.Status && v.MatchKey(func(key string) bool { return key != "" && verify(key) }) {
+			v.Addr = common.GetIpByAddr(addr)
+			id = v.Id
+			return false
+		}
+		return true
+	})
+	if id == 0 {
+		return 0, errors.New("not found")
+	}
+	return
+}
+
+// GetIdByCert map the verified client certificate to the client by subject and serial number
+func (s *DbUtils) GetIdByCert(cert *x509.Certificate, addr string) (id int, err error) {
+	serial := crypt.CertSerial(cert)
+	s.JsonDb.Clients.Range(func(key, value interface{}) bool {
+		v := value.(*Client)
+		if v.CertSerial != "" && v.CertSerial == serial && v.CertCommonName() == cert.Subject.CommonName && v.Status {
+			v.Addr = common.GetIpByAddr(addr)
+			id = v.Id
+			return false
+		}
+		return true
+	})
+	if id == 0 {
+		return 0, errors.New("the certificate is revoked or not issued to any client")
+	}
+	return
+}
+
 func (s *DbUtils) NewTask(t *Tunnel) (err error) {
 	s.JsonDb.Tasks.Range(func(key, value interface{}) bool {
 		v := value.(*Tunnel)
@@ -264,7 +305,7 @@ func (s *DbUtils) VerifyVkey(vkey string, id int) (res bool) {
 	res = true
 	s.JsonDb.Clients.Range(func(key, value interface{}) bool {
 		v := value.(*Client)
-		if v.VerifyKey == vkey && v.Id != id {
+		if v.Id != id && (v.VerifyKey == vkey || v.OldKeyValid() && v.OldVerifyKey == vkey) {
 			res = false
 			return false
 		}
@@ -317,10 +358,15 @@ func (s *DbUtils) GetGlobal() (c *Glob) {
 }
 
 func (s *DbUtils) GetClientIdByVkey(vkey string) (id int, err error) {
+	return s.GetClientIdByKey(func(key string) bool { return crypt.Md5(key) == vkey })
+}
+
+// GetClientIdByKey 查找 vkey 匹配的客户端，match 检查 vkey 或轮换前的 vkey
+func (s *DbUtils) GetClientIdByKey(match func(key string) bool) (id int, err error) {
 	var exist bool
 	s.JsonDb.Clients.Range(func(key, value interface{}) bool {
 		v := value.(*Client)
-		if crypt.Md5(v.VerifyKey) == vkey {
+		if v.MatchKey(match) {
 			exist = true
 			id = v.Id
 			return false
@@ -338,7 +384,7 @@ func (s *DbUtils) GetClientByVkey(vkey string) (c *Client, err error) {
 	var exist bool
 	s.JsonDb.Clients.Range(func(key, value interface{}) bool {
 		v := value.(*Client)
-		if fmt.Sprintf("%x", md5.Sum([]byte(v.VerifyKey))) == vkey {
+		if v.MatchKey(func(key string) bool { return fmt.Sprintf("%x", md5.Sum([]byte(key))) == vkey }) {
 			exist = true
 			c = v
 			return false
@@ -412,3 +458,79 @@ func (s *DbUtils) GetInfoByHost(host string, r *http.Request) (h *Host, err erro
 	err = errors.New("The host could not be parsed")
 	return
 }
+
+func (s *DbUtils) NewTemplate(t *Template) error {
+	if t.Name == "" {
+		return errors.New("template name can not be empty")
+	}
+	if s.IsTemplateNameExist(t.Name, t.Id) {
+		return errors.New("template name has exist")
+	}
+	if t.Id == 0 {
+		t.Id = int(s.JsonDb.GetTemplateId())
+	}
+	s.JsonDb.Templates.Store(t.Id, t)
+	s.JsonDb.StoreTemplateToJsonFile()
+	return nil
+}
+
+func (s *DbUtils) UpdateTemplate(t *Template) error {
+	if s.IsTemplateNameExist(t.Name, t.Id) {
+		return errors.New("template name has exist")
+	}
+	s.JsonDb.Templates.Store(t.Id, t)
+	s.JsonDb.StoreTemplateToJsonFile()
+	return nil
+}
+
+func (s *DbUtils) DelTemplate(id int) error {
+	s.JsonDb.Templates.Delete(id)
+	s.JsonDb.StoreTemplateToJsonFile()
+	return nil
+}
+
+func (s *DbUtils) IsTemplateNameExist(name string, id int) (exist bool) {
+	s.JsonDb.Templates.Range(func(key, value interface{}) bool {
+		v := value.(*Template)
+		if v.Name == name && v.Id != id {
+			exist = true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+func (s *DbUtils) GetTemplate(id int) (t *Template, err error) {
+	if v, ok := s.JsonDb.Templates.Load(id); ok {
+		t = v.(*Template)
+		return
+	}
+	err = errors.New("template not found")
+	return
+}
+
+func (s *DbUtils) GetTemplateList(start, length int, search string) ([]*Template, int) {
+	all := make([]*Template, 0)
+	s.JsonDb.Templates.Range(func(key, value interface{}) bool {
+		v := value.(*Template)
+		if search != "" && !(v.Id == common.GetIntNoErrByStr(search) || strings.Contains(v.Name, search) || strings.Contains(v.Remark, search)) {
+			return true
+		}
+		all = append(all, v)
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].Id < all[j].Id })
+	cnt := len(all)
+	if start < 0 {
+		start = 0
+	}
+	if length <= 0 || start >= cnt {
+		return []*Template{}, cnt
+	}
+	end := start + length
+	if end > cnt {
+		end = cnt
+	}
+	return all[start:end], cnt
+}
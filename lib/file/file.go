@@ -1,10 +1,10 @@
 package file
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"github.com/astaxie/beego/logs"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -16,32 +16,45 @@ import (
 
 func NewJsonDb(runPath string) *JsonDb {
 	return &JsonDb{
-		RunPath:        runPath,
-		TaskFilePath:   filepath.Join(runPath, "conf", "tasks.json"),
-		HostFilePath:   filepath.Join(runPath, "conf", "hosts.json"),
-		ClientFilePath: filepath.Join(runPath, "conf", "clients.json"),
-		GlobalFilePath: filepath.Join(runPath, "conf", "global.json"),
+		RunPath:          runPath,
+		TaskFilePath:     filepath.Join(runPath, "conf", "tasks.json"),
+		HostFilePath:     filepath.Join(runPath, "conf", "hosts.json"),
+		ClientFilePath:   filepath.Join(runPath, "conf", "clients.json"),
+		GlobalFilePath:   filepath.Join(runPath, "conf", "global.json"),
+		TemplateFilePath: filepath.Join(runPath, "conf", "templates.json"),
+		Store:            &FileStore{Dir: filepath.Join(runPath, "conf")},
 	}
 }
 
 type JsonDb struct {
-	Tasks            sync.Map
-	Hosts            sync.Map
-	HostsTmp         sync.Map
-	Clients          sync.Map
-	Global           *Glob
-	RunPath          string
-	ClientIncreaseId int32  //client increased id
-	TaskIncreaseId   int32  //task increased id
-	HostIncreaseId   int32  //host increased id
-	TaskFilePath     string //task file path
-	HostFilePath     string //host file path
-	ClientFilePath   string //client file path
-	GlobalFilePath   string //global file path
+	Tasks              sync.Map
+	Hosts              sync.Map
+	HostsTmp           sync.Map
+	Clients            sync.Map
+	Templates          sync.Map
+	Global             *Glob
+	RunPath            string
+	ClientIncreaseId   int32             //client increased id
+	TaskIncreaseId     int32             //task increased id
+	HostIncreaseId     int32             //host increased id
+	TemplateIncreaseId int32             //template increased id
+	TaskFilePath       string            //task file path
+	HostFilePath       string            //host file path
+	ClientFilePath     string            //client file path
+	GlobalFilePath     string            //global file path
+	TemplateFilePath   string            //template file path
+	Store              Store             // the json files are kept in the store, by the base name of the paths
+	OnStore            func(name string) // called after a file is saved, the other nodes of a cluster reload it
+	OnMerge            func(name string) // called after the changes of other nodes are merged into a saved file, it should be reloaded
+	ReadOnly           atomic.Bool       // the files are not saved any more, set when a new process takes over
+	idStep             int32             // the ids of the records created by this node, see SetIdStep
+	idOffset           int32
+	bases              map[string]*recordBase
+	baseMu             sync.Mutex
 }
 
 func (s *JsonDb) LoadTaskFromJsonFile() {
-	loadSyncMapFromFile(s.TaskFilePath, func(v string) {
+	s.loadRecords(s.TaskFilePath, true, func(v string) {
 		var err error
 		post := new(Tunnel)
 		if json.Unmarshal([]byte(v), &post) != nil {
@@ -58,7 +71,7 @@ func (s *JsonDb) LoadTaskFromJsonFile() {
 }
 
 func (s *JsonDb) LoadClientFromJsonFile() {
-	loadSyncMapFromFile(s.ClientFilePath, func(v string) {
+	s.loadRecords(s.ClientFilePath, true, func(v string) {
 		post := new(Client)
 		if json.Unmarshal([]byte(v), &post) != nil {
 			return
@@ -78,7 +91,7 @@ func (s *JsonDb) LoadClientFromJsonFile() {
 }
 
 func (s *JsonDb) LoadHostFromJsonFile() {
-	loadSyncMapFromFile(s.HostFilePath, func(v string) {
+	s.loadRecords(s.HostFilePath, true, func(v string) {
 		var err error
 		post := new(Host)
 		if json.Unmarshal([]byte(v), &post) != nil {
@@ -94,8 +107,21 @@ func (s *JsonDb) LoadHostFromJsonFile() {
 	})
 }
 
+func (s *JsonDb) LoadTemplateFromJsonFile() {
+	s.loadRecords(s.TemplateFilePath, true, func(v string) {
+		post := new(Template)
+		if json.Unmarshal([]byte(v), &post) != nil {
+			return
+		}
+		s.Templates.Store(post.Id, post)
+		if post.Id > int(s.TemplateIncreaseId) {
+			s.TemplateIncreaseId = int32(post.Id)
+		}
+	})
+}
+
 func (s *JsonDb) LoadGlobalFromJsonFile() {
-	loadSyncMapFromFileWithSingleJson(s.GlobalFilePath, func(v string) {
+	s.loadRecords(s.GlobalFilePath, false, func(v string) {
 		post := new(Glob)
 		if json.Unmarshal([]byte(v), &post) != nil {
 			return
@@ -117,7 +143,7 @@ var hostLock sync.Mutex
 
 func (s *JsonDb) StoreHostToJsonFile() {
 	hostLock.Lock()
-	storeSyncMapToFile(s.Hosts, s.HostFilePath)
+	s.storeRecords(&s.Hosts, s.HostFilePath)
 	hostLock.Unlock()
 }
 
@@ -125,7 +151,7 @@ var taskLock sync.Mutex
 
 func (s *JsonDb) StoreTasksToJsonFile() {
 	taskLock.Lock()
-	storeSyncMapToFile(s.Tasks, s.TaskFilePath)
+	s.storeRecords(&s.Tasks, s.TaskFilePath)
 	taskLock.Unlock()
 }
 
@@ -133,68 +159,81 @@ var clientLock sync.Mutex
 
 func (s *JsonDb) StoreClientsToJsonFile() {
 	clientLock.Lock()
-	storeSyncMapToFile(s.Clients, s.ClientFilePath)
+	s.storeRecords(&s.Clients, s.ClientFilePath)
 	clientLock.Unlock()
 }
 
+var templateLock sync.Mutex
+
+func (s *JsonDb) StoreTemplateToJsonFile() {
+	templateLock.Lock()
+	s.storeRecords(&s.Templates, s.TemplateFilePath)
+	templateLock.Unlock()
+}
+
 var globalLock sync.Mutex
 
 func (s *JsonDb) StoreGlobalToJsonFile() {
 	globalLock.Lock()
-	storeGlobalToFile(s.Global, s.GlobalFilePath)
+	s.storeGlobal(s.GlobalFilePath)
 	globalLock.Unlock()
 }
 
 func (s *JsonDb) GetClientId() int32 {
-	return atomic.AddInt32(&s.ClientIncreaseId, 1)
+	return s.nextId(&s.ClientIncreaseId)
 }
 
 func (s *JsonDb) GetTaskId() int32 {
-	return atomic.AddInt32(&s.TaskIncreaseId, 1)
+	return s.nextId(&s.TaskIncreaseId)
 }
 
 func (s *JsonDb) GetHostId() int32 {
-	return atomic.AddInt32(&s.HostIncreaseId, 1)
+	return s.nextId(&s.HostIncreaseId)
 }
 
-func loadSyncMapFromFile(filePath string, f func(value string)) {
-	if !common.FileExists(filePath) {
-		return
+func (s *JsonDb) GetTemplateId() int32 {
+	return s.nextId(&s.TemplateIncreaseId)
+}
+
+// loadRecords read the file from the store, split is false for a file of one json
+func (s *JsonDb) loadRecords(filePath string, split bool, f func(value string)) {
+	var b []byte
+	var err error
+	if cs, ok := s.Store.(CasStore); ok && split {
+		var version string
+		b, version, err = cs.LoadVersion(filepath.Base(filePath))
+		s.setBase(filepath.Base(filePath), &recordBase{version: version, records: splitRecords(b)})
+	} else {
+		b, err = s.Store.Load(filepath.Base(filePath))
 	}
-	b, err := common.ReadAllFromFile(filePath)
 	if err != nil {
 		panic(err)
 	}
+	if b == nil {
+		return
+	}
+	if !split {
+		f(string(b))
+		return
+	}
 	for _, v := range strings.Split(string(b), "\n"+common.CONN_DATA_SEQ) {
 		f(v)
 	}
 }
 
-func loadSyncMapFromFileWithSingleJson(filePath string, f func(value string)) {
-	if !common.FileExists(filePath) {
+func (s *JsonDb) storeRecords(m *sync.Map, filePath string) {
+	if s.ReadOnly.Load() {
 		return
 	}
-
-	b, err := common.ReadAllFromFile(filePath)
-	if err != nil {
-		panic(err)
+	if cs, ok := s.Store.(CasStore); ok {
+		s.writeRecords(cs, filePath, records(m))
+		return
 	}
-
-	f(string(b))
+	s.write(filePath, records(m))
 }
 
-func storeSyncMapToFile(m sync.Map, filePath string) {
-	file, err := os.Create(filePath + ".tmp")
-	// first create a temporary file to store
-	if err != nil {
-		logs.Error("store to file: create tmp file error: %v", err)
-		return
-	}
-	defer func() {
-		file.Close()
-		os.Remove(filePath + ".tmp")
-	}()
-	var writeErr bool
+func records(m *sync.Map) []byte {
+	var buf bytes.Buffer
 	m.Range(func(key, value interface{}) bool {
 		var b []byte
 		var err error
@@ -217,64 +256,66 @@ func storeSyncMapToFile(m sync.Map, filePath string) {
 				return true
 			}
 			b, err = json.Marshal(obj)
+		case *Template:
+			b, err = json.Marshal(value.(*Template))
 		default:
 			return true
 		}
 		if err != nil {
 			return true
 		}
-		_, err = file.Write(b)
-		if err != nil {
-			logs.Error("store to file: write error: %v", err)
-			writeErr = true
-			return false
-		}
-		_, err = file.Write([]byte("\n" + common.CONN_DATA_SEQ))
-		if err != nil {
-			logs.Error("store to file: write separator error: %v", err)
-			writeErr = true
-			return false
-		}
+		buf.Write(b)
+		buf.WriteString("\n" + common.CONN_DATA_SEQ)
 		return true
 	})
-	if writeErr {
-		return
-	}
-	_ = file.Sync()
-	_ = file.Close()
-	err = os.Rename(filePath+".tmp", filePath)
-	if err != nil {
-		logs.Error(err, "store to file err, data will lost")
-	}
+	return buf.Bytes()
 }
 
-func storeGlobalToFile(m *Glob, filePath string) {
-	file, err := os.Create(filePath + ".tmp")
-	// first create a temporary file to store
-	if err != nil {
-		logs.Error("store global to file: create tmp file error: %v", err)
+func (s *JsonDb) storeGlobal(filePath string) {
+	if s.ReadOnly.Load() {
 		return
 	}
-	defer func() {
-		file.Close()
-		os.Remove(filePath + ".tmp")
-	}()
-
-	var b []byte
-	b, err = json.Marshal(m)
+	b, err := json.Marshal(s.Global)
 	if err != nil {
 		logs.Error("store global to file: marshal error: %v", err)
 		return
 	}
-	_, err = file.Write(b)
-	if err != nil {
-		logs.Error("store global to file: write error: %v", err)
+	s.write(filePath, b)
+}
+
+func (s *JsonDb) write(filePath string, b []byte) {
+	name := filepath.Base(filePath)
+	if err := s.Store.Save(name, b); err != nil {
+		logs.Error(err, "store to file err, data will lost")
 		return
 	}
-	_ = file.Sync()
-	_ = file.Close()
-	err = os.Rename(filePath+".tmp", filePath)
-	if err != nil {
-		logs.Error(err, "store to file err, data will lost")
+	if s.OnStore != nil {
+		s.OnStore(name)
 	}
 }
+
+// Snapshot 停止保存后写入当前的数据，平滑重启的新进程从文件加载，之后本进程不会覆盖新进程保存的文件
+func (s *JsonDb) Snapshot() {
+	for _, l := range []*sync.Mutex{&hostLock, &taskLock, &clientLock, &templateLock, &globalLock} {
+		l.Lock()
+		defer l.Unlock()
+	}
+	s.ReadOnly.Store(true)
+	s.write(s.HostFilePath, records(&s.Hosts))
+	s.write(s.TaskFilePath, records(&s.Tasks))
+	s.write(s.ClientFilePath, records(&s.Clients))
+	s.write(s.TemplateFilePath, records(&s.Templates))
+	if b, err := json.Marshal(s.Global); err == nil {
+		s.write(s.GlobalFilePath, b)
+	}
+}
+
+// Resume 新进程没有接管时恢复保存，期间的修改一起保存
+func (s *JsonDb) Resume() {
+	s.ReadOnly.Store(false)
+	s.StoreHostToJsonFile()
+	s.StoreTasksToJsonFile()
+	s.StoreClientsToJsonFile()
+	s.StoreTemplateToJsonFile()
+	s.StoreGlobalToJsonFile()
+}
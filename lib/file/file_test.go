@@ -0,0 +1,53 @@
+package file
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+type memStore struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (s *memStore) Load(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []byte(s.files[name]), nil
+}
+
+func (s *memStore) Save(name string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = string(b)
+	return nil
+}
+
+func (s *memStore) get(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[name]
+}
+
+func TestSnapshot(t *testing.T) {
+	store := &memStore{files: make(map[string]string)}
+	db := NewJsonDb(t.TempDir())
+	db.Store = store
+	db.Clients.Store(1, &Client{Id: 1, VerifyKey: "a", Flow: new(Flow), Cnf: new(Config)})
+	db.Snapshot()
+	if !strings.Contains(store.get("clients.json"), `"VerifyKey":"a"`) {
+		t.Fatalf("the snapshot is not saved: %s", store.get("clients.json"))
+	}
+	// the changes after the snapshot are not saved over the files of the new process
+	db.Clients.Store(2, &Client{Id: 2, VerifyKey: "b", Flow: new(Flow), Cnf: new(Config)})
+	db.StoreClientsToJsonFile()
+	if strings.Contains(store.get("clients.json"), `"VerifyKey":"b"`) {
+		t.Fatal("saved after the snapshot")
+	}
+	// the new process is not started, the changes are saved
+	db.Resume()
+	if !strings.Contains(store.get("clients.json"), `"VerifyKey":"b"`) {
+		t.Fatal("the changes are not saved after resume")
+	}
+}
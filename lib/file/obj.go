@@ -1,11 +1,14 @@
 package file
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/rate"
 	"github.com/pkg/errors"
 )
@@ -55,13 +58,33 @@ type Client struct {
 	BlackIpList     []string
 	CreateTime      string
 	LastOnlineTime  string
-	IpWhite         bool     // 是否启用ip白名单
-	IpWhitePass     string   // ip授权密码
-	IpWhiteList     []string // ip白名单
-	ExpireTime      string   // 到期时间,留空表示永不过期,格式 2006-01-02 15:04:05
+	IpWhite         bool             // 是否启用ip白名单
+	IpWhitePass     string           // ip授权密码
+	IpWhiteList     []string         // ip白名单
+	ExpireTime      string           // 到期时间,留空表示永不过期,格式 2006-01-02 15:04:05
+	AuthMode        string           // 认证方式 vkey(默认)、cert、both
+	CertSerial      string           // 当前有效的客户端证书序列号,重新签发或吊销后旧证书失效
+	CertNotAfter    string           // 客户端证书到期时间
+	BridgeConns     int              // 允许 npc 建立的桥接数据连接数,0和1表示不开启多连接
+	Weights         string           // high/normal/bulk 优先级的带宽份额,如 8:4:1,空则使用默认
+	BridgeStats     []BridgeConnStat `json:"-"` // 每条桥接数据连接的状态,仅用于展示
+	OldVerifyKey    string           // 轮换前的 vkey,到 OldKeyExpire 之前仍可连接
+	OldKeyExpire    string           // 旧 vkey 的失效时间
+	KeyRotated      bool             // npc 已用新的 vkey 连接
+	RotateStatus    string           `json:"-"` // vkey 轮换状态,仅用于展示
 	sync.RWMutex
 }
 
+// BridgeConnStat 多连接桥接中每条连接的流数和吞吐
+type BridgeConnStat struct {
+	Addr       string
+	Streams    int
+	InletFlow  int64
+	ExportFlow int64
+	InletRate  int64 // bytes/s
+	ExportRate int64
+}
+
 func NewClient(vKey string, noStore bool, noDisplay bool) *Client {
 	return &Client{
 		Cnf:       new(Config),
@@ -81,6 +104,123 @@ func NewClient(vKey string, noStore bool, noDisplay bool) *Client {
 	}
 }
 
+const (
+	AuthModeVkey = "vkey"
+	AuthModeCert = "cert"
+	AuthModeBoth = "both"
+)
+
+// GetAuthMode returns vkey for the clients created before the auth mode
+func (s *Client) GetAuthMode() string {
+	if s.AuthMode == "" {
+		return AuthModeVkey
+	}
+	return s.AuthMode
+}
+
+// vkey 轮换状态
+const (
+	RotatePending = "pending" // 新旧 vkey 都有效,npc 还没有用新的 vkey 连接
+	RotateDone    = "done"    // npc 已用新的 vkey 连接
+	RotateExpired = "expired" // 旧 vkey 已失效,npc 没有用新的 vkey 连接过
+)
+
+// ErrRotatePending 上一次轮换还没有完成
+var ErrRotatePending = errors.New("the last vkey rotation is pending, npc has not connected with the new vkey")
+
+// RotateKey 更换 vkey,旧的 vkey 在 grace 之内仍然可以连接。
+// 上一次轮换未完成时拒绝,否则仍使用最早 vkey 的 npc 无法连接
+func (s *Client) RotateKey(vkey string, grace time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.OldVerifyKey != "" && !s.KeyRotated && s.oldKeyValid() {
+		return ErrRotatePending
+	}
+	s.OldVerifyKey = s.VerifyKey
+	s.OldKeyExpire = time.Now().Add(grace).Format("2006-01-02 15:04:05")
+	s.VerifyKey = vkey
+	s.KeyRotated = false
+	return nil
+}
+
+// SetKey 直接修改 vkey,旧的 vkey 立即失效
+func (s *Client) SetKey(vkey string) {
+	s.Lock()
+	s.VerifyKey, s.OldVerifyKey, s.KeyRotated = vkey, "", false
+	s.Unlock()
+}
+
+// PendingKey 轮换未完成时返回旧的和新的 vkey
+func (s *Client) PendingKey() (oldKey, newKey string, ok bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.KeyRotated || !s.oldKeyValid() {
+		return "", "", false
+	}
+	return s.OldVerifyKey, s.VerifyKey, true
+}
+
+// OldKeyValid 旧的 vkey 是否还在宽限期内
+func (s *Client) OldKeyValid() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.oldKeyValid()
+}
+
+func (s *Client) oldKeyValid() bool {
+	if s.OldVerifyKey == "" {
+		return false
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", s.OldKeyExpire, time.Local)
+	return err == nil && time.Now().Before(t)
+}
+
+// MatchKey 用 match 校验 vkey 和宽限期内旧的 vkey,npc 用新的 vkey 连接后轮换完成
+func (s *Client) MatchKey(match func(vkey string) bool) bool {
+	s.Lock()
+	defer s.Unlock()
+	if match(s.VerifyKey) {
+		if s.OldVerifyKey != "" {
+			s.KeyRotated = true
+		}
+		return true
+	}
+	return s.oldKeyValid() && match(s.OldVerifyKey)
+}
+
+// ProofKey npc 认证时使用的 vkey,宽限期内可能是旧的 vkey,都不匹配时为空
+func (s *Client) ProofKey(match func(vkey string) bool) string {
+	s.RLock()
+	defer s.RUnlock()
+	if match(s.VerifyKey) {
+		return s.VerifyKey
+	}
+	if s.oldKeyValid() && match(s.OldVerifyKey) {
+		return s.OldVerifyKey
+	}
+	return ""
+}
+
+// GetRotateStatus 没有轮换过 vkey 时为空
+func (s *Client) GetRotateStatus() string {
+	s.RLock()
+	defer s.RUnlock()
+	switch {
+	case s.OldVerifyKey == "":
+		return ""
+	case s.KeyRotated:
+		return RotateDone
+	case s.oldKeyValid():
+		return RotatePending
+	}
+	return RotateExpired
+}
+
+// CertCommonName is the subject of the client certificate
+func (s *Client) CertCommonName() string {
+	return "npc-" + strconv.Itoa(s.Id)
+}
+
 func (s *Client) CutConn() {
 	atomic.AddInt32(&s.NowConn, 1)
 }
@@ -100,7 +240,7 @@ func (s *Client) GetConn() bool {
 func (s *Client) HasTunnel(t *Tunnel) (exist bool) {
 	GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 		v := value.(*Tunnel)
-		if v.Client.Id == s.Id && v.Port == t.Port && t.Port != 0 {
+		if v.Client.Id == s.Id && t.Port != 0 && (v.Port == t.Port || (v.Ports != "" || t.Ports != "") && hasSamePort(v, t)) {
 			exist = true
 			return false
 		}
@@ -109,6 +249,20 @@ func (s *Client) HasTunnel(t *Tunnel) (exist bool) {
 	return
 }
 
+// hasSamePort 两个隧道是否有相同的端口，用于端口范围隧道
+func hasSamePort(a, b *Tunnel) bool {
+	ports := make(map[int]bool)
+	for _, p := range a.GetPorts() {
+		ports[p] = true
+	}
+	for _, p := range b.GetPorts() {
+		if ports[p] {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Client) GetTunnelNum() (num int) {
 	GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 		v := value.(*Tunnel)
@@ -149,8 +303,9 @@ type Tunnel struct {
 	Status       bool
 	RunStatus    bool
 	Client       *Client
-	Ports        string
+	Ports        string // 端口范围，如 10000-10100，tcp 和 udp 隧道用一个任务监听所有端口，Port 为第一个端口
 	Flow         *Flow
+	PortFlow     map[int]*Flow // 端口范围中每个端口的流量，Flow 为总流量
 	Password     string
 	Remark       string
 	TargetAddr   string
@@ -158,12 +313,113 @@ type Tunnel struct {
 	LocalPath    string
 	StripPre     string
 	ProtoVersion string
+	Compression  string // 压缩算法 snappy/zstd/lz4,空则跟随客户端,none不压缩
+	Priority     string // 连接在多路复用中的优先级 high/normal/bulk,空为 normal
 	Target       *Target
 	MultiAccount *MultiAccount
+	TemplateId   int // 来源模板id,0表示非模板创建
+	TemplateItem int // 模板中的条目id
 	Health
 	sync.RWMutex
 }
 
+// GetPorts 隧道监听的端口，端口范围按顺序展开
+func (s *Tunnel) GetPorts() []int {
+	if s.Ports == "" {
+		return []int{s.Port}
+	}
+	return common.GetPorts(s.Ports)
+}
+
+// IsPortRange 是否为端口范围隧道，只有 tcp 和 udp 隧道支持
+func (s *Tunnel) IsPortRange() bool {
+	return s.Ports != "" && (s.Mode == "tcp" || s.Mode == "udp")
+}
+
+// SetPorts 设置监听端口，p 为单个端口或端口范围
+func (s *Tunnel) SetPorts(p string) error {
+	p = strings.TrimSpace(p)
+	if p == "" || common.IsPort(p) || p == "0" {
+		s.Port = common.GetIntNoErrByStr(p)
+		s.Ports = ""
+		return nil
+	}
+	ports := common.GetPorts(p)
+	if len(ports) == 0 {
+		return errors.New("port range " + p + " error")
+	}
+	s.Port = ports[0]
+	s.Ports = p
+	if len(ports) == 1 {
+		s.Ports = ""
+	}
+	return nil
+}
+
+// CheckPortRange 检查端口范围隧道的每个目标，目标端口数需与监听端口数相同
+func (s *Tunnel) CheckPortRange() error {
+	if s.Mode != "tcp" && s.Mode != "udp" {
+		return errors.New("only tcp and udp tunnels support port range")
+	}
+	n := len(s.GetPorts())
+	for _, v := range strings.Split(s.Target.TargetStr, "\n") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if _, ports := splitRangeTarget(v); len(common.GetPorts(ports)) != n {
+			return errors.New("the target " + v + " does not have " + strconv.Itoa(n) + " ports")
+		}
+	}
+	return nil
+}
+
+// InitPortFlow 为端口范围中的每个端口准备流量统计，保留已有的统计
+func (s *Tunnel) InitPortFlow() {
+	m := make(map[int]*Flow)
+	for _, p := range s.GetPorts() {
+		if f, ok := s.PortFlow[p]; ok {
+			m[p] = f
+		} else {
+			m[p] = new(Flow)
+		}
+	}
+	s.PortFlow = m
+}
+
+// RangeTarget 端口范围中第 i 个端口对应的目标，target 为目标端口范围，如 10.1.50.2:20000-20100，没有 ip 时只返回端口
+func RangeTarget(target string, i int) (string, error) {
+	host, ports := splitRangeTarget(target)
+	for _, v := range strings.Split(ports, ",") {
+		start, end := v, v
+		if arr := strings.Split(v, "-"); len(arr) == 2 {
+			start, end = arr[0], arr[1]
+		}
+		if !common.IsPort(start) || !common.IsPort(end) {
+			continue
+		}
+		a, b := common.GetIntNoErrByStr(start), common.GetIntNoErrByStr(end)
+		if b < a {
+			continue
+		}
+		if i <= b-a {
+			if host == "" {
+				return strconv.Itoa(a + i), nil
+			}
+			return host + ":" + strconv.Itoa(a+i), nil
+		}
+		i -= b - a + 1
+	}
+	return "", errors.New("the target " + target + " has no port for the index")
+}
+
+// splitRangeTarget 拆分目标的 ip 和端口范围
+func splitRangeTarget(target string) (host, ports string) {
+	if i := strings.LastIndex(target, ":"); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return "", target
+}
+
 type Health struct {
 	HealthCheckTimeout  int
 	HealthMaxFail       int
@@ -193,6 +449,8 @@ type Host struct {
 	Flow         *Flow
 	Client       *Client
 	Target       *Target //目标
+	TemplateId   int     // 来源模板id,0表示非模板创建
+	TemplateItem int     // 模板中的条目id
 	Health       `json:"-"`
 	sync.RWMutex
 }
@@ -239,3 +497,133 @@ type Glob struct {
 	ServerUrl   string
 	sync.RWMutex
 }
+
+// Template 隧道/域名模板,实例化时按客户端替换变量
+// 支持的变量: {remark} 客户端备注, {client_id} 客户端id, {suffix} 域名后缀
+type Template struct {
+	Id           int
+	Name         string
+	Remark       string
+	PortOffset   int    // 端口偏移,实际端口 = 条目端口 + PortOffset + 序号*PortStep
+	PortStep     int    // 批量实例化时每个客户端的端口步长
+	DomainSuffix string // 域名后缀,替换 {suffix}
+	Tunnels      []*TemplateTunnel
+	Hosts        []*TemplateHost
+	Bases        map[int]int // 客户端id -> 实例化时的端口基数(偏移+序号*步长),同步模板时新增的条目沿用
+	MaxItemId    int         // 已分配的最大条目id,删除的条目id不再使用
+	sync.RWMutex
+}
+
+type TemplateTunnel struct {
+	Id        int
+	Mode      string
+	Port      int // 0表示自动分配
+	TargetStr string
+	Remark    string
+	Password  string
+}
+
+type TemplateHost struct {
+	Id        int
+	Host      string
+	TargetStr string
+	Location  string
+	Scheme    string
+	Remark    string
+}
+
+// Render 替换模板变量
+func (s *Template) Render(str string, c *Client, suffix string) string {
+	remark := c.Remark
+	if remark == "" {
+		remark = strconv.Itoa(c.Id)
+	}
+	return strings.NewReplacer("{remark}", remark, "{client_id}", strconv.Itoa(c.Id), "{suffix}", suffix).Replace(str)
+}
+
+// PortBase 批量实例化时第index个客户端的端口基数
+func (s *Template) PortBase(offset, index int) int {
+	return offset + index*s.PortStep
+}
+
+// GetPort 计算条目在端口基数下的实例端口,条目端口为0时返回0由调用方自动分配
+func (s *Template) GetPort(t *TemplateTunnel, base int) int {
+	if t.Port == 0 {
+		return 0
+	}
+	return t.Port + base
+}
+
+// AssignItemIds 修改模板时,与修改前相同、备注相同或模式和端口相同的条目沿用原来的id,
+// 其他条目分配新的id,已创建的实例按条目id对应。old 为 nil 时是新的模板
+func (s *Template) AssignItemIds(old *Template) {
+	var ids []*int
+	var keys [][]string
+	for _, v := range s.Tunnels {
+		ids, keys = append(ids, &v.Id), append(keys, v.matchKeys())
+	}
+	for _, v := range s.Hosts {
+		ids, keys = append(ids, &v.Id), append(keys, v.matchKeys())
+	}
+	var oldIds []int
+	var oldKeys [][]string
+	if old != nil {
+		old.RLock()
+		s.MaxItemId = old.MaxItemId
+		for _, v := range old.Tunnels {
+			oldIds, oldKeys = append(oldIds, v.Id), append(oldKeys, v.matchKeys())
+		}
+		for _, v := range old.Hosts {
+			oldIds, oldKeys = append(oldIds, v.Id), append(oldKeys, v.matchKeys())
+		}
+		old.RUnlock()
+	}
+	used := make(map[int]bool)
+	// 按匹配优先级依次查找, 每个旧条目只匹配一次
+	for k := 0; k < itemMatchLevels; k++ {
+		for i, id := range ids {
+			for j, oldId := range oldIds {
+				if *id == 0 && !used[oldId] && keys[i][k] != "" && keys[i][k] == oldKeys[j][k] {
+					*id, used[oldId] = oldId, true
+				}
+			}
+		}
+	}
+	for _, id := range oldIds {
+		if id > s.MaxItemId {
+			s.MaxItemId = id
+		}
+	}
+	for _, id := range ids {
+		if *id == 0 {
+			s.MaxItemId++
+			*id = s.MaxItemId
+		}
+	}
+}
+
+const itemMatchLevels = 3
+
+// remarkKey 空备注的条目不按备注匹配
+func remarkKey(prefix, remark string) string {
+	if remark == "" {
+		return ""
+	}
+	return prefix + remark
+}
+
+func (t *TemplateTunnel) matchKeys() []string {
+	return []string{
+		fmt.Sprintf("tunnel,%s,%d,%s,%s,%s", t.Mode, t.Port, t.TargetStr, t.Remark, t.Password),
+		remarkKey("tunnel,", t.Remark),
+		fmt.Sprintf("tunnel,%s,%d", t.Mode, t.Port),
+	}
+}
+
+func (h *TemplateHost) matchKeys() []string {
+	return []string{
+		fmt.Sprintf("host,%s,%s,%s,%s,%s", h.Host, h.TargetStr, h.Location, h.Scheme, h.Remark),
+		fmt.Sprintf("host,%s,%s,%s", h.Host, h.Location, h.Scheme),
+		remarkKey("host,", h.Remark),
+	}
+}
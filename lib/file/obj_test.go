@@ -0,0 +1,145 @@
+package file
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProofKey(t *testing.T) {
+	c := &Client{VerifyKey: "new", OldVerifyKey: "old", OldKeyExpire: time.Now().Add(time.Hour).Format("2006-01-02 15:04:05")}
+	for _, v := range []struct {
+		key, want string
+	}{{"new", "new"}, {"old", "old"}, {"other", ""}} {
+		if got := c.ProofKey(func(vkey string) bool { return vkey == v.key }); got != v.want {
+			t.Fatalf("npc with %s: got %q, want %q", v.key, got, v.want)
+		}
+	}
+	// the old vkey is not accepted after the grace period
+	c.OldKeyExpire = time.Now().Add(-time.Hour).Format("2006-01-02 15:04:05")
+	if got := c.ProofKey(func(vkey string) bool { return vkey == "old" }); got != "" {
+		t.Fatalf("expired old vkey got %q", got)
+	}
+}
+
+func TestClientDisplayFieldsNotStored(t *testing.T) {
+	c := &Client{BridgeStats: []BridgeConnStat{{Addr: "127.0.0.1:1"}}, RotateStatus: "pending"}
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "BridgeStats") || strings.Contains(string(b), "RotateStatus") {
+		t.Fatal(string(b))
+	}
+}
+
+func TestTemplateRender(t *testing.T) {
+	tpl := new(Template)
+	c := &Client{Id: 3, Remark: "office"}
+	if got := tpl.Render("{remark}-{client_id}.{suffix}", c, "example.com"); got != "office-3.example.com" {
+		t.Fatalf("got %q", got)
+	}
+	// the client id is used when the client has no remark
+	c.Remark = ""
+	if got := tpl.Render("{remark}.{suffix}", c, "example.com"); got != "3.example.com" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestTemplateGetPort(t *testing.T) {
+	tpl := &Template{PortStep: 10}
+	item := &TemplateTunnel{Port: 8000}
+	for index, want := range []int{8100, 8110, 8120} {
+		if got := tpl.GetPort(item, tpl.PortBase(100, index)); got != want {
+			t.Fatalf("client %d: got %d, want %d", index, got, want)
+		}
+	}
+	// port 0 is left to the caller to allocate
+	if got := tpl.GetPort(&TemplateTunnel{}, tpl.PortBase(100, 1)); got != 0 {
+		t.Fatalf("auto port got %d", got)
+	}
+}
+
+func TestAssignItemIds(t *testing.T) {
+	old := &Template{
+		Tunnels: []*TemplateTunnel{
+			{Id: 1, Mode: "tcp", Port: 8000, TargetStr: "127.0.0.1:80", Remark: "web"},
+			{Id: 2, Mode: "tcp", Port: 8001, TargetStr: "127.0.0.1:22", Remark: "ssh"},
+			{Id: 3, Mode: "udp", Port: 8002, TargetStr: "127.0.0.1:53", Remark: "dns"},
+		},
+		Hosts:     []*TemplateHost{{Id: 4, Host: "{remark}.a.com", TargetStr: "127.0.0.1:80", Location: "/", Scheme: "all"}},
+		MaxItemId: 5,
+	}
+	old.AssignItemIds(nil)
+	if old.MaxItemId != 5 || old.Tunnels[0].Id != 1 {
+		t.Fatalf("ids of a new template with ids changed")
+	}
+	// web is removed, ssh moves to the first line with a new port, dns changes its target
+	nt := &Template{
+		Tunnels: []*TemplateTunnel{
+			{Mode: "tcp", Port: 9001, TargetStr: "127.0.0.1:22", Remark: "ssh"},
+			{Mode: "udp", Port: 8002, TargetStr: "127.0.0.1:5353", Remark: "dns2"},
+			{Mode: "tcp", Port: 8003, TargetStr: "127.0.0.1:3306", Remark: "db"},
+		},
+		Hosts: []*TemplateHost{{Host: "{remark}.a.com", TargetStr: "127.0.0.1:8080", Location: "/", Scheme: "all"}},
+	}
+	nt.AssignItemIds(old)
+	for i, want := range []int{2, 3, 6} {
+		if got := nt.Tunnels[i].Id; got != want {
+			t.Fatalf("tunnel %d: got id %d, want %d", i, got, want)
+		}
+	}
+	if nt.Hosts[0].Id != 4 || nt.MaxItemId != 6 {
+		t.Fatalf("host id %d, max id %d", nt.Hosts[0].Id, nt.MaxItemId)
+	}
+	// the id of the removed web is not reused
+	nt2 := &Template{Tunnels: []*TemplateTunnel{{Mode: "tcp", Port: 8000, Remark: "new"}}}
+	nt2.AssignItemIds(nt)
+	if nt2.Tunnels[0].Id != 7 {
+		t.Fatalf("got id %d, want 7", nt2.Tunnels[0].Id)
+	}
+	// the items without a remark are not matched by the empty remark
+	nt3 := &Template{
+		Tunnels: []*TemplateTunnel{{Mode: "udp", Port: 9000, TargetStr: "127.0.0.1:53"}},
+		Hosts:   []*TemplateHost{{Host: "b.com", TargetStr: "127.0.0.1:80", Location: "/", Scheme: "all"}},
+	}
+	nt3.AssignItemIds(&Template{
+		Tunnels:   []*TemplateTunnel{{Id: 1, Mode: "tcp", Port: 8000, TargetStr: "127.0.0.1:80"}},
+		Hosts:     []*TemplateHost{{Id: 2, Host: "a.com", TargetStr: "127.0.0.1:80", Location: "/", Scheme: "all"}},
+		MaxItemId: 2,
+	})
+	if nt3.Tunnels[0].Id != 3 || nt3.Hosts[0].Id != 4 {
+		t.Fatalf("tunnel id %d, host id %d", nt3.Tunnels[0].Id, nt3.Hosts[0].Id)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	c := &Client{VerifyKey: "a"}
+	if err := c.RotateKey("b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// npc still holds a, b is not confirmed
+	if err := c.RotateKey("c", time.Hour); err != ErrRotatePending {
+		t.Fatal(err)
+	}
+	is := func(key string) func(string) bool { return func(v string) bool { return v == key } }
+	if !c.MatchKey(is("a")) || c.KeyRotated {
+		t.Fatal("the old vkey", c.KeyRotated)
+	}
+	if !c.MatchKey(is("b")) || !c.KeyRotated || c.GetRotateStatus() != RotateDone {
+		t.Fatal("the new vkey", c.KeyRotated)
+	}
+	if err := c.RotateKey("c", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if c.MatchKey(is("a")) || !c.MatchKey(is("b")) {
+		t.Fatal("only the last vkey is kept in the grace")
+	}
+	// the grace of the pending rotation is over
+	c = &Client{VerifyKey: "a"}
+	c.RotateKey("b", -time.Second)
+	if err := c.RotateKey("c", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,487 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"github.com/astaxie/beego/logs"
+)
+
+// Store keeps the json files of the db, the nodes of a cluster share one store
+type Store interface {
+	Load(name string) ([]byte, error) // nil without error if the file does not exist
+	Save(name string, b []byte) error
+}
+
+// CasStore saves a file only if no one saved it after it was loaded, the db merges the records
+// changed by the other nodes when the save fails, so the concurrent changes are not lost
+type CasStore interface {
+	Store
+	// LoadVersion returns the file and its version, the version of a file not existing is ""
+	LoadVersion(name string) (b []byte, version string, err error)
+	// SaveVersion saves the file if its version is still version, ok is false if it is changed
+	SaveVersion(name string, b []byte, version string) (newVersion string, ok bool, err error)
+}
+
+// FileStore is the files in a directory, the conf of the run path by default
+type FileStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+func (s *FileStore) Load(name string) ([]byte, error) {
+	p := filepath.Join(s.Dir, name)
+	if !common.FileExists(p) {
+		return nil, nil
+	}
+	return common.ReadAllFromFile(p)
+}
+
+// Save write a temporary file first and rename it, the file is never half written
+func (s *FileStore) Save(name string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(name, b)
+}
+
+// LoadVersion the version is the hash of the content
+func (s *FileStore) LoadVersion(name string) ([]byte, string, error) {
+	b, err := s.Load(name)
+	if err != nil || b == nil {
+		return b, "", err
+	}
+	return b, fileVersion(b), nil
+}
+
+// SaveVersion the directory may be shared by the nodes, a lock file keeps out the other processes
+func (s *FileStore) SaveVersion(name string, b []byte, version string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := lockFile(filepath.Join(s.Dir, name+".lock"))
+	if err != nil {
+		return "", false, err
+	}
+	defer unlock()
+	if _, cur, err := s.LoadVersion(name); err != nil {
+		return "", false, err
+	} else if cur != version {
+		return "", false, nil
+	}
+	if err := s.save(name, b); err != nil {
+		return "", false, err
+	}
+	return fileVersion(b), true, nil
+}
+
+func fileVersion(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// lockFile create the lock file exclusively, a lock older than 30 seconds is left by a dead process
+func lockFile(p string) (unlock func(), err error) {
+	for i := 0; i < 100; i++ {
+		var f *os.File
+		if f, err = os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err == nil {
+			f.Close()
+			return func() { os.Remove(p) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, e := os.Stat(p); e == nil && time.Since(fi.ModTime()) > time.Second*30 {
+			os.Remove(p)
+			continue
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return nil, errors.New("the file " + p + " is locked")
+}
+
+func (s *FileStore) save(name string, b []byte) error {
+	p := filepath.Join(s.Dir, name)
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(p + ".tmp")
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	_ = f.Sync()
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+var (
+	storeKinds = map[string]func(arg string) (Store, error){
+		"file": func(arg string) (Store, error) {
+			if arg == "" {
+				arg = "conf"
+			}
+			if !filepath.IsAbs(arg) {
+				arg = filepath.Join(common.GetRunPath(), arg)
+			}
+			return &FileStore{Dir: arg}, nil
+		},
+	}
+	store Store
+)
+
+// RegisterStore add a kind of store, it is set as kind:arg, eg: file:/data/nps
+func RegisterStore(kind string, f func(arg string) (Store, error)) {
+	storeKinds[kind] = f
+}
+
+// NewStore create the store of the setting
+func NewStore(setting string) (Store, error) {
+	kind, arg, _ := strings.Cut(setting, ":")
+	if f, ok := storeKinds[kind]; ok {
+		return f(arg)
+	}
+	return nil, errors.New("unknown store " + kind)
+}
+
+// SetStore set the store of the db, it must be called before the first GetDb
+func SetStore(s Store) {
+	store = s
+}
+
+// ReloadFromStore merge the file saved by another node, the flows, rates and connections of the records are kept.
+// It returns the tasks changed or removed, their servers should be restarted
+func (s *JsonDb) ReloadFromStore(name string) (restart []int) {
+	tmp := NewJsonDb(s.RunPath)
+	tmp.Store = s.Store
+	switch name {
+	case filepath.Base(s.ClientFilePath):
+		tmp.LoadClientFromJsonFile()
+		s.mergeClients(tmp)
+	case filepath.Base(s.TaskFilePath):
+		s.Clients.Range(func(key, value interface{}) bool {
+			tmp.Clients.Store(key, value)
+			return true
+		})
+		tmp.LoadTaskFromJsonFile()
+		restart = s.mergeTasks(tmp)
+	case filepath.Base(s.HostFilePath):
+		s.Clients.Range(func(key, value interface{}) bool {
+			tmp.Clients.Store(key, value)
+			return true
+		})
+		tmp.LoadHostFromJsonFile()
+		s.mergeHosts(tmp)
+	case filepath.Base(s.TemplateFilePath):
+		tmp.LoadTemplateFromJsonFile()
+		seen := make(map[interface{}]bool)
+		tmp.Templates.Range(func(key, value interface{}) bool {
+			seen[key] = true
+			s.Templates.Store(key, value)
+			maxId(&s.TemplateIncreaseId, key.(int))
+			return true
+		})
+		deleteUnseen(&s.Templates, seen)
+	case filepath.Base(s.GlobalFilePath):
+		tmp.LoadGlobalFromJsonFile()
+		if tmp.Global != nil {
+			s.Global = tmp.Global
+		}
+		return
+	}
+	// the records are the same as the file now
+	s.setBase(name, tmp.base(name))
+	return
+}
+
+func (s *JsonDb) mergeClients(tmp *JsonDb) {
+	seen := make(map[interface{}]bool)
+	tmp.Clients.Range(func(key, value interface{}) bool {
+		c := value.(*Client)
+		seen[key] = true
+		if old, err := s.GetClient(c.Id); err == nil {
+			keepFlow(&c.Flow, old.Flow)
+			if c.RateLimit == old.RateLimit && old.Rate != nil {
+				c.Rate.Stop()
+				c.Rate = old.Rate
+			}
+			c.NowConn = atomic.LoadInt32(&old.NowConn)
+			c.IsConnect, c.Version, c.LastOnlineTime = old.IsConnect, old.Version, old.LastOnlineTime
+			c.Addr, c.LocalAddr, c.BridgeStats = old.Addr, old.LocalAddr, old.BridgeStats
+		}
+		s.Clients.Store(key, c)
+		maxId(&s.ClientIncreaseId, c.Id)
+		return true
+	})
+	s.Clients.Range(func(key, value interface{}) bool {
+		if !seen[key] && !value.(*Client).NoStore {
+			s.Clients.Delete(key)
+		}
+		return true
+	})
+	// the tasks and hosts point to the new clients
+	s.Tasks.Range(func(key, value interface{}) bool {
+		t := value.(*Tunnel)
+		if c, err := s.GetClient(t.Client.Id); err == nil {
+			t.Client = c
+		}
+		return true
+	})
+	s.Hosts.Range(func(key, value interface{}) bool {
+		h := value.(*Host)
+		if c, err := s.GetClient(h.Client.Id); err == nil {
+			h.Client = c
+		}
+		return true
+	})
+}
+
+func (s *JsonDb) mergeTasks(tmp *JsonDb) (restart []int) {
+	seen := make(map[interface{}]bool)
+	tmp.Tasks.Range(func(key, value interface{}) bool {
+		t := value.(*Tunnel)
+		seen[key] = true
+		if v, ok := s.Tasks.Load(key); ok {
+			old := v.(*Tunnel)
+			if sameRecord(old, t, "RunStatus", "HealthNextTime", "HealthMap", "HealthRemoveArr") {
+				keepFlow(&t.Flow, old.Flow)
+				return true
+			}
+			keepFlow(&t.Flow, old.Flow)
+			restart = append(restart, t.Id)
+		}
+		s.Tasks.Store(key, t)
+		maxId(&s.TaskIncreaseId, t.Id)
+		return true
+	})
+	s.Tasks.Range(func(key, value interface{}) bool {
+		if !seen[key] && !value.(*Tunnel).NoStore {
+			s.Tasks.Delete(key)
+			restart = append(restart, key.(int))
+		}
+		return true
+	})
+	return
+}
+
+func (s *JsonDb) mergeHosts(tmp *JsonDb) {
+	seen := make(map[interface{}]bool)
+	tmp.Hosts.Range(func(key, value interface{}) bool {
+		h := value.(*Host)
+		seen[key] = true
+		if v, ok := s.Hosts.Load(key); ok {
+			old := v.(*Host)
+			keepFlow(&h.Flow, old.Flow)
+			if sameRecord(old, h) {
+				return true
+			}
+		}
+		s.Hosts.Store(key, h)
+		maxId(&s.HostIncreaseId, h.Id)
+		return true
+	})
+	s.Hosts.Range(func(key, value interface{}) bool {
+		if !seen[key] && !value.(*Host).NoStore {
+			s.Hosts.Delete(key)
+		}
+		return true
+	})
+}
+
+// keepFlow use the flow of the node for the record, only the limit is from the store
+func keepFlow(f **Flow, old *Flow) {
+	if old == nil {
+		return
+	}
+	var limit int64
+	if *f != nil {
+		limit = (*f).FlowLimit
+	}
+	old.Lock()
+	old.FlowLimit = limit
+	old.Unlock()
+	*f = old
+}
+
+// sameRecord compare the settings of two records, the flow, the client and the runtime fields are ignored
+func sameRecord(a, b interface{}, runtime ...string) bool {
+	ma, mb := recordMap(a, runtime), recordMap(b, runtime)
+	return ma != nil && reflect.DeepEqual(ma, mb)
+}
+
+func recordMap(v interface{}, runtime []string) map[string]interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]interface{})
+	if json.Unmarshal(b, &m) != nil {
+		return nil
+	}
+	if c, ok := m["Client"].(map[string]interface{}); ok {
+		m["Client"] = c["Id"]
+	}
+	if t, ok := m["Target"].(map[string]interface{}); ok {
+		delete(t, "TargetArr")
+	}
+	delete(m, "Flow")
+	for _, k := range runtime {
+		delete(m, k)
+	}
+	return m
+}
+
+func deleteUnseen(m *sync.Map, seen map[interface{}]bool) {
+	m.Range(func(key, value interface{}) bool {
+		if !seen[key] {
+			m.Delete(key)
+		}
+		return true
+	})
+}
+
+func maxId(id *int32, v int) {
+	for {
+		cur := atomic.LoadInt32(id)
+		if int32(v) <= cur || atomic.CompareAndSwapInt32(id, cur, int32(v)) {
+			return
+		}
+	}
+}
+
+// recordBase is the records of a file as last loaded or saved by this node, the common base of a merge
+type recordBase struct {
+	version string
+	records map[int]string
+}
+
+func (s *JsonDb) base(name string) *recordBase {
+	s.baseMu.Lock()
+	defer s.baseMu.Unlock()
+	if b, ok := s.bases[name]; ok {
+		return b
+	}
+	return &recordBase{}
+}
+
+func (s *JsonDb) setBase(name string, b *recordBase) {
+	s.baseMu.Lock()
+	defer s.baseMu.Unlock()
+	if s.bases == nil {
+		s.bases = make(map[string]*recordBase)
+	}
+	s.bases[name] = b
+}
+
+// writeRecords save the records if the file is not changed after the base, or merge the changes
+// of the other nodes and try again. After a merge the base is not moved until the file is reloaded,
+// so the next save merges again instead of removing the records of the others
+func (s *JsonDb) writeRecords(cs CasStore, filePath string, b []byte) {
+	name := filepath.Base(filePath)
+	local := splitRecords(b)
+	for i := 0; i < 10; i++ {
+		base := s.base(name)
+		remote, version, err := cs.LoadVersion(name)
+		if err != nil {
+			logs.Error("load %s error %v, the changes are not saved", name, err)
+			return
+		}
+		out, merged := b, version != base.version
+		if merged {
+			out = mergeRecords(base.records, local, splitRecords(remote))
+		}
+		newVersion, ok, err := cs.SaveVersion(name, out, version)
+		if err != nil {
+			logs.Error(err, "store to file err, data will lost")
+			return
+		}
+		if !ok {
+			continue
+		}
+		if !merged {
+			s.setBase(name, &recordBase{version: newVersion, records: local})
+		}
+		if s.OnStore != nil {
+			s.OnStore(name)
+		}
+		if merged && s.OnMerge != nil {
+			s.OnMerge(name)
+		}
+		return
+	}
+	logs.Error("%s is saved by others all the time, the changes are not saved", name)
+}
+
+// runtimeFields are set by the running node, a record only differs in them is not changed
+var runtimeFields = []string{"RunStatus", "HealthNextTime", "HealthMap", "HealthRemoveArr", "PortFlow",
+	"Addr", "LocalAddr", "IsConnect", "NowConn", "Version", "LastOnlineTime"}
+
+// mergeRecords three-way merge the records by id, the change of this node wins if both changed a record
+func mergeRecords(base, local, remote map[int]string) []byte {
+	ids := make([]int, 0, len(local)+len(remote))
+	for id := range local {
+		ids = append(ids, id)
+	}
+	for id := range remote {
+		if _, ok := local[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	var buf bytes.Buffer
+	for _, id := range ids {
+		v, in := local[id]
+		if b, inBase := base[id]; in == inBase && (!in || sameRecord(json.RawMessage(v), json.RawMessage(b), runtimeFields...)) {
+			v, in = remote[id]
+		}
+		if in {
+			buf.WriteString(v)
+			buf.WriteString("\n" + common.CONN_DATA_SEQ)
+		}
+	}
+	return buf.Bytes()
+}
+
+func splitRecords(b []byte) map[int]string {
+	m := make(map[int]string)
+	for _, v := range strings.Split(string(b), "\n"+common.CONN_DATA_SEQ) {
+		var r struct{ Id int }
+		if v != "" && json.Unmarshal([]byte(v), &r) == nil {
+			m[r.Id] = v
+		}
+	}
+	return m
+}
+
+// SetIdStep the nodes of a cluster create the records with different ids, the ids of a node
+// are offset in every step, the step is the largest node id
+func (s *JsonDb) SetIdStep(step, offset int) {
+	atomic.StoreInt32(&s.idOffset, int32(offset%step))
+	atomic.StoreInt32(&s.idStep, int32(step))
+}
+
+func (s *JsonDb) nextId(id *int32) int32 {
+	for {
+		cur := atomic.LoadInt32(id)
+		n := cur + 1
+		if step := atomic.LoadInt32(&s.idStep); step > 1 {
+			n += ((atomic.LoadInt32(&s.idOffset)-n)%step + step) % step
+		}
+		if atomic.CompareAndSwapInt32(id, cur, n) {
+			return n
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package file
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNextId(t *testing.T) {
+	db := NewJsonDb(t.TempDir())
+	if id := db.GetClientId(); id != 1 {
+		t.Fatal(id)
+	}
+	db.SetIdStep(3, 2)
+	for _, want := range []int32{2, 5, 8} {
+		if id := db.GetClientId(); id != want {
+			t.Fatal(id, want)
+		}
+	}
+	// the id of another node is merged
+	maxId(&db.ClientIncreaseId, 9)
+	if id := db.GetClientId(); id != 11 {
+		t.Fatal(id)
+	}
+	db.SetIdStep(3, 3)
+	if id := db.GetClientId(); id != 12 {
+		t.Fatal(id)
+	}
+}
+
+func clientsOf(t *testing.T, db *JsonDb) map[int]string {
+	b, err := db.Store.Load("clients.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[int]string)
+	for id, v := range splitRecords(b) {
+		var c Client
+		if err := json.Unmarshal([]byte(v), &c); err != nil {
+			t.Fatal(err)
+		}
+		m[id] = c.Remark
+	}
+	return m
+}
+
+func TestMergeRecords(t *testing.T) {
+	dir := t.TempDir()
+	nodes := make([]*JsonDb, 2)
+	for i := range nodes {
+		nodes[i] = NewJsonDb(dir)
+		nodes[i].Store = &FileStore{Dir: dir}
+		nodes[i].SetIdStep(2, i+1)
+	}
+	a, b := nodes[0], nodes[1]
+	newClient := func(db *JsonDb, remark string) *Client {
+		c := &Client{Id: int(db.GetClientId()), Remark: remark, Flow: new(Flow), Cnf: new(Config)}
+		db.Clients.Store(c.Id, c)
+		return c
+	}
+	newClient(a, "a")
+	a.StoreClientsToJsonFile()
+	b.LoadClientFromJsonFile()
+
+	// both nodes create a client before they know the other one
+	newClient(a, "a2")
+	c := newClient(b, "b")
+	c.Flow.InletFlow = 100
+	b.Clients.Range(func(key, value interface{}) bool {
+		if v := value.(*Client); v.Remark == "a" {
+			v.Remark = "a changed by b"
+		}
+		return true
+	})
+	a.StoreClientsToJsonFile()
+	b.StoreClientsToJsonFile()
+	if m := clientsOf(t, a); len(m) != 3 || m[1] != "a changed by b" || m[3] != "a2" || m[2] != "b" {
+		t.Fatal(m)
+	}
+	// b saves again before it reloads the file, the client of a is kept
+	c.Remark = "b2"
+	b.StoreClientsToJsonFile()
+	if m := clientsOf(t, a); len(m) != 3 || m[3] != "a2" || m[2] != "b2" {
+		t.Fatal(m)
+	}
+	// a deletes its client after the reload
+	a.ReloadFromStore("clients.json")
+	a.Clients.Delete(3)
+	a.StoreClientsToJsonFile()
+	if m := clientsOf(t, b); len(m) != 2 || m[1] != "a changed by b" || m[2] != "b2" {
+		t.Fatal(m)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/file"
@@ -16,14 +17,15 @@ import (
 )
 
 type connGroup struct {
-	src    io.ReadWriteCloser
-	dst    io.ReadWriteCloser
-	wg     *sync.WaitGroup
-	n      *int64
-	flow   *file.Flow
-	task   *file.Tunnel
-	host   *file.Host
-	remote string
+	src       io.ReadWriteCloser
+	dst       io.ReadWriteCloser
+	wg        *sync.WaitGroup
+	n         *int64
+	flow      *file.Flow
+	task      *file.Tunnel
+	host      *file.Host
+	remote    string
+	halfClose *atomic.Bool // a direction is half closed, the conns are closed after both directions end
 }
 
 //func newConnGroup(dst, src io.ReadWriteCloser, wg *sync.WaitGroup, n *int64) connGroup {
@@ -35,16 +37,17 @@ type connGroup struct {
 //	}
 //}
 
-func newConnGroup(dst, src io.ReadWriteCloser, wg *sync.WaitGroup, n *int64, flow *file.Flow, task *file.Tunnel, host *file.Host, remote string) connGroup {
+func newConnGroup(dst, src io.ReadWriteCloser, wg *sync.WaitGroup, n *int64, flow *file.Flow, task *file.Tunnel, host *file.Host, remote string, halfClose *atomic.Bool) connGroup {
 	return connGroup{
-		src:    src,
-		dst:    dst,
-		wg:     wg,
-		n:      n,
-		flow:   flow,
-		task:   task,
-		host:   host,
-		remote: remote,
+		src:       src,
+		dst:       dst,
+		wg:        wg,
+		n:         n,
+		flow:      flow,
+		task:      task,
+		host:      host,
+		remote:    remote,
+		halfClose: halfClose,
 	}
 }
 
@@ -57,7 +60,8 @@ func CopyBuffer(dst io.Writer, src io.Reader, flow *file.Flow, task *file.Tunnel
 		}
 		nr, er := src.Read(buf)
 
-		if task != nil {
+		// IP白名单的授权页面只对tcp、file隧道生效，socks、透明代理等的原始数据流只统计流量
+		if task != nil && (task.Mode == "tcp" || task.Mode == "file") {
 			if task.Client.IpWhite && task.Client.IpWhitePass != "" {
 
 				if common.IsAuthIp(remote, task.Client.VerifyKey, task.Client.IpWhiteList) {
@@ -164,6 +168,15 @@ func copyConnGroup(group interface{}) {
 
 	var err error
 	err = CopyBuffer(cg.dst, cg.src, cg.flow, cg.task, cg.host, cg.remote)
+	if err == io.EOF {
+		// the src shut down its write direction, pass it to the dst and keep copying the other direction,
+		// a mux conn closed by the other side reads nps_mux.ErrRemoteClosed and both are closed below
+		if cw, ok := cg.dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+			cg.halfClose.Store(true)
+			cg.wg.Done()
+			return
+		}
+	}
 	if err != nil {
 		cg.src.Close()
 		cg.dst.Close()
@@ -202,12 +215,17 @@ func copyConns(group interface{}) {
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 	var in, out int64
+	halfClose := new(atomic.Bool)
 	remoteAddr := conns.conn2.RemoteAddr().String()
-	_ = connCopyPool.Invoke(newConnGroup(conns.conn1, conns.conn2, wg, &in, conns.flow, conns.task, conns.host, remoteAddr))
+	_ = connCopyPool.Invoke(newConnGroup(conns.conn1, conns.conn2, wg, &in, conns.flow, conns.task, conns.host, remoteAddr, halfClose))
 	// outside to mux : incoming
-	_ = connCopyPool.Invoke(newConnGroup(conns.conn2, conns.conn1, wg, &out, conns.flow, conns.task, conns.host, remoteAddr))
+	_ = connCopyPool.Invoke(newConnGroup(conns.conn2, conns.conn1, wg, &out, conns.flow, conns.task, conns.host, remoteAddr, halfClose))
 	// mux to outside : outgoing
 	wg.Wait()
+	if halfClose.Load() {
+		conns.conn1.Close()
+		conns.conn2.Close()
+	}
 	//if conns.flow != nil {
 	//	conns.flow.Add(in, out)
 	//}
@@ -0,0 +1,302 @@
+// Package graceful 平滑重启：新进程通过文件描述符继承旧进程监听的端口，旧进程停止接受新连接后等待已有连接结束。
+// udp 的端口没有连接，同一个 socket 上的数据包可能属于旧进程的会话（kcp、quic、udp 隧道），
+// 新进程在旧进程关闭 socket 后才读取（WaitUDP），旧进程的这些会话随之结束
+package graceful
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	envSockets = "NPS_GRACEFUL_SOCKETS" // the keys of the inherited sockets, the fds start from 3
+	envReady   = "NPS_GRACEFUL_READY"   // the fd written by the new process when it is ready
+	envState   = "NPS_GRACEFUL_STATE"   // the state passed from the old process
+	envRelease = "NPS_GRACEFUL_RELEASE" // the fd read by the new process, EOF when the old process closes the sockets
+)
+
+// ErrClosed the sockets are handed to the new process
+var ErrClosed = errors.New("the listening sockets are handed to the new process")
+
+type socket interface {
+	Close() error
+	File() (*os.File, error)
+}
+
+var (
+	mu        sync.Mutex
+	inherited = make(map[string]*os.File)
+	sockets   = make(map[string]socket)
+	readyFile *os.File
+	holdFile  *os.File // the old process closes it after the sockets are closed
+	released  = make(chan struct{})
+	state     string
+	closed    bool
+	taken     = sync.NewCond(&mu) // broadcast when an inherited socket is listened again
+)
+
+func init() {
+	if keys := os.Getenv(envSockets); keys != "" {
+		for i, key := range strings.Split(keys, ",") {
+			inherited[key] = os.NewFile(uintptr(3+i), key)
+		}
+	}
+	if fd, err := strconv.Atoi(os.Getenv(envReady)); err == nil {
+		readyFile = os.NewFile(uintptr(fd), "ready")
+	}
+	if fd, err := strconv.Atoi(os.Getenv(envRelease)); err == nil {
+		f := os.NewFile(uintptr(fd), "release")
+		go func() {
+			// 旧进程关闭 socket 或退出时读到 EOF
+			f.Read(make([]byte, 1))
+			f.Close()
+			close(released)
+		}()
+	} else {
+		close(released)
+	}
+	state = os.Getenv(envState)
+	// npc 等子进程不再继承
+	os.Unsetenv(envSockets)
+	os.Unsetenv(envReady)
+	os.Unsetenv(envState)
+	os.Unsetenv(envRelease)
+}
+
+// Inherited reports whether the process is started by a graceful restart
+func Inherited() bool {
+	return readyFile != nil
+}
+
+// State returns the state passed by the old process
+func State() string {
+	return state
+}
+
+// Closed reports whether the sockets are handed to the new process, the accept errors are expected then
+func Closed() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return closed
+}
+
+// Option is a socket option set before a new socket is bound, the inherited sockets have it already.
+// the sockets with different options are told apart by Name
+type Option struct {
+	Name    string
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+func (o *Option) key(network, addr string) string {
+	if o == nil {
+		return network + "/" + addr
+	}
+	return network + "+" + o.Name + "/" + addr
+}
+
+func (o *Option) config() *net.ListenConfig {
+	if o == nil {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: o.Control}
+}
+
+// ListenTCP listen the address, use the socket of the old process if it is inherited
+func ListenTCP(addr *net.TCPAddr) (*net.TCPListener, error) {
+	return ListenTCPOption(addr, nil)
+}
+
+// ListenTCPOption is ListenTCP with the socket option, such as IP_TRANSPARENT
+func ListenTCPOption(addr *net.TCPAddr, opt *Option) (*net.TCPListener, error) {
+	key := opt.key("tcp", addr.String())
+	mu.Lock()
+	defer mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	var l *net.TCPListener
+	if f, ok := inherited[key]; ok {
+		delete(inherited, key)
+		taken.Broadcast()
+		fl, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if l, ok = fl.(*net.TCPListener); !ok {
+			fl.Close()
+			return nil, errors.New("the inherited socket " + key + " is not a tcp listener")
+		}
+	} else {
+		nl, err := opt.config().Listen(context.Background(), "tcp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		l = nl.(*net.TCPListener)
+	}
+	sockets[key] = l
+	return l, nil
+}
+
+// Listen is ListenTCP with the address string
+func Listen(addr string) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return ListenTCP(tcpAddr)
+}
+
+// ListenUDP listen the address, use the socket of the old process if it is inherited
+func ListenUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return ListenUDPOption(addr, nil)
+}
+
+// ListenUDPOption is ListenUDP with the socket option, such as IP_TRANSPARENT
+func ListenUDPOption(addr *net.UDPAddr, opt *Option) (*net.UDPConn, error) {
+	key := opt.key("udp", addr.String())
+	mu.Lock()
+	defer mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	var c *net.UDPConn
+	if f, ok := inherited[key]; ok {
+		delete(inherited, key)
+		taken.Broadcast()
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if c, ok = pc.(*net.UDPConn); !ok {
+			pc.Close()
+			return nil, errors.New("the inherited socket " + key + " is not a udp socket")
+		}
+	} else {
+		pc, err := opt.config().ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		c = pc.(*net.UDPConn)
+	}
+	sockets[key] = c
+	return c, nil
+}
+
+// WaitUDP blocks until the old process closes the inherited sockets, it returns at once if there is no old process.
+// the udp sockets are read after it, so a datagram of a session of the old process is not read by the new one
+func WaitUDP() {
+	<-released
+}
+
+// Has reports whether a socket of the port is inherited and not listened yet,
+// the port can not be bound again but is available to Listen
+func Has(network string, port int) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	for key := range inherited {
+		if n, p := keyPort(key); n == network && p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait blocks until the inherited sockets are listened again, except the ones of the later ports,
+// which are listened after the clients reconnect
+func Wait(later []int) {
+	skip := make(map[int]bool)
+	for _, p := range later {
+		skip[p] = true
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for {
+		pending := false
+		for key := range inherited {
+			if _, p := keyPort(key); !skip[p] {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return
+		}
+		taken.Wait()
+	}
+}
+
+// keyPort returns the network and the port of the key of a socket
+func keyPort(key string) (string, int) {
+	network, addr, _ := strings.Cut(key, "/")
+	network, _, _ = strings.Cut(network, "+")
+	_, p, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(p)
+	return network, port
+}
+
+// Ready tell the old process the new one is serving, the inherited sockets not used in keep are closed
+func Ready(keep time.Duration) {
+	mu.Lock()
+	f := readyFile
+	readyFile = nil
+	mu.Unlock()
+	if f == nil {
+		return
+	}
+	f.Write([]byte{1})
+	f.Close()
+	// npc 配置文件中的隧道在客户端重连后才监听
+	time.AfterFunc(keep, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for key, f := range inherited {
+			f.Close()
+			delete(inherited, key)
+		}
+	})
+}
+
+// Close stop listening, the connections accepted are not closed.
+// the sessions on the udp sockets end, the new process reads the sockets after it
+func Close() {
+	mu.Lock()
+	closed = true
+	all := sockets
+	sockets = make(map[string]socket)
+	f := holdFile
+	holdFile = nil
+	mu.Unlock()
+	for _, s := range all {
+		s.Close()
+	}
+	if f != nil {
+		f.Close()
+	}
+}
+
+// files returns the dup of the listening sockets, the closed ones are skipped
+func files() ([]string, []*os.File) {
+	mu.Lock()
+	defer mu.Unlock()
+	var keys []string
+	var fs []*os.File
+	for key, s := range sockets {
+		f, err := s.File()
+		if err != nil {
+			delete(sockets, key)
+			continue
+		}
+		keys = append(keys, key)
+		fs = append(fs, f)
+	}
+	return keys, fs
+}
@@ -0,0 +1,315 @@
+//go:build !windows
+// +build !windows
+
+package graceful
+
+import (
+	"io"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const envChild = "NPS_GRACEFUL_TEST_CHILD"
+
+// the test binary is started again as the new process
+func TestMain(m *testing.M) {
+	switch os.Getenv(envChild) {
+	case "serve":
+		l, err := Listen(State())
+		if err != nil {
+			os.Exit(2)
+		}
+		Ready(0)
+		c, err := l.Accept()
+		if err != nil {
+			os.Exit(3)
+		}
+		c.Write([]byte("new"))
+		c.Close()
+		os.Exit(0)
+	case "udp":
+		addr, _ := net.ResolveUDPAddr("udp", State())
+		c, err := ListenUDP(addr)
+		if err != nil {
+			os.Exit(2)
+		}
+		Ready(0)
+		WaitUDP()
+		b := make([]byte, 64)
+		n, from, err := c.ReadFromUDP(b)
+		if err != nil {
+			os.Exit(3)
+		}
+		c.WriteToUDP(append([]byte("new "), b[:n]...), from)
+		os.Exit(0)
+	case "fail":
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	closed = false
+	sockets = make(map[string]socket)
+}
+
+func TestUpgrade(t *testing.T) {
+	reset()
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	// listen again with the fixed address as the tasks do
+	if l, err = Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envChild, "serve")
+	p, err := Upgrade(10*time.Second, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	if !Closed() {
+		t.Fatal("the sockets should be closed")
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("the old process should not accept")
+	}
+	c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		p.Kill()
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "new" {
+		t.Fatalf("read %q, error %v", b, err)
+	}
+	if _, err := Upgrade(time.Second, ""); err != ErrClosed {
+		t.Fatal("upgrade twice", err)
+	}
+}
+
+// the datagrams of a udp session are read by the old process until it closes the socket, then by the new one
+func TestUpgradeUDP(t *testing.T) {
+	reset()
+	c, err := ListenUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := c.LocalAddr().(*net.UDPAddr)
+	c.Close()
+	if c, err = ListenUDP(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envChild, "udp")
+	p, err := Upgrade(10*time.Second, addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Kill()
+	session, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.SetDeadline(time.Now().Add(5 * time.Second))
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 64)
+	for _, v := range []string{"a", "b"} {
+		session.Write([]byte(v))
+		// the new process has the time to read it
+		time.Sleep(100 * time.Millisecond)
+		n, from, err := c.ReadFromUDP(b)
+		if err != nil || string(b[:n]) != v {
+			t.Fatalf("the old process reads %q, error %v", b[:n], err)
+		}
+		c.WriteToUDP([]byte("old "+v), from)
+		if n, err = session.Read(b); err != nil || string(b[:n]) != "old "+v {
+			t.Fatalf("read %q, error %v", b[:n], err)
+		}
+	}
+	Close()
+	session.Write([]byte("c"))
+	n, err := session.Read(b)
+	if err != nil || string(b[:n]) != "new c" {
+		t.Fatalf("read %q, error %v", b[:n], err)
+	}
+}
+
+func TestUpgradeFail(t *testing.T) {
+	reset()
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	t.Setenv(envChild, "fail")
+	if _, err := Upgrade(10*time.Second, ""); err == nil {
+		t.Fatal("expected error when the new process exits")
+	}
+	if Closed() {
+		t.Fatal("the old process keeps serving")
+	}
+	// still accepting
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestListenUDP(t *testing.T) {
+	reset()
+	c, err := ListenUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, fs := files()
+	for _, f := range fs {
+		f.Close()
+	}
+	if len(keys) != 1 || keys[0] != "udp/127.0.0.1:0" {
+		t.Fatal(keys)
+	}
+	c.Close()
+	// the closed sockets are not passed
+	if keys, _ = files(); len(keys) != 0 {
+		t.Fatal(keys)
+	}
+}
+
+func TestListenOption(t *testing.T) {
+	reset()
+	var calls int
+	opt := &Option{Name: "test", Control: func(network, address string, c syscall.RawConn) error {
+		calls++
+		return nil
+	}}
+	l, err := ListenTCPOption(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := ListenUDPOption(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if calls != 2 {
+		t.Fatalf("control is called %d times", calls)
+	}
+	keys, fs := files()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "tcp+test/127.0.0.1:0" || keys[1] != "udp+test/127.0.0.1:0" {
+		t.Fatal(keys)
+	}
+	// the inherited socket has the option already
+	mu.Lock()
+	for i, key := range keys {
+		inherited[key] = fs[i]
+	}
+	mu.Unlock()
+	l2, err := ListenTCPOption(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	if calls != 2 || l2.Addr().String() != l.Addr().String() {
+		t.Fatalf("control is called %d times, listen on %s", calls, l2.Addr())
+	}
+	// a socket without the option is not taken for it
+	if _, err := ListenUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	f, ok := inherited["udp+test/127.0.0.1:0"]
+	delete(inherited, "udp+test/127.0.0.1:0")
+	mu.Unlock()
+	if !ok {
+		t.Fatal("the udp socket with the option is taken by ListenUDP")
+	}
+	f.Close()
+}
+
+func TestWait(t *testing.T) {
+	reset()
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	later, err := ListenUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laterPort := later.LocalAddr().(*net.UDPAddr).Port
+	// listen again with the fixed addresses as the tasks do
+	l.Close()
+	later.Close()
+	reset()
+	if l, err = ListenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}); err != nil {
+		t.Fatal(err)
+	}
+	if later, err = ListenUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: laterPort}); err != nil {
+		t.Fatal(err)
+	}
+	keys, fs := files()
+	l.Close()
+	later.Close()
+	// as the new process inherits them
+	reset()
+	mu.Lock()
+	for i, key := range keys {
+		inherited[key] = fs[i]
+	}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		for key, f := range inherited {
+			f.Close()
+			delete(inherited, key)
+		}
+		mu.Unlock()
+	}()
+	if !Has("tcp", port) || !Has("udp", laterPort) || Has("udp", port) {
+		t.Fatal("the inherited ports are not reported")
+	}
+	done := make(chan struct{})
+	go func() {
+		Wait([]int{laterPort})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("ready before the port is listened")
+	case <-time.After(100 * time.Millisecond):
+	}
+	l, err = ListenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready after the port is listened")
+	}
+	if Has("tcp", port) {
+		t.Fatal("the listened port is still reported")
+	}
+}
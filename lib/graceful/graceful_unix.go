@@ -0,0 +1,94 @@
+//go:build !windows
+// +build !windows
+
+package graceful
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// OnSignal call f when SIGUSR2 is received
+func OnSignal(f func()) {
+	s := make(chan os.Signal, 1)
+	signal.Notify(s, syscall.SIGUSR2)
+	go func() {
+		for range s {
+			f()
+		}
+	}()
+}
+
+// Upgrade start a new process of the same executable and arguments with the listening sockets,
+// it returns after the new process is ready, the old process keeps serving if an error is returned.
+// the new process reads the udp sockets after Close is called
+func Upgrade(timeout time.Duration, st string) (*os.Process, error) {
+	if Closed() {
+		return nil, ErrClosed
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	keys, fs := files()
+	defer func() {
+		for _, f := range fs {
+			f.Close()
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// 新进程读取 udp socket 前等待 hold 关闭
+	release, hold, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(fs, w, release)
+	cmd.Env = append(os.Environ(),
+		envSockets+"="+strings.Join(keys, ","),
+		envReady+"="+strconv.Itoa(3+len(fs)),
+		envRelease+"="+strconv.Itoa(4+len(fs)),
+		envState+"="+st,
+	)
+	err = cmd.Start()
+	w.Close()
+	release.Close()
+	if err != nil {
+		hold.Close()
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		// 新进程未就绪就退出时读到 EOF
+		_, err := r.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = errors.New("the new process is not ready in " + timeout.String())
+	}
+	if err != nil {
+		hold.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	mu.Lock()
+	holdFile = hold
+	mu.Unlock()
+	go cmd.Wait()
+	return cmd.Process, nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package graceful
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// OnSignal there is no SIGUSR2 on windows
+func OnSignal(f func()) {
+}
+
+// Upgrade sockets can not be passed to a new process on windows
+func Upgrade(timeout time.Duration, st string) (*os.Process, error) {
+	return nil, errors.New("graceful restart is not supported on windows")
+}
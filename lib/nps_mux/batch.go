@@ -0,0 +1,102 @@
+package nps_mux
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	batchSize    = 64 << 10 // bytes of a batched write, and the read buffer of the mux
+	batchFrames  = 256      // frames of a batched write, writev takes 1024 buffers at most
+	batchLatency = time.Millisecond
+)
+
+// batchWriter coalesces the queued packages into one write.
+// the conns which support writev (tcp, unix) get the frames by net.Buffers without copying,
+// the others (tls, kcp, rate limited...) get them copied into one buffer,
+// so a tls bridge writes one record for a batch but not one for every frame.
+// a batch is limited to the bytes written in batchLatency by the measured write rate,
+// on a slow link a high priority package does not wait for a large batch of bulk data.
+type batchWriter struct {
+	w        io.Writer
+	vectored bool
+	bufs     net.Buffers
+	packs    []*muxPackager
+	flat     []byte
+	size     int
+	limit    int
+}
+
+func newBatchWriter(c net.Conn) *batchWriter {
+	b := &batchWriter{w: c, limit: batchSize}
+	switch c.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		b.vectored = true
+	default:
+		b.flat = make([]byte, 0, batchSize+poolSizeBuffer)
+	}
+	return b
+}
+
+// add the package to the batch, returns whether the batch is full and should be flushed
+func (Self *batchWriter) add(pack *muxPackager) bool {
+	n := len(Self.bufs)
+	Self.bufs = pack.appendTo(Self.bufs)
+	for _, b := range Self.bufs[n:] {
+		Self.size += len(b)
+	}
+	Self.packs = append(Self.packs, pack)
+	return Self.size >= Self.limit || len(Self.packs) >= batchFrames
+}
+
+// flush writes the batch and gives the packages back to the pool
+func (Self *batchWriter) flush() (err error) {
+	if len(Self.packs) == 0 {
+		return
+	}
+	start := time.Now()
+	if Self.vectored {
+		bufs := Self.bufs // WriteTo consumes the slice
+		_, err = bufs.WriteTo(Self.w)
+	} else {
+		for _, b := range Self.bufs {
+			Self.flat = append(Self.flat, b...)
+		}
+		_, err = Self.w.Write(Self.flat)
+		Self.flat = Self.flat[:0]
+	}
+	Self.setLimit(Self.size, time.Since(start))
+	Self.release()
+	return
+}
+
+// setLimit updates the limit of the batch by the rate of the last write
+func (Self *batchWriter) setLimit(size int, d time.Duration) {
+	limit := batchSize
+	if d > 0 {
+		limit = int(float64(size) * float64(batchLatency) / float64(d))
+	}
+	limit = (Self.limit*3 + limit) / 4
+	if limit < poolSizeBuffer {
+		limit = poolSizeBuffer
+	} else if limit > batchSize {
+		limit = batchSize
+	}
+	Self.limit = limit
+}
+
+// release gives the packages of the batch back to the pool
+func (Self *batchWriter) release() {
+	for i, pack := range Self.packs {
+		pack.release()
+		muxPack.Put(pack)
+		Self.packs[i] = nil
+	}
+	for i := range Self.bufs {
+		Self.bufs[i] = nil
+	}
+	Self.packs = Self.packs[:0]
+	Self.bufs = Self.bufs[:0]
+	Self.size = 0
+}
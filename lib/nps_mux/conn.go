@@ -12,6 +12,14 @@ import (
 	"time"
 )
 
+// ErrRemoteClosed is read after the data when the other side closed the conn,
+// io.EOF is only read after its CloseWrite, the conn is still writable then
+var ErrRemoteClosed = errors.New("the conn is closed by the other side")
+
+// halfCloseIdle a half closed conn is closed after no data is read or written for it,
+// the target of a visitor closed fully only gets the close write and may keep its side open
+var halfCloseIdle = time.Minute
+
 type conn struct {
 	net.Conn
 	connStatusOkCh   chan struct{}
@@ -19,9 +27,13 @@ type conn struct {
 	connId           int32
 	isClose          bool
 	closingFlag      bool // closing conn flag
+	writeClosed      bool // CloseWrite is called
 	receiveWindow    *receiveWindow
 	sendWindow       *sendWindow
 	once             sync.Once
+	idleOnce         sync.Once
+	idleTimer        atomic.Pointer[time.Timer] // started after a half close
+	active           atomic.Int64               // unix nano of the last read or write
 }
 
 func NewConn(connId int32, mux *Mux) *conn {
@@ -47,6 +59,12 @@ func (s *conn) Read(buf []byte) (n int, err error) {
 	}
 	// waiting for takeout from receive window finish or timeout
 	n, err = s.receiveWindow.Read(buf, s.connId)
+	if n > 0 {
+		s.active.Store(time.Now().UnixNano())
+	}
+	if err == io.EOF && s.closingFlag {
+		err = ErrRemoteClosed
+	}
 	return
 }
 
@@ -54,16 +72,64 @@ func (s *conn) Write(buf []byte) (n int, err error) {
 	if s.isClose {
 		return 0, errors.New("the conn has closed")
 	}
-	if s.closingFlag {
+	if s.closingFlag || s.writeClosed {
 		return 0, errors.New("io: write on closed conn")
 	}
 	if len(buf) == 0 {
 		return 0, nil
 	}
 	n, err = s.sendWindow.WriteFull(buf, s.connId)
+	if n > 0 {
+		s.active.Store(time.Now().UnixNano())
+	}
 	return
 }
 
+// SetPriority set the priority class of the data sent by the conn,
+// call it before writing, default is PriorityNormal
+func (s *conn) SetPriority(priority uint8) {
+	if priority < priorityCount {
+		s.sendWindow.priority = priority
+	}
+}
+
+// CloseWrite shut down the write direction, the other side reads io.EOF after the data written before,
+// the conn is readable until Close, it fails if the other side does not support half close
+func (s *conn) CloseWrite() error {
+	if s.isClose || s.closingFlag || s.writeClosed {
+		return errors.New("the conn has closed")
+	}
+	if !s.receiveWindow.mux.halfClose.Load() {
+		return errors.New("the other side does not support half close")
+	}
+	s.writeClosed = true
+	// in the chain of the data, it will not overtake the data
+	s.receiveWindow.mux.sendPriority(muxConnCloseWrite, s.connId, s.sendWindow.priority, nil)
+	s.halfClosed()
+	return nil
+}
+
+// halfClosed start to close the conn after it is idle for halfCloseIdle, called after a close write of either side
+func (s *conn) halfClosed() {
+	s.idleOnce.Do(func() {
+		s.active.Store(time.Now().UnixNano())
+		s.idleTimer.Store(time.AfterFunc(halfCloseIdle, s.checkIdle))
+	})
+}
+
+func (s *conn) checkIdle() {
+	if s.isClose {
+		return
+	}
+	if d := halfCloseIdle - time.Since(time.Unix(0, s.active.Load())); d > 0 {
+		if t := s.idleTimer.Load(); t != nil {
+			t.Reset(d)
+		}
+		return
+	}
+	s.Close()
+}
+
 func (s *conn) Close() (err error) {
 	s.once.Do(s.closeProcess)
 	return
@@ -71,11 +137,14 @@ func (s *conn) Close() (err error) {
 
 func (s *conn) closeProcess() {
 	s.isClose = true
+	if t := s.idleTimer.Load(); t != nil {
+		t.Stop()
+	}
 	s.receiveWindow.mux.connMap.Delete(s.connId)
 	if !s.receiveWindow.mux.IsClose() {
 		// if server or user close the conn while reading, will Get a io.EOF
 		// and this Close method will be invoke, send this signal to close other side
-		s.receiveWindow.mux.sendInfo(muxConnClose, s.connId, nil)
+		s.receiveWindow.mux.sendPriority(muxConnClose, s.connId, s.sendWindow.priority, nil)
 	}
 	s.sendWindow.CloseWindow()
 	s.receiveWindow.CloseWindow()
@@ -424,6 +493,7 @@ type sendWindow struct {
 	buf       []byte
 	setSizeCh chan struct{}
 	timeout   time.Time
+	priority  uint8
 	// send window receive the receive window max size and read size
 	// done size store the size send window has send, send and read will be totally equal
 	// so send minus read, send window can get the current window size remaining
@@ -625,9 +695,9 @@ func (Self *sendWindow) WriteFull(buf []byte, id int32) (n int, err error) {
 		n += int(l)
 		l = 0
 		if part {
-			Self.mux.sendInfo(muxNewMsgPart, id, bufSeg)
+			Self.mux.sendPriority(muxNewMsgPart, id, Self.priority, bufSeg)
 		} else {
-			Self.mux.sendInfo(muxNewMsg, id, bufSeg)
+			Self.mux.sendPriority(muxNewMsg, id, Self.priority, bufSeg)
 		}
 		// send to other side, not send nil data to other side
 	}
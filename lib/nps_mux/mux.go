@@ -1,6 +1,7 @@
 package nps_mux
 
 import (
+	"bufio"
 	"errors"
 	"io"
 	"log"
@@ -21,6 +22,7 @@ const (
 	muxNewConn
 	muxConnClose
 	muxPingReturn
+	muxConnCloseWrite
 	muxPing            int32 = -1
 	maximumSegmentSize       = poolSizeWindow
 	maximumWindowSize        = 1 << 27 // 1<<31-1 TCP slide window size is very large,
@@ -42,6 +44,7 @@ type Mux struct {
 	pingCheckTime      uint32 // we check the ping per 5s
 	pingCheckThreshold uint32
 	connType           string
+	halfClose          atomic.Bool // the other side knows muxConnCloseWrite
 	writeQueue         priorityQueue
 	newConnQueue       connQueue
 }
@@ -122,7 +125,23 @@ func (s *Mux) Addr() net.Addr {
 	return s.conn.LocalAddr()
 }
 
+// EnableHalfClose is called when the other side supports the close write frame,
+// otherwise CloseWrite of the conns fails and the caller should close the conn
+func (s *Mux) EnableHalfClose() {
+	s.halfClose.Store(true)
+}
+
+// SetWeight set the bandwidth share of a priority class of the streams,
+// the data of the classes are sent by the shares when the link is busy
+func (s *Mux) SetWeight(priority uint8, weight uint32) {
+	s.writeQueue.SetWeight(priority, weight)
+}
+
 func (s *Mux) sendInfo(flag uint8, id int32, data interface{}) {
+	s.sendPriority(flag, id, PriorityNormal, data)
+}
+
+func (s *Mux) sendPriority(flag uint8, id int32, priority uint8, data interface{}) {
 	if s.isClose.Load() {
 		return
 	}
@@ -135,35 +154,36 @@ func (s *Mux) sendInfo(flag uint8, id int32, data interface{}) {
 		_ = s.Close()
 		return
 	}
+	pack.priority = priority
 	s.writeQueue.Push(pack)
 	return
 }
 
 func (s *Mux) writeSession() {
 	go func() {
+		w := newBatchWriter(s.conn)
 		for {
 			if s.isClose.Load() {
 				break
 			}
 			pack := s.writeQueue.Pop()
-			if s.isClose.Load() {
+			if s.isClose.Load() || pack == nil {
 				break
 			}
-			//if pack.flag == muxNewMsg || pack.flag == muxNewMsgPart {
-			//	if pack.length >= 100 {
-			//		log.Println("write session id", pack.id, "\n", string(pack.content[:100]))
-			//	} else {
-			//		log.Println("write session id", pack.id, "\n", string(pack.content[:pack.length]))
-			//	}
-			//}
-			err := pack.Pack(s.conn)
-			muxPack.Put(pack)
-			if err != nil {
+			// take the packages queued by now into the batch, never wait for more,
+			// a package waits for one batch write at most
+			for full := w.add(pack); !full; full = w.add(pack) {
+				if pack = s.writeQueue.TryPop(); pack == nil {
+					break
+				}
+			}
+			if err := w.flush(); err != nil {
 				log.Println("mux: Pack err", err)
 				_ = s.Close()
 				break
 			}
 		}
+		w.release()
 	}()
 }
 
@@ -242,13 +262,15 @@ func (s *Mux) readSession() {
 		var pack *muxPackager
 		var l uint16
 		var err error
+		// unpack the frames from the buffer, not a small read for every header
+		r := bufio.NewReaderSize(s.conn, batchSize)
 		for {
 			if s.isClose.Load() {
 				return
 			}
 			pack = muxPack.Get()
 			s.bw.StartRead()
-			if l, err = pack.UnPack(s.conn); err != nil {
+			if l, err = pack.UnPack(r); err != nil {
 				log.Println("mux: read session unpack from connection err", err)
 				_ = s.Close()
 				break
@@ -299,8 +321,12 @@ func (s *Mux) readSession() {
 					connection.closingFlag = true
 					connection.receiveWindow.Stop() // close signal to receive window
 					continue
+				case muxConnCloseWrite: //the other side will not write, read io.EOF after the data
+					connection.receiveWindow.Stop()
+					connection.halfClosed()
+					continue
 				}
-			} else if pack.flag == muxConnClose {
+			} else if pack.flag == muxConnClose || pack.flag == muxConnCloseWrite {
 				continue
 			}
 			muxPack.Put(pack)
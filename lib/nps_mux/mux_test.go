@@ -701,3 +701,276 @@ func TestChain(t *testing.T) {
 //	}()
 //	time.Sleep(time.Second * 100000)
 //}
+
+func TestPriorityWeights(t *testing.T) {
+	q := new(priorityQueue)
+	q.New()
+	q.SetWeight(PriorityBulk, 2)
+	for p := uint8(0); p < priorityCount; p++ {
+		for i := 0; i < 100; i++ {
+			pack := &muxPackager{flag: muxNewMsg, priority: p}
+			pack.length = maximumSegmentSize
+			q.push(pack)
+		}
+	}
+	// normal 4, high 8, bulk 2 segments each round
+	var count [priorityCount]int
+	for i := 0; i < 140; i++ {
+		count[q.TryPop().priority]++
+	}
+	if count != [priorityCount]int{40, 80, 20} {
+		t.Fatal(count)
+	}
+	// the other classes are idle, bulk gets all of the bandwidth
+	for q.TryPop() != nil {
+	}
+	for i := 0; i < 10; i++ {
+		q.push(&muxPackager{flag: muxNewMsg, priority: PriorityBulk})
+	}
+	for i := 0; i < 10; i++ {
+		if pack := q.TryPop(); pack == nil || pack.priority != PriorityBulk {
+			t.Fatal(i, pack)
+		}
+	}
+}
+
+// dequeuedAfter returns how many packages are popped before the interactive
+// package of the class, when it is pushed behind a backlog of bulk data
+func dequeuedAfter(interactive uint8) int {
+	q := new(priorityQueue)
+	q.New()
+	for i := 0; i < 100; i++ {
+		pack := &muxPackager{flag: muxNewMsg, priority: PriorityBulk}
+		pack.length = maximumSegmentSize
+		q.push(pack)
+	}
+	// the bulk stream is sending
+	for i := 0; i < 10; i++ {
+		q.TryPop()
+	}
+	pack := &muxPackager{flag: muxNewMsg, priority: interactive}
+	pack.length = 16
+	q.push(pack)
+	for n := 0; ; n++ {
+		pack := q.TryPop()
+		if pack == nil {
+			return -1
+		}
+		if pack.length == 16 {
+			return n
+		}
+	}
+}
+
+func TestPriorityLatency(t *testing.T) {
+	// same class, it waits for the whole backlog
+	if n := dequeuedAfter(PriorityBulk); n != 90 {
+		t.Fatal("same class with the bulk stream:", n)
+	}
+	// the bulk class only finishes its quota of the round
+	for _, p := range []uint8{PriorityNormal, PriorityHigh} {
+		if n := dequeuedAfter(p); n < 0 || n > 1 {
+			t.Fatal("priority", p, "waits for", n, "bulk packages")
+		}
+	}
+}
+
+func TestMuxStats(t *testing.T) {
+	a, b := net.Pipe()
+	server := NewMux(a, "tcp", 0)
+	client := NewMux(b, "tcp", 0)
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := server.Accept()
+		accepted <- c
+	}()
+	c, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetPriority(PriorityBulk)
+	<-accepted
+	if _, err := c.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// the data is not read by the server
+	st := server.Stats()
+	if st.Streams != 1 || st.Conns[0].RecvBuffered != 1000 || st.Conns[0].RecvWindow == 0 {
+		t.Fatalf("%+v", st)
+	}
+	st = client.Stats()
+	if st.Streams != 1 || st.Conns[0].Priority != PriorityBulk || st.Conns[0].SendUsed != 1000 || st.Queued != 0 || st.Latency <= 0 {
+		t.Fatalf("%+v", st)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	a, b := net.Pipe()
+	server := NewMux(a, "tcp", 0)
+	client := NewMux(b, "tcp", 0)
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := server.Accept()
+		accepted <- c
+	}()
+	c, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	// the other side may not know the fin frame
+	if err := c.CloseWrite(); err == nil {
+		t.Fatal("half close without EnableHalfClose")
+	}
+	client.EnableHalfClose()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("ping")); err == nil {
+		t.Fatal("write after half close")
+	}
+	if buf, err := io.ReadAll(s); err != nil || string(buf) != "ping" {
+		t.Fatal(string(buf), err)
+	}
+	// the other direction is still open
+	go func() {
+		s.Write([]byte("pong"))
+		s.Close()
+	}()
+	// the full close is not read as a half close
+	if buf, err := io.ReadAll(c); err != ErrRemoteClosed || string(buf) != "pong" {
+		t.Fatal(string(buf), err)
+	}
+	c.Close()
+}
+
+// a half closed conn is closed after it is idle, the data in time keeps it
+func TestHalfCloseIdle(t *testing.T) {
+	defer func(d time.Duration) { halfCloseIdle = d }(halfCloseIdle)
+	halfCloseIdle = 200 * time.Millisecond
+	a, b := net.Pipe()
+	server := NewMux(a, "tcp", 0)
+	client := NewMux(b, "tcp", 0)
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := server.Accept()
+		accepted <- c
+	}()
+	client.EnableHalfClose()
+	c, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := io.ReadAll(s); err != nil || len(buf) != 0 {
+		t.Fatal(string(buf), err)
+	}
+	start := time.Now()
+	go func() {
+		for i := 0; i < 5; i++ {
+			if _, err := s.Write([]byte("data")); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	// the read ends when either side is closed by the idle
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, _ := io.ReadAll(c)
+	if string(buf) != string(bytes.Repeat([]byte("data"), 5)) {
+		t.Fatal(string(buf))
+	}
+	if d := time.Since(start); d < 600*time.Millisecond || d > 2*time.Second {
+		t.Fatal("closed after", d)
+	}
+	// the other side is closed too
+	time.Sleep(100 * time.Millisecond)
+	if _, err := s.Write([]byte("data")); err == nil {
+		t.Fatal("the other side is not closed")
+	}
+}
+
+// tcpPair returns both sides of a loopback tcp connection
+func tcpPair(b testing.TB) (client, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	if client, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		b.Fatal(err)
+	}
+	server = <-ch
+	return
+}
+
+// benchmarkMux writes size bytes per call on streams conns at the same time
+func benchmarkMux(b *testing.B, streams, size int) {
+	c1, c2 := tcpPair(b)
+	server := NewMux(c1, "tcp", 0)
+	client := NewMux(c2, "tcp", 0)
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+	conns := make([]net.Conn, streams)
+	for i := range conns {
+		c, err := client.NewConn()
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer c.Close()
+		conns[i] = c
+	}
+	buf := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		n := b.N / streams
+		if i < b.N%streams {
+			n++
+		}
+		wg.Add(1)
+		go func(c net.Conn, n int) {
+			defer wg.Done()
+			for ; n > 0; n-- {
+				if _, err := c.Write(buf); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(c, n)
+	}
+	wg.Wait()
+}
+
+func BenchmarkMuxSmall(b *testing.B)        { benchmarkMux(b, 1, 128) }
+func BenchmarkMuxSmallStreams(b *testing.B) { benchmarkMux(b, 16, 128) }
+func BenchmarkMuxLarge(b *testing.B)        { benchmarkMux(b, 1, 64<<10) }
+func BenchmarkMuxLargeStreams(b *testing.B) { benchmarkMux(b, 16, 64<<10) }
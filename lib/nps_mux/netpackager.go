@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/astaxie/beego/logs"
 	"io"
+	"net"
 )
 
 type basePackager struct {
@@ -46,16 +47,6 @@ func (Self *basePackager) Set(content []byte) (err error) {
 	return
 }
 
-func (Self *basePackager) Pack(writer io.Writer) (err error) {
-	binary.LittleEndian.PutUint16(Self.buf[5:7], Self.length)
-	_, err = writer.Write(Self.buf[:7])
-	if err != nil {
-		return
-	}
-	_, err = writer.Write(Self.content[:Self.length])
-	return
-}
-
 func (Self *basePackager) UnPack(reader io.Reader) (n uint16, err error) {
 	Self.reset()
 	l, err := io.ReadFull(reader, Self.buf[5:7])
@@ -89,9 +80,10 @@ func (Self *basePackager) reset() {
 }
 
 type muxPackager struct {
-	flag   uint8
-	id     int32
-	window uint64
+	flag     uint8
+	id       int32
+	window   uint64
+	priority uint8 // class of the conn, only used by the write queue
 	basePackager
 }
 
@@ -113,21 +105,41 @@ func (Self *muxPackager) Set(flag uint8, id int32, content interface{}) (err err
 }
 
 func (Self *muxPackager) Pack(writer io.Writer) (err error) {
+	bufs := Self.appendTo(make(net.Buffers, 0, 2))
+	_, err = bufs.WriteTo(writer)
+	Self.release()
+	return
+}
+
+// appendTo appends the header and the content of the package to bufs without copying,
+// the buffers can not be used after release
+func (Self *muxPackager) appendTo(bufs net.Buffers) net.Buffers {
 	Self.buf = Self.buf[0:13]
 	Self.buf[0] = byte(Self.flag)
 	binary.LittleEndian.PutUint32(Self.buf[1:5], uint32(Self.id))
 	switch Self.flag {
 	case muxNewMsg, muxNewMsgPart, muxPingFlag, muxPingReturn:
-		err = Self.basePackager.Pack(writer)
-		windowBuff.Put(Self.content)
+		binary.LittleEndian.PutUint16(Self.buf[5:7], Self.length)
+		bufs = append(bufs, Self.buf[:7])
+		if Self.length > 0 {
+			bufs = append(bufs, Self.content[:Self.length])
+		}
 	case muxMsgSendOk:
 		binary.LittleEndian.PutUint64(Self.buf[5:13], Self.window)
-		_, err = writer.Write(Self.buf[:13])
+		bufs = append(bufs, Self.buf[:13])
 	default:
-		_, err = writer.Write(Self.buf[:5])
+		bufs = append(bufs, Self.buf[:5])
+	}
+	return bufs
+}
+
+// release gives the buffers of a packed package back to the pool
+func (Self *muxPackager) release() {
+	switch Self.flag {
+	case muxNewMsg, muxNewMsgPart, muxPingFlag, muxPingReturn:
+		windowBuff.Put(Self.content)
 	}
 	windowBuff.Put(Self.buf)
-	return
 }
 
 func (Self *muxPackager) UnPack(reader io.Reader) (n uint16, err error) {
@@ -167,5 +179,6 @@ func (Self *muxPackager) reset() {
 	Self.length = 0
 	Self.content = nil
 	Self.window = 0
+	Self.priority = 0
 	Self.buf = nil
 }
@@ -11,10 +11,25 @@ import (
 	"unsafe"
 )
 
+// priority classes of the streams, the data of the classes share the
+// bandwidth by their weights, see Mux.SetWeight
+const (
+	PriorityNormal uint8 = iota
+	PriorityHigh
+	PriorityBulk
+	priorityCount
+)
+
+var defaultWeights = [priorityCount]uint32{PriorityNormal: 4, PriorityHigh: 8, PriorityBulk: 1}
+
 type priorityQueue struct {
 	highestChain *bufChain
 	middleChain  *bufChain
-	lowestChain  *bufChain
+	dataChains   [priorityCount]*bufChain
+	weights      [priorityCount]uint32
+	deficit      [priorityCount]int64
+	current      uint8
+	queued       atomic.Int64 // bytes of the data in the chains
 	starving     uint8
 	stop         bool
 	cond         *sync.Cond
@@ -25,13 +40,17 @@ func (Self *priorityQueue) New() {
 	Self.highestChain.new(4)
 	Self.middleChain = new(bufChain)
 	Self.middleChain.new(32)
-	Self.lowestChain = new(bufChain)
-	Self.lowestChain.new(256)
+	for i := range Self.dataChains {
+		Self.dataChains[i] = new(bufChain)
+		Self.dataChains[i].new(256)
+		Self.weights[i] = defaultWeights[i]
+	}
 	locker := new(sync.Mutex)
 	Self.cond = sync.NewCond(locker)
 }
 
 func (Self *priorityQueue) Push(packager *muxPackager) {
+	Self.queued.Add(int64(packager.length))
 	Self.push(packager)
 	Self.cond.Broadcast()
 	return
@@ -43,14 +62,49 @@ func (Self *priorityQueue) push(packager *muxPackager) {
 		Self.highestChain.pushHead(unsafe.Pointer(packager))
 	// the ping package need highest priority
 	// prevent ping calculation error
-	case muxNewConn, muxNewConnOk, muxNewConnFail:
-		// the New conn package need some priority too
+	case muxNewConn, muxNewConnOk, muxNewConnFail, muxMsgSendOk:
+		// the New conn package need some priority too,
+		// the window size package is small, but the other side waits for it
 		Self.middleChain.pushHead(unsafe.Pointer(packager))
 	default:
-		Self.lowestChain.pushHead(unsafe.Pointer(packager))
+		// the data and close package of a conn stay in the chain of its class,
+		// close package will not overtake the data
+		Self.dataChains[packager.priority%priorityCount].pushHead(unsafe.Pointer(packager))
 	}
 }
 
+// SetWeight set the bandwidth share of the priority class, minimum is 1
+func (Self *priorityQueue) SetWeight(priority uint8, weight uint32) {
+	if priority >= priorityCount {
+		return
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	atomic.StoreUint32(&Self.weights[priority], weight)
+}
+
+// popData pops the data packages by deficit round robin, a class sends
+// weight * maximumSegmentSize bytes each round, an idle class can not save
+// up its quota, so a busy bulk class only delays others a few segments
+func (Self *priorityQueue) popData() (packager *muxPackager) {
+	for i := uint8(0); i <= priorityCount; i++ {
+		c := Self.current
+		if Self.deficit[c] > 0 {
+			ptr, ok := Self.dataChains[c].popTail()
+			if ok {
+				packager = (*muxPackager)(ptr)
+				Self.deficit[c] -= int64(packager.length)
+				return
+			}
+			Self.deficit[c] = 0
+		}
+		Self.current = (c + 1) % priorityCount
+		Self.deficit[Self.current] += int64(atomic.LoadUint32(&Self.weights[Self.current])) * maximumSegmentSize
+	}
+	return
+}
+
 const maxStarving uint8 = 8
 
 func (Self *priorityQueue) Pop() (packager *muxPackager) {
@@ -84,13 +138,21 @@ func (Self *priorityQueue) Pop() (packager *muxPackager) {
 }
 
 func (Self *priorityQueue) TryPop() (packager *muxPackager) {
+	packager = Self.tryPop()
+	if packager != nil {
+		Self.queued.Add(-int64(packager.length))
+	}
+	return
+}
+
+func (Self *priorityQueue) tryPop() (packager *muxPackager) {
 	ptr, ok := Self.highestChain.popTail()
 	if ok {
 		packager = (*muxPackager)(ptr)
 		return
 	}
 	if Self.starving < maxStarving {
-		// not pop too much, lowestChain will wait too long
+		// not pop too much, data chains will wait too long
 		ptr, ok = Self.middleChain.popTail()
 		if ok {
 			packager = (*muxPackager)(ptr)
@@ -98,9 +160,8 @@ func (Self *priorityQueue) TryPop() (packager *muxPackager) {
 			return
 		}
 	}
-	ptr, ok = Self.lowestChain.popTail()
-	if ok {
-		packager = (*muxPackager)(ptr)
+	packager = Self.popData()
+	if packager != nil {
 		if Self.starving > 0 {
 			Self.starving = Self.starving / 2
 		}
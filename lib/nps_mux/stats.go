@@ -0,0 +1,58 @@
+package nps_mux
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the runtime state of the mux, for troubleshooting slow connections
+type Stats struct {
+	Addr      string        // remote address of the connection
+	Latency   time.Duration // round trip time of the ping
+	Bandwidth float64       // estimated read bandwidth, bytes/s, 0 before enough data is read
+	Streams   int           // open streams
+	Queued    int64         // bytes waiting in the write queue
+	Conns     []StreamStats
+}
+
+// StreamStats is the window state of a stream
+type StreamStats struct {
+	Id           int32
+	Priority     uint8
+	SendWindow   uint32 // window size granted by the other side
+	SendUsed     uint32 // bytes sent and not read by the other side yet
+	SendWaiting  bool   // the writer waits for the window
+	RecvWindow   uint32
+	RecvBuffered uint32 // bytes received and not read by the application
+	RecvWaiting  bool   // the other side is told to wait
+}
+
+// Stats returns the state of the mux and its streams
+func (s *Mux) Stats() Stats {
+	st := Stats{
+		Latency:   time.Duration(math.Float64frombits(atomic.LoadUint64(&s.latency)) * float64(time.Second)),
+		Bandwidth: s.bw.Get(),
+		Queued:    s.writeQueue.queued.Load(),
+	}
+	if addr := s.conn.RemoteAddr(); addr != nil {
+		st.Addr = addr.String()
+	}
+	s.connMap.RLock()
+	for _, c := range s.connMap.cMap {
+		st.Conns = append(st.Conns, c.stats())
+	}
+	s.connMap.RUnlock()
+	st.Streams = len(st.Conns)
+	sort.Slice(st.Conns, func(i, j int) bool { return st.Conns[i].Id < st.Conns[j].Id })
+	return st
+}
+
+func (s *conn) stats() StreamStats {
+	st := StreamStats{Id: s.connId, Priority: s.sendWindow.priority}
+	st.SendWindow, st.SendUsed, st.SendWaiting = s.sendWindow.unpack(atomic.LoadUint64(&s.sendWindow.maxSizeDone))
+	st.RecvWindow, _, st.RecvWaiting = s.receiveWindow.unpack(atomic.LoadUint64(&s.receiveWindow.maxSizeDone))
+	st.RecvBuffered = s.receiveWindow.bufQueue.Len()
+	return st
+}
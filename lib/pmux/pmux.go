@@ -14,6 +14,8 @@ import (
 	"time"
 
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/graceful"
 	"github.com/astaxie/beego/logs"
 	"github.com/pkg/errors"
 )
@@ -38,21 +40,54 @@ type PortMux struct {
 	done        chan struct{}  // 关闭时触发 process() 退出，避免 send on closed channel
 	wg          sync.WaitGroup // 跟踪 in-flight process()，保证 Close() 关闭 conn channel 前全部退出
 	managerHost string
+	wsPath      string // http requests with this path are websocket bridge connections
+	wsHost      string // tls connections with this server name are websocket bridge connections
 	clientConn  chan *PortConn
 	httpConn    chan *PortConn
 	httpsConn   chan *PortConn
 	managerConn chan *PortConn
+	wsConn      chan *PortConn
+	wssConn     chan *PortConn
+	served      map[chan *PortConn]bool // the routes served on the port, all if nil, the connections of other routes are closed
 }
 
 func NewPortMux(port int, managerHost string) *PortMux {
-	pMux := &PortMux{
+	return NewPortMuxWithWs(port, managerHost, "", "")
+}
+
+// NewPortMuxWithWs also distinguish websocket bridge connections,
+// ws by the request path and wss by the tls server name
+func NewPortMuxWithWs(port int, managerHost, wsPath, wsHost string) *PortMux {
+	pMux := newPortMux(port, managerHost, wsPath, wsHost)
+	pMux.Start()
+	return pMux
+}
+
+func newPortMux(port int, managerHost, wsPath, wsHost string) *PortMux {
+	return &PortMux{
 		managerHost: managerHost,
+		wsPath:      wsPath,
+		wsHost:      wsHost,
 		port:        port,
 		done:        make(chan struct{}),
 		clientConn:  make(chan *PortConn),
 		httpConn:    make(chan *PortConn),
 		httpsConn:   make(chan *PortConn),
 		managerConn: make(chan *PortConn),
+		wsConn:      make(chan *PortConn),
+		wssConn:     make(chan *PortConn),
+	}
+}
+
+// NewWsPortMux shares the http or https proxy port with the websocket bridge, only the proxy and
+// the websocket bridge are served, the client and manager connections are closed
+func NewWsPortMux(port int, wsPath, wsHost string, http, https bool) *PortMux {
+	pMux := newPortMux(port, "", wsPath, wsHost)
+	pMux.served = map[chan *PortConn]bool{
+		pMux.wsConn:    wsPath != "",
+		pMux.wssConn:   wsHost != "",
+		pMux.httpConn:  http,
+		pMux.httpsConn: https,
 	}
 	pMux.Start()
 	return pMux
@@ -64,7 +99,7 @@ func (pMux *PortMux) Start() error {
 	if err != nil {
 		return err
 	}
-	pMux.Listener, err = net.ListenTCP("tcp", tcpAddr)
+	pMux.Listener, err = graceful.ListenTCP(tcpAddr)
 	if err != nil {
 		logs.Error(err)
 		os.Exit(0)
@@ -110,13 +145,17 @@ func (pMux *PortMux) process(conn net.Conn) {
 		buffer.Reset()
 		r := bufio.NewReader(conn)
 		buffer.Write(buf)
-		for {
+		var isWs bool
+		for first := true; ; first = false {
 			b, _, err := r.ReadLine()
 			if err != nil {
 				logs.Warn("read line error", err.Error())
 				conn.Close()
 				break
 			}
+			if first {
+				isWs = pMux.isWsRequestLine(string(buf) + string(b))
+			}
 			buffer.Write(b)
 			buffer.Write([]byte("\r\n"))
 			if strings.Index(string(b), "Host:") == 0 || strings.Index(string(b), "host:") == 0 {
@@ -125,7 +164,9 @@ func (pMux *PortMux) process(conn net.Conn) {
 				str = strings.Replace(str, "host:", "", -1)
 				str = strings.TrimSpace(str)
 				// Determine whether it is the same as the manager domain name
-				if common.GetIpByAddr(str) == pMux.managerHost {
+				if isWs {
+					ch = pMux.wsConn
+				} else if common.GetIpByAddr(str) == pMux.managerHost {
 					ch = pMux.managerConn
 				} else {
 					ch = pMux.httpConn
@@ -141,6 +182,20 @@ func (pMux *PortMux) process(conn net.Conn) {
 	default: // https
 		readMore = true
 		ch = pMux.httpsConn
+		if pMux.wsHost != "" {
+			var serverName string
+			serverName, rs = readServerName(conn, buf)
+			// the whole record is buffered, later reads go to the conn directly
+			readMore = len(rs) <= len(buf)
+			if serverName == pMux.wsHost {
+				ch = pMux.wssConn
+			}
+		}
+	}
+	if ch == nil || pMux.served != nil && !pMux.served[ch] {
+		// 端口上没有这种连接的服务，例如 http 代理端口上的 ws 复用不接收客户端连接
+		conn.Close()
+		return
 	}
 	// 清除读超时，后续由 PortConn 的消费者自行管理超时
 	conn.SetReadDeadline(time.Time{})
@@ -170,9 +225,55 @@ func (pMux *PortMux) Close() error {
 	close(pMux.httpsConn)
 	close(pMux.httpConn)
 	close(pMux.managerConn)
+	close(pMux.wsConn)
+	close(pMux.wssConn)
 	return nil
 }
 
+// the request line is like "GET /ws HTTP/1.1"
+func (pMux *PortMux) isWsRequestLine(line string) bool {
+	if pMux.wsPath == "" {
+		return false
+	}
+	arr := strings.Split(line, " ")
+	if len(arr) < 2 {
+		return false
+	}
+	path := arr[1]
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return path == pMux.wsPath
+}
+
+// read the tls client hello record, the 3 bytes head has been read
+func readServerName(conn net.Conn, head []byte) (string, []byte) {
+	rb := append([]byte{}, head...)
+	if head[0] != 0x16 {
+		return "", rb
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", rb
+	}
+	rb = append(rb, b...)
+	recordLen := int(b[0])<<8 | int(b[1])
+	if recordLen <= 0 || recordLen > 16384 {
+		return "", rb
+	}
+	body := make([]byte, recordLen)
+	n, err := io.ReadFull(conn, body)
+	rb = append(rb, body[:n]...)
+	if err != nil {
+		return "", rb
+	}
+	clientHello := new(crypt.ClientHelloMsg)
+	if !clientHello.Unmarshal(body) {
+		return "", rb
+	}
+	return clientHello.GetServerName(), rb
+}
+
 func (pMux *PortMux) GetClientListener() net.Listener {
 	return NewPortListener(pMux.clientConn, pMux.Listener.Addr())
 }
@@ -188,3 +289,11 @@ func (pMux *PortMux) GetHttpsListener() net.Listener {
 func (pMux *PortMux) GetManagerListener() net.Listener {
 	return NewPortListener(pMux.managerConn, pMux.Listener.Addr())
 }
+
+func (pMux *PortMux) GetWsListener() net.Listener {
+	return NewPortListener(pMux.wsConn, pMux.Listener.Addr())
+}
+
+func (pMux *PortMux) GetWssListener() net.Listener {
+	return NewPortListener(pMux.wssConn, pMux.Listener.Addr())
+}
@@ -1,9 +1,14 @@
 package pmux
 
 import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
 	"testing"
 	"time"
 
+	"ehang.io/nps/lib/common"
 	"github.com/astaxie/beego/logs"
 )
 
@@ -38,3 +43,86 @@ func TestPortMux_Close(t *testing.T) {
 	conn, err := l.Accept()
 	logs.Warn(conn, err)
 }
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// route send the head on a new connection, the conn accepted by l is returned
+func route(t *testing.T, port int, l net.Listener, send func(c net.Conn)) []byte {
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go send(c)
+	if l == nil {
+		// not served, the conn is closed at once instead of waiting for the accept timeout
+		c.SetReadDeadline(time.Now().Add(time.Second * 3))
+		_, err := c.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+			t.Fatal("the conn is not closed", err)
+		}
+		return nil
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if ac, err := l.Accept(); err == nil {
+			accepted <- ac
+		}
+	}()
+	select {
+	case ac := <-accepted:
+		defer ac.Close()
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(ac, b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	case <-time.After(time.Second * 3):
+		t.Fatal("the conn is not routed")
+	}
+	return nil
+}
+
+func httpGet(path, host string) func(c net.Conn) {
+	return func(c net.Conn) {
+		c.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	}
+}
+
+func tlsHello(serverName string) func(c net.Conn) {
+	return func(c net.Conn) {
+		tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}
+}
+
+func TestWsPortMux(t *testing.T) {
+	// ws on the http proxy port
+	port := freePort(t)
+	m := NewWsPortMux(port, "/ws", "", true, false)
+	defer m.Close()
+	http, ws := m.GetHttpListener(), m.GetWsListener()
+	if b := route(t, port, ws, httpGet("/ws?a=1", "a.com")); string(b) != "GET" {
+		t.Fatal(b)
+	}
+	route(t, port, http, httpGet("/", "a.com"))
+	route(t, port, nil, func(c net.Conn) { c.Write([]byte(common.CONN_TEST)) })
+	route(t, port, nil, tlsHello("a.com"))
+
+	// wss on the https proxy port, by the server name
+	port = freePort(t)
+	m = NewWsPortMux(port, "", "ws.a.com", false, true)
+	defer m.Close()
+	https, wss := m.GetHttpsListener(), m.GetWssListener()
+	if b := route(t, port, wss, tlsHello("ws.a.com")); b[0] != 0x16 {
+		t.Fatal(b)
+	}
+	route(t, port, https, tlsHello("a.com"))
+	route(t, port, nil, httpGet("/ws", "a.com"))
+}
@@ -1,6 +1,7 @@
 package rate
 
 import (
+	"errors"
 	"io"
 )
 
@@ -32,6 +33,13 @@ func (s *rateConn) Write(b []byte) (n int, err error) {
 	return
 }
 
+func (s *rateConn) CloseWrite() error {
+	if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("the conn does not support half close")
+}
+
 func (s *rateConn) Close() error {
 	return s.conn.Close()
 }
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server/cluster"
+	"ehang.io/nps/server/proxy"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// Cluster 集群模式下的节点，未开启时为 nil
+var Cluster *cluster.Cluster
+
+var reconcileLock sync.Mutex
+
+// InitCluster 按 cluster_node 开启集群模式，必须在第一次使用 db 之前调用
+func InitCluster() error {
+	self, err := cluster.ParseNodes(beego.AppConfig.String("cluster_node"))
+	if err != nil || len(self) == 0 {
+		return err
+	}
+	peers, err := cluster.ParseNodes(beego.AppConfig.String("cluster_peers"))
+	if err != nil {
+		return err
+	}
+	key := beego.AppConfig.String("cluster_key")
+	if key == "" {
+		return errors.New("cluster_key must be set in cluster mode")
+	}
+	c := cluster.NewCluster(self[0], peers, key)
+	file.RegisterStore("node", func(arg string) (file.Store, error) {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, err
+		}
+		return c.NewStore(id)
+	})
+	st, err := file.NewStore(beego.AppConfig.DefaultString("cluster_store", "file:conf"))
+	if err != nil {
+		return err
+	}
+	// 使用 node:id 的节点读写本节点的存储
+	c.Store = st
+	c.LocalClients = func() []int {
+		if Bridge == nil {
+			return nil
+		}
+		return Bridge.GetClientIds()
+	}
+	c.Link = func(clientId, taskId int, link *conn.Link) (net.Conn, error) {
+		var t *file.Tunnel
+		if taskId != 0 {
+			t, _ = file.GetDb().GetTask(taskId)
+		}
+		return Bridge.SendLocalLinkInfo(clientId, link, t)
+	}
+	c.Flows = eachFlow
+	c.OnMembers = func() {
+		go reconcileTasks()
+	}
+	c.OnChanged = reloadFromStore
+	if err := c.Start(); err != nil {
+		return err
+	}
+	file.SetStore(st)
+	db := file.GetDb().JsonDb
+	db.OnStore = func(name string) {
+		go c.Notify(name)
+	}
+	// 合并了其他节点的修改，重新加载保存的文件
+	db.OnMerge = func(name string) {
+		go reloadFromStore(name)
+	}
+	// 各节点新建的记录使用不同的 id
+	step := self[0].Id
+	for _, p := range peers {
+		if p.Id > step {
+			step = p.Id
+		}
+	}
+	db.SetIdStep(step, self[0].Id)
+	Cluster = c
+	logs.Info("cluster node %d started at %s, the alive nodes are %v", c.Self.Id, c.Self.Addr, c.Members())
+	go func() {
+		// 端口在节点之间移动时旧节点可能还没有关闭，定时重试
+		for range time.Tick(time.Second * 10) {
+			reconcileTasks()
+		}
+	}()
+	return nil
+}
+
+// reloadFromStore 重新加载其他节点保存的文件，重启设置改变的隧道
+func reloadFromStore(name string) {
+	if Cluster == nil {
+		// 启动中，db 还没有加载
+		return
+	}
+	restart := file.GetDb().JsonDb.ReloadFromStore(name)
+	for _, id := range restart {
+		closeServer(id)
+	}
+	reconcileTasks()
+}
+
+// remoteLink 打开到其他节点上客户端的链接
+func remoteLink(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error) {
+	var taskId int
+	if t != nil {
+		taskId = t.Id
+	}
+	return Cluster.NewLink(clientId, link, taskId)
+}
+
+// ownTask 集群模式下隧道端口只在选中的节点上监听，npc 配置文件的隧道在其连接的节点上
+func ownTask(t *file.Tunnel) bool {
+	if Cluster == nil || t.NoStore || t.Port == 0 || t.Mode == "secret" || t.Mode == "p2p" {
+		return true
+	}
+	return Cluster.Owner(t.Port) == Cluster.Self.Id
+}
+
+// reconcileTasks 启动本节点拥有的隧道，关闭移到其他节点的
+func reconcileTasks() {
+	if Cluster == nil {
+		return
+	}
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		t := value.(*file.Tunnel)
+		_, running := RunList.Load(t.Id)
+		if want := t.Status && ownTask(t); want && !running {
+			AddTask(t)
+		} else if !want && running {
+			logs.Info("task %d port %d is owned by node %d", t.Id, t.Port, Cluster.Owner(t.Port))
+			closeServer(t.Id)
+		}
+		return true
+	})
+}
+
+// closeServer 关闭隧道的监听，不改变隧道的状态
+func closeServer(id int) {
+	if v, ok := RunList.Load(id); ok {
+		if svr, ok := v.(proxy.Service); ok {
+			if err := svr.Close(); err != nil {
+				logs.Error("stop server id %d error", id, err)
+			}
+		}
+		RunList.Delete(id)
+	}
+}
+
+func eachFlow(f func(key string, flow *file.Flow)) {
+	db := file.GetDb().JsonDb
+	db.Clients.Range(func(key, value interface{}) bool {
+		f("client/"+strconv.Itoa(key.(int)), value.(*file.Client).Flow)
+		return true
+	})
+	db.Tasks.Range(func(key, value interface{}) bool {
+		f("task/"+strconv.Itoa(key.(int)), value.(*file.Tunnel).Flow)
+		return true
+	})
+	db.Hosts.Range(func(key, value interface{}) bool {
+		f("host/"+strconv.Itoa(key.(int)), value.(*file.Host).Flow)
+		return true
+	})
+}
@@ -0,0 +1,575 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/graceful"
+	"github.com/astaxie/beego/logs"
+)
+
+// Node is a nps of the cluster
+type Node struct {
+	Id   int
+	Addr string // address of the link between the nodes
+}
+
+// ParseNodes parse the nodes of the setting, eg: 1@10.0.0.1:8030,2@10.0.0.2:8030
+func ParseNodes(s string) ([]Node, error) {
+	var nodes []Node
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(v, "@")
+		n, err := strconv.Atoi(id)
+		if !ok || err != nil || n <= 0 || addr == "" {
+			return nil, fmt.Errorf("the node %s is not id@host:port", v)
+		}
+		nodes = append(nodes, Node{Id: n, Addr: addr})
+	}
+	return nodes, nil
+}
+
+// Cluster link the nps nodes sharing one store, the public ports are owned by the alive nodes
+// and a visitor on a node is forwarded to the node of the client
+type Cluster struct {
+	Self     Node
+	Interval time.Duration // heartbeat interval, a peer is down after 3 missed heartbeats
+
+	LocalClients func() []int                                                  // clients with a bridge connection on this node
+	Link         func(clientId, taskId int, link *conn.Link) (net.Conn, error) // open a link to a local client for a peer
+	Flows        func(f func(key string, flow *file.Flow))                     // the flow counters to aggregate
+	OnMembers    func()                                                        // the alive nodes changed
+	OnChanged    func(name string)                                             // a file of the store is saved by a peer
+	Store        file.Store                                                    // served to the peers using the store of this node
+
+	key      []byte
+	peers    map[int]*peer
+	members  []int
+	accepted []conn.Tunnel
+	mu       sync.Mutex
+	flows    *flowTracker
+	listener net.Listener
+	closing  chan struct{}
+	once     sync.Once
+}
+
+type peer struct {
+	Node
+	mu       sync.Mutex
+	lastSeen time.Time
+	clients  map[int]bool
+	linkMu   sync.Mutex
+	tunnel   conn.Tunnel // the link dialed by this node, the requests go on it
+}
+
+type request struct {
+	Type     string
+	From     int
+	Clients  []int               `json:",omitempty"`
+	Flows    map[string][2]int64 `json:",omitempty"`
+	ClientId int                 `json:",omitempty"`
+	TaskId   int                 `json:",omitempty"`
+	Link     *conn.Link          `json:",omitempty"`
+	Name     string              `json:",omitempty"`
+	Data     []byte              `json:",omitempty"`
+	Version  string              `json:",omitempty"` // the version of the file to save, see file.CasStore
+}
+
+type response struct {
+	Error   string `json:",omitempty"`
+	Data    []byte `json:",omitempty"`
+	Version string `json:",omitempty"`
+	Saved   bool   `json:",omitempty"`
+}
+
+// handshake of a link, each node signs the nonce of the other by the cluster key
+type handshake struct {
+	Id    int
+	Nonce string `json:",omitempty"`
+	Sign  string `json:",omitempty"`
+}
+
+// secureConn the link after the handshake is encrypted by aead, the keys are derived from the cluster key and both nonces
+type secureConn struct {
+	net.Conn
+	aead *conn.AeadConn
+}
+
+func (s *Cluster) secure(c net.Conn, acceptNonce, dialNonce string, accepted bool) (net.Conn, error) {
+	a, err := conn.NewAeadConn(c, s.key, []byte(acceptNonce+" "+dialNonce), accepted)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{Conn: c, aead: a}, nil
+}
+
+func (s *secureConn) Read(b []byte) (int, error) {
+	return s.aead.Read(b)
+}
+
+func (s *secureConn) Write(b []byte) (int, error) {
+	return s.aead.Write(b)
+}
+
+func NewCluster(self Node, peers []Node, key string) *Cluster {
+	s := &Cluster{
+		Self:     self,
+		Interval: time.Second,
+		key:      []byte(key),
+		peers:    make(map[int]*peer),
+		members:  []int{self.Id},
+		flows:    newFlowTracker(),
+		closing:  make(chan struct{}),
+	}
+	for _, n := range peers {
+		if n.Id != self.Id {
+			s.peers[n.Id] = &peer{Node: n}
+		}
+	}
+	return s
+}
+
+// Start listen the link of the peers and connect to them, it returns after the first heartbeats
+func (s *Cluster) Start() error {
+	l, err := graceful.Listen(s.Self.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	go conn.Accept(l, s.accept)
+	for _, p := range s.peers {
+		go s.keepPeer(p)
+	}
+	go s.watchMembers()
+	time.Sleep(s.Interval * 2)
+	s.updateMembers()
+	return nil
+}
+
+func (s *Cluster) Close() {
+	s.once.Do(func() {
+		close(s.closing)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		s.mu.Lock()
+		accepted := s.accepted
+		s.accepted = nil
+		s.mu.Unlock()
+		for _, t := range accepted {
+			t.Close()
+		}
+		for _, p := range s.peers {
+			p.linkMu.Lock()
+			if p.tunnel != nil {
+				p.tunnel.Close()
+			}
+			p.linkMu.Unlock()
+		}
+	})
+}
+
+// Members returns the alive nodes, this node included
+func (s *Cluster) Members() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.members...)
+}
+
+// Owner returns the node owning the port, picked by rendezvous hashing so only the ports of a joined or lost node move
+func (s *Cluster) Owner(port int) int {
+	var owner int
+	var best uint64
+	for _, id := range s.Members() {
+		sum := sha256.Sum256([]byte(strconv.Itoa(port) + ":" + strconv.Itoa(id)))
+		if v := binary.BigEndian.Uint64(sum[:8]); owner == 0 || v > best {
+			owner, best = id, v
+		}
+	}
+	return owner
+}
+
+// ClientNode returns the alive peer holding the bridge connection of the client, 0 if none
+func (s *Cluster) ClientNode(clientId int) int {
+	for _, p := range s.peers {
+		p.mu.Lock()
+		ok := p.clients[clientId] && s.alive(p)
+		p.mu.Unlock()
+		if ok {
+			return p.Id
+		}
+	}
+	return 0
+}
+
+// NewLink open a link to the client on another node, the peer applies the codec of the client,
+// the data between the nodes is encrypted by the cluster link
+func (s *Cluster) NewLink(clientId int, link *conn.Link, taskId int) (net.Conn, error) {
+	id := s.ClientNode(clientId)
+	if id == 0 {
+		return nil, fmt.Errorf("the client %d is not connect", clientId)
+	}
+	c, err := s.openStream(s.peers[id])
+	if err != nil {
+		return nil, err
+	}
+	timeout := link.Option.Timeout + s.Interval*3
+	c.SetDeadline(time.Now().Add(timeout))
+	_, err = s.call(c, &request{Type: "link", ClientId: clientId, TaskId: taskId, Link: link})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	link.Crypt, link.Compress, link.Cipher, link.Compression = false, false, "", ""
+	return c, nil
+}
+
+// Notify tell the alive peers the file is saved
+func (s *Cluster) Notify(name string) {
+	for _, p := range s.peers {
+		p.mu.Lock()
+		ok := s.alive(p)
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if err := s.send(p, &request{Type: "changed", Name: name}); err != nil {
+			logs.Warn("notify node %d error %v", p.Id, err)
+		}
+	}
+}
+
+func (s *Cluster) alive(p *peer) bool {
+	return !p.lastSeen.IsZero() && time.Since(p.lastSeen) < s.Interval*3
+}
+
+func (s *Cluster) sign(id int, nonce string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(strconv.Itoa(id) + " " + nonce))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *Cluster) verify(h *handshake, nonce string) error {
+	if !hmac.Equal([]byte(h.Sign), []byte(s.sign(h.Id, nonce))) {
+		return errors.New("the cluster key does not match")
+	}
+	return nil
+}
+
+func (s *Cluster) accept(c net.Conn) {
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	nonce := crypt.GetRandomString(16)
+	var h handshake
+	if err := writeMsg(c, &handshake{Id: s.Self.Id, Nonce: nonce}); err != nil || readMsg(c, &h) != nil {
+		c.Close()
+		return
+	}
+	p, ok := s.peers[h.Id]
+	if err := s.verify(&h, nonce); err != nil || !ok {
+		logs.Warn("the node %d from %s is refused, error %v", h.Id, c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	if err := writeMsg(c, &handshake{Id: s.Self.Id, Sign: s.sign(s.Self.Id, h.Nonce)}); err != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	sc, err := s.secure(c, nonce, h.Nonce, true)
+	if err != nil {
+		c.Close()
+		return
+	}
+	t := conn.NewTunnel(sc, "tcp", 60)
+	s.mu.Lock()
+	s.accepted = append(s.accepted, t)
+	s.mu.Unlock()
+	logs.Info("the node %d connected from %s", p.Id, c.RemoteAddr())
+	defer func() {
+		t.Close()
+		s.mu.Lock()
+		for i, v := range s.accepted {
+			if v == t {
+				s.accepted = append(s.accepted[:i], s.accepted[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+	}()
+	for {
+		stream, err := t.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(p, stream)
+	}
+}
+
+func (s *Cluster) dial(p *peer) (conn.Tunnel, error) {
+	c, err := net.DialTimeout("tcp", p.Addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	nonce := crypt.GetRandomString(16)
+	var h handshake
+	if err = readMsg(c, &h); err == nil && h.Id != p.Id {
+		err = fmt.Errorf("the node at %s is %d", p.Addr, h.Id)
+	}
+	acceptNonce := h.Nonce
+	if err == nil {
+		err = writeMsg(c, &handshake{Id: s.Self.Id, Nonce: nonce, Sign: s.sign(s.Self.Id, h.Nonce)})
+	}
+	if err == nil {
+		if err = readMsg(c, &h); err == nil {
+			err = s.verify(&h, nonce)
+		}
+	}
+	var sc net.Conn
+	if err == nil {
+		sc, err = s.secure(c, acceptNonce, nonce, false)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return conn.NewTunnel(sc, "tcp", 60), nil
+}
+
+// keepPeer keep the link to the peer and send the heartbeats on it
+func (s *Cluster) keepPeer(p *peer) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		err := s.send(p, &request{Type: "heartbeat", Clients: s.localClients(), Flows: s.flows.local(s.Flows)})
+		if err != nil {
+			logs.Trace("heartbeat to node %d error %v", p.Id, err)
+		}
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Cluster) localClients() []int {
+	if s.LocalClients == nil {
+		return nil
+	}
+	return s.LocalClients()
+}
+
+// openStream open a stream on the link to the peer, the link is dialed again if it is closed
+func (s *Cluster) openStream(p *peer) (net.Conn, error) {
+	p.linkMu.Lock()
+	if p.tunnel == nil || p.tunnel.IsClose() {
+		select {
+		case <-s.closing:
+			p.linkMu.Unlock()
+			return nil, errors.New("the cluster is closed")
+		default:
+		}
+		t, err := s.dial(p)
+		if err != nil {
+			p.linkMu.Unlock()
+			return nil, err
+		}
+		p.tunnel = t
+	}
+	t := p.tunnel
+	p.linkMu.Unlock()
+	// 打开流时不持有锁，Close 可以关闭等待中的 tunnel
+	c, err := t.NewConn()
+	if err != nil {
+		t.Close()
+	}
+	return c, err
+}
+
+// send a request without data in the response
+func (s *Cluster) send(p *peer, req *request) error {
+	c, err := s.openStream(p)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(s.Interval * 3))
+	_, err = s.call(c, req)
+	return err
+}
+
+func (s *Cluster) call(c net.Conn, req *request) (*response, error) {
+	req.From = s.Self.Id
+	if err := writeMsg(c, req); err != nil {
+		return nil, err
+	}
+	res := new(response)
+	if err := readMsg(c, res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return res, nil
+}
+
+func (s *Cluster) serve(p *peer, c net.Conn) {
+	var req request
+	if err := readMsg(c, &req); err != nil || req.From != p.Id {
+		c.Close()
+		return
+	}
+	res := new(response)
+	switch req.Type {
+	case "heartbeat":
+		clients := make(map[int]bool, len(req.Clients))
+		for _, id := range req.Clients {
+			clients[id] = true
+		}
+		p.mu.Lock()
+		p.lastSeen = time.Now()
+		p.clients = clients
+		p.mu.Unlock()
+		s.flows.apply(p.Id, req.Flows, s.Flows)
+	case "link":
+		if s.Link == nil || req.Link == nil {
+			res.Error = "the node does not serve links"
+			break
+		}
+		target, err := s.Link(req.ClientId, req.TaskId, req.Link)
+		if err != nil {
+			res.Error = err.Error()
+			break
+		}
+		if err := writeMsg(c, res); err != nil {
+			target.Close()
+			c.Close()
+			return
+		}
+		// the codec of the link with npc is applied here
+		conn.CopyWaitGroup(target, c, req.Link, nil, nil, true, nil, nil, nil)
+		return
+	case "changed":
+		if s.OnChanged != nil {
+			go s.OnChanged(req.Name)
+		}
+	case "load":
+		if s.Store == nil {
+			res.Error = "the node does not serve the store"
+		} else if cs, ok := s.Store.(file.CasStore); ok {
+			var err error
+			if res.Data, res.Version, err = cs.LoadVersion(req.Name); err != nil {
+				res.Error = err.Error()
+			}
+		} else if b, err := s.Store.Load(req.Name); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Data = b
+		}
+	case "save":
+		if s.Store == nil {
+			res.Error = "the node does not serve the store"
+		} else if err := s.Store.Save(req.Name, req.Data); err != nil {
+			res.Error = err.Error()
+		}
+	case "save_version":
+		if cs, ok := s.Store.(file.CasStore); !ok {
+			res.Error = "the store of the node does not save by version"
+		} else {
+			var err error
+			if res.Version, res.Saved, err = cs.SaveVersion(req.Name, req.Data, req.Version); err != nil {
+				res.Error = err.Error()
+			}
+		}
+	default:
+		res.Error = "unknown request " + req.Type
+	}
+	writeMsg(c, res)
+	c.Close()
+}
+
+// watchMembers check the alive peers every heartbeat
+func (s *Cluster) watchMembers() {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			s.updateMembers()
+		}
+	}
+}
+
+func (s *Cluster) updateMembers() {
+	members := []int{s.Self.Id}
+	for _, p := range s.peers {
+		p.mu.Lock()
+		if s.alive(p) {
+			members = append(members, p.Id)
+		}
+		p.mu.Unlock()
+	}
+	sort.Ints(members)
+	s.mu.Lock()
+	changed := fmt.Sprint(members) != fmt.Sprint(s.members)
+	s.members = members
+	s.mu.Unlock()
+	if changed {
+		logs.Info("the alive nodes of the cluster are %v", members)
+		if s.OnMembers != nil {
+			s.OnMembers()
+		}
+	}
+}
+
+const maxMsgSize = 64 << 20
+
+// writeMsg write the json of the message after its length
+func writeMsg(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+func readMsg(r io.Reader, v interface{}) error {
+	var l uint32
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return err
+	}
+	if l > maxMsgSize {
+		return errors.New("the message is too large")
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,293 @@
+package cluster
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+)
+
+// startNodes starts n nodes on localhost, setup is called before the start of every node
+func startNodes(t *testing.T, n int, setup func(i int, c *Cluster)) []*Cluster {
+	var nodes []Node
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, Node{Id: i + 1, Addr: l.Addr().String()})
+		l.Close()
+	}
+	var cs []*Cluster
+	for i, node := range nodes {
+		c := NewCluster(node, nodes, "cluster key")
+		c.Interval = 50 * time.Millisecond
+		if setup != nil {
+			setup(i, c)
+		}
+		cs = append(cs, c)
+		t.Cleanup(c.Close)
+	}
+	var wg sync.WaitGroup
+	for _, c := range cs {
+		wg.Add(1)
+		go func(c *Cluster) {
+			defer wg.Done()
+			if err := c.Start(); err != nil {
+				t.Error(err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	waitFor(t, func() bool {
+		for _, c := range cs {
+			if len(c.Members()) != n {
+				return false
+			}
+		}
+		return true
+	})
+	return cs
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+func TestClusterOwner(t *testing.T) {
+	cs := startNodes(t, 3, nil)
+	owners := make(map[int]int)
+	count := make(map[int]int)
+	for port := 10000; port < 10300; port++ {
+		o := cs[0].Owner(port)
+		if o != cs[1].Owner(port) || o != cs[2].Owner(port) {
+			t.Fatalf("the nodes do not agree on the owner of port %d", port)
+		}
+		owners[port] = o
+		count[o]++
+	}
+	if len(count) != 3 || count[1] < 50 || count[2] < 50 || count[3] < 50 {
+		t.Fatalf("ports are not spread %v", count)
+	}
+
+	// the ports of the lost node move, the others stay
+	cs[2].Close()
+	waitFor(t, func() bool {
+		return reflect.DeepEqual(cs[0].Members(), []int{1, 2}) && reflect.DeepEqual(cs[1].Members(), []int{1, 2})
+	})
+	for port, o := range owners {
+		if n := cs[0].Owner(port); (o != 3 && n != o) || n == 3 || n != cs[1].Owner(port) {
+			t.Fatalf("port %d owned by %d, then %d", port, o, n)
+		}
+	}
+}
+
+func TestClusterLink(t *testing.T) {
+	cs := startNodes(t, 2, func(i int, c *Cluster) {
+		if i == 1 {
+			c.LocalClients = func() []int { return []int{7} }
+			c.Link = func(clientId, taskId int, link *conn.Link) (net.Conn, error) {
+				a, b := net.Pipe()
+				go io.Copy(b, b)
+				return a, nil
+			}
+		}
+	})
+	waitFor(t, func() bool { return cs[0].ClientNode(7) == 2 })
+	if _, err := cs[0].NewLink(8, conn.NewLink("tcp", "127.0.0.1:80", false, false, "", false, ""), 0); err == nil {
+		t.Fatal("expected error for a client not connected")
+	}
+	// snappy is symmetric, the echo of npc is decoded on the node of the client
+	link := conn.NewLink("tcp", "127.0.0.1:80", false, true, "", false, "")
+	c, err := cs[0].NewLink(7, link, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if link.Compress {
+		t.Fatal("the link should be plain on the node of the visitor")
+	}
+	buf := []byte("hello cluster")
+	if _, err := c.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(buf))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != string(buf) {
+		t.Fatalf("read %q, error %v", got, err)
+	}
+}
+
+func TestClusterFlow(t *testing.T) {
+	flows := make([]*file.Flow, 3)
+	startNodes(t, 3, func(i int, c *Cluster) {
+		flows[i] = &file.Flow{InletFlow: 1000, ExportFlow: 2000}
+		f := flows[i]
+		c.Flows = func(each func(key string, flow *file.Flow)) {
+			each("client/1", f)
+		}
+	})
+	time.Sleep(200 * time.Millisecond)
+	flows[0].Add(100, 10)
+	flows[1].Add(50, 5)
+	waitFor(t, func() bool {
+		for _, f := range flows {
+			if in, out := flowOf(f)[0], flowOf(f)[1]; in != 1150 || out != 2015 {
+				return false
+			}
+		}
+		return true
+	})
+	flows[2].Add(1, 1)
+	waitFor(t, func() bool { return flowOf(flows[0]) == [2]int64{1151, 2016} })
+	time.Sleep(200 * time.Millisecond)
+	for _, f := range flows {
+		if v := flowOf(f); v != [2]int64{1151, 2016} {
+			t.Fatalf("flow %v", v)
+		}
+	}
+}
+
+func TestClusterStore(t *testing.T) {
+	dir := t.TempDir()
+	changed := make(chan string, 1)
+	cs := startNodes(t, 2, func(i int, c *Cluster) {
+		if i == 0 {
+			c.Store = &file.FileStore{Dir: dir}
+			c.OnChanged = func(name string) { changed <- name }
+		}
+	})
+	st, err := cs[1].NewStore(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := st.Load("clients.json"); err != nil || b != nil {
+		t.Fatalf("load %q, error %v", b, err)
+	}
+	if err := st.Save("clients.json", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := cs[0].Store.Load("clients.json"); err != nil || string(b) != "data" {
+		t.Fatalf("load %q, error %v", b, err)
+	}
+	// the file is saved only if it is not changed since it is loaded
+	vs := st.(file.CasStore)
+	_, version, err := vs.LoadVersion("clients.json")
+	if err != nil || version == "" {
+		t.Fatal(version, err)
+	}
+	if _, ok, err := vs.SaveVersion("clients.json", []byte("new"), version); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, ok, err := vs.SaveVersion("clients.json", []byte("lost"), version); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if b, _ := cs[0].Store.Load("clients.json"); string(b) != "new" {
+		t.Fatalf("load %q", b)
+	}
+	cs[1].Notify("clients.json")
+	select {
+	case name := <-changed:
+		if name != "clients.json" {
+			t.Fatal(name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change notified")
+	}
+}
+
+func TestClusterKey(t *testing.T) {
+	cs := startNodes(t, 2, nil)
+	other := NewCluster(Node{Id: 2, Addr: "127.0.0.1:0"}, []Node{cs[0].Self}, "wrong key")
+	if _, err := other.dial(other.peers[1]); err == nil {
+		t.Fatal("expected error with a wrong key")
+	}
+}
+
+// recorder forwards the connections to the address and records the bytes sent to it
+type recorder struct {
+	net.Listener
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newRecorder(t *testing.T, addr string) *recorder {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			go func() {
+				io.Copy(c, target)
+				c.Close()
+			}()
+			go func() {
+				io.Copy(io.MultiWriter(target, r), c)
+				target.Close()
+			}()
+		}
+	}()
+	return r
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(b)
+}
+
+func (r *recorder) contains(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Contains(r.buf.Bytes(), []byte(s))
+}
+
+// the records of the store are not readable on the network
+func TestClusterLinkEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	var r *recorder
+	cs := startNodes(t, 2, func(i int, c *Cluster) {
+		if i == 0 {
+			c.Store = &file.FileStore{Dir: dir}
+		} else {
+			r = newRecorder(t, c.peers[1].Addr)
+			c.peers[1].Addr = r.Addr().String()
+		}
+	})
+	st, err := cs[1].NewStore(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Save("clients.json", []byte(`{"VerifyKey":"secret vkey"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := cs[0].Store.Load("clients.json"); !bytes.Contains(b, []byte("secret vkey")) {
+		t.Fatalf("load %q", b)
+	}
+	if r.contains("secret vkey") || r.contains("heartbeat") {
+		t.Fatal("the link between the nodes is plain")
+	}
+}
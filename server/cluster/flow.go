@@ -0,0 +1,100 @@
+package cluster
+
+import (
+	"sync"
+
+	"ehang.io/nps/lib/file"
+)
+
+// flowTracker aggregate the flows across the nodes, every node reports the flows counted by itself since start,
+// the growth of a report is added to the counters of the others. A missed report is made up by the next one
+type flowTracker struct {
+	mu   sync.Mutex
+	base map[string][2]int64         // the flows when first seen, loaded from the store
+	recv map[string][2]int64         // the flows added from the reports of the peers
+	last map[int]map[string][2]int64 // the last report of every peer
+}
+
+func newFlowTracker() *flowTracker {
+	return &flowTracker{
+		base: make(map[string][2]int64),
+		recv: make(map[string][2]int64),
+		last: make(map[int]map[string][2]int64),
+	}
+}
+
+func flowOf(f *file.Flow) [2]int64 {
+	f.RLock()
+	defer f.RUnlock()
+	return [2]int64{f.InletFlow, f.ExportFlow}
+}
+
+// local returns the flows counted by this node
+func (s *flowTracker) local(each func(f func(key string, flow *file.Flow))) map[string][2]int64 {
+	if each == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string][2]int64)
+	each(func(key string, flow *file.Flow) {
+		if flow == nil {
+			return
+		}
+		cur := flowOf(flow)
+		base, ok := s.base[key]
+		if !ok {
+			s.base[key] = cur
+			return
+		}
+		recv := s.recv[key]
+		var v [2]int64
+		for i := range v {
+			if v[i] = cur[i] - base[i] - recv[i]; v[i] < 0 {
+				// the counter is reset, count again from now
+				s.base[key], s.recv[key] = cur, [2]int64{}
+				return
+			}
+		}
+		if v[0] > 0 || v[1] > 0 {
+			res[key] = v
+		}
+	})
+	return res
+}
+
+// apply the report of the peer to the counters of this node
+func (s *flowTracker) apply(id int, report map[string][2]int64, each func(f func(key string, flow *file.Flow))) {
+	if each == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.last[id]
+	if last == nil {
+		last = make(map[string][2]int64)
+		s.last[id] = last
+	}
+	each(func(key string, flow *file.Flow) {
+		v, ok := report[key]
+		if !ok || flow == nil {
+			return
+		}
+		prev := last[key]
+		if v[0] < prev[0] || v[1] < prev[1] {
+			// the peer restarted
+			prev = [2]int64{}
+		}
+		last[key] = v
+		in, out := v[0]-prev[0], v[1]-prev[1]
+		if in == 0 && out == 0 {
+			return
+		}
+		if _, seen := s.base[key]; !seen {
+			s.base[key] = flowOf(flow)
+		}
+		flow.Add(in, out)
+		r := s.recv[key]
+		s.recv[key] = [2]int64{r[0] + in, r[1] + out}
+	})
+}
@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"ehang.io/nps/lib/file"
+)
+
+// nodeStore use the store of another node, the node must be alive to save the changes
+type nodeStore struct {
+	c  *Cluster
+	id int
+}
+
+// NewStore returns the store served by the node, a file store of this node if it is the node itself
+func (s *Cluster) NewStore(id int) (file.Store, error) {
+	if id == s.Self.Id {
+		if s.Store == nil {
+			return nil, fmt.Errorf("the node %d has no store", id)
+		}
+		return s.Store, nil
+	}
+	if _, ok := s.peers[id]; !ok {
+		return nil, fmt.Errorf("the node %d is not a peer", id)
+	}
+	return &nodeStore{c: s, id: id}, nil
+}
+
+func (s *nodeStore) Load(name string) ([]byte, error) {
+	b, _, err := s.LoadVersion(name)
+	return b, err
+}
+
+// LoadVersion waits for the node at start
+func (s *nodeStore) LoadVersion(name string) ([]byte, string, error) {
+	var err error
+	for i := 0; i < 30; i++ {
+		var res *response
+		if res, err = s.request(&request{Type: "load", Name: name}); err == nil {
+			return res.Data, res.Version, nil
+		}
+		time.Sleep(time.Second)
+	}
+	return nil, "", fmt.Errorf("load %s from node %d error %v", name, s.id, err)
+}
+
+func (s *nodeStore) Save(name string, b []byte) error {
+	_, err := s.request(&request{Type: "save", Name: name, Data: b})
+	return err
+}
+
+func (s *nodeStore) SaveVersion(name string, b []byte, version string) (string, bool, error) {
+	res, err := s.request(&request{Type: "save_version", Name: name, Data: b, Version: version})
+	if err != nil {
+		return "", false, err
+	}
+	return res.Version, res.Saved, nil
+}
+
+func (s *nodeStore) request(req *request) (*response, error) {
+	c, err := s.c.openStream(s.c.peers[s.id])
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second * 30))
+	return s.c.call(c, req)
+}
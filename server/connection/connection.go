@@ -1,37 +1,84 @@
 package connection
 
 import (
+	"crypto/tls"
 	"net"
 	"os"
 	"strconv"
 
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/graceful"
 	"ehang.io/nps/lib/pmux"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
+	"github.com/quic-go/quic-go"
 )
 
 var pMux *pmux.PortMux
+var wsPMux *pmux.PortMux // websocket bridge shares the http/https proxy port
 var bridgePort string
 var httpsPort string
 var httpPort string
 var webPort string
+var wsBridgePort string
+var wsBridgePath string
+var wsBridgeHost string
 
 func InitConnectionService() {
 	bridgePort = beego.AppConfig.String("bridge_port")
 	httpsPort = beego.AppConfig.String("https_proxy_port")
 	httpPort = beego.AppConfig.String("http_proxy_port")
 	webPort = beego.AppConfig.String("web_port")
+	wsBridgePort = beego.AppConfig.String("ws_bridge_port")
+	wsBridgePath = beego.AppConfig.DefaultString("ws_bridge_path", "/ws")
+	wsBridgeHost = beego.AppConfig.String("ws_bridge_host")
 
-	if httpPort == bridgePort || httpsPort == bridgePort || webPort == bridgePort {
+	// ws sharing the bridge or http proxy port is distinguished by path, wss on the https proxy port by server name
+	var wsPath, wsHost string
+	if wsBridgePort != "" && wsBridgePort == httpsPort {
+		if wsBridgeHost == "" {
+			logs.Error("ws_bridge_host must be set when ws_bridge_port is the same as https_proxy_port")
+			os.Exit(0)
+		}
+		wsHost = wsBridgeHost
+	} else if wsBridgePort != "" {
+		wsPath = wsBridgePath
+	}
+
+	if httpPort == bridgePort || httpsPort == bridgePort || webPort == bridgePort || wsBridgePort == bridgePort {
 		port, err := strconv.Atoi(bridgePort)
 		if err != nil {
 			logs.Error(err)
 			os.Exit(0)
 		}
-		pMux = pmux.NewPortMux(port, beego.AppConfig.String("web_host"))
+		if wsBridgePort == bridgePort {
+			pMux = pmux.NewPortMuxWithWs(port, beego.AppConfig.String("web_host"), wsPath, wsHost)
+		} else {
+			pMux = pmux.NewPortMux(port, beego.AppConfig.String("web_host"))
+		}
+	}
+	if wsBridgePort != bridgePort && (wsBridgePort == httpPort || wsBridgePort == httpsPort) {
+		port, err := strconv.Atoi(wsBridgePort)
+		if err != nil {
+			logs.Error(err)
+			os.Exit(0)
+		}
+		wsPMux = pmux.NewWsPortMux(port, wsPath, wsHost, wsBridgePort == httpPort, wsBridgePort == httpsPort)
 	}
 }
 
+// getPortMux returns the port mux listening on the port p
+func getPortMux(p string) *pmux.PortMux {
+	if pMux != nil && p == bridgePort {
+		return pMux
+	}
+	if wsPMux != nil && p == wsBridgePort {
+		return wsPMux
+	}
+	return nil
+}
+
 func GetBridgeListener(tp string) (net.Listener, error) {
 	logs.Info("server start, the bridge type is %s, the bridge port is %s", tp, bridgePort)
 	var p int
@@ -42,22 +89,22 @@ func GetBridgeListener(tp string) (net.Listener, error) {
 	if pMux != nil {
 		return pMux.GetClientListener(), nil
 	}
-	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""})
+	return graceful.ListenTCP(&net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""})
 }
 
 func GetHttpListener() (net.Listener, error) {
-	if pMux != nil && httpPort == bridgePort {
-		logs.Info("start http listener, port is", bridgePort)
-		return pMux.GetHttpListener(), nil
+	if m := getPortMux(httpPort); m != nil {
+		logs.Info("start http listener, port is", httpPort)
+		return m.GetHttpListener(), nil
 	}
 	logs.Info("start http listener, port is", httpPort)
 	return getTcpListener(beego.AppConfig.String("http_proxy_ip"), httpPort)
 }
 
 func GetHttpsListener() (net.Listener, error) {
-	if pMux != nil && httpsPort == bridgePort {
-		logs.Info("start https listener, port is", bridgePort)
-		return pMux.GetHttpsListener(), nil
+	if m := getPortMux(httpsPort); m != nil {
+		logs.Info("start https listener, port is", httpsPort)
+		return m.GetHttpsListener(), nil
 	}
 	logs.Info("start https listener, port is", httpsPort)
 	return getTcpListener(beego.AppConfig.String("http_proxy_ip"), httpsPort)
@@ -72,6 +119,74 @@ func GetWebManagerListener() (net.Listener, error) {
 	return getTcpListener(beego.AppConfig.String("web_ip"), webPort)
 }
 
+// GetWsBridgeListener returns the listener of the websocket bridge, tls is already handled for wss
+func GetWsBridgeListener() (net.Listener, string, error) {
+	if wsBridgePort == "" {
+		return nil, "", nil
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{getBridgeCert("ws_bridge")}}
+	if m := getPortMux(wsBridgePort); m != nil {
+		if wsBridgePort == httpsPort {
+			logs.Info("websocket bridge start, wss://%s:%s%s", wsBridgeHost, wsBridgePort, wsBridgePath)
+			return tls.NewListener(m.GetWssListener(), tlsConfig), wsBridgePath, nil
+		}
+		logs.Info("websocket bridge start, ws port is %s, path is %s", wsBridgePort, wsBridgePath)
+		return m.GetWsListener(), wsBridgePath, nil
+	}
+	l, err := getTcpListener(beego.AppConfig.String("bridge_ip"), wsBridgePort)
+	if err != nil {
+		return nil, "", err
+	}
+	if beego.AppConfig.DefaultBool("ws_bridge_tls", false) {
+		logs.Info("websocket bridge start, wss port is %s, path is %s", wsBridgePort, wsBridgePath)
+		return tls.NewListener(l, tlsConfig), wsBridgePath, nil
+	}
+	logs.Info("websocket bridge start, ws port is %s, path is %s", wsBridgePort, wsBridgePath)
+	return l, wsBridgePath, nil
+}
+
+// GetQuicBridgeListener returns the listener of the quic bridge, nil if quic_bridge_port is not set
+func GetQuicBridgeListener() (*quic.Listener, error) {
+	p := beego.AppConfig.String("quic_bridge_port")
+	if p == "" {
+		return nil, nil
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, err
+	}
+	ip := beego.AppConfig.String("bridge_ip")
+	if ip == "" {
+		ip = "0.0.0.0"
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{getBridgeCert("quic_bridge")},
+		NextProtos:   []string{conn.QuicAlpn},
+	}
+	logs.Info("quic bridge start, the quic bridge port is", port)
+	pc, err := graceful.ListenUDP(&net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+	if err != nil {
+		return nil, err
+	}
+	// 平滑重启时旧进程的 quic 会话结束后再读取
+	graceful.WaitUDP()
+	return quic.Listen(pc, tlsConfig, conn.QuicConfig(beego.AppConfig.DefaultInt("disconnect_timeout", 60)))
+}
+
+// getBridgeCert load the cert of the websocket or quic bridge, use the default cert if not set
+func getBridgeCert(prefix string) tls.Certificate {
+	certFile := beego.AppConfig.String(prefix + "_cert_file")
+	keyFile := beego.AppConfig.String(prefix + "_key_file")
+	if certFile != "" && keyFile != "" {
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			return cert
+		} else {
+			logs.Error("load %s cert error, use the default cert %v", prefix, err)
+		}
+	}
+	return crypt.GetCert()
+}
+
 func getTcpListener(ip, p string) (net.Listener, error) {
 	port, err := strconv.Atoi(p)
 	if err != nil {
@@ -81,5 +196,5 @@ func getTcpListener(ip, p string) (net.Listener, error) {
 	if ip == "" {
 		ip = "0.0.0.0"
 	}
-	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(ip), port, ""})
+	return graceful.ListenTCP(&net.TCPAddr{net.ParseIP(ip), port, ""})
 }
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/graceful"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+var upgradeLock sync.Mutex
+
+// gracefulTimeout 平滑重启时旧进程等待已有连接结束的时间
+func gracefulTimeout() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("graceful_timeout", 60)) * time.Second
+}
+
+// initGraceful 收到 SIGUSR2 时平滑重启；由旧进程启动时等待旧进程上的客户端重连
+func initGraceful() {
+	if graceful.Inherited() {
+		// npc 在旧进程断开后按重试间隔重连
+		expect := gracefulTimeout() + time.Second*30
+		clients, later, _ := strings.Cut(graceful.State(), "|")
+		ids := parseInts(clients)
+		Bridge.Expect(ids, expect)
+		go func() {
+			// 各个端口在自己的 goroutine 中开始监听，npc 配置文件中的隧道在客户端重连后才监听
+			graceful.Wait(parseInts(later))
+			graceful.Ready(expect)
+			logs.Info("took over the listening sockets, waiting for %d clients to reconnect", len(ids))
+		}()
+	}
+	graceful.OnSignal(func() {
+		if err := Upgrade(); err != nil {
+			logs.Error("graceful restart error", err)
+		}
+	})
+}
+
+// Upgrade 启动新进程接管监听的端口，本进程不再接受新连接，
+// 空闲的客户端断开后重连到新进程，其余连接结束或超过 graceful_timeout 后退出。
+// udp 的会话不等待，kcp、quic 桥接的客户端立即重连
+func Upgrade() error {
+	upgradeLock.Lock()
+	defer upgradeLock.Unlock()
+	db := file.GetDb().JsonDb
+	// 新进程从文件加载配置和流量，启动后由新进程保存
+	db.Snapshot()
+	ids := Bridge.GetClientIds()
+	p, err := graceful.Upgrade(time.Second*30, joinInts(ids)+"|"+joinInts(laterPorts()))
+	if err != nil {
+		db.Resume()
+		return err
+	}
+	// kcp、quic 的会话在 udp socket 关闭后中断，新进程此后才读取这些 socket
+	Bridge.CloseUdpClients()
+	graceful.Close()
+	if Cluster != nil {
+		// 新进程以同一节点加入集群
+		Cluster.Close()
+	}
+	logs.Info("the new process %d is serving, draining %d clients", p.Pid, len(ids))
+	go drain(gracefulTimeout())
+	return nil
+}
+
+// laterPorts 客户端重连后才监听的端口，即 npc 配置文件中的隧道
+func laterPorts() (ports []int) {
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if _, ok := RunList.Load(v.Id); !ok || !v.NoStore {
+			return true
+		}
+		if v.IsPortRange() {
+			ports = append(ports, v.GetPorts()...)
+		} else {
+			ports = append(ports, v.Port)
+		}
+		return true
+	})
+	return
+}
+
+func joinInts(a []int) string {
+	s := make([]string, len(a))
+	for i, v := range a {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ",")
+}
+
+func parseInts(s string) (a []int) {
+	for _, v := range strings.Split(s, ",") {
+		if i, err := strconv.Atoi(v); err == nil {
+			a = append(a, i)
+		}
+	}
+	return
+}
+
+// drain 断开没有连接的客户端让其重连到新进程，全部断开或超时后退出
+func drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		expired := time.Now().After(deadline)
+		var busy int
+		for _, id := range Bridge.GetClientIds() {
+			if c, err := file.GetDb().GetClient(id); err == nil && atomic.LoadInt32(&c.NowConn) > 0 && !expired {
+				busy++
+				continue
+			}
+			Bridge.DelClient(id)
+		}
+		if busy == 0 {
+			logs.Info("all connections are closed, exit")
+			os.Exit(0)
+		}
+	}
+}
@@ -69,9 +69,33 @@ func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string) error {
 	return s.doAuth(r, c, u, p, common.UnauthorizedBytes, "401 Unauthorized")
 }
 
-// proxyAuth check for HTTP forward proxy (407 + Proxy-Authenticate).
-func (s *BaseServer) proxyAuth(r *http.Request, c *conn.Conn, u, p string) error {
-	return s.doAuth(r, c, u, p, common.ProxyAuthRequiredBytes, "407 Proxy Authentication Required")
+// proxyAuth check for HTTP forward proxy (407 + Proxy-Authenticate), by the accounts of the tunnel.
+func (s *BaseServer) proxyAuth(r *http.Request, c *conn.Conn) error {
+	if !s.needAuth() {
+		return nil
+	}
+	if u, p, ok := common.GetBasicAuth(r); !ok || !s.checkAccount(u, p) {
+		c.Write([]byte(common.ProxyAuthRequiredBytes))
+		c.Close()
+		return errors.New("407 Proxy Authentication Required")
+	}
+	return nil
+}
+
+// needAuth reports whether the proxy tunnel has an account, the accounts are shared by
+// the socks5, socks4 and http proxies of the tunnel
+func (s *BaseServer) needAuth() bool {
+	return (s.task.Client.Cnf.U != "" && s.task.Client.Cnf.P != "") ||
+		(s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0)
+}
+
+// checkAccount checks the user by the multi accounts of the tunnel, or the account of the client
+func (s *BaseServer) checkAccount(user, pass string) bool {
+	if s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0 {
+		expected, found := s.task.MultiAccount.AccountMap[user]
+		return found && pass == expected
+	}
+	return user == s.task.Client.Cnf.U && pass == s.task.Client.Cnf.P
 }
 
 func (s *BaseServer) doAuth(r *http.Request, c *conn.Conn, u, p, failBytes, errMsg string) error {
@@ -120,11 +144,17 @@ func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
 	}
 
 	protoVersion := ""
+	compression := ""
+	priority := ""
 	if task != nil {
 		protoVersion = task.ProtoVersion
+		compression = task.Compression
+		priority = task.Priority
 	}
 
 	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy, protoVersion)
+	link.SetCompression(compression)
+	link.Priority = priority
 	if target, err := s.bridge.SendLinkInfo(client.Id, link, s.task); err != nil {
 		logs.Warn("get connection from client id %d  error %s", client.Id, err.Error())
 		c.Close()
@@ -133,7 +163,7 @@ func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
 		if f != nil {
 			f()
 		}
-		conn.CopyWaitGroup(target, c.Conn, link.Crypt, link.Compress, client.Rate, flow, true, rb, task, host)
+		conn.CopyWaitGroup(target, c.Conn, link, client.Rate, flow, true, rb, task, host)
 	}
 	return nil
 }
@@ -9,6 +9,7 @@ import (
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/lib/goroutine"
+	"ehang.io/nps/lib/graceful"
 	"ehang.io/nps/server/connection"
 	"ehang.io/nps/web"
 	"encoding/json"
@@ -23,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type httpServer struct {
@@ -32,10 +34,9 @@ type httpServer struct {
 	httpServer    *http.Server
 	httpsServer   *http.Server
 	httpsListener net.Listener
-	useCache      bool
+	https         *HttpsServer
 	addOrigin     bool
-	cache         *cache.Cache
-	cacheLen      int
+	cache         atomic.Pointer[cache.Cache] // nil if http_cache is off
 }
 
 func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, useCache bool, cacheLen int, addOrigin bool) *httpServer {
@@ -47,14 +48,28 @@ func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, use
 		},
 		httpPort:  httpPort,
 		httpsPort: httpsPort,
-		useCache:  useCache,
-		cacheLen:  cacheLen,
 		addOrigin: addOrigin,
 	}
+	httpServer.SetCache(useCache, cacheLen)
+	return httpServer
+}
+
+// SetCache 修改 http_cache 和 http_cache_length，已缓存的内容丢弃
+func (s *httpServer) SetCache(useCache bool, cacheLen int) {
+	s.Lock()
+	defer s.Unlock()
+	setCache(&s.cache, useCache, cacheLen)
+	if s.https != nil {
+		s.https.cache.Store(s.cache.Load())
+	}
+}
+
+func setCache(p *atomic.Pointer[cache.Cache], useCache bool, cacheLen int) {
 	if useCache {
-		httpServer.cache = cache.New(cacheLen)
+		p.Store(cache.New(cacheLen))
+	} else {
+		p.Store(nil)
 	}
-	return httpServer
 }
 
 func (s *httpServer) Start() error {
@@ -71,7 +86,7 @@ func (s *httpServer) Start() error {
 				os.Exit(0)
 			}
 			err = s.httpServer.Serve(l)
-			if err != nil {
+			if err != nil && !graceful.Closed() {
 				logs.Error(err)
 				os.Exit(0)
 			}
@@ -85,7 +100,13 @@ func (s *httpServer) Start() error {
 				logs.Error(err)
 				os.Exit(0)
 			}
-			logs.Error(NewHttpsServer(s.httpsListener, s.bridge, s.useCache, s.cacheLen).Start())
+			https := NewHttpsServer(s.httpsListener, s.bridge, false, 0)
+			s.Lock()
+			// 与 http 共用缓存
+			https.cache.Store(s.cache.Load())
+			s.https = https
+			s.Unlock()
+			logs.Error(https.Start())
 		}()
 	}
 	return nil
@@ -252,7 +273,11 @@ reset:
 		logs.Notice("connect to target %s error %s", lk.Host, err)
 		return
 	}
-	connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
+	if connClient, err = conn.GetConn(target, lk, host.Client.Rate, true); err != nil {
+		logs.Notice("connect to target %s error %s", lk.Host, err)
+		target.Close()
+		return
+	}
 
 	//read from inc-client
 	go func() {
@@ -273,8 +298,8 @@ reset:
 
 	for {
 		//if the cache start and the request is in the cache list, return the cache
-		if s.useCache {
-			if v, ok := s.cache.Get(filepath.Join(host.Host, r.URL.Path)); ok {
+		if ch := s.cache.Load(); ch != nil {
+			if v, ok := ch.Get(filepath.Join(host.Host, r.URL.Path)); ok {
 				n, err := c.Write(v.([]byte))
 				if err != nil {
 					break
@@ -8,7 +8,6 @@ import (
 	"strings"
 	"sync"
 
-	"ehang.io/nps/lib/cache"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/crypt"
@@ -27,10 +26,7 @@ type HttpsServer struct {
 func NewHttpsServer(l net.Listener, bridge NetBridge, useCache bool, cacheLen int) *HttpsServer {
 	https := &HttpsServer{listener: l}
 	https.bridge = bridge
-	https.useCache = useCache
-	if useCache {
-		https.cache = cache.New(cacheLen)
-	}
+	setCache(&https.cache, useCache, cacheLen)
 	return https
 }
 
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// MixedModeServer serves socks4/4a, socks5 and the http proxy on one port, the protocol is told by the
+// first byte, the accounts and the flow of the tunnel are shared by the protocols
+type MixedModeServer struct {
+	BaseServer
+	socks    *Sock5ModeServer
+	http     *TunnelModeServer
+	listener net.Listener
+}
+
+func NewMixedModeServer(bridge NetBridge, task *file.Tunnel) *MixedModeServer {
+	s := new(MixedModeServer)
+	s.bridge = bridge
+	s.task = task
+	s.socks = NewSock5ModeServer(bridge, task)
+	s.http = NewTunnelModeServer(ProcessHttp, bridge, task)
+	return s
+}
+
+func (s *MixedModeServer) handleConn(c net.Conn) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(c, first); err != nil {
+		c.Close()
+		return
+	}
+	// the first byte is read again by the protocol
+	pc := conn.NewConn(c)
+	pc.Rb = first
+	switch first[0] {
+	case socks4Version:
+		s.socks.handleSocks4(pc)
+	case 5:
+		s.socks.handleConn(pc)
+	default:
+		ProcessHttp(pc, s.http)
+	}
+}
+
+// start
+func (s *MixedModeServer) Start() error {
+	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), func(c net.Conn) {
+		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+			logs.Warn("client id %d, task id %d, error %s, when mixed connection", s.task.Client.Id, s.task.Id, err.Error())
+			c.Close()
+			return
+		}
+		logs.Trace("New mixed connection,client %d,remote address %s", s.task.Client.Id, c.RemoteAddr())
+		s.handleConn(c)
+		s.task.Client.AddConn()
+	}, &s.listener)
+}
+
+// close
+func (s *MixedModeServer) Close() error {
+	return s.listener.Close()
+}
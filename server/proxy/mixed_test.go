@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+)
+
+type linkTestBridge struct {
+	target net.Conn
+	host   chan string
+}
+
+func (b *linkTestBridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error) {
+	b.host <- link.Host
+	return b.target, nil
+}
+
+func TestMixedMode(t *testing.T) {
+	setupProxyTestConf(t)
+	for _, v := range []struct {
+		name  string
+		hello func(t *testing.T, c net.Conn)
+	}{
+		{"socks4a", func(t *testing.T, c net.Conn) {
+			c.Write(append([]byte{4, 1, 0, 80, 0, 0, 0, 1}, "u:p\x00example.com\x00"...))
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(c, b); err != nil || b[1] != socks4Granted {
+				t.Fatal(b, err)
+			}
+		}},
+		{"socks5", func(t *testing.T, c net.Conn) {
+			c.Write([]byte{5, 1, UserPassAuth})
+			b := make([]byte, 2)
+			io.ReadFull(c, b)
+			c.Write([]byte{userAuthVersion, 1, 'u', 1, 'p'})
+			if _, err := io.ReadFull(c, b); err != nil || b[1] != authSuccess {
+				t.Fatal(b, err)
+			}
+			c.Write(append([]byte{5, connectMethod, 0, domainName, 11}, "example.com\x00\x50"...))
+			b = make([]byte, 10)
+			if _, err := io.ReadFull(c, b); err != nil || b[1] != succeeded {
+				t.Fatal(b, err)
+			}
+		}},
+		{"http", func(t *testing.T, c net.Conn) {
+			auth := base64.StdEncoding.EncodeToString([]byte("u:p"))
+			c.Write([]byte("CONNECT example.com:80 HTTP/1.1\r\nHost: example.com:80\r\nProxy-Authorization: Basic " + auth + "\r\n\r\n"))
+			resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil || resp.StatusCode != 200 {
+				t.Fatal(resp, err)
+			}
+		}},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			npc, target := net.Pipe()
+			defer npc.Close()
+			bridge := &linkTestBridge{target: target, host: make(chan string, 1)}
+			client := file.NewClient("test", true, true)
+			client.Id = 1
+			task := &file.Tunnel{
+				Id:           1,
+				Client:       client,
+				Mode:         "mixed",
+				Flow:         new(file.Flow),
+				Target:       &file.Target{},
+				MultiAccount: &file.MultiAccount{AccountMap: map[string]string{"u": "p"}},
+			}
+			s := NewMixedModeServer(bridge, task)
+			c, server := net.Pipe()
+			defer c.Close()
+			done := make(chan struct{})
+			go func() {
+				s.handleConn(server)
+				close(done)
+			}()
+			v.hello(t, c)
+			if host := <-bridge.host; host != "example.com:80" {
+				t.Fatal(host)
+			}
+			exchange(t, c, npc)
+			c.Close()
+			npc.Close()
+			<-done
+			// every protocol counts against the client and the tunnel
+			if client.Flow.InletFlow == 0 || client.Flow.InletFlow != task.Flow.InletFlow || client.Flow.ExportFlow != task.Flow.ExportFlow {
+				t.Fatalf("client flow %d/%d, tunnel flow %d/%d", client.Flow.InletFlow, client.Flow.ExportFlow, task.Flow.InletFlow, task.Flow.ExportFlow)
+			}
+		})
+	}
+}
+
+func TestMixedModeAuthFailed(t *testing.T) {
+	setupProxyTestConf(t)
+	client := file.NewClient("test", true, true)
+	task := &file.Tunnel{
+		Client:       client,
+		Mode:         "mixed",
+		Target:       &file.Target{},
+		MultiAccount: &file.MultiAccount{AccountMap: map[string]string{"u": "p"}},
+	}
+	s := NewMixedModeServer(&linkTestBridge{host: make(chan string, 1)}, task)
+	c, server := net.Pipe()
+	defer c.Close()
+	go s.handleConn(server)
+	c.Write(append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, "u:x\x00"...))
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(c, b); err != nil || b[1] != socks4BadUserId {
+		t.Fatal(b, err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/graceful"
 	"github.com/astaxie/beego/logs"
 )
 
@@ -19,6 +21,8 @@ type P2PServer struct {
 type p2p struct {
 	visitorAddr  *net.UDPAddr
 	providerAddr *net.UDPAddr
+	visitorMsg   bool // reply in the format of the request, see conn.ParseP2pMsg
+	providerMsg  bool
 }
 
 func NewP2PServer(p2pPort int) *P2PServer {
@@ -31,10 +35,11 @@ func NewP2PServer(p2pPort int) *P2PServer {
 func (s *P2PServer) Start() error {
 	logs.Info("start p2p server port", s.p2pPort)
 	var err error
-	s.listener, err = net.ListenUDP("udp", &net.UDPAddr{net.ParseIP("0.0.0.0"), s.p2pPort, ""})
+	s.listener, err = graceful.ListenUDP(&net.UDPAddr{net.ParseIP("0.0.0.0"), s.p2pPort, ""})
 	if err != nil {
 		return err
 	}
+	graceful.WaitUDP()
 	for {
 		buf := common.BufPoolUdp.Get().([]byte)
 		n, addr, err := s.listener.ReadFromUDP(buf)
@@ -44,37 +49,46 @@ func (s *P2PServer) Start() error {
 			}
 			continue
 		}
-		go s.handleP2P(addr, string(buf[:n]))
+		go s.handleP2P(addr, buf[:n])
 	}
 	return nil
 }
 
-func (s *P2PServer) handleP2P(addr *net.UDPAddr, str string) {
+func (s *P2PServer) handleP2P(addr *net.UDPAddr, b []byte) {
 	var (
 		v  *p2p
 		ok bool
 	)
-	arr := strings.Split(str, common.CONN_DATA_SEQ)
-	if len(arr) < 2 {
+	password, role, isMsg, err := conn.ParseP2pMsg(b)
+	if err != nil {
 		return
 	}
-	if v, ok = s.p2p[arr[0]]; !ok {
+	if v, ok = s.p2p[password]; !ok {
 		v = new(p2p)
-		s.p2p[arr[0]] = v
+		s.p2p[password] = v
 	}
-	logs.Trace("new p2p connection ,role %s , password %s ,local address %s", arr[1], arr[0], addr.String())
-	if arr[1] == common.WORK_P2P_VISITOR {
+	logs.Trace("new p2p connection ,role %s , password %s ,local address %s", role, password, addr.String())
+	if role == common.WORK_P2P_VISITOR {
 		v.visitorAddr = addr
+		v.visitorMsg = isMsg
 		for i := 20; i > 0; i-- {
 			if v.providerAddr != nil {
-				s.listener.WriteTo([]byte(v.providerAddr.String()), v.visitorAddr)
-				s.listener.WriteTo([]byte(v.visitorAddr.String()), v.providerAddr)
+				s.listener.WriteTo(p2pAddrReply(v.providerAddr, v.visitorMsg), v.visitorAddr)
+				s.listener.WriteTo(p2pAddrReply(v.visitorAddr, v.providerMsg), v.providerAddr)
 				break
 			}
 			time.Sleep(time.Second)
 		}
-		delete(s.p2p, arr[0])
+		delete(s.p2p, password)
 	} else {
 		v.providerAddr = addr
+		v.providerMsg = isMsg
+	}
+}
+
+func p2pAddrReply(addr *net.UDPAddr, isMsg bool) []byte {
+	if isMsg {
+		return conn.P2pAddrMsg(addr.String())
 	}
+	return []byte(addr.String())
 }
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/graceful"
+)
+
+// portRange 端口范围隧道的端口，端口在范围中的序号与目标端口的序号一一对应
+type portRange struct {
+	task  *file.Tunnel
+	ports []int
+	index map[int]int // 端口 -> 序号
+}
+
+func newPortRange(task *file.Tunnel) *portRange {
+	r := &portRange{task: task, ports: task.GetPorts()}
+	r.index = make(map[int]int, len(r.ports))
+	for i, p := range r.ports {
+		r.index[p] = i
+	}
+	task.InitPortFlow()
+	return r
+}
+
+// target 端口对应的目标，多个目标时轮询
+func (r *portRange) target(port int) (string, error) {
+	i, ok := r.index[port]
+	if !ok {
+		return "", errors.New("port " + strconv.Itoa(port) + " is not in the range")
+	}
+	target, err := r.task.Target.GetRandomTarget()
+	if err != nil {
+		return "", err
+	}
+	return file.RangeTarget(target, i)
+}
+
+// flow 端口的流量统计
+func (r *portRange) flow(port int) *file.Flow {
+	return r.task.PortFlow[port]
+}
+
+// listenTcp 监听范围中的所有端口，任一端口失败时关闭已监听的端口
+func (r *portRange) listenTcp(ip string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(r.ports))
+	for _, p := range r.ports {
+		l, err := graceful.Listen(ip + ":" + strconv.Itoa(p))
+		if err != nil {
+			for _, v := range listeners {
+				v.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUdp 同 listenTcp
+func (r *portRange) listenUdp(ip string) ([]*net.UDPConn, error) {
+	listeners := make([]*net.UDPConn, 0, len(r.ports))
+	for _, p := range r.ports {
+		l, err := graceful.ListenUDP(&net.UDPAddr{IP: net.ParseIP(ip), Port: p})
+		if err != nil {
+			for _, v := range listeners {
+				v.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// portFlowConn 端口范围隧道的连接，流量计入端口，计法同隧道流量
+type portFlowConn struct {
+	net.Conn
+	port int
+	flow *file.Flow
+}
+
+func (c *portFlowConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.flow.Add(int64(n), int64(n))
+	}
+	return
+}
+
+func (c *portFlowConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.flow.Add(int64(n), int64(n))
+	}
+	return
+}
+
+// CloseWrite 半关闭
+func (c *portFlowConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("the conn does not support half close")
+}
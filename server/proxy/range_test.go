@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/file"
+)
+
+func TestRangeTarget(t *testing.T) {
+	for _, v := range []struct {
+		target string
+		i      int
+		want   string
+	}{
+		{"10.1.50.2:20000-20100", 0, "10.1.50.2:20000"},
+		{"10.1.50.2:20000-20100", 100, "10.1.50.2:20100"},
+		{"8001-8009,10002,13000-14000", 9, "10002"},
+		{"8001-8009,10002,13000-14000", 11, "13001"},
+		{"[::1]:20000-20001", 1, "[::1]:20001"},
+	} {
+		if got, err := file.RangeTarget(v.target, v.i); err != nil || got != v.want {
+			t.Fatalf("%s %d: got %s %v, want %s", v.target, v.i, got, err, v.want)
+		}
+	}
+	if _, err := file.RangeTarget("10.1.50.2:20000-20001", 2); err == nil {
+		t.Fatal("the index out of the range should fail")
+	}
+	task := &file.Tunnel{Mode: "tcp", Target: &file.Target{TargetStr: "10.1.50.2:20000-20002\n10.1.50.3:20000-20001"}}
+	if err := task.SetPorts("10000-10002"); err != nil || task.Port != 10000 {
+		t.Fatal(task.Port, err)
+	}
+	if err := task.CheckPortRange(); err == nil {
+		t.Fatal("the target with less ports should fail")
+	}
+}
+
+// freePorts finds n continuous free tcp ports
+func freePorts(t *testing.T, n int) int {
+	for i := 0; i < 100; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		free := start+n <= 65535
+		for p := start; free && p < start+n; p++ {
+			if l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(p)); err != nil {
+				free = false
+			} else {
+				l.Close()
+			}
+		}
+		if free {
+			return start
+		}
+	}
+	t.Fatal("no free ports")
+	return 0
+}
+
+func newRangeTask(start, n int) *file.Tunnel {
+	client := file.NewClient("test", true, true)
+	client.Id = 1
+	task := &file.Tunnel{
+		Id:       1,
+		Client:   client,
+		Mode:     "tcp",
+		ServerIp: "127.0.0.1",
+		Flow:     new(file.Flow),
+		Target:   &file.Target{TargetStr: "10.1.50.2:20000-" + strconv.Itoa(20000+n-1)},
+	}
+	task.SetPorts(strconv.Itoa(start) + "-" + strconv.Itoa(start+n-1))
+	return task
+}
+
+func inletFlow(f *file.Flow) int64 {
+	if f == nil {
+		return -1
+	}
+	f.RLock()
+	defer f.RUnlock()
+	return f.InletFlow
+}
+
+func TestTunnelPortRange(t *testing.T) {
+	setupProxyTestConf(t)
+	start := freePorts(t, 3)
+	npc, target := net.Pipe()
+	bridge := &linkTestBridge{target: target, host: make(chan string, 1)}
+	task := newRangeTask(start, 3)
+	s := NewTunnelModeServer(ProcessTunnel, bridge, task)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Start()
+	}()
+
+	var c net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(start+1)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if host := <-bridge.host; host != "10.1.50.2:20001" {
+		t.Fatal(host)
+	}
+	c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(npc, b); err != nil || string(b) != "ping" {
+		t.Fatal(string(b), err)
+	}
+	c.Close()
+	npc.Close()
+	time.Sleep(50 * time.Millisecond)
+	if n := inletFlow(task.PortFlow[start+1]); n != 4 {
+		t.Fatal("the flow of the port", n)
+	}
+	if n := inletFlow(task.PortFlow[start]); n != 0 {
+		t.Fatal("the flow of the other port", n)
+	}
+	if n := inletFlow(task.Flow); n != 4 {
+		t.Fatal("the flow of the tunnel", n)
+	}
+
+	s.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Close")
+	}
+}
+
+func TestTunnelPortRangeStartFailed(t *testing.T) {
+	setupProxyTestConf(t)
+	start := freePorts(t, 3)
+	l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(start+2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := NewTunnelModeServer(ProcessTunnel, &linkTestBridge{}, newRangeTask(start, 3))
+	if err := s.Start(); err == nil {
+		t.Fatal("start should fail when a port is used")
+	}
+	// the ports listened before the failure are closed
+	for p := start; p < start+2; p++ {
+		l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+}
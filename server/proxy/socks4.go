@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	socks4Version   = 4
+	socks4Granted   = 90
+	socks4Rejected  = 91
+	socks4BadUserId = 93
+)
+
+// socks4 and socks4a of the mixed mode, socks4 has no password,
+// the account of the tunnel is sent as user:password in the user id
+func (s *Sock5ModeServer) handleSocks4(c net.Conn) {
+	/*
+		+----+----+----+----+----+----+----+----+----+----+....+----+
+		| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+		+----+----+----+----+----+----+----+----+----+----+....+----+
+		   1    1      2              4           variable       1
+	*/
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c, header); err != nil || header[0] != socks4Version {
+		logs.Warn("illegal socks4 request", err)
+		c.Close()
+		return
+	}
+	userId, err := readNullString(c)
+	if err != nil {
+		logs.Warn("read socks4 user id error", err)
+		c.Close()
+		return
+	}
+	host := net.IP(header[4:8]).String()
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		// socks4a, the domain follows the user id
+		if host, err = readNullString(c); err != nil {
+			logs.Warn("read socks4a domain error", err)
+			c.Close()
+			return
+		}
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4]))))
+	if s.needAuth() {
+		user, pass, _ := strings.Cut(userId, ":")
+		if !s.checkAccount(user, pass) {
+			logs.Warn("socks4 validation failed, remote %s", c.RemoteAddr())
+			s.sendSocks4Reply(c, socks4BadUserId, "")
+			c.Close()
+			return
+		}
+	}
+	switch header[1] {
+	case connectMethod:
+		s.DealClient(conn.NewConn(c), s.task.Client, addr, nil, common.CONN_TCP, func() {
+			s.sendSocks4Reply(c, socks4Granted, "")
+		}, s.task.Client.Flow, s.task.Target.LocalProxy, s.task, nil)
+	case bindMethod:
+		s.bind(c, addr, func(addr string) {
+			if addr == "" {
+				s.sendSocks4Reply(c, socks4Rejected, "")
+			} else {
+				s.sendSocks4Reply(c, socks4Granted, addr)
+			}
+		})
+	default:
+		s.sendSocks4Reply(c, socks4Rejected, "")
+		c.Close()
+	}
+}
+
+// reply of socks4, only ipv4 can be sent, the others are 0.0.0.0
+func (s *Sock5ModeServer) sendSocks4Reply(c net.Conn, rep uint8, addr string) {
+	reply := make([]byte, 8)
+	reply[1] = rep
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		p, _ := strconv.Atoi(port)
+		binary.BigEndian.PutUint16(reply[2:4], uint16(p))
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			copy(reply[4:], ip)
+		}
+	}
+	c.Write(reply)
+}
+
+// read the user id or the domain, the request is not buffered so that the data after it is not read
+func readNullString(c net.Conn) (string, error) {
+	b := make([]byte, 0, 32)
+	one := make([]byte, 1)
+	for len(b) <= 255 {
+		if _, err := io.ReadFull(c, one); err != nil {
+			return "", err
+		}
+		if one[0] == 0 {
+			return string(b), nil
+		}
+		b = append(b, one[0])
+	}
+	return "", errors.New("the string is too long")
+}
@@ -10,6 +10,7 @@ import (
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server/tool"
 	"github.com/astaxie/beego/logs"
 )
 
@@ -86,18 +87,28 @@ func (s *Sock5ModeServer) handleRequest(c net.Conn) {
 
 // reply
 func (s *Sock5ModeServer) sendReply(c net.Conn, rep uint8) {
+	s.sendAddrReply(c, rep, c.LocalAddr().String())
+}
+
+// reply with the address, BIND replies the listener and then the peer
+func (s *Sock5ModeServer) sendAddrReply(c net.Conn, rep uint8, addr string) {
 	reply := []byte{
 		5,
 		rep,
 		0,
-		1,
+		ipV4,
 	}
-
-	localAddr := c.LocalAddr().String()
-	localHost, localPort, _ := net.SplitHostPort(localAddr)
-	ipBytes := net.ParseIP(localHost).To4()
-	nPort, _ := strconv.Atoi(localPort)
-	reply = append(reply, ipBytes...)
+	host, port, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, ip4...)
+	} else if ip != nil {
+		reply[3] = ipV6
+		reply = append(reply, ip.To16()...)
+	} else {
+		reply = append(reply, net.IPv4zero.To4()...)
+	}
+	nPort, _ := strconv.Atoi(port)
 	portBytes := make([]byte, 2)
 	binary.BigEndian.PutUint16(portBytes, uint16(nPort))
 	reply = append(reply, portBytes...)
@@ -105,65 +116,57 @@ func (s *Sock5ModeServer) sendReply(c net.Conn, rep uint8) {
 	c.Write(reply)
 }
 
-// do conn
-func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
+// read the address of the request
+func (s *Sock5ModeServer) readAddr(c net.Conn) (addr string, rep uint8, err error) {
+	rep = serverFailure
 	addrType := make([]byte, 1)
-	if _, err := io.ReadFull(c, addrType); err != nil {
-		logs.Warn("read addr type error", err)
-		s.sendReply(c, serverFailure)
-		c.Close()
+	if _, err = io.ReadFull(c, addrType); err != nil {
 		return
 	}
 	var host string
 	switch addrType[0] {
 	case ipV4:
 		ipv4 := make(net.IP, net.IPv4len)
-		if _, err := io.ReadFull(c, ipv4); err != nil {
-			logs.Warn("read ipv4 error", err)
-			s.sendReply(c, serverFailure)
-			c.Close()
+		if _, err = io.ReadFull(c, ipv4); err != nil {
 			return
 		}
 		host = ipv4.String()
 	case ipV6:
 		ipv6 := make(net.IP, net.IPv6len)
-		if _, err := io.ReadFull(c, ipv6); err != nil {
-			logs.Warn("read ipv6 error", err)
-			s.sendReply(c, serverFailure)
-			c.Close()
+		if _, err = io.ReadFull(c, ipv6); err != nil {
 			return
 		}
 		host = ipv6.String()
 	case domainName:
 		var domainLen uint8
-		if err := binary.Read(c, binary.BigEndian, &domainLen); err != nil {
-			logs.Warn("read domain len error", err)
-			s.sendReply(c, serverFailure)
-			c.Close()
+		if err = binary.Read(c, binary.BigEndian, &domainLen); err != nil {
 			return
 		}
 		domain := make([]byte, domainLen)
-		if _, err := io.ReadFull(c, domain); err != nil {
-			logs.Warn("read domain error", err)
-			s.sendReply(c, serverFailure)
-			c.Close()
+		if _, err = io.ReadFull(c, domain); err != nil {
 			return
 		}
 		host = string(domain)
 	default:
-		s.sendReply(c, addrTypeNotSupported)
+		return "", addrTypeNotSupported, errors.New("address type not supported")
+	}
+	var port uint16
+	if err = binary.Read(c, binary.BigEndian, &port); err != nil {
 		return
 	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), succeeded, nil
+}
 
-	var port uint16
-	if err := binary.Read(c, binary.BigEndian, &port); err != nil {
-		logs.Warn("read port error", err)
-		s.sendReply(c, serverFailure)
+// do conn
+func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
+	addr, rep, err := s.readAddr(c)
+	if err != nil {
+		logs.Warn("read request addr error", err)
+		s.sendReply(c, rep)
 		c.Close()
 		return
 	}
 	// connect to host
-	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
 	var ltype string
 	if command == associateMethod {
 		ltype = common.CONN_UDP
@@ -172,7 +175,7 @@ func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
 	}
 	s.DealClient(conn.NewConn(c), s.task.Client, addr, nil, ltype, func() {
 		s.sendReply(c, succeeded)
-	}, s.task.Flow, s.task.Target.LocalProxy, nil, nil)
+	}, s.task.Client.Flow, s.task.Target.LocalProxy, s.task, nil)
 	return
 }
 
@@ -183,6 +186,93 @@ func (s *Sock5ModeServer) handleConnect(c net.Conn) {
 
 // passive mode
 func (s *Sock5ModeServer) handleBind(c net.Conn) {
+	addr, rep, err := s.readAddr(c)
+	if err != nil {
+		logs.Warn("read bind addr error", err)
+		s.sendReply(c, rep)
+		c.Close()
+		return
+	}
+	s.bind(c, addr, func(addr string) {
+		if addr == "" {
+			s.sendReply(c, serverFailure)
+		} else {
+			s.sendAddrReply(c, succeeded, addr)
+		}
+	})
+}
+
+// bind the peer for the socks5 or socks4 client, the peer connects to a listener on the client,
+// or on the server for the local proxy, reply is called with the listener and then the peer,
+// empty addr is a failure
+func (s *Sock5ModeServer) bind(c net.Conn, addr string, reply func(addr string)) {
+	if s.task.Target.LocalProxy {
+		s.bindOnServer(c, addr, reply)
+		return
+	}
+	link := conn.NewLink(common.CONN_BIND, addr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, c.RemoteAddr().String(), false, "")
+	link.SetCompression(s.task.Compression)
+	link.Priority = s.task.Priority
+	target, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
+	if err != nil {
+		logs.Warn("socks bind on client id %d error %s", s.task.Client.Id, err.Error())
+		reply("")
+		c.Close()
+		return
+	}
+	s.bindOnClient(c, target, link, reply)
+}
+
+// the client sends the address of its listener and then the address of the peer
+func (s *Sock5ModeServer) bindOnClient(c, target net.Conn, link *conn.Link, reply func(addr string)) {
+	tc := conn.NewConn(target)
+	for i := 0; i < 2; i++ {
+		addr, err := tc.GetShortLenContent()
+		if err != nil {
+			logs.Warn("socks bind on client id %d error %v", s.task.Client.Id, err)
+			reply("")
+			target.Close()
+			c.Close()
+			return
+		}
+		reply(string(addr))
+	}
+	conn.CopyWaitGroup(target, c, link, s.task.Client.Rate, s.task.Client.Flow, true, nil, s.task, nil)
+}
+
+// the listener on the server only uses the ports in allow_ports
+func (s *Sock5ModeServer) bindOnServer(c net.Conn, peer string, reply func(addr string)) {
+	port := tool.GenerateServerPort("tcp")
+	if port == 0 {
+		logs.Warn("socks bind error, no port is available in allow_ports")
+		reply("")
+		c.Close()
+		return
+	}
+	l, err := conn.ListenBind(s.task.ServerIp, port)
+	if err != nil {
+		logs.Warn("socks bind listen error", err)
+		reply("")
+		c.Close()
+		return
+	}
+	defer l.Close()
+	// the peer reaches the server by the ip the socks5 client uses
+	host, _, _ := net.SplitHostPort(c.LocalAddr().String())
+	if ip := net.ParseIP(s.task.ServerIp); ip != nil && !ip.IsUnspecified() {
+		host = ip.String()
+	}
+	reply(net.JoinHostPort(host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	target, err := conn.AcceptBind(l, peer)
+	if err != nil {
+		logs.Warn("socks bind accept error", err)
+		reply("")
+		c.Close()
+		return
+	}
+	l.Close()
+	reply(target.RemoteAddr().String())
+	conn.CopyWaitGroup(target, c, nil, s.task.Client.Rate, s.task.Client.Flow, true, nil, s.task, nil)
 }
 func (s *Sock5ModeServer) sendUdpReply(writeConn net.Conn, c net.Conn, rep uint8, serverIp string) {
 	reply := []byte{
@@ -205,56 +295,13 @@ func (s *Sock5ModeServer) sendUdpReply(writeConn net.Conn, c net.Conn, rep uint8
 
 func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	defer c.Close()
-	addrType := make([]byte, 1)
-	if _, err := io.ReadFull(c, addrType); err != nil {
-		logs.Warn("read addr type error", err)
-		s.sendReply(c, serverFailure)
-		return
-	}
-	var host string
-	switch addrType[0] {
-	case ipV4:
-		ipv4 := make(net.IP, net.IPv4len)
-		if _, err := io.ReadFull(c, ipv4); err != nil {
-			logs.Warn("read ipv4 error", err)
-			s.sendReply(c, serverFailure)
-			return
-		}
-		host = ipv4.String()
-	case ipV6:
-		ipv6 := make(net.IP, net.IPv6len)
-		if _, err := io.ReadFull(c, ipv6); err != nil {
-			logs.Warn("read ipv6 error", err)
-			s.sendReply(c, serverFailure)
-			return
-		}
-		host = ipv6.String()
-	case domainName:
-		var domainLen uint8
-		if err := binary.Read(c, binary.BigEndian, &domainLen); err != nil {
-			logs.Warn("read domain len error", err)
-			s.sendReply(c, serverFailure)
-			return
-		}
-		domain := make([]byte, domainLen)
-		if _, err := io.ReadFull(c, domain); err != nil {
-			logs.Warn("read domain error", err)
-			s.sendReply(c, serverFailure)
-			return
-		}
-		host = string(domain)
-	default:
-		s.sendReply(c, addrTypeNotSupported)
-		return
-	}
-	//读取端口
-	var port uint16
-	if err := binary.Read(c, binary.BigEndian, &port); err != nil {
-		logs.Warn("read port error", err)
-		s.sendReply(c, serverFailure)
+	addr, rep, err := s.readAddr(c)
+	if err != nil {
+		logs.Warn("read request addr error", err)
+		s.sendReply(c, rep)
 		return
 	}
-	logs.Warn(host, strconv.Itoa(int(port)))
+	logs.Warn(addr)
 	replyAddr, err := net.ResolveUDPAddr("udp", s.task.ServerIp+":0")
 	if err != nil {
 		logs.Error("build local reply addr error", err)
@@ -271,6 +318,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	defer reply.Close()
 	// new a tunnel to client
 	link := conn.NewLink("udp5", "", s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, c.RemoteAddr().String(), false, "")
+	link.Priority = s.task.Priority
 	target, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
 	if err != nil {
 		logs.Warn("get connection from client id %d  error %s", s.task.Client.Id, err.Error())
@@ -362,10 +410,7 @@ func (s *Sock5ModeServer) handleConn(c net.Conn) {
 		return
 	}
 
-	needAuth := (s.task.Client.Cnf.U != "" && s.task.Client.Cnf.P != "") ||
-		(s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0)
-
-	if needAuth {
+	if s.needAuth() {
 		if !methodOffered(methods, UserPassAuth) {
 			// Client cannot authenticate; reply no acceptable methods (RFC 1928).
 			_, _ = c.Write([]byte{5, 0xFF})
@@ -428,17 +473,7 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 		}
 	}
 
-	ok := false
-	if s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0 {
-		// multi-user auth
-		if expected, found := s.task.MultiAccount.AccountMap[string(user)]; found && string(pass) == expected {
-			ok = true
-		}
-	} else {
-		ok = string(user) == s.task.Client.Cnf.U && string(pass) == s.task.Client.Cnf.P
-	}
-
-	if ok {
+	if s.checkAccount(string(user), string(pass)) {
 		if _, err := c.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return err
 		}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server/tool"
+	"github.com/astaxie/beego"
+)
+
+func newSocks5TestServer(localProxy bool, target net.Conn) *Sock5ModeServer {
+	client := file.NewClient("test", true, true)
+	client.Id = 1
+	task := &file.Tunnel{
+		Id:       1,
+		Client:   client,
+		Mode:     "socks5",
+		ServerIp: "127.0.0.1",
+		Flow:     new(file.Flow),
+		Target:   &file.Target{LocalProxy: localProxy},
+	}
+	return NewSock5ModeServer(&tunnelTestBridge{target: target}, task)
+}
+
+// socks5Bind sends the BIND request of the peer to the server and returns the first reply
+func socks5Bind(t *testing.T, c net.Conn, peer string) string {
+	t.Helper()
+	if _, err := c.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil || b[1] != 0 {
+		t.Fatal(b, err)
+	}
+	host, port, _ := net.SplitHostPort(peer)
+	p, _ := strconv.Atoi(port)
+	req := append([]byte{5, bindMethod, 0, ipV4}, net.ParseIP(host).To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(p))
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	return readSocks5Reply(t, c)
+}
+
+func readSocks5Reply(t *testing.T, c net.Conn) string {
+	t.Helper()
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(c, b); err != nil || b[1] != succeeded || b[3] != ipV4 {
+		t.Fatal(b, err)
+	}
+	return net.JoinHostPort(net.IP(b[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(b[8:]))))
+}
+
+// exchange checks the data is copied both ways
+func exchange(t *testing.T, a, b net.Conn) {
+	t.Helper()
+	go a.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "ping" {
+		t.Fatal(string(buf), err)
+	}
+	go b.Write([]byte("pong"))
+	if _, err := io.ReadFull(a, buf); err != nil || string(buf) != "pong" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+func TestSocks5BindOnServer(t *testing.T) {
+	setupProxyTestConf(t)
+	s := newSocks5TestServer(true, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			s.handleConn(c)
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	addr := socks5Bind(t, c, "127.0.0.1:21")
+	peer, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if got := readSocks5Reply(t, c); got != peer.LocalAddr().String() {
+		t.Fatalf("second reply %s, the peer is %s", got, peer.LocalAddr())
+	}
+	exchange(t, c, peer)
+}
+
+func TestSocks5BindOnClient(t *testing.T) {
+	setupProxyTestConf(t)
+	npc, target := net.Pipe()
+	defer npc.Close()
+	s := newSocks5TestServer(false, target)
+	c, server := net.Pipe()
+	defer c.Close()
+	go s.handleConn(server)
+	go func() {
+		nc := conn.NewConn(npc)
+		nc.WriteLenContent([]byte("192.168.1.2:2000"))
+		nc.WriteLenContent([]byte("192.168.1.3:3000"))
+	}()
+	if addr := socks5Bind(t, c, "192.168.1.3:0"); addr != "192.168.1.2:2000" {
+		t.Fatal(addr)
+	}
+	if addr := readSocks5Reply(t, c); addr != "192.168.1.3:3000" {
+		t.Fatal(addr)
+	}
+	exchange(t, c, npc)
+}
+
+type failTestBridge struct{}
+
+func (b *failTestBridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error) {
+	return nil, errors.New("the client does not support bind")
+}
+
+// the listener on the server is only for the local proxy and uses a port in allow_ports
+func TestSocks5BindOnServerAllowPorts(t *testing.T) {
+	setupProxyTestConf(t)
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	beego.AppConfig.Set("allow_ports", strconv.Itoa(port))
+	tool.InitAllowPort()
+	t.Cleanup(func() {
+		beego.AppConfig.Set("allow_ports", "")
+		tool.InitAllowPort()
+	})
+	s := newSocks5TestServer(true, nil)
+	c, server := net.Pipe()
+	defer c.Close()
+	go s.handleConn(server)
+	if addr := socks5Bind(t, c, "127.0.0.1:21"); addr != net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) {
+		t.Fatalf("bind on %s, allow_ports is %d", addr, port)
+	}
+}
+
+// a failed bind on the client is not moved to the server
+func TestSocks5BindOnClientFail(t *testing.T) {
+	setupProxyTestConf(t)
+	s := newSocks5TestServer(false, nil)
+	s.bridge = &failTestBridge{}
+	c, server := net.Pipe()
+	defer c.Close()
+	go s.handleConn(server)
+	if _, err := c.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	req := append([]byte{5, bindMethod, 0, ipV4}, 127, 0, 0, 1, 0, 21)
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 10)
+	if _, err := io.ReadFull(c, b); err != nil || b[1] != serverFailure {
+		t.Fatal(b, err)
+	}
+}
+
+// the ip white list of the client does not inject its auth page into a socks stream
+func TestSocks5IpWhiteRawStream(t *testing.T) {
+	setupProxyTestConf(t)
+	npc, target := net.Pipe()
+	defer npc.Close()
+	s := newSocks5TestServer(false, target)
+	s.task.Client.IpWhite, s.task.Client.IpWhitePass = true, "pass"
+	c, server := net.Pipe()
+	defer c.Close()
+	go s.handleConn(server)
+	if _, err := c.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	c.Write(append([]byte{5, connectMethod, 0, ipV4}, 127, 0, 0, 1, 0, 80))
+	readSocks5Reply(t, c)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	npc.SetDeadline(time.Now().Add(5 * time.Second))
+	exchange(t, c, npc)
+	// the flow is added after the write
+	for i := 0; ; i++ {
+		s.task.Client.Flow.Lock()
+		n := s.task.Client.Flow.InletFlow
+		s.task.Client.Flow.Unlock()
+		if n == 8 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the flow of the client is", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
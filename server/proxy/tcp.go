@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"ehang.io/nps/bridge"
 	"ehang.io/nps/lib/common"
@@ -21,8 +22,10 @@ import (
 
 type TunnelModeServer struct {
 	BaseServer
-	process  process
-	listener net.Listener
+	process   process
+	listener  net.Listener
+	ports     *portRange     // 端口范围隧道
+	listeners []net.Listener // 端口范围隧道的所有端口
 }
 
 // tcp|http|host
@@ -36,20 +39,52 @@ func NewTunnelModeServer(process process, bridge NetBridge, task *file.Tunnel) *
 
 // 开始
 func (s *TunnelModeServer) Start() error {
-	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), func(c net.Conn) {
-		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
-			logs.Warn("client id %d, task id %d,error %s, when tcp connection", s.task.Client.Id, s.task.Id, err.Error())
-			c.Close()
-			return
-		}
-		logs.Trace("new tcp connection,local port %d,client %d,remote address %s", s.task.Port, s.task.Client.Id, c.RemoteAddr())
-		s.process(conn.NewConn(c), s)
-		s.task.Client.AddConn()
-	}, &s.listener)
+	if s.task.IsPortRange() {
+		return s.startRange()
+	}
+	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), s.handle, &s.listener)
+}
+
+func (s *TunnelModeServer) handle(c net.Conn) {
+	if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+		logs.Warn("client id %d, task id %d,error %s, when tcp connection", s.task.Client.Id, s.task.Id, err.Error())
+		c.Close()
+		return
+	}
+	logs.Trace("new tcp connection,local port %d,client %d,remote address %s", s.task.Port, s.task.Client.Id, c.RemoteAddr())
+	s.process(conn.NewConn(c), s)
+	s.task.Client.AddConn()
+}
+
+// startRange 监听端口范围中的所有端口，任一端口失败时都不监听
+func (s *TunnelModeServer) startRange() error {
+	var err error
+	s.ports = newPortRange(s.task)
+	if s.listeners, err = s.ports.listenTcp(s.task.ServerIp); err != nil {
+		return err
+	}
+	s.listener = s.listeners[0]
+	var wg sync.WaitGroup
+	for i, l := range s.listeners {
+		wg.Add(1)
+		go func(l net.Listener, port int) {
+			defer wg.Done()
+			conn.Accept(l, func(c net.Conn) {
+				s.handle(&portFlowConn{Conn: c, port: port, flow: s.ports.flow(port)})
+			})
+		}(l, s.ports.ports[i])
+	}
+	wg.Wait()
+	return nil
 }
 
 // close
 func (s *TunnelModeServer) Close() error {
+	if s.listeners != nil {
+		for _, l := range s.listeners[1:] {
+			l.Close()
+		}
+	}
 	return s.listener.Close()
 }
 
@@ -100,7 +135,13 @@ type process func(c *conn.Conn, s *TunnelModeServer) error
 
 // tcp proxy
 func ProcessTunnel(c *conn.Conn, s *TunnelModeServer) error {
-	targetAddr, err := s.task.Target.GetRandomTarget()
+	var targetAddr string
+	var err error
+	if pc, ok := c.Conn.(*portFlowConn); ok {
+		targetAddr, err = s.ports.target(pc.port)
+	} else {
+		targetAddr, err = s.task.Target.GetRandomTarget()
+	}
 	if err != nil {
 		c.Close()
 		logs.Warn("tcp port %d ,client id %d,task id %d connect error %s", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
@@ -118,7 +159,7 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 		return err
 	}
 	// Authenticate before establishing CONNECT tunnel (fixes auth-after-200 bug).
-	if err := s.proxyAuth(r, c, s.task.Client.Cnf.U, s.task.Client.Cnf.P); err != nil {
+	if err := s.proxyAuth(r, c); err != nil {
 		logs.Warn("http proxy auth failed, client %d, remote %s: %v", s.task.Client.Id, c.Conn.RemoteAddr(), err)
 		return err
 	}
@@ -130,5 +171,5 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 		rb = nil
 	}
 	logs.Info("http proxy request, method %s, host %s, client %d, remote %s", r.Method, addr, s.task.Client.Id, c.Conn.RemoteAddr())
-	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, nil, nil)
+	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, s.task, nil)
 }
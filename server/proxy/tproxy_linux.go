@@ -0,0 +1,341 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/graceful"
+	"github.com/astaxie/beego/logs"
+)
+
+// not defined by syscall
+const (
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR, also the type of the control message
+)
+
+// TproxyModeServer is the transparent proxy of the packets sent to the port by the TPROXY target of iptables,
+// the original destination is the local address of a tcp conn, or the IP_ORIGDSTADDR of a udp packet.
+// the tcp conns are proxied like socks5, the udp of a source is relayed by a udp5 link of the client,
+// and the replies are sent from the address the packet was sent to
+type TproxyModeServer struct {
+	BaseServer
+	listener  net.Listener
+	udp       *net.UDPConn
+	addrMap   sync.Map // source address -> *tproxySession
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+type tproxySession struct {
+	udpSession
+	senders map[string]*net.UDPConn // sockets bound to the original destinations, only used by the reader
+}
+
+func NewTproxyModeServer(bridge NetBridge, task *file.Tunnel) *TproxyModeServer {
+	s := new(TproxyModeServer)
+	s.bridge = bridge
+	s.task = task
+	s.closeCh = make(chan struct{})
+	return s
+}
+
+// transparent lets the socket receive the packets of any destination and send from any source
+func transparent(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+			return
+		}
+		// an ipv4 socket does not know the ipv6 options
+		_ = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return
+		}
+		if strings.HasPrefix(network, "udp") {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+				return
+			}
+			_ = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// tproxyOption the listening sockets of tproxy are passed to the new process by a graceful restart
+var tproxyOption = &graceful.Option{Name: "transparent", Control: transparent}
+
+// origDst returns the original destination in the control messages of a udp packet
+func origDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// sockaddr_in: family, port, addr
+			return &net.UDPAddr{IP: net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]), Port: int(binary.BigEndian.Uint16(m.Data[2:4]))}, nil
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6RecvOrigDstAddr && len(m.Data) >= 24:
+			// sockaddr_in6: family, port, flowinfo, addr
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), m.Data[8:24]...)), Port: int(binary.BigEndian.Uint16(m.Data[2:4]))}, nil
+		}
+	}
+	return nil, errors.New("no original destination of the udp packet")
+}
+
+// start
+func (s *TproxyModeServer) Start() error {
+	var err error
+	ip := net.ParseIP(s.task.ServerIp)
+	if s.udp, err = graceful.ListenUDPOption(&net.UDPAddr{IP: ip, Port: s.task.Port}, tproxyOption); err != nil {
+		return err
+	}
+	if s.listener, err = graceful.ListenTCPOption(&net.TCPAddr{IP: ip, Port: s.task.Port}, tproxyOption); err != nil {
+		s.udp.Close()
+		return err
+	}
+	go s.serveUdp()
+	go s.sweeper()
+	conn.Accept(s.listener, func(c net.Conn) {
+		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+			logs.Warn("client id %d, task id %d, error %s, when tproxy connection", s.task.Client.Id, s.task.Id, err.Error())
+			c.Close()
+			return
+		}
+		// the local address is the original destination
+		dst := c.LocalAddr().(*net.TCPAddr)
+		if s.isSelf(dst.IP, dst.Port) {
+			c.Close()
+			return
+		}
+		target := dst.String()
+		logs.Trace("New tproxy connection,client %d,remote address %s,target %s", s.task.Client.Id, c.RemoteAddr(), target)
+		s.DealClient(conn.NewConn(c), s.task.Client, target, nil, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, s.task, nil)
+		s.task.Client.AddConn()
+	})
+	return nil
+}
+
+// isSelf reports whether the destination is the listener itself, the conns and the packets
+// sent to the port directly but not by TPROXY would be proxied to the listener again
+func (s *TproxyModeServer) isSelf(ip net.IP, port int) bool {
+	if port != s.task.Port {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TproxyModeServer) serveUdp() {
+	oob := make([]byte, 128)
+	graceful.WaitUDP()
+	for {
+		buf := common.BufPoolUdp.Get().([]byte)
+		n, oobn, _, addr, err := s.udp.ReadMsgUDP(buf, oob)
+		if err != nil {
+			common.BufPoolUdp.Put(buf)
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			continue
+		}
+		dst, err := origDst(oob[:oobn])
+		if err != nil || s.isSelf(dst.IP, dst.Port) || IsGlobalBlackIp(addr.String()) || common.IsBlackIp(addr.String(), s.task.Client.VerifyKey, s.task.Client.BlackIpList) {
+			common.BufPoolUdp.Put(buf)
+			continue
+		}
+		go s.process(addr, dst, buf, n)
+	}
+}
+
+// process sends a packet of the source to dst by the session of the source, the buf is put back to the pool
+func (s *TproxyModeServer) process(addr, dst *net.UDPAddr, buf []byte, n int) {
+	defer common.BufPoolUdp.Put(buf)
+	// the datagram of the udp5 link, the header is the destination
+	var b bytes.Buffer
+	if err := common.NewUDPDatagram(common.NewUDPHeader(0, 0, common.ToSocksAddr(dst)), buf[:n]).Write(&b); err != nil {
+		return
+	}
+	key := addr.String()
+	if v, ok := s.addrMap.Load(key); ok {
+		s.dispatch(key, v.(*tproxySession), b.Bytes(), n)
+		return
+	}
+	sess := &tproxySession{udpSession: udpSession{ready: make(chan struct{})}, senders: make(map[string]*net.UDPConn)}
+	sess.touch()
+	if existing, loaded := s.addrMap.LoadOrStore(key, sess); loaded {
+		s.dispatch(key, existing.(*tproxySession), b.Bytes(), n)
+		return
+	}
+	if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+		logs.Warn("client id %d, task id %d, error %s, when tproxy udp", s.task.Client.Id, s.task.Id, err.Error())
+		s.failSession(key, sess, err)
+		return
+	}
+	defer s.task.Client.AddConn()
+	link := conn.NewLink("udp5", "", s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, key, false, "")
+	link.Priority = s.task.Priority
+	target, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
+	if err != nil {
+		logs.Warn("get connection from client id %d error %s", s.task.Client.Id, err.Error())
+		s.failSession(key, sess, err)
+		return
+	}
+	sess.target = target
+	sess.rawConn = target
+	close(sess.ready)
+	logs.Trace("New tproxy udp connection,client %d,remote address %s", s.task.Client.Id, key)
+	s.dispatch(key, sess, b.Bytes(), n)
+	s.reply(key, addr, sess)
+}
+
+func (s *TproxyModeServer) failSession(key string, sess *tproxySession, err error) {
+	sess.err = err
+	close(sess.ready)
+	s.addrMap.Delete(key)
+}
+
+// dispatch writes a datagram to the session, it waits for the session being built
+func (s *TproxyModeServer) dispatch(key string, sess *tproxySession, data []byte, n int) {
+	select {
+	case <-sess.ready:
+		if sess.err != nil {
+			return
+		}
+	case <-time.After(udpBuildTimeout):
+		logs.Warn("tproxy udp session build timeout for %s, drop packet", key)
+		return
+	case <-s.closeCh:
+		return
+	}
+	if _, err := sess.target.Write(data); err != nil {
+		s.removeSession(key, sess)
+		return
+	}
+	sess.touch()
+	s.addFlow(n)
+}
+
+// addFlow 流量计入客户端和隧道
+func (s *TproxyModeServer) addFlow(n int) {
+	s.task.Client.Flow.Add(int64(n), int64(n))
+	s.task.Flow.Add(int64(n), int64(n))
+}
+
+// reply reads the length prefixed datagrams of the client, and sends them to the source from their addresses
+func (s *TproxyModeServer) reply(key string, addr *net.UDPAddr, sess *tproxySession) {
+	defer s.removeSession(key, sess)
+	defer func() {
+		for _, c := range sess.senders {
+			c.Close()
+		}
+	}()
+	c := conn.NewConn(sess.rawConn)
+	lc := net.ListenConfig{Control: transparent}
+	for {
+		sess.rawConn.SetReadDeadline(time.Now().Add(udpReadDeadline))
+		b, err := c.GetShortLenContent()
+		if err != nil {
+			return
+		}
+		d, err := common.ReadUDPDatagram(bytes.NewReader(b))
+		if err != nil {
+			logs.Warn("unpack tproxy udp data error %s", err.Error())
+			return
+		}
+		from := d.Header.Addr.String()
+		sender, ok := sess.senders[from]
+		if !ok {
+			pc, err := lc.ListenPacket(context.Background(), "udp", from)
+			if err != nil {
+				logs.Warn("tproxy udp reply from %s error %s", from, err.Error())
+				continue
+			}
+			sender = pc.(*net.UDPConn)
+			sess.senders[from] = sender
+		}
+		sess.touch()
+		if _, err := sender.WriteToUDP(d.Data, addr); err != nil {
+			logs.Warn(err)
+			return
+		}
+		s.addFlow(len(d.Data))
+	}
+}
+
+func (s *TproxyModeServer) removeSession(key string, sess *tproxySession) {
+	if v, ok := s.addrMap.Load(key); ok && v.(*tproxySession) == sess {
+		s.addrMap.Delete(key)
+	}
+	if sess.target != nil {
+		sess.target.Close()
+	}
+}
+
+// sweeper closes the idle sessions, the reader of the session returns and cleans up
+func (s *TproxyModeServer) sweeper() {
+	ticker := time.NewTicker(udpSweepInterval)
+	defer ticker.Stop()
+	idleNs := int64(udpSessionIdleTimeout)
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+			now := time.Now().UnixNano()
+			s.addrMap.Range(func(k, v interface{}) bool {
+				sess := v.(*tproxySession)
+				if sess.target != nil && now-atomic.LoadInt64(&sess.lastActive) > idleNs {
+					s.removeSession(k.(string), sess)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// close
+func (s *TproxyModeServer) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+	s.addrMap.Range(func(k, v interface{}) bool {
+		s.removeSession(k.(string), v.(*tproxySession))
+		return true
+	})
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
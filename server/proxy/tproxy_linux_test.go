@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+)
+
+// cmsg builds a control message of level and typ
+func cmsg(level, typ int32, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = level
+	h.Type = typ
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestOrigDst(t *testing.T) {
+	v4 := make([]byte, 16)
+	binary.LittleEndian.PutUint16(v4, syscall.AF_INET)
+	binary.BigEndian.PutUint16(v4[2:], 53)
+	copy(v4[4:], []byte{8, 8, 4, 4})
+	v6 := make([]byte, 28)
+	binary.LittleEndian.PutUint16(v6, syscall.AF_INET6)
+	binary.BigEndian.PutUint16(v6[2:], 443)
+	copy(v6[8:], net.ParseIP("2001:db8::1"))
+	for _, c := range []struct {
+		oob  []byte
+		want string
+	}{
+		{cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, v4), "8.8.4.4:53"},
+		{cmsg(syscall.SOL_IPV6, ipv6RecvOrigDstAddr, v6), "[2001:db8::1]:443"},
+		// the other messages are skipped
+		{append(cmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}), cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, v4)...), "8.8.4.4:53"},
+	} {
+		addr, err := origDst(c.oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != c.want {
+			t.Fatalf("got %s, want %s", addr, c.want)
+		}
+	}
+	if _, err := origDst(cmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0})); err == nil {
+		t.Fatal("no original destination should fail")
+	}
+}
+
+type tproxyTestBridge struct {
+	target net.Conn
+	err    error
+	links  chan *conn.Link
+}
+
+func (b *tproxyTestBridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error) {
+	b.links <- link
+	return b.target, b.err
+}
+
+func newTproxyTestServer(bridge NetBridge) *TproxyModeServer {
+	client := file.NewClient("test", true, true)
+	client.Id = 1
+	return NewTproxyModeServer(bridge, &file.Tunnel{Id: 1, Client: client, Mode: "tproxy", Port: 1, Flow: new(file.Flow), Target: &file.Target{}})
+}
+
+// packet passes the udp packet to the session of the source as serveUdp does
+func packet(s *TproxyModeServer, src, dst *net.UDPAddr, data string) {
+	buf := common.BufPoolUdp.Get().([]byte)
+	n := copy(buf, data)
+	go s.process(src, dst, buf, n)
+}
+
+func TestTproxyUdpSession(t *testing.T) {
+	setupProxyTestConf(t)
+	npc, target := net.Pipe()
+	bridge := &tproxyTestBridge{target: target, links: make(chan *conn.Link, 2)}
+	s := newTproxyTestServer(bridge)
+	defer s.Close()
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}
+	dst := &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 53}
+	read := func(want string) {
+		t.Helper()
+		b := make([]byte, 1024)
+		npc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := npc.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := common.ReadUDPDatagram(bytes.NewReader(b[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Header.Addr.String() != dst.String() || string(d.Data) != want {
+			t.Fatalf("got %s %q, want %s %q", d.Header.Addr, d.Data, dst, want)
+		}
+	}
+	packet(s, src, dst, "one")
+	if link := <-bridge.links; link.ConnType != "udp5" || link.RemoteAddr != src.String() {
+		t.Fatalf("link %s from %s", link.ConnType, link.RemoteAddr)
+	}
+	read("one")
+	// the later packets of the source use the session
+	packet(s, src, dst, "two")
+	read("two")
+	if len(bridge.links) != 0 {
+		t.Fatal("a second link is opened for the same source")
+	}
+	// the flow is added after the write
+	for i := 0; ; i++ {
+		s.task.Flow.RLock()
+		in := s.task.Flow.InletFlow
+		s.task.Flow.RUnlock()
+		if in == 6 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("flow %d", in)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the flow limit of the client counts the tproxy traffic
+	s.task.Client.Flow.RLock()
+	in := s.task.Client.Flow.InletFlow
+	s.task.Client.Flow.RUnlock()
+	if in != 6 {
+		t.Fatalf("client flow %d", in)
+	}
+	// the session is removed when the link of the client is closed
+	npc.Close()
+	for i := 0; ; i++ {
+		if _, ok := s.addrMap.Load(src.String()); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the session is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTproxyUdpSessionFail(t *testing.T) {
+	setupProxyTestConf(t)
+	bridge := &tproxyTestBridge{err: errors.New("the client is offline"), links: make(chan *conn.Link, 2)}
+	s := newTproxyTestServer(bridge)
+	defer s.Close()
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}
+	dst := &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 53}
+	packet(s, src, dst, "one")
+	<-bridge.links
+	// a failed session is not kept, the next packet tries again
+	for i := 0; ; i++ {
+		if _, ok := s.addrMap.Load(src.String()); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the failed session is kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	packet(s, src, dst, "two")
+	select {
+	case <-bridge.links:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no link is opened for the next packet")
+	}
+}
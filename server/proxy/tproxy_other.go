@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+
+	"ehang.io/nps/lib/file"
+)
+
+// TproxyModeServer needs the TPROXY target of iptables, only linux is supported
+type TproxyModeServer struct {
+	BaseServer
+}
+
+func NewTproxyModeServer(bridge NetBridge, task *file.Tunnel) *TproxyModeServer {
+	s := new(TproxyModeServer)
+	s.bridge = bridge
+	s.task = task
+	return s
+}
+
+func (s *TproxyModeServer) Start() error {
+	return errors.New("tproxy mode is only supported on linux")
+}
+
+func (s *TproxyModeServer) Close() error {
+	return nil
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -12,6 +13,7 @@ import (
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/graceful"
 	"github.com/astaxie/beego/logs"
 )
 
@@ -37,6 +39,7 @@ type udpSession struct {
 	lastActive int64              // 最近活跃时间（unix nano，原子读写）
 	ready      chan struct{}      // 会话就绪后关闭；建立失败时也关闭
 	err        error              // 建立失败时设置；ready 关闭后才允许读
+	flow       *file.Flow         // 端口范围隧道中该端口的流量，普通隧道为 nil
 }
 
 func (u *udpSession) touch() {
@@ -47,6 +50,8 @@ type UdpModeServer struct {
 	BaseServer
 	addrMap   sync.Map
 	listener  *net.UDPConn
+	ports     *portRange     // 端口范围隧道
+	listeners []*net.UDPConn // 端口范围隧道的所有端口，与 ports 中的端口按序号对应
 	closeOnce sync.Once
 	closeCh   chan struct{}
 }
@@ -65,14 +70,45 @@ func (s *UdpModeServer) Start() error {
 	if s.task.ServerIp == "" {
 		s.task.ServerIp = "0.0.0.0"
 	}
-	s.listener, err = net.ListenUDP("udp", &net.UDPAddr{net.ParseIP(s.task.ServerIp), s.task.Port, ""})
+	if s.task.IsPortRange() {
+		return s.startRange()
+	}
+	s.listener, err = graceful.ListenUDP(&net.UDPAddr{net.ParseIP(s.task.ServerIp), s.task.Port, ""})
 	if err != nil {
 		return err
 	}
 	go s.sweeper()
+	s.serve(s.listener, s.task.Port)
+	return nil
+}
+
+// startRange 监听端口范围中的所有端口，任一端口失败时都不监听
+func (s *UdpModeServer) startRange() error {
+	var err error
+	s.ports = newPortRange(s.task)
+	if s.listeners, err = s.ports.listenUdp(s.task.ServerIp); err != nil {
+		return err
+	}
+	s.listener = s.listeners[0]
+	go s.sweeper()
+	var wg sync.WaitGroup
+	for i, l := range s.listeners {
+		wg.Add(1)
+		go func(l *net.UDPConn, port int) {
+			defer wg.Done()
+			s.serve(l, port)
+		}(l, s.ports.ports[i])
+	}
+	wg.Wait()
+	return nil
+}
+
+// serve 读取一个端口的包，直到端口关闭
+func (s *UdpModeServer) serve(l *net.UDPConn, port int) {
+	graceful.WaitUDP()
 	for {
 		buf := common.BufPoolUdp.Get().([]byte)
-		n, addr, err := s.listener.ReadFromUDP(buf)
+		n, addr, err := l.ReadFromUDP(buf)
 		if err != nil {
 			common.BufPoolUdp.Put(buf)
 			if strings.Contains(err.Error(), "use of closed network connection") {
@@ -90,14 +126,19 @@ func (s *UdpModeServer) Start() error {
 			continue
 		}
 
-		go s.process(addr, buf, n)
+		go s.process(l, port, addr, buf, n)
 	}
-	return nil
 }
 
 // process 处理单个 UDP 包。函数持有 buf 的所有权，所有路径必须归还。
-func (s *UdpModeServer) process(addr *net.UDPAddr, buf []byte, n int) {
+// 端口范围隧道中同一 src addr 访问不同端口是不同的会话。
+func (s *UdpModeServer) process(l *net.UDPConn, port int, addr *net.UDPAddr, buf []byte, n int) {
 	key := addr.String()
+	var flow *file.Flow
+	if s.ports != nil {
+		key += "/" + strconv.Itoa(port)
+		flow = s.ports.flow(port)
+	}
 	data := buf[:n]
 
 	// 快路径：会话已存在
@@ -108,7 +149,7 @@ func (s *UdpModeServer) process(addr *net.UDPAddr, buf []byte, n int) {
 	}
 
 	// 慢路径：尝试成为该 key 的"会话建立者"
-	placeholder := &udpSession{ready: make(chan struct{})}
+	placeholder := &udpSession{ready: make(chan struct{}), flow: flow}
 	placeholder.touch()
 	if existing, loaded := s.addrMap.LoadOrStore(key, placeholder); loaded {
 		// 输了占位竞争，等赢家把会话建好后复用
@@ -118,7 +159,7 @@ func (s *UdpModeServer) process(addr *net.UDPAddr, buf []byte, n int) {
 	}
 
 	// 赢得占位 —— 我去建立会话
-	s.runSession(addr, key, placeholder, buf, n)
+	s.runSession(l, port, addr, key, placeholder, buf, n)
 }
 
 // dispatch 把数据写入 sess.target。若 sess 仍在建立中则阻塞等待，超时则丢包。
@@ -143,13 +184,21 @@ func (s *UdpModeServer) dispatch(key string, sess *udpSession, data []byte, n in
 		return
 	}
 	sess.touch()
+	s.addFlow(sess, n)
+}
+
+// addFlow 流量计入客户端、隧道和端口
+func (s *UdpModeServer) addFlow(sess *udpSession, n int) {
 	s.task.Client.Flow.Add(int64(n), int64(n))
 	s.task.Flow.Add(int64(n), int64(n))
+	if sess.flow != nil {
+		sess.flow.Add(int64(n), int64(n))
+	}
 }
 
 // runSession 由占位赢家执行：建立到 npc 的 stream、发送首包、运行下行读循环。
 // buf 由本函数负责归还。
-func (s *UdpModeServer) runSession(addr *net.UDPAddr, key string, sess *udpSession, buf []byte, n int) {
+func (s *UdpModeServer) runSession(l *net.UDPConn, port int, addr *net.UDPAddr, key string, sess *udpSession, buf []byte, n int) {
 	data := buf[:n]
 
 	// 失败时统一清理：关 ready 通道唤醒所有输家、删占位、归还 buf。
@@ -168,14 +217,29 @@ func (s *UdpModeServer) runSession(addr *net.UDPAddr, key string, sess *udpSessi
 	// 只有赢家消耗 NowConn 配额，函数返回时释放。
 	defer s.task.Client.AddConn()
 
-	link := conn.NewLink(common.CONN_UDP, s.task.Target.TargetStr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, addr.String(), s.task.Target.LocalProxy, "")
+	targetAddr := s.task.Target.TargetStr
+	if s.ports != nil {
+		var err error
+		if targetAddr, err = s.ports.target(port); err != nil {
+			failBuild(err)
+			return
+		}
+	}
+	link := conn.NewLink(common.CONN_UDP, targetAddr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, addr.String(), s.task.Target.LocalProxy, "")
+	link.SetCompression(s.task.Compression)
+	link.Priority = s.task.Priority
 	clientConn, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
 	if err != nil {
 		failBuild(err)
 		return
 	}
 
-	target := conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, nil, true)
+	target, err := conn.GetConn(clientConn, link, nil, true)
+	if err != nil {
+		clientConn.Close()
+		failBuild(err)
+		return
+	}
 	sess.target = target
 	sess.rawConn = clientConn
 	sess.touch()
@@ -191,8 +255,7 @@ func (s *UdpModeServer) runSession(addr *net.UDPAddr, key string, sess *udpSessi
 		return
 	}
 	common.BufPoolUdp.Put(buf)
-	s.task.Client.Flow.Add(int64(n), int64(n))
-	s.task.Flow.Add(int64(n), int64(n))
+	s.addFlow(sess, n)
 
 	// 下行读循环
 	rbuf := common.BufPoolUdp.Get().([]byte)
@@ -208,12 +271,11 @@ func (s *UdpModeServer) runSession(addr *net.UDPAddr, key string, sess *udpSessi
 			return
 		}
 		sess.touch()
-		if _, err := s.listener.WriteTo(rbuf[:rn], addr); err != nil {
+		if _, err := l.WriteTo(rbuf[:rn], addr); err != nil {
 			logs.Warn(err)
 			return
 		}
-		s.task.Client.Flow.Add(int64(rn), int64(rn))
-		s.task.Flow.Add(int64(rn), int64(rn))
+		s.addFlow(sess, rn)
 	}
 }
 
@@ -264,5 +326,10 @@ func (s *UdpModeServer) Close() error {
 		s.removeSession(k.(string), v.(*udpSession))
 		return true
 	})
+	if s.listeners != nil {
+		for _, l := range s.listeners[1:] {
+			l.Close()
+		}
+	}
 	return s.listener.Close()
 }
@@ -6,6 +6,7 @@ import (
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/lib/goroutine"
+	"ehang.io/nps/lib/nps_mux"
 	"errors"
 	"github.com/astaxie/beego/logs"
 	"io"
@@ -69,6 +70,10 @@ func (rp *HttpReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 
 func (c *flowConn) Read(p []byte) (n int, err error) {
 	n, err = c.ReadWriteCloser.Read(p)
+	// net/http ends a response without length by io.EOF
+	if err == nps_mux.ErrRemoteClosed {
+		err = io.EOF
+	}
 	return n, err
 }
 
@@ -124,7 +129,10 @@ func NewHttpReverseProxy(s *httpServer) *HttpReverseProxy {
 					logs.Notice("connect to target %s error %s", lk.Host, err)
 					return nil, NewHTTPError(http.StatusBadGateway, "Cannot connect to the server")
 				}
-				connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
+				if connClient, err = conn.GetConn(target, lk, host.Client.Rate, true); err != nil {
+					target.Close()
+					return nil, NewHTTPError(http.StatusBadGateway, "Cannot connect to the server")
+				}
 				return &flowConn{
 					ReadWriteCloser: connClient,
 					fakeAddr:        local,
@@ -155,7 +163,10 @@ func NewHttpReverseProxy(s *httpServer) *HttpReverseProxy {
 			logs.Notice("connect to target %s error %s", lk.Host, err)
 			return nil, NewHTTPError(http.StatusBadGateway, "Cannot connect to the target")
 		}
-		connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
+		if connClient, err = conn.GetConn(target, lk, host.Client.Rate, true); err != nil {
+			target.Close()
+			return nil, NewHTTPError(http.StatusBadGateway, "Cannot connect to the target")
+		}
 		return &flowConn{
 			ReadWriteCloser: connClient,
 			fakeAddr:        local,
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/server/tool"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/config"
+	"github.com/astaxie/beego/logs"
+)
+
+// liveConfigs 修改后不需要重启的配置项，值为生效的方法，其他配置项修改后需要重启
+var liveConfigs = map[string]func(){
+	"log_level":          setLogLevel,
+	"allow_ports":        tool.InitAllowPort,
+	"disconnect_timeout": func() { Bridge.SetDisconnectTime(beego.AppConfig.DefaultInt("disconnect_timeout", 60)) },
+	"ip_limit":           func() { Bridge.SetIpVerify(common.GetBoolByStr(beego.AppConfig.String("ip_limit"))) },
+	"http_cache":         setHttpCache,
+	"http_cache_length":  setHttpCache,
+	// 以下每次使用时读取
+	"http_add_origin_header":     nil,
+	"open_captcha":               nil,
+	"web_username":               nil,
+	"web_password":               nil,
+	"auth_key":                   nil,
+	"allow_user_login":           nil,
+	"allow_user_register":        nil,
+	"allow_user_change_username": nil,
+	"allow_flow_limit":           nil,
+	"allow_rate_limit":           nil,
+	"allow_connection_num_limit": nil,
+	"allow_multi_ip":             nil,
+	"allow_tunnel_num_limit":     nil,
+	"allow_local_proxy":          nil,
+	"allow_legacy_auth":          nil,
+	"show_http_proxy_port":       nil,
+}
+
+var (
+	reloadLock     sync.Mutex
+	confPath       string
+	confModTime    time.Time
+	startConfigs   map[string]string // the settings nps is started with
+	appliedConfigs map[string]string
+	pendingRestart []string
+	logAdapter     string // 启动时创建的日志输出，修改 log_level 后重新创建
+	logOptions     string
+)
+
+// SetLogger 创建日志输出，options 为除 level 以外的 json 配置项
+func SetLogger(adapter, level, options string) error {
+	logAdapter, logOptions = adapter, options
+	return logs.SetLogger(adapter, fmt.Sprintf(`{"level":%s,%s}`, level, options))
+}
+
+// setLogLevel 日志输出有自己的级别，只修改 BeeLogger 的级别不够，需要重新创建
+func setLogLevel() {
+	level := beego.AppConfig.DefaultInt("log_level", 7)
+	logs.SetLevel(level)
+	if logAdapter == "" {
+		return
+	}
+	logs.GetBeeLogger().DelLogger(logAdapter)
+	if err := SetLogger(logAdapter, fmt.Sprint(level), logOptions); err != nil {
+		logs.Error("set the log level error %v", err)
+	}
+}
+
+// PendingRestart returns the changed settings which take effect after a restart
+func PendingRestart() []string {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return append([]string(nil), pendingRestart...)
+}
+
+// initReload 监视 nps.conf，修改后或收到 SIGHUP 时重新加载
+func initReload() {
+	confPath = filepath.Join(common.GetRunPath(), "conf", "nps.conf")
+	startConfigs = configValues(beego.AppConfig)
+	appliedConfigs = startConfigs
+	if fi, err := os.Stat(confPath); err == nil {
+		confModTime = fi.ModTime()
+	}
+	s := make(chan os.Signal, 1)
+	signal.Notify(s, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(time.Second * 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s:
+				ReloadConfig()
+			case <-ticker.C:
+				if fi, err := os.Stat(confPath); err == nil && !fi.ModTime().Equal(confModTime) {
+					ReloadConfig()
+				}
+			}
+		}
+	}()
+}
+
+// ReloadConfig 重新加载 nps.conf，可以生效的配置项立即生效，需要重启的记录在 PendingRestart
+func ReloadConfig() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	if fi, err := os.Stat(confPath); err == nil {
+		confModTime = fi.ModTime()
+	}
+	// 先解析，配置文件有错误时保持原来的配置
+	cnf, err := config.NewConfig("ini", confPath)
+	if err != nil {
+		logs.Error("reload %s error, keep the running config %v", confPath, err)
+		return
+	}
+	values := configValues(cnf)
+	changed := diffConfigs(appliedConfigs, values)
+	if len(changed) == 0 {
+		return
+	}
+	appliedConfigs = values
+	for _, key := range changed {
+		f, live := liveConfigs[key]
+		if !live {
+			continue
+		}
+		// 只修改可以生效的配置项，需要重启的仍读到启动时的值
+		if err := beego.AppConfig.Set(key, values[key]); err != nil {
+			logs.Error("reload the config %s error %v", key, err)
+			continue
+		}
+		if f != nil {
+			f()
+		}
+		logs.Info("the config %s is changed to %q", key, values[key])
+	}
+	pendingRestart = nil
+	for _, key := range diffConfigs(startConfigs, values) {
+		if _, live := liveConfigs[key]; !live {
+			pendingRestart = append(pendingRestart, key)
+		}
+	}
+	if len(pendingRestart) > 0 {
+		logs.Warn("the config %v is changed, restart nps to take effect", pendingRestart)
+	}
+}
+
+func configValues(c config.Configer) map[string]string {
+	values := make(map[string]string)
+	section, err := c.GetSection("default")
+	if err != nil {
+		return values
+	}
+	for k, v := range section {
+		values[k] = v
+	}
+	return values
+}
+
+// diffConfigs returns the sorted keys added, removed or changed
+func diffConfigs(a, b map[string]string) []string {
+	var keys []string
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func setHttpCache() {
+	useCache, _ := beego.AppConfig.Bool("http_cache")
+	cacheLen, _ := beego.AppConfig.Int("http_cache_length")
+	RunList.Range(func(key, value interface{}) bool {
+		if v, ok := value.(interface{ SetCache(bool, int) }); ok {
+			v.SetCache(useCache, cacheLen)
+		}
+		return true
+	})
+}
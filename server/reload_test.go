@@ -0,0 +1,69 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/astaxie/beego"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	a := map[string]string{"web_port": "8080", "log_level": "7", "ip_limit": "true"}
+	b := map[string]string{"web_port": "8080", "log_level": "3", "auth_key": "k"}
+	if got, want := diffConfigs(a, b), []string{"auth_key", "ip_limit", "log_level"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := diffConfigs(a, a); len(got) != 0 {
+		t.Fatalf("same configs got %v", got)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "nps.conf")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	path := write("web_port=8080\nweb_username=admin\nlog_level=7\n")
+	if err := beego.LoadAppConfig("ini", path); err != nil {
+		t.Fatal(err)
+	}
+	confPath = path
+	startConfigs = configValues(beego.AppConfig)
+	appliedConfigs = startConfigs
+
+	write("web_port=9090\nweb_username=root\nlog_level=3\n")
+	ReloadConfig()
+	if got := beego.AppConfig.String("web_username"); got != "root" {
+		t.Fatalf("live config web_username got %q", got)
+	}
+	if got := beego.AppConfig.String("log_level"); got != "3" {
+		t.Fatalf("live config log_level got %q", got)
+	}
+	// the settings which need a restart keep the running value
+	if got := beego.AppConfig.String("web_port"); got != "8080" {
+		t.Fatalf("web_port got %q before a restart", got)
+	}
+	if got := PendingRestart(); !reflect.DeepEqual(got, []string{"web_port"}) {
+		t.Fatalf("pending restart got %v", got)
+	}
+
+	// a broken file keeps the running config
+	write("[default\nweb_username=other\n")
+	ReloadConfig()
+	if got := beego.AppConfig.String("web_username"); got != "root" {
+		t.Fatalf("broken config is applied, web_username got %q", got)
+	}
+
+	// changing it back clears the pending restart
+	write("web_port=8080\nweb_username=root\nlog_level=3\n")
+	ReloadConfig()
+	if got := PendingRestart(); len(got) != 0 {
+		t.Fatalf("pending restart got %v", got)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"ehang.io/nps/bridge"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/graceful"
 	"ehang.io/nps/server/proxy"
 	"ehang.io/nps/server/tool"
 	"github.com/astaxie/beego"
@@ -44,7 +45,7 @@ func InitFromCsv() {
 	}
 	//Initialize services in server-side files
 	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
-		if value.(*file.Tunnel).Status {
+		if value.(*file.Tunnel).Status && ownTask(value.(*file.Tunnel)) {
 			AddTask(value.(*file.Tunnel))
 		}
 		return true
@@ -58,7 +59,7 @@ func DealBridgeTask() {
 		case t := <-Bridge.OpenTask:
 			StartTask(t.Id)
 		case t := <-Bridge.CloseTask:
-			StopServer(t.Id)
+			DelTask(t.Id)
 		case id := <-Bridge.CloseClient:
 			DelTunnelAndHostByClientId(id, true)
 			if v, ok := file.GetDb().JsonDb.Clients.Load(id); ok {
@@ -85,7 +86,16 @@ func DealBridgeTask() {
 
 // start a new server
 func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeDisconnect int) {
+	if err := InitCluster(); err != nil {
+		logs.Error("start cluster error", err)
+		os.Exit(0)
+	}
 	Bridge = bridge.NewTunnel(bridgePort, bridgeType, common.GetBoolByStr(beego.AppConfig.String("ip_limit")), RunList, bridgeDisconnect)
+	if Cluster != nil {
+		Bridge.Remote = remoteLink
+	}
+	initGraceful()
+	initReload()
 	// 启动流量持久化（只启动一次，避免每次 AddTask 创建泄漏的 goroutine）
 	if minute, err := beego.AppConfig.Int("flow_store_interval"); err == nil && minute > 0 {
 		go flowSession(time.Minute * time.Duration(minute))
@@ -107,7 +117,7 @@ func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeD
 	go dealClientFlow()
 	go dealClientExpire()
 	if svr := NewMode(Bridge, cnf); svr != nil {
-		if err := svr.Start(); err != nil {
+		if err := svr.Start(); err != nil && !graceful.Closed() {
 			logs.Error(err)
 		}
 		RunList.Store(cnf.Id, svr)
@@ -180,6 +190,10 @@ func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 		service = proxy.NewTunnelModeServer(proxy.ProcessTunnel, Bridge, c)
 	case "socks5":
 		service = proxy.NewSock5ModeServer(Bridge, c)
+	case "mixed":
+		service = proxy.NewMixedModeServer(Bridge, c)
+	case "tproxy":
+		service = proxy.NewTproxyModeServer(Bridge, c)
 	case "httpProxy":
 		service = proxy.NewTunnelModeServer(proxy.ProcessHttp, Bridge, c)
 	case "tcpTrans":
@@ -224,6 +238,12 @@ func StopServer(id int) error {
 		}
 		return nil
 	}
+	if t, err := file.GetDb().GetTask(id); err == nil && t.Status && !ownTask(t) {
+		// 集群中由其他节点监听，保存后该节点关闭
+		t.Status = false
+		file.GetDb().UpdateTask(t)
+		return nil
+	}
 	return errors.New("task is not running")
 }
 
@@ -235,12 +255,21 @@ func AddTask(t *file.Tunnel) error {
 		RunList.Store(t.Id, nil)
 		return nil
 	}
-	if b := tool.TestServerPort(t.Port, t.Mode); !b && t.Mode != "httpHostServer" {
+	if t.IsPortRange() {
+		if !tool.TestServerPorts(t.GetPorts(), t.Mode) {
+			logs.Error("taskId %d start error ports %s open failed", t.Id, t.Ports)
+			return errors.New("the port open error")
+		}
+	} else if b := tool.TestServerPort(t.Port, t.Mode); !b && t.Mode != "httpHostServer" {
 		logs.Error("taskId %d start error port %d open failed", t.Id, t.Port)
 		return errors.New("the port open error")
 	}
 	if svr := NewMode(Bridge, t); svr != nil {
-		logs.Info("tunnel task %s start mode：%s port %d", t.Remark, t.Mode, t.Port)
+		if t.IsPortRange() {
+			logs.Info("tunnel task %s start mode：%s ports %s", t.Remark, t.Mode, t.Ports)
+		} else {
+			logs.Info("tunnel task %s start mode：%s port %d", t.Remark, t.Mode, t.Port)
+		}
 		//RunList[t.Id] = svr
 		RunList.Store(t.Id, svr)
 		go func() {
@@ -263,8 +292,10 @@ func StartTask(id int) error {
 	if err != nil {
 		return err
 	}
-	if err := AddTask(t); err != nil {
-		return err
+	if ownTask(t) {
+		if err := AddTask(t); err != nil {
+			return err
+		}
 	}
 	t.Status = true
 	file.GetDb().UpdateTask(t)
@@ -302,7 +333,7 @@ func GetTunnel(start, length int, typeVal string, clientId int, search string, s
 			}
 		}
 		if v.Client != nil {
-			if _, ok := Bridge.Client.Load(v.Client.Id); ok {
+			if vv, ok := Bridge.Client.Load(v.Client.Id); ok && !vv.(*bridge.Client).Suspended() {
 				v.Client.IsConnect = true
 			} else {
 				v.Client.IsConnect = false
@@ -352,13 +383,17 @@ func dealClientData() {
 
 	file.GetDb().JsonDb.Clients.Range(func(key, value interface{}) bool {
 		v := value.(*file.Client)
-		if vv, ok := Bridge.Client.Load(v.Id); ok {
+		if vv, ok := Bridge.Client.Load(v.Id); ok && !vv.(*bridge.Client).Suspended() {
 			v.IsConnect = true
 			v.LastOnlineTime = time.Now().Format("2006-01-02 15:04:05")
 			v.Version = vv.(*bridge.Client).Version
+			v.BridgeStats = Bridge.GetBridgeStats(v.Id)
 		} else {
-			v.IsConnect = false
+			// 集群中连接在其他节点的客户端
+			v.IsConnect = Cluster != nil && Cluster.ClientNode(v.Id) != 0
+			v.BridgeStats = nil
 		}
+		v.RotateStatus = v.GetRotateStatus()
 
 		return true
 	})
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server/tool"
+	"github.com/astaxie/beego/logs"
+)
+
+// ApplyTemplate 将模板实例化到一组客户端
+// 第i个客户端的端口为 条目端口 + offset + i*PortStep, 已存在的实例会被跳过
+// 返回每个失败条目的描述, 单个条目失败不影响其他条目
+// 调用方需持有模板的写锁, 客户端的端口基数会记录到模板中
+func ApplyTemplate(t *file.Template, clientIds []int, offset int, suffix string) (errs []string) {
+	if t.Bases == nil {
+		t.Bases = make(map[int]int)
+	}
+	for index, clientId := range clientIds {
+		c, err := file.GetDb().GetClient(clientId)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("client %d: %s", clientId, err.Error()))
+			continue
+		}
+		// the instances already created keep the base of the first apply
+		base, ok := t.Bases[c.Id]
+		if !ok {
+			base = t.PortBase(offset, index)
+			t.Bases[c.Id] = base
+		}
+		errs = append(errs, applyTemplateToClient(t, c, base, suffix)...)
+	}
+	file.GetDb().JsonDb.StoreTemplateToJsonFile()
+	return
+}
+
+// ReapplyTemplate 将模板修改同步到已实例化的隧道和域名
+// 已分配的端口保持不变, 模板中删除的条目对应的实例会被删除, 新增的条目会被创建
+func ReapplyTemplate(t *file.Template) (errs []string) {
+	var clientIds []int
+	seen := make(map[int]bool)
+	addClient := func(c *file.Client) {
+		if c != nil && !seen[c.Id] {
+			seen[c.Id] = true
+			clientIds = append(clientIds, c.Id)
+		}
+	}
+
+	var delTasks []int
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.TemplateId != t.Id {
+			return true
+		}
+		addClient(v.Client)
+		item := getTemplateTunnel(t, v.TemplateItem)
+		if item == nil {
+			delTasks = append(delTasks, v.Id)
+			return true
+		}
+		if err := updateTemplateTunnel(t, item, v); err != nil {
+			errs = append(errs, fmt.Sprintf("client %d tunnel %d: %s", v.Client.Id, v.Id, err.Error()))
+		}
+		return true
+	})
+	for _, id := range delTasks {
+		DelTask(id)
+	}
+
+	var delHosts []int
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.TemplateId != t.Id {
+			return true
+		}
+		addClient(v.Client)
+		item := getTemplateHost(t, v.TemplateItem)
+		if item == nil {
+			delHosts = append(delHosts, v.Id)
+			return true
+		}
+		if err := updateTemplateHost(t, item, v); err != nil {
+			errs = append(errs, fmt.Sprintf("client %d host %d: %s", v.Client.Id, v.Id, err.Error()))
+		}
+		return true
+	})
+	for _, id := range delHosts {
+		file.GetDb().DelHost(id)
+	}
+	file.GetDb().JsonDb.StoreTasksToJsonFile()
+	file.GetDb().JsonDb.StoreHostToJsonFile()
+
+	// create instances for items added after the first apply
+	sort.Ints(clientIds)
+	for _, clientId := range clientIds {
+		c, err := file.GetDb().GetClient(clientId)
+		if err != nil {
+			continue
+		}
+		errs = append(errs, applyTemplateToClient(t, c, portBase(t, c.Id), t.DomainSuffix)...)
+	}
+	return
+}
+
+// portBase 客户端实例化时的端口基数, 没有记录时由已有实例的端口推算
+func portBase(t *file.Template, clientId int) int {
+	if base, ok := t.Bases[clientId]; ok {
+		return base
+	}
+	base := t.PortOffset
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.TemplateId != t.Id || v.Client.Id != clientId {
+			return true
+		}
+		if item := getTemplateTunnel(t, v.TemplateItem); item != nil && item.Port != 0 {
+			base = v.Port - item.Port
+			return false
+		}
+		return true
+	})
+	return base
+}
+
+// DelTemplate 删除模板, 已创建的隧道和域名保留但解除关联
+func DelTemplate(id int) error {
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		if v := value.(*file.Tunnel); v.TemplateId == id {
+			v.TemplateId, v.TemplateItem = 0, 0
+		}
+		return true
+	})
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		if v := value.(*file.Host); v.TemplateId == id {
+			v.TemplateId, v.TemplateItem = 0, 0
+		}
+		return true
+	})
+	file.GetDb().JsonDb.StoreTasksToJsonFile()
+	file.GetDb().JsonDb.StoreHostToJsonFile()
+	return file.GetDb().DelTemplate(id)
+}
+
+func applyTemplateToClient(t *file.Template, c *file.Client, base int, suffix string) (errs []string) {
+	for _, item := range t.Tunnels {
+		if findTemplateTunnel(t.Id, item.Id, c.Id) != nil {
+			continue
+		}
+		if err := newTemplateTunnel(t, item, c, base, suffix); err != nil {
+			errs = append(errs, fmt.Sprintf("client %d tunnel %s: %s", c.Id, t.Render(item.Remark, c, suffix), err.Error()))
+		}
+	}
+	for _, item := range t.Hosts {
+		if findTemplateHost(t.Id, item.Id, c.Id) != nil {
+			continue
+		}
+		if err := newTemplateHost(t, item, c, suffix); err != nil {
+			errs = append(errs, fmt.Sprintf("client %d host %s: %s", c.Id, t.Render(item.Host, c, suffix), err.Error()))
+		}
+	}
+	return
+}
+
+func newTemplateTunnel(t *file.Template, item *file.TemplateTunnel, c *file.Client, base int, suffix string) error {
+	if c.MaxTunnelNum != 0 && c.GetTunnelNum() >= c.MaxTunnelNum {
+		return errors.New("the number of tunnels exceeds the limit")
+	}
+	port := t.GetPort(item, base)
+	if port == 0 {
+		port = tool.GenerateServerPort(item.Mode)
+	}
+	if isTemplatePortUsed(port, item.Mode, 0) || !tool.TestServerPort(port, item.Mode) {
+		return fmt.Errorf("port %d is occupied or not allowed", port)
+	}
+	task := &file.Tunnel{
+		Id:           int(file.GetDb().JsonDb.GetTaskId()),
+		Port:         port,
+		Mode:         item.Mode,
+		Status:       true,
+		Client:       c,
+		Remark:       t.Render(item.Remark, c, suffix),
+		Password:     t.Render(item.Password, c, suffix),
+		Target:       &file.Target{TargetStr: t.Render(item.TargetStr, c, suffix)},
+		Flow:         new(file.Flow),
+		TemplateId:   t.Id,
+		TemplateItem: item.Id,
+	}
+	if err := file.GetDb().NewTask(task); err != nil {
+		return err
+	}
+	logs.Info("template %s create tunnel %d for client %d, port %d", t.Name, task.Id, c.Id, task.Port)
+	return AddTask(task)
+}
+
+func newTemplateHost(t *file.Template, item *file.TemplateHost, c *file.Client, suffix string) error {
+	if c.MaxTunnelNum != 0 && c.GetTunnelNum() >= c.MaxTunnelNum {
+		return errors.New("the number of tunnels exceeds the limit")
+	}
+	h := &file.Host{
+		Id:           int(file.GetDb().JsonDb.GetHostId()),
+		Host:         t.Render(item.Host, c, suffix),
+		Location:     item.Location,
+		Scheme:       item.Scheme,
+		Remark:       t.Render(item.Remark, c, suffix),
+		Client:       c,
+		Target:       &file.Target{TargetStr: t.Render(item.TargetStr, c, suffix)},
+		Flow:         new(file.Flow),
+		TemplateId:   t.Id,
+		TemplateItem: item.Id,
+	}
+	if h.Scheme == "" {
+		h.Scheme = "all"
+	}
+	if err := file.GetDb().NewHost(h); err != nil {
+		return err
+	}
+	logs.Info("template %s create host %s for client %d", t.Name, h.Host, c.Id)
+	return nil
+}
+
+func updateTemplateTunnel(t *file.Template, item *file.TemplateTunnel, v *file.Tunnel) error {
+	if v.Mode != item.Mode && (isTemplatePortUsed(v.Port, item.Mode, v.Id) || (!v.Status && !tool.TestServerPort(v.Port, item.Mode))) {
+		return fmt.Errorf("port %d is occupied or not allowed for mode %s", v.Port, item.Mode)
+	}
+	v.Mode = item.Mode
+	v.Remark = t.Render(item.Remark, v.Client, t.DomainSuffix)
+	v.Password = t.Render(item.Password, v.Client, t.DomainSuffix)
+	v.Target = &file.Target{TargetStr: t.Render(item.TargetStr, v.Client, t.DomainSuffix)}
+	if !v.Status {
+		return nil
+	}
+	// restart the running tunnel so the new mode and target take effect
+	StopServer(v.Id)
+	return StartTask(v.Id)
+}
+
+func updateTemplateHost(t *file.Template, item *file.TemplateHost, v *file.Host) error {
+	h := &file.Host{
+		Id:       v.Id,
+		Host:     t.Render(item.Host, v.Client, t.DomainSuffix),
+		Location: item.Location,
+		Scheme:   item.Scheme,
+	}
+	if h.Location == "" {
+		h.Location = "/"
+	}
+	if h.Scheme == "" {
+		h.Scheme = "all"
+	}
+	if file.GetDb().IsHostExist(h) {
+		return errors.New("host has exist")
+	}
+	v.Host = h.Host
+	v.Location = h.Location
+	v.Scheme = h.Scheme
+	v.Remark = t.Render(item.Remark, v.Client, t.DomainSuffix)
+	v.Target = &file.Target{TargetStr: t.Render(item.TargetStr, v.Client, t.DomainSuffix)}
+	return nil
+}
+
+// isTemplatePortUsed 检查端口是否已被其他隧道占用(包括未运行的隧道)
+func isTemplatePortUsed(port int, mode string, excludeId int) (used bool) {
+	if mode == "p2p" || mode == "secret" {
+		return false
+	}
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.Id == excludeId || v.Port != port || v.Mode == "p2p" || v.Mode == "secret" {
+			return true
+		}
+		if (v.Mode == "udp") == (mode == "udp") {
+			used = true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+func getTemplateTunnel(t *file.Template, id int) *file.TemplateTunnel {
+	for _, v := range t.Tunnels {
+		if v.Id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func getTemplateHost(t *file.Template, id int) *file.TemplateHost {
+	for _, v := range t.Hosts {
+		if v.Id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func findTemplateTunnel(templateId, itemId, clientId int) (t *file.Tunnel) {
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.TemplateId == templateId && v.TemplateItem == itemId && v.Client.Id == clientId {
+			t = v
+			return false
+		}
+		return true
+	})
+	return
+}
+
+func findTemplateHost(templateId, itemId, clientId int) (h *file.Host) {
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.TemplateId == templateId && v.TemplateItem == itemId && v.Client.Id == clientId {
+			h = v
+			return false
+		}
+		return true
+	})
+	return
+}
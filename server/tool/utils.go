@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/graceful"
 	"github.com/astaxie/beego"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/load"
@@ -47,14 +48,28 @@ func TestServerPort(p int, m string) (b bool) {
 			return false
 		}
 	}
+	// 平滑重启时继承的端口还在监听，不能再绑定
 	if m == "udp" {
-		b = common.TestUdpPort(p)
+		b = graceful.Has("udp", p) || common.TestUdpPort(p)
 	} else {
-		b = common.TestTcpPort(p)
+		b = graceful.Has("tcp", p) || common.TestTcpPort(p)
 	}
 	return
 }
 
+// TestServerPorts 端口范围隧道的每个端口都需可用
+func TestServerPorts(ps []int, m string) bool {
+	if len(ps) == 0 {
+		return false
+	}
+	for _, p := range ps {
+		if !TestServerPort(p, m) {
+			return false
+		}
+	}
+	return true
+}
+
 func GenerateServerPort(m string) int {
 	// allow_ports 已配置：在允许范围内随机选取，打乱顺序后逐个尝试以避免重复命中已占用端口
 	if len(ports) != 0 {
@@ -55,6 +55,8 @@ func (s *BaseController) Prepare() {
 		s.CheckUserAuth()
 	} else {
 		s.Data["isAdmin"] = true
+		// 修改后需要重启才生效的配置项
+		s.Data["pending_restart"] = strings.Join(server.PendingRestart(), ", ")
 	}
 	s.Data["allow_user_login"], _ = beego.AppConfig.Bool("allow_user_login")
 	s.Data["allow_flow_limit"], _ = beego.AppConfig.Bool("allow_flow_limit")
@@ -110,6 +112,7 @@ func (s *BaseController) display(tpl ...string) {
 		tlsPort := strconv.Itoa(beego.AppConfig.DefaultInt("tls_bridge_port", 8025))
 		s.Data["tls_p"] = tlsPort
 		s.Data["tls_enable"] = true
+		s.Data["tls_fingerprint"] = crypt.GetCertFingerprint()
 		s.Data["p1"] = strconv.Itoa(server.Bridge.TunnelPort) + " / " + tlsPort
 	} else {
 		s.Data["tls_enable"] = false
@@ -222,8 +225,12 @@ func (s *BaseController) SetType(name string) {
 }
 
 func (s *BaseController) CheckUserAuth() {
+	if s.controllerName == "template" {
+		s.StopRun()
+		return
+	}
 	if s.controllerName == "client" {
-		if s.actionName == "add" {
+		if s.actionName == "add" || s.actionName == "issuecert" || s.actionName == "revokecert" || s.actionName == "rotatevkey" {
 			s.StopRun()
 			return
 		}
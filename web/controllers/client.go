@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/lib/rate"
 	"ehang.io/nps/server"
@@ -15,6 +17,13 @@ type ClientController struct {
 	BaseController
 }
 
+// clientRow 客户端列表的一行,带上不保存到文件的展示字段
+type clientRow struct {
+	*file.Client
+	BridgeStats  []file.BridgeConnStat
+	RotateStatus string
+}
+
 func (s *ClientController) List() {
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["menu"] = "client"
@@ -36,7 +45,11 @@ func (s *ClientController) List() {
 	cmd["ip"] = common.GetIpByAddr(ip)
 	cmd["bridgeType"] = beego.AppConfig.String("bridge_type")
 	cmd["bridgePort"] = server.Bridge.TunnelPort
-	s.AjaxTable(list, cnt, cnt, cmd)
+	rows := make([]clientRow, 0, len(list))
+	for _, v := range list {
+		rows = append(rows, clientRow{Client: v, BridgeStats: v.BridgeStats, RotateStatus: v.RotateStatus})
+	}
+	s.AjaxTable(rows, cnt, cnt, cmd)
 }
 
 // 添加客户端
@@ -64,6 +77,8 @@ func (s *ClientController) Add() {
 			WebUserName:     s.getEscapeString("web_username"),
 			WebPassword:     s.getEscapeString("web_password"),
 			MaxTunnelNum:    s.GetIntNoErr("max_tunnel"),
+			BridgeConns:     s.GetIntNoErr("bridge_conns"),
+			Weights:         s.getEscapeString("weights"),
 			Flow: &file.Flow{
 				ExportFlow: 0,
 				InletFlow:  0,
@@ -75,6 +90,10 @@ func (s *ClientController) Add() {
 			IpWhiteList: RemoveRepeatedElement(strings.Split(s.getEscapeString("ipwhitelist"), "\r\n")),
 			ExpireTime:  normalizeExpireTime(s.getEscapeString("expire_time")),
 			CreateTime:  time.Now().Format("2006-01-02 15:04:05"),
+			AuthMode:    s.getAuthMode(),
+		}
+		if _, err := conn.ParseWeights(t.Weights); err != nil {
+			s.AjaxErr(err.Error())
 		}
 		if err := file.GetDb().NewClient(t); err != nil {
 			s.AjaxErr(err.Error())
@@ -108,6 +127,7 @@ func (s *ClientController) Edit() {
 			s.Data["c"] = c
 			s.Data["BlackIpList"] = strings.Join(c.BlackIpList, "\r\n")
 			s.Data["IpWhiteList"] = strings.Join(c.IpWhiteList, "\r\n")
+			s.Data["cert_enabled"] = crypt.GetClientCA() != nil
 		}
 		s.SetInfo("edit client")
 		s.display()
@@ -128,11 +148,26 @@ func (s *ClientController) Edit() {
 					s.AjaxErr("Vkey duplicate, please reset")
 					return
 				}
-				c.VerifyKey = s.getEscapeString("vkey")
+				if vkey := s.getEscapeString("vkey"); vkey != c.VerifyKey {
+					// 直接修改时旧的 vkey 立即失效,不中断 npc 请使用轮换
+					c.SetKey(vkey)
+				}
 				c.Flow.FlowLimit = int64(s.GetIntNoErr("flow_limit"))
 				c.RateLimit = s.GetIntNoErr("rate_limit")
 				c.MaxConn = s.GetIntNoErr("max_conn")
 				c.MaxTunnelNum = s.GetIntNoErr("max_tunnel")
+				c.BridgeConns = s.GetIntNoErr("bridge_conns")
+				if _, err := conn.ParseWeights(s.getEscapeString("weights")); err != nil {
+					s.AjaxErr(err.Error())
+					return
+				}
+				// npc 重连后生效
+				c.Weights = s.getEscapeString("weights")
+				if mode := s.getAuthMode(); mode != c.GetAuthMode() {
+					c.AuthMode = mode
+					// 认证方式变更后要求客户端重新认证
+					server.DelClientConnect(c.Id)
+				}
 			}
 			if s.GetString("flow_inlet") != "" {
 				c.Flow.InletFlow = int64(s.GetIntNoErr("flow_inlet"))
@@ -173,6 +208,90 @@ func (s *ClientController) Edit() {
 	}
 }
 
+// 签发客户端证书，之前签发的证书随即失效
+func (s *ClientController) IssueCert() {
+	c, err := file.GetDb().GetClient(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr("client ID not found")
+	}
+	ca := crypt.GetClientCA()
+	if ca == nil {
+		s.AjaxErr("tls client auth is not enabled")
+	}
+	certPEM, keyPEM, cert, err := ca.Issue(c.CertCommonName(), s.GetIntNoErr("days", 365))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	c.CertSerial = crypt.CertSerial(cert)
+	c.CertNotAfter = cert.NotAfter.Local().Format("2006-01-02 15:04:05")
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	if c.GetAuthMode() != file.AuthModeVkey {
+		server.DelClientConnect(c.Id)
+	}
+	// 私钥不在服务端保存，只在签发时返回一次
+	json := ajax("issue success", 1)
+	json["name"] = c.CertCommonName() + ".pem"
+	json["cert"] = string(certPEM) + string(keyPEM)
+	s.Data["json"] = json
+	s.ServeJSON()
+	s.StopRun()
+}
+
+// 吊销客户端证书
+func (s *ClientController) RevokeCert() {
+	c, err := file.GetDb().GetClient(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr("client ID not found")
+	}
+	c.CertSerial, c.CertNotAfter = "", ""
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	if c.GetAuthMode() != file.AuthModeVkey {
+		server.DelClientConnect(c.Id)
+	}
+	s.AjaxOk("revoke success")
+}
+
+// 轮换 vkey,宽限期内新旧 vkey 都可以连接,在线的 npc 会收到新的 vkey
+func (s *ClientController) RotateVkey() {
+	c, err := file.GetDb().GetClient(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr("client ID not found")
+	}
+	vkey := crypt.GetVkey()
+	for !file.GetDb().VerifyVkey(vkey, c.Id) {
+		vkey = crypt.GetVkey()
+	}
+	if err := c.RotateKey(vkey, time.Duration(s.GetIntNoErr("hours", 24))*time.Hour); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	if !server.Bridge.PushVkey(c.Id) {
+		s.AjaxOk("rotate success, but npc is offline or does not support receiving the new vkey")
+	}
+	s.AjaxOk("rotate success")
+}
+
+// 客户端每条桥接连接的多路复用状态,用于排查慢的客户端
+func (s *ClientController) MuxStats() {
+	data := make(map[string]interface{})
+	if stats := server.Bridge.GetMuxStats(s.GetIntNoErr("id")); stats == nil {
+		data["code"] = 0
+	} else {
+		data["code"] = 1
+		data["data"] = stats
+	}
+	s.Data["json"] = data
+	s.ServeJSON()
+}
+
+func (s *ClientController) getAuthMode() string {
+	switch mode := s.getEscapeString("auth_mode"); mode {
+	case file.AuthModeCert, file.AuthModeBoth:
+		return mode
+	}
+	return file.AuthModeVkey
+}
+
 func RemoveRepeatedElement(arr []string) (newArr []string) {
 	newArr = make([]string, 0)
 	for i := 0; i < len(arr); i++ {
@@ -1,6 +1,10 @@
 package controllers
 
 import (
+	"errors"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/server"
 	"ehang.io/nps/server/tool"
@@ -41,6 +45,18 @@ func (s *IndexController) Socks5() {
 	s.display("index/list")
 }
 
+func (s *IndexController) Mixed() {
+	s.SetInfo("mixed")
+	s.SetType("mixed")
+	s.display("index/list")
+}
+
+func (s *IndexController) Tproxy() {
+	s.SetInfo("tproxy")
+	s.SetType("tproxy")
+	s.display("index/list")
+}
+
 func (s *IndexController) Http() {
 	s.SetInfo("http proxy")
 	s.SetType("httpProxy")
@@ -94,7 +110,6 @@ func (s *IndexController) Add() {
 	} else {
 		id := int(file.GetDb().JsonDb.GetTaskId())
 		t := &file.Tunnel{
-			Port:         s.GetIntNoErr("port"),
 			ServerIp:     s.getEscapeString("server_ip"),
 			Mode:         s.getEscapeString("type"),
 			Target:       &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy")},
@@ -105,15 +120,26 @@ func (s *IndexController) Add() {
 			LocalPath:    s.getEscapeString("local_path"),
 			StripPre:     s.getEscapeString("strip_pre"),
 			ProtoVersion: s.getEscapeString("proto_version"),
+			Compression:  s.getEscapeString("compression"),
+			Priority:     s.getEscapeString("priority"),
 			Flow:         &file.Flow{},
 		}
+		if err := t.SetPorts(s.getEscapeString("port")); err != nil {
+			s.AjaxErr(err.Error())
+		}
 
 		if t.Port <= 0 {
 			t.Port = tool.GenerateServerPort(t.Mode)
 		}
 
-		if !tool.TestServerPort(t.Port, t.Mode) {
-			s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
+		if !conn.ValidCompression(t.Compression) {
+			s.AjaxErr("unsupported compression " + t.Compression)
+		}
+		if !conn.ValidPriority(t.Priority) {
+			s.AjaxErr("unsupported priority " + t.Priority)
+		}
+		if err := checkTaskPort(t, nil); err != nil {
+			s.AjaxErr(err.Error())
 		}
 		var err error
 		if t.Client, err = file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
@@ -145,6 +171,9 @@ func (s *IndexController) Copy() {
 			oldTask.Client = client
 		}
 
+		if oldTask.Ports != "" {
+			s.AjaxErr("the tunnel with a port range can not be copied")
+		}
 		id := int(file.GetDb().JsonDb.GetTaskId())
 		newTask := &file.Tunnel{
 			Client:       oldTask.Client,
@@ -159,6 +188,8 @@ func (s *IndexController) Copy() {
 			LocalPath:    oldTask.LocalPath,
 			StripPre:     oldTask.StripPre,
 			ProtoVersion: oldTask.ProtoVersion,
+			Compression:  oldTask.Compression,
+			Priority:     oldTask.Priority,
 			Flow:         &file.Flow{},
 		}
 		if !tool.TestServerPort(newTask.Port, newTask.Mode) {
@@ -211,25 +242,36 @@ func (s *IndexController) Edit() {
 			} else {
 				t.Client = client
 			}
-			if s.GetIntNoErr("port") != t.Port {
-				t.Port = s.GetIntNoErr("port")
-
-				if t.Port <= 0 {
-					t.Port = tool.GenerateServerPort(t.Mode)
-				}
-
-				if !tool.TestServerPort(t.Port, t.Mode) {
-					s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
-					return
-				}
+			oldPorts := t.GetPorts()
+			if err := t.SetPorts(s.getEscapeString("port")); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			if t.Port <= 0 {
+				t.Port = tool.GenerateServerPort(t.Mode)
 			}
 			t.ServerIp = s.getEscapeString("server_ip")
 			t.Mode = s.getEscapeString("type")
 			t.Target = &file.Target{TargetStr: s.getEscapeString("target")}
+			// 正在监听的端口不需要检查
+			if err := checkTaskPort(t, oldPorts); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
 			t.Password = s.getEscapeString("password")
 			t.Id = id
 			t.LocalPath = s.getEscapeString("local_path")
 			t.ProtoVersion = s.getEscapeString("proto_version")
+			t.Compression = s.getEscapeString("compression")
+			if !conn.ValidCompression(t.Compression) {
+				s.AjaxErr("unsupported compression " + t.Compression)
+				return
+			}
+			t.Priority = s.getEscapeString("priority")
+			if !conn.ValidPriority(t.Priority) {
+				s.AjaxErr("unsupported priority " + t.Priority)
+				return
+			}
 			t.StripPre = s.getEscapeString("strip_pre")
 			t.Remark = s.getEscapeString("remark")
 			t.Target.LocalProxy = s.GetBoolNoErr("local_proxy")
@@ -247,6 +289,22 @@ func (s *IndexController) Edit() {
 	}
 }
 
+// checkTaskPort 检查隧道的端口是否可用，端口范围隧道检查所有端口和目标，跳过 skip 中的端口
+func checkTaskPort(t *file.Tunnel, skip []int) error {
+	ports := t.GetPorts()
+	if t.Ports != "" {
+		if err := t.CheckPortRange(); err != nil {
+			return err
+		}
+	}
+	for _, p := range ports {
+		if !common.InIntArr(skip, p) && !tool.TestServerPort(p, t.Mode) {
+			return errors.New("The port cannot be opened because it may has been occupied or is no longer allowed.")
+		}
+	}
+	return nil
+}
+
 func (s *IndexController) Stop() {
 	id := s.GetIntNoErr("id")
 	if err := server.StopServer(id); err != nil {
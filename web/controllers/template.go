@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server"
+)
+
+type TemplateController struct {
+	BaseController
+}
+
+func (s *TemplateController) List() {
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "template"
+		s.SetInfo("template")
+		s.display("template/list")
+		return
+	}
+	start, length := s.GetAjaxParams()
+	list, cnt := file.GetDb().GetTemplateList(start, length, s.getEscapeString("search"))
+	s.AjaxTable(list, cnt, cnt, nil)
+}
+
+func (s *TemplateController) Add() {
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "template"
+		s.SetInfo("add template")
+		s.display()
+		return
+	}
+	t := new(file.Template)
+	if err := s.fillTemplate(t); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	t.AssignItemIds(nil)
+	if err := file.GetDb().NewTemplate(t); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOkWithId("add success", t.Id)
+}
+
+func (s *TemplateController) Edit() {
+	id := s.GetIntNoErr("id")
+	t, err := file.GetDb().GetTemplate(id)
+	if s.Ctx.Request.Method == "GET" {
+		if err != nil {
+			s.error()
+			return
+		}
+		s.Data["menu"] = "template"
+		s.Data["t"] = t
+		s.Data["tunnels"] = formatTemplateTunnels(t.Tunnels)
+		s.Data["hosts"] = formatTemplateHosts(t.Hosts)
+		s.SetInfo("edit template")
+		s.display()
+		return
+	}
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	nt := new(file.Template)
+	if err := s.fillTemplate(nt); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if file.GetDb().IsTemplateNameExist(nt.Name, t.Id) {
+		s.AjaxErr("template name has exist")
+	}
+	nt.AssignItemIds(t)
+	t.Lock()
+	t.Name, t.Remark, t.DomainSuffix = nt.Name, nt.Remark, nt.DomainSuffix
+	t.PortOffset, t.PortStep = nt.PortOffset, nt.PortStep
+	t.Tunnels, t.Hosts, t.MaxItemId = nt.Tunnels, nt.Hosts, nt.MaxItemId
+	t.Unlock()
+	if err := file.GetDb().UpdateTemplate(t); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if s.GetBoolNoErr("reapply") {
+		t.RLock()
+		errs := server.ReapplyTemplate(t)
+		t.RUnlock()
+		if len(errs) > 0 {
+			s.AjaxErr(strings.Join(errs, "\n"))
+		}
+	}
+	s.AjaxOk("modified success")
+}
+
+func (s *TemplateController) Del() {
+	if err := server.DelTemplate(s.GetIntNoErr("id")); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOk("delete success")
+}
+
+// 将模板实例化到一个或多个客户端
+func (s *TemplateController) Apply() {
+	t, err := file.GetDb().GetTemplate(s.GetIntNoErr("id"))
+	if s.Ctx.Request.Method == "GET" {
+		if err != nil {
+			s.error()
+			return
+		}
+		s.Data["menu"] = "template"
+		s.Data["t"] = t
+		s.SetInfo("apply template")
+		s.display()
+		return
+	}
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	var clientIds []int
+	for _, v := range strings.Split(s.getEscapeString("client_ids"), ",") {
+		if id := common.GetIntNoErrByStr(strings.TrimSpace(v)); id > 0 {
+			clientIds = append(clientIds, id)
+		}
+	}
+	if len(clientIds) == 0 {
+		s.AjaxErr("please select at least one client")
+	}
+	suffix := s.getEscapeString("domain_suffix")
+	if suffix == "" {
+		suffix = t.DomainSuffix
+	}
+	t.Lock()
+	errs := server.ApplyTemplate(t, clientIds, s.GetIntNoErr("port_offset", t.PortOffset), suffix)
+	t.Unlock()
+	if len(errs) > 0 {
+		s.AjaxErr(strings.Join(errs, "\n"))
+	}
+	s.AjaxOk("apply success")
+}
+
+// 将模板修改同步到已创建的隧道和域名
+func (s *TemplateController) Reapply() {
+	t, err := file.GetDb().GetTemplate(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	t.RLock()
+	errs := server.ReapplyTemplate(t)
+	t.RUnlock()
+	if len(errs) > 0 {
+		s.AjaxErr(strings.Join(errs, "\n"))
+	}
+	s.AjaxOk("reapply success")
+}
+
+func (s *TemplateController) fillTemplate(t *file.Template) (err error) {
+	t.Name = s.getEscapeString("name")
+	t.Remark = s.getEscapeString("remark")
+	t.PortOffset = s.GetIntNoErr("port_offset")
+	t.PortStep = s.GetIntNoErr("port_step")
+	t.DomainSuffix = s.getEscapeString("domain_suffix")
+	if t.Tunnels, err = parseTemplateTunnels(s.getEscapeString("tunnels")); err != nil {
+		return
+	}
+	t.Hosts, err = parseTemplateHosts(s.getEscapeString("hosts"))
+	return
+}
+
+// 每行一个隧道: 模式,端口,目标,备注[,密码]  端口为0时自动分配
+// 条目id由 Template.AssignItemIds 分配, 同步模板时按id匹配已创建的隧道
+func parseTemplateTunnels(str string) ([]*file.TemplateTunnel, error) {
+	list := make([]*file.TemplateTunnel, 0)
+	for i, line := range strings.Split(str, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		arr := strings.Split(line, ",")
+		if len(arr) < 4 {
+			return nil, fmt.Errorf("tunnel line %d format error", i+1)
+		}
+		t := &file.TemplateTunnel{
+			Mode:      strings.TrimSpace(arr[0]),
+			TargetStr: strings.TrimSpace(arr[2]),
+			Remark:    strings.TrimSpace(arr[3]),
+		}
+		if len(arr) > 4 {
+			t.Password = strings.TrimSpace(arr[4])
+		}
+		port, err := strconv.Atoi(strings.TrimSpace(arr[1]))
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("tunnel line %d port error", i+1)
+		}
+		t.Port = port
+		switch t.Mode {
+		case "tcp", "udp", "socks5", "httpProxy", "mixed", "tproxy":
+		case "secret", "p2p":
+			if t.Password == "" {
+				return nil, fmt.Errorf("tunnel line %d password can not be empty", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("tunnel line %d mode %s is not supported", i+1, t.Mode)
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// 每行一个域名: 域名,目标,路径,协议,备注
+func parseTemplateHosts(str string) ([]*file.TemplateHost, error) {
+	list := make([]*file.TemplateHost, 0)
+	for i, line := range strings.Split(str, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		arr := strings.Split(line, ",")
+		if len(arr) < 2 {
+			return nil, fmt.Errorf("host line %d format error", i+1)
+		}
+		for len(arr) < 5 {
+			arr = append(arr, "")
+		}
+		h := &file.TemplateHost{
+			Host:      strings.TrimSpace(arr[0]),
+			TargetStr: strings.TrimSpace(arr[1]),
+			Location:  strings.TrimSpace(arr[2]),
+			Scheme:    strings.TrimSpace(arr[3]),
+			Remark:    strings.TrimSpace(arr[4]),
+		}
+		if h.Location == "" {
+			h.Location = "/"
+		}
+		switch h.Scheme {
+		case "":
+			h.Scheme = "all"
+		case "all", "http", "https":
+		default:
+			return nil, fmt.Errorf("host line %d scheme %s is not supported", i+1, h.Scheme)
+		}
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+func formatTemplateTunnels(list []*file.TemplateTunnel) string {
+	lines := make([]string, 0, len(list))
+	for _, v := range list {
+		line := fmt.Sprintf("%s,%d,%s,%s", v.Mode, v.Port, v.TargetStr, v.Remark)
+		if v.Password != "" {
+			line += "," + v.Password
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatTemplateHosts(list []*file.TemplateHost) string {
+	lines := make([]string, 0, len(list))
+	for _, v := range list {
+		lines = append(lines, fmt.Sprintf("%s,%s,%s,%s,%s", v.Host, v.TargetStr, v.Location, v.Scheme, v.Remark))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"testing"
+)
+
+func TestParseTemplateTunnels(t *testing.T) {
+	list, err := parseTemplateTunnels("tcp,8000,127.0.0.1:80,web\n\n  udp, 0 ,127.0.0.1:53,dns  \nsecret,0,127.0.0.1:22,ssh,pwd\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("got %d tunnels", len(list))
+	}
+	if v := list[1]; v.Mode != "udp" || v.Port != 0 || v.TargetStr != "127.0.0.1:53" || v.Remark != "dns" {
+		t.Fatalf("got %+v", *v)
+	}
+	if list[2].Password != "pwd" {
+		t.Fatalf("password not parsed")
+	}
+	if got := formatTemplateTunnels(list); got != "tcp,8000,127.0.0.1:80,web\nudp,0,127.0.0.1:53,dns\nsecret,0,127.0.0.1:22,ssh,pwd" {
+		t.Fatalf("format got %q", got)
+	}
+	for _, s := range []string{
+		"tcp,8000,127.0.0.1:80",
+		"tcp,70000,127.0.0.1:80,web",
+		"tcp,x,127.0.0.1:80,web",
+		"p2p,0,127.0.0.1:80,web",
+		"ftp,21,127.0.0.1:21,ftp",
+	} {
+		if _, err := parseTemplateTunnels(s); err == nil {
+			t.Fatalf("%q should be rejected", s)
+		}
+	}
+}
+
+func TestParseTemplateHosts(t *testing.T) {
+	list, err := parseTemplateHosts("{remark}.a.com,127.0.0.1:80\nb.com,127.0.0.1:81,/api,https,api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := list[0]; v.Location != "/" || v.Scheme != "all" {
+		t.Fatalf("defaults not set: %+v", *v)
+	}
+	if v := list[1]; v.Location != "/api" || v.Scheme != "https" || v.Remark != "api" {
+		t.Fatalf("got %+v", *v)
+	}
+	if got := formatTemplateHosts(list); got != "{remark}.a.com,127.0.0.1:80,/,all,\nb.com,127.0.0.1:81,/api,https,api" {
+		t.Fatalf("format got %q", got)
+	}
+	for _, s := range []string{"a.com", "a.com,127.0.0.1:80,/,ftp"} {
+		if _, err := parseTemplateHosts(s); err == nil {
+			t.Fatalf("%q should be rejected", s)
+		}
+	}
+}
@@ -149,6 +149,9 @@ function submitform(action, url, postdata) {
         case 'stop':
         case 'delete':
 		case 'copy':
+		case 'reapply':
+		case 'revokecert':
+		case 'rotatevkey':
             var confirmObj = (languages && languages['content'] && languages['content']['confirm']) ? languages['content']['confirm'][action] : null;
             var confirmMsg = (confirmObj && (confirmObj[languages['current']] || confirmObj[languages['default']])) || ('Are you sure you want to ' + action + ' it?');
             if (! confirm(confirmMsg)) return;